@@ -0,0 +1,83 @@
+// Package cmd handles all CLI calls
+/*
+Copyright © 2020 John Suarez jsuar@users.noreply.github.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+	"github.com/spf13/cobra"
+)
+
+// applyCmd represents the apply command
+var applyCmd = &cobra.Command{
+	Use:   "apply <plan-file>",
+	Short: "Applies a plan saved with scale-in or scale-out --out",
+	Long: `The apply command registers exactly the job changes saved in a
+plan file by scale-in --out or scale-out --out. Jobs modified since the
+plan was made are refused, as is a plan made against another cluster.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		plan, err := nomadhelper.ReadPlanFile(args[0])
+		if err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+
+		forEachTarget(cmd, func(ctx context.Context, nh *nomadhelper.NomadHelper) *nomadhelper.Report {
+			return nh.ApplyPlan(ctx, plan)
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(applyCmd)
+}
+
+// newPlanFile returns the plan to record when --out is set. A plan can only
+// be saved for a plan run against a single cluster.
+func newPlanFile(cmd *cobra.Command, command string) (*nomadhelper.PlanFile, error) {
+	out, _ := cmd.Flags().GetString("out")
+	if out == "" {
+		return nil, nil
+	}
+	force, _ := cmd.Flags().GetBool("force")
+	interactive, _ := cmd.Flags().GetBool("interactive")
+	if force || interactive {
+		return nil, fmt.Errorf("--out cannot be combined with --force or --interactive")
+	}
+	allRegions, _ := rootCmd.PersistentFlags().GetBool("all-regions")
+	if allRegions || len(contextNames()) > 1 {
+		return nil, fmt.Errorf("--out requires a single cluster")
+	}
+	return nomadhelper.NewPlanFile(command), nil
+}
+
+// writePlanFile saves the plan recorded during the run, if any
+func writePlanFile(cmd *cobra.Command, plan *nomadhelper.PlanFile) {
+	if plan == nil {
+		return
+	}
+	out, _ := cmd.Flags().GetString("out")
+	if err := plan.Write(out); err != nil {
+		fmt.Fprintln(cmd.OutOrStdout(), err)
+		return
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "Plan with %d changes saved to %s. Apply it with: nomad-custodian apply %s\n",
+		len(plan.Changes), out, out)
+}
@@ -17,6 +17,8 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+
 	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
 	"github.com/spf13/cobra"
 )
@@ -28,11 +30,12 @@ var backupJobsCmd = &cobra.Command{
 	Short:   "Creates a backup of all jobs registered in Nomad",
 	Long: `The backup-jobs command will created a new directory named with the current time
 in seconds under the jobs-backup directory. All jobs register with Nomad will be written as 
-a JSON file in the directory with the name of the job as the file name.`,
+a JSON file in the directory with the name of the job as the file name. When several
+contexts or regions are targeted, each gets a subdirectory named after it.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		nh := new(nomadhelper.NomadHelper)
-		nh.Init()
-		nh.BackupJobs()
+		forEachTarget(cmd, func(ctx context.Context, nh *nomadhelper.NomadHelper) *nomadhelper.Report {
+			return nh.BackupJobs(ctx)
+		})
 	},
 }
 
@@ -0,0 +1,871 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/jsuar/nomad-custodian/pkg/fakenomad"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// newTestServer starts a fake Nomad agent seeded with the jobs in testing/
+func newTestServer(t *testing.T) *fakenomad.Server {
+	server, err := fakenomad.NewServerFromDir("../testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// writeConfig writes a config file for a test run
+func writeConfig(t *testing.T, dir string, content string) string {
+	path := filepath.Join(dir, "custodian.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// execute runs the CLI against the fake server and returns its output
+func execute(t *testing.T, server *fakenomad.Server, config string, args ...string) string {
+	return run(t, config, append(args, "--address", server.URL)...)
+}
+
+// run runs the CLI with the clusters of the config file and returns its output
+func run(t *testing.T, config string, args ...string) string {
+	resetFlags(rootCmd)
+
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	rootCmd.SetArgs(append(args, "--config", config))
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+// resetFlags restores the default flag values between runs
+func resetFlags(cmd *cobra.Command) {
+	reset := func(flag *pflag.Flag) {
+		if !flag.Changed {
+			return
+		}
+		// Setting a slice flag appends to it once it has been set, so it
+		// gets a fresh value instead
+		if flag.Value.Type() == "stringSlice" {
+			fresh := pflag.NewFlagSet(flag.Name, pflag.ContinueOnError)
+			fresh.StringSlice(flag.Name, nil, "")
+			flag.Value = fresh.Lookup(flag.Name).Value
+		} else {
+			flag.Value.Set(flag.DefValue)
+		}
+		flag.Changed = false
+	}
+	cmd.Flags().VisitAll(reset)
+	cmd.PersistentFlags().VisitAll(reset)
+	for _, child := range cmd.Commands() {
+		resetFlags(child)
+	}
+}
+
+// counts returns the first task group count of every job on the server
+func counts(server *fakenomad.Server) map[string]int {
+	result := make(map[string]int)
+	for _, id := range []string{"couchbase", "demo-webapp", "example", "nginx"} {
+		if job := server.Client.Job(id); job != nil {
+			result[id] = *job.TaskGroups[0].Count
+		}
+	}
+	return result
+}
+
+// testDir creates a temporary working directory with an empty config file
+func testDir(t *testing.T) (string, string, func()) {
+	dir, err := ioutil.TempDir("", "custodian")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cwd, _ := os.Getwd()
+	os.Chdir(dir)
+	config := writeConfig(t, dir, "# test config\n")
+	return dir, config, func() {
+		os.Chdir(cwd)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestList(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	_, config, cleanup := testDir(t)
+	defer cleanup()
+
+	output := execute(t, server, config, "list")
+
+	for _, want := range []string{"Job: couchbase", "Job: demo-webapp", "Job: example", "Job: nginx", "custodian-ignore"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output:\n%s", want, output)
+		}
+	}
+}
+
+func TestScaleInScaleOut(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	_, config, cleanup := testDir(t)
+	defer cleanup()
+
+	original := map[string]int{"couchbase": 2, "demo-webapp": 3, "example": 2, "nginx": 2}
+	scaledIn := map[string]int{"couchbase": 1, "demo-webapp": 1, "example": 1, "nginx": 2}
+
+	tests := []struct {
+		name       string
+		args       []string
+		want       []string
+		wantCounts map[string]int
+	}{
+		{"Plan Scale In", []string{"scale-in"}, []string{"Job: demo-webapp, running", "Meta[custodian-demo-count]", "nginx"}, original},
+		{"Scale In", []string{"scale-in", "--force"}, []string{"Job: couchbase, running"}, scaledIn},
+		{"Scale In Again", []string{"scale-in", "--force"}, []string{"already scaled in"}, scaledIn},
+		{"Plan Scale Out", []string{"scale-out"}, []string{"Job: example, running"}, scaledIn},
+		{"Scale Out", []string{"scale-out", "--force"}, []string{"Job: couchbase, running"}, original},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := execute(t, server, config, tt.args...)
+			for _, want := range tt.want {
+				if !strings.Contains(output, want) {
+					t.Errorf("expected %q in output:\n%s", want, output)
+				}
+			}
+			if got := counts(server); fmt.Sprint(got) != fmt.Sprint(tt.wantCounts) {
+				t.Errorf("expected counts %v, got %v", tt.wantCounts, got)
+			}
+		})
+	}
+}
+
+func TestDeleteAllJobs(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	_, config, cleanup := testDir(t)
+	defer cleanup()
+
+	execute(t, server, config, "delete-all-jobs", "-f", "-p", "--auto-approve")
+
+	if got := counts(server); len(got) != 1 || got["nginx"] != 2 {
+		t.Errorf("expected only the ignored nginx job to remain, got %v", got)
+	}
+}
+
+func TestBackupJobs(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	dir, config, cleanup := testDir(t)
+	defer cleanup()
+
+	execute(t, server, config, "backup-jobs")
+
+	files, _ := filepath.Glob(filepath.Join(dir, "jobs-backup", "*", "*.json"))
+	if len(files) != 4 {
+		t.Errorf("expected 4 backup files, got %v", files)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	dir, _, cleanup := testDir(t)
+	defer cleanup()
+
+	var payloads []map[string]interface{}
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := make(map[string]interface{})
+		json.NewDecoder(r.Body).Decode(&payload)
+		payloads = append(payloads, payload)
+	}))
+	defer hook.Close()
+
+	config := writeConfig(t, dir, fmt.Sprintf("notifiers:\n  - name: hook\n    type: webhook\n    url: %s\n", hook.URL))
+	execute(t, server, config, "scale-in", "--notify-message", "Scale in starts in 15 minutes")
+	execute(t, server, config, "scale-in", "--force")
+
+	if len(payloads) != 2 {
+		t.Fatalf("expected 2 notifications, got %d", len(payloads))
+	}
+	if payloads[0]["kind"] != "planned" || payloads[0]["message"] != "Scale in starts in 15 minutes" {
+		t.Errorf("unexpected planned notification %v", payloads[0])
+	}
+	if payloads[1]["kind"] != "applied" || len(payloads[1]["results"].([]interface{})) != 4 {
+		t.Errorf("unexpected applied notification %v", payloads[1])
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	_, config, cleanup := testDir(t)
+	defer cleanup()
+
+	output := execute(t, server, config, "scale-in", "--force", "--timeout", "1ns")
+
+	for _, want := range []string{"Run stopped: context deadline exceeded", "couchbase", "cancelled"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output:\n%s", want, output)
+		}
+	}
+	if got := counts(server); got["demo-webapp"] != 3 {
+		t.Errorf("expected no jobs to change, got %v", got)
+	}
+}
+
+func TestPlanApply(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	dir, config, cleanup := testDir(t)
+	defer cleanup()
+
+	plan := filepath.Join(dir, "plan.json")
+	output := execute(t, server, config, "scale-in", "--out", plan)
+	if !strings.Contains(output, "Plan with 3 changes saved") {
+		t.Errorf("expected the plan to be saved:\n%s", output)
+	}
+	if got := counts(server); got["demo-webapp"] != 3 {
+		t.Fatalf("expected no jobs to change while planning, got %v", got)
+	}
+
+	// A job changed after planning is refused, the others are applied
+	changed := server.Client.Job("couchbase")
+	changed.SetMeta("owner", "storage")
+	server.Client.Jobs().Register(changed, nil)
+
+	output = execute(t, server, config, "apply", plan)
+
+	if !strings.Contains(output, "job modified since the plan was made") {
+		t.Errorf("expected couchbase to be refused:\n%s", output)
+	}
+	want := map[string]int{"couchbase": 2, "demo-webapp": 1, "example": 1, "nginx": 2}
+	if got := counts(server); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected counts %v, got %v", want, got)
+	}
+}
+
+func TestInteractive(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	_, config, cleanup := testDir(t)
+	defer cleanup()
+	defer func(f func() bool) { stdinIsTerminal = f }(stdinIsTerminal)
+	defer rootCmd.SetIn(nil)
+
+	stdinIsTerminal = func() bool { return false }
+	output := execute(t, server, config, "scale-in", "--interactive")
+	if !strings.Contains(output, "--interactive requires stdin to be a terminal") {
+		t.Errorf("expected interactive mode to be refused:\n%s", output)
+	}
+
+	stdinIsTerminal = func() bool { return true }
+	rootCmd.SetIn(strings.NewReader("y\nn\nq\n"))
+	execute(t, server, config, "delete-all-jobs", "--interactive")
+
+	if job := server.Client.Job("couchbase"); *job.Status != "dead" {
+		t.Errorf("expected couchbase to be stopped, got %s", *job.Status)
+	}
+	for _, id := range []string{"demo-webapp", "example"} {
+		if job := server.Client.Job(id); *job.Status != "running" {
+			t.Errorf("expected %s to keep running, got %s", id, *job.Status)
+		}
+	}
+}
+
+func TestUndelete(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	_, config, cleanup := testDir(t)
+	defer cleanup()
+
+	output := execute(t, server, config, "delete-all-jobs", "-f", "-p", "--auto-approve")
+	if !strings.Contains(output, "Restore them with: nomad-custodian undelete") {
+		t.Fatalf("expected the delete batch to be reported:\n%s", output)
+	}
+
+	output = execute(t, server, config, "undelete")
+	batches, _ := filepath.Glob(filepath.Join("jobs-backup", "deleted", "*"))
+	if len(batches) != 1 || !strings.Contains(output, filepath.Base(batches[0])) {
+		t.Fatalf("expected a single batch to be listed, got %v:\n%s", batches, output)
+	}
+
+	execute(t, server, config, "undelete", filepath.Base(batches[0]), "--force")
+
+	want := map[string]int{"couchbase": 2, "demo-webapp": 3, "example": 2, "nginx": 2}
+	if got := counts(server); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected counts %v, got %v", want, got)
+	}
+}
+
+func TestGC(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	_, config, cleanup := testDir(t)
+	defer cleanup()
+
+	server.Client.Jobs().Deregister("example", false, nil)
+
+	output := execute(t, server, config, "gc")
+	if !strings.Contains(output, "None") || server.Client.Job("example") == nil {
+		t.Errorf("expected nothing to be collected with the default thresholds:\n%s", output)
+	}
+
+	output = execute(t, server, config, "gc", "--dead-for", "0s", "--force")
+	if !strings.Contains(output, "stopped") || server.Client.Job("example") != nil {
+		t.Errorf("expected the stopped job to be purged:\n%s", output)
+	}
+	if got := counts(server); len(got) != 3 {
+		t.Errorf("expected the other jobs to be kept, got %v", got)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	_, config, cleanup := testDir(t)
+	defer cleanup()
+
+	job := server.Client.Job("example")
+	job.Meta = map[string]string{"custodian-expires": "2020-01-01T00:00:00Z"}
+	server.Client.Jobs().Register(job, nil)
+
+	output := execute(t, server, config, "expire")
+	if !strings.Contains(output, "expired") || *server.Client.Job("example").Status == "dead" {
+		t.Errorf("expected the expired job to be planned only:\n%s", output)
+	}
+
+	output = execute(t, server, config, "expire", "--force", "--purge")
+	if server.Client.Job("example") != nil {
+		t.Errorf("expected the expired job to be purged:\n%s", output)
+	}
+	if got := counts(server); len(got) != 3 {
+		t.Errorf("expected the other jobs to be kept, got %v", got)
+	}
+}
+
+func TestCompliance(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	dir, _, cleanup := testDir(t)
+	defer cleanup()
+	config := writeConfig(t, dir, `
+compliance:
+  required:
+    - key: owner
+    - key: environment
+      allowed: [prod, dev]
+`)
+
+	output := execute(t, server, config, "compliance")
+	if !strings.Contains(output, "missing owner, missing environment") || !strings.Contains(output, "notified") {
+		t.Errorf("expected every job to be reported:\n%s", output)
+	}
+
+	execute(t, server, config, "compliance", "--action", "mark", "--force")
+	if got := server.Client.Job("example").Meta["custodian-violation"]; got != "missing owner, missing environment" {
+		t.Errorf("expected the job to be marked, got %q", got)
+	}
+
+	output = execute(t, server, config, "compliance", "--action", "delete")
+	if !strings.Contains(output, "unknown compliance action") {
+		t.Errorf("expected the action to be rejected:\n%s", output)
+	}
+}
+
+func TestMarked(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	_, config, cleanup := testDir(t)
+	defer cleanup()
+
+	job := server.Client.Job("example")
+	job.Meta = map[string]string{"custodian-marked-for": "stop@2020-01-01"}
+	server.Client.Jobs().Register(job, nil)
+
+	output := execute(t, server, config, "marked")
+	if !strings.Contains(output, "due") || *server.Client.Job("example").Status == "dead" {
+		t.Errorf("expected the due mark to be planned only:\n%s", output)
+	}
+
+	output = execute(t, server, config, "marked", "--force")
+	if *server.Client.Job("example").Status != "dead" {
+		t.Errorf("expected the marked job to be stopped:\n%s", output)
+	}
+}
+
+func TestCost(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	dir, config, cleanup := testDir(t)
+	defer cleanup()
+
+	output := execute(t, server, config, "cost")
+	if !strings.Contains(output, "no cost rates") {
+		t.Errorf("expected missing rates to be reported:\n%s", output)
+	}
+
+	config = writeConfig(t, dir, `
+cost:
+  currency: EUR
+  cpu-per-mhz: 0.001
+  memory-per-mb: 0.0001
+  node-classes:
+    gpu:
+      cpu-per-mhz: 0.01
+`)
+	output = execute(t, server, config, "cost")
+	if !strings.Contains(output, "1431.68 EUR") {
+		t.Errorf("expected a cost table:\n%s", output)
+	}
+}
+
+func TestRightsize(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	_, config, cleanup := testDir(t)
+	defer cleanup()
+
+	job := server.Client.Job("demo-webapp")
+	group := *job.TaskGroups[0].Name
+	task := job.TaskGroups[0].Tasks[0].Name
+	server.Client.AddAllocation(&nomad.Allocation{ID: "a1", JobID: "demo-webapp", TaskGroup: group, ClientStatus: "running"},
+		&nomad.AllocResourceUsage{Tasks: map[string]*nomad.TaskResourceUsage{
+			task: {ResourceUsage: &nomad.ResourceUsage{
+				CpuStats:    &nomad.CpuStats{TotalTicks: 10},
+				MemoryStats: &nomad.MemoryStats{RSS: 10 * 1024 * 1024},
+			}},
+		}})
+
+	output := execute(t, server, config, "rightsize", "--window", "0s")
+	if !strings.Contains(output, "-> 20 (peak 10, avg 10)") {
+		t.Errorf("expected a recommendation:\n%s", output)
+	}
+
+	execute(t, server, config, "rightsize", "--window", "0s", "--force")
+	if got := *server.Client.Job("demo-webapp").TaskGroups[0].Tasks[0].Resources.CPU; got != 20 {
+		t.Errorf("expected the job to be rightsized, got %d MHz", got)
+	}
+}
+
+func TestIdle(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	_, config, cleanup := testDir(t)
+	defer cleanup()
+
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := "3"
+		if strings.Contains(r.URL.Query().Get("query"), `"demo-webapp"`) {
+			value = "0"
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1700000000,%q]}]}}`, value)
+	}))
+	defer prometheus.Close()
+
+	output := execute(t, server, config, "idle", "--prometheus-url", prometheus.URL)
+	if !strings.Contains(output, "requires --prometheus-query") {
+		t.Errorf("expected the missing query to be reported:\n%s", output)
+	}
+
+	output = execute(t, server, config, "idle", "--force", "--idle-for", "0s", "--prometheus-url", prometheus.URL,
+		"--prometheus-query", `sum(rate(requests{service="{{.ID}}"}[6h]))`)
+	if got := counts(server); got["demo-webapp"] != 1 || got["couchbase"] == 1 {
+		t.Errorf("expected only the job without traffic to be scaled in, got %v:\n%s", got, output)
+	}
+}
+
+func TestScaleInDrainNodes(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	_, config, cleanup := testDir(t)
+	defer cleanup()
+
+	for _, id := range []string{"client-1", "client-2"} {
+		server.Client.AddNode(&nomad.NodeListStub{ID: id, Name: id, Datacenter: "dc1", Status: "ready",
+			SchedulingEligibility: nomad.NodeSchedulingEligible})
+	}
+
+	output := execute(t, server, config, "scale-in", "--force", "--drain-nodes")
+	if !strings.Contains(output, "drained") || !server.Client.Node("client-1").Drain || server.Client.Node("client-2").Drain {
+		t.Errorf("expected one node to be drained and one kept:\n%s", output)
+	}
+
+	output = execute(t, server, config, "scale-out", "--force", "--restore-nodes")
+	if node := server.Client.Node("client-1"); node.Drain || node.SchedulingEligibility != nomad.NodeSchedulingEligible {
+		t.Errorf("expected the node to be eligible again:\n%s", output)
+	}
+}
+
+func TestScaleInSelectJobs(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	_, config, cleanup := testDir(t)
+	defer cleanup()
+
+	output := execute(t, server, config, "scale-in", "--force", "--jobs", "demo-*,example", "--ignore-jobs", "exa*")
+	if got := counts(server); got["demo-webapp"] != 1 || got["example"] != 2 || got["couchbase"] != 2 {
+		t.Errorf("expected only demo-webapp to be scaled in, got %v:\n%s", got, output)
+	}
+	got := strings.Join(strings.Fields(output), " ")
+	for _, want := range []string{"couchbase filtered out", "example ignored via config exa*", "filtered out 2"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in output:\n%s", want, output)
+		}
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	_, config, cleanup := testDir(t)
+	defer cleanup()
+
+	execute(t, server, config, "scale-in", "--force")
+	job := server.Client.Job("demo-webapp")
+	job.SetMeta("custodian-demo-count", "7")
+	server.Client.AddJob(job)
+
+	output := execute(t, server, config, "doctor")
+	if got := strings.Join(strings.Fields(output), " "); !strings.Contains(got,
+		"demo-webapp custodian-demo-count is 7, version 0 has 3 recompute-counts") || strings.Contains(got, "couchbase") {
+		t.Errorf("expected only demo-webapp to be reported:\n%s", output)
+	}
+
+	output = execute(t, server, config, "doctor", "--fix", "suggested", "--force")
+	if got := server.Client.Job("demo-webapp").Meta["custodian-demo-count"]; got != "3" {
+		t.Errorf("expected the saved count to be recomputed, got %s:\n%s", got, output)
+	}
+	execute(t, server, config, "scale-out", "--force")
+	if got := counts(server); got["demo-webapp"] != 3 {
+		t.Errorf("expected demo-webapp to scale out to 3, got %v", got)
+	}
+}
+
+func TestNativeScale(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	dir, config, cleanup := testDir(t)
+	defer cleanup()
+
+	plan := filepath.Join(dir, "plan.json")
+	output := execute(t, server, config, "scale-in", "--native", "--out", plan)
+	if !strings.Contains(output, "Plan with 3 changes saved") {
+		t.Errorf("expected the plan to be saved:\n%s", output)
+	}
+	output = execute(t, server, config, "apply", plan)
+	want := map[string]int{"couchbase": 1, "demo-webapp": 1, "example": 1, "nginx": 2}
+	if got := counts(server); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected counts %v, got %v:\n%s", want, got, output)
+	}
+	if meta := server.Client.Job("demo-webapp").Meta; meta["custodian-action"] != "" {
+		t.Errorf("expected the job meta to be left alone, got %v", meta)
+	}
+
+	output = execute(t, server, config, "scale-in", "--native", "--force")
+	if got := strings.Join(strings.Fields(output), " "); !strings.Contains(got, "demo-webapp already scaled in scaling events") {
+		t.Errorf("expected the scaled in jobs to be skipped:\n%s", output)
+	}
+
+	output = execute(t, server, config, "scale-out", "--native", "--force")
+	want = map[string]int{"couchbase": 2, "demo-webapp": 3, "example": 2, "nginx": 2}
+	if got := counts(server); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected counts %v, got %v:\n%s", want, got, output)
+	}
+}
+
+func TestStateStore(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	_, config, cleanup := testDir(t)
+	defer cleanup()
+
+	output := execute(t, server, config, "scale-in", "--state-store", "nomad-variables", "--force")
+	want := map[string]int{"couchbase": 1, "demo-webapp": 1, "example": 1, "nginx": 2}
+	if got := counts(server); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected counts %v, got %v:\n%s", want, got, output)
+	}
+	if meta := server.Client.Job("demo-webapp").Meta; meta["custodian-action"] != "" {
+		t.Errorf("expected the job meta to be left alone, got %v", meta)
+	}
+	output = execute(t, server, config, "list", "--state-store", "nomad-variables")
+	if got := strings.Join(strings.Fields(output), " "); !strings.Contains(got, "custodian-action scaled-in (nomad-variables)") {
+		t.Errorf("expected the state in the list output:\n%s", output)
+	}
+
+	output = execute(t, server, config, "migrate-state", "--from", "nomad-variables", "--to", "file", "--force")
+	if _, err := os.Stat(filepath.Join("jobs-backup", "scale-state.json")); err != nil {
+		t.Errorf("expected the state file to be written: %v\n%s", err, output)
+	}
+
+	output = execute(t, server, config, "scale-out", "--state-store", "file", "--force")
+	want = map[string]int{"couchbase": 2, "demo-webapp": 3, "example": 2, "nginx": 2}
+	if got := counts(server); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected counts %v, got %v:\n%s", want, got, output)
+	}
+}
+
+// recordedServer serves a fake Nomad agent and records the ACL token and
+// region of every request
+type recordedServer struct {
+	*fakenomad.Server
+	URL string
+
+	mu      sync.Mutex
+	tokens  map[string]bool
+	regions map[string]bool
+	http    *httptest.Server
+}
+
+func newRecordedServer(t *testing.T) *recordedServer {
+	s := &recordedServer{Server: newTestServer(t), tokens: make(map[string]bool), regions: make(map[string]bool)}
+	s.http = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.tokens[r.Header.Get("X-Nomad-Token")] = true
+		s.regions[r.URL.Query().Get("region")] = true
+		s.mu.Unlock()
+		s.Server.ServeHTTP(w, r)
+	}))
+	s.URL = s.http.URL
+	return s
+}
+
+func (s *recordedServer) Close() {
+	s.http.Close()
+	s.Server.Close()
+}
+
+// seen returns the tokens and regions of the requests received
+func (s *recordedServer) seen() (tokens []string, regions []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token := range s.tokens {
+		tokens = append(tokens, token)
+	}
+	for region := range s.regions {
+		regions = append(regions, region)
+	}
+	sort.Strings(tokens)
+	sort.Strings(regions)
+	return tokens, regions
+}
+
+func TestNomadConfig(t *testing.T) {
+	dir, _, cleanup := testDir(t)
+	defer cleanup()
+	for name, value := range map[string]string{"NOMAD_NAMESPACE": "env-namespace", "NOMAD_REGION": "env-region",
+		"NOMAD_TOKEN": "env-token", "ADDRESS": "http://stray.example:4646", "NAMESPACE": "stray-namespace"} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	cfgFile = writeConfig(t, dir, `region: config-region
+token: config-token
+contexts:
+  a:
+    address: http://a.example:4646
+    token: a-token
+    ca-cert: /etc/nomad/a-ca.pem
+    client-cert: /etc/nomad/a-cli.pem
+    client-key: /etc/nomad/a-cli-key.pem
+    tls-server-name: server.a.nomad
+    tls-skip-verify: true
+  b:
+    address: http://b.example:4646
+    region: b-region
+`)
+	initConfig()
+	defer resetFlags(rootCmd)
+
+	tests := []struct {
+		name    string
+		context string
+		flags   map[string]string
+		want    nomad.Config
+		wantTLS nomad.TLSConfig
+	}{
+		{"Config Over Env", "", nil,
+			nomad.Config{Address: "http://127.0.0.1:4646", Region: "config-region", Namespace: "env-namespace", SecretID: "config-token"},
+			nomad.TLSConfig{}},
+		{"Flags Over Config", "", map[string]string{"token": "flag-token", "namespace": "flag-namespace"},
+			nomad.Config{Address: "http://127.0.0.1:4646", Region: "config-region", Namespace: "flag-namespace", SecretID: "flag-token"},
+			nomad.TLSConfig{}},
+		{"Context Over Config", "a", nil,
+			nomad.Config{Address: "http://a.example:4646", Region: "config-region", Namespace: "env-namespace", SecretID: "a-token"},
+			nomad.TLSConfig{CACert: "/etc/nomad/a-ca.pem", ClientCert: "/etc/nomad/a-cli.pem", ClientKey: "/etc/nomad/a-cli-key.pem",
+				TLSServerName: "server.a.nomad", Insecure: true}},
+		{"Context Region", "b", nil,
+			nomad.Config{Address: "http://b.example:4646", Region: "b-region", Namespace: "env-namespace", SecretID: "config-token"},
+			nomad.TLSConfig{}},
+		{"Flags Over Context", "a", map[string]string{"address": "http://flag.example:4646", "token": "flag-token",
+			"ca-cert": "/etc/nomad/flag-ca.pem"},
+			nomad.Config{Address: "http://flag.example:4646", Region: "config-region", Namespace: "env-namespace", SecretID: "flag-token"},
+			nomad.TLSConfig{CACert: "/etc/nomad/flag-ca.pem", ClientCert: "/etc/nomad/a-cli.pem", ClientKey: "/etc/nomad/a-cli-key.pem",
+				TLSServerName: "server.a.nomad", Insecure: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetFlags(rootCmd)
+			for name, value := range tt.flags {
+				rootCmd.PersistentFlags().Set(name, value)
+			}
+			config, err := nomadConfig(tt.context)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := nomad.Config{Address: config.Address, Region: config.Region, Namespace: config.Namespace, SecretID: config.SecretID}
+			if got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+			if tls := *config.TLSConfig; tls.CACert != tt.wantTLS.CACert || tls.ClientCert != tt.wantTLS.ClientCert ||
+				tls.ClientKey != tt.wantTLS.ClientKey || tls.TLSServerName != tt.wantTLS.TLSServerName || tls.Insecure != tt.wantTLS.Insecure {
+				t.Errorf("expected TLS settings %+v, got %+v", tt.wantTLS, tls)
+			}
+		})
+	}
+
+	if _, err := nomadConfig("missing"); err == nil || !strings.Contains(err.Error(), `context "missing" not found`) {
+		t.Errorf("expected an unknown context to be rejected, got %v", err)
+	}
+}
+
+func TestTargets(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+	dir, _, cleanup := testDir(t)
+	defer cleanup()
+	cfgFile = writeConfig(t, dir, fmt.Sprintf(`contexts:
+  prod:
+    address: %s
+  dev:
+    address: http://dev.example:4646
+`, server.URL))
+	initConfig()
+	defer resetFlags(rootCmd)
+
+	tests := []struct {
+		name  string
+		flags map[string]string
+		want  []string
+	}{
+		{"No Context", nil, []string{""}},
+		{"Contexts", map[string]string{"context": "prod,dev"}, []string{"prod", "dev"}},
+		{"All Contexts", map[string]string{"all-contexts": "true"}, []string{"dev", "prod"}},
+		{"All Regions", map[string]string{"context": "prod", "all-regions": "true"}, []string{"prod/global"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetFlags(rootCmd)
+			for name, value := range tt.flags {
+				rootCmd.PersistentFlags().Set(name, value)
+			}
+			clusters, err := targets()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, cluster := range clusters {
+				got = append(got, cluster.Name)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("expected targets %v, got %v", tt.want, got)
+			}
+			if tt.name == "All Regions" && clusters[0].Config.Region != "global" {
+				t.Errorf("expected the region to be set, got %q", clusters[0].Config.Region)
+			}
+		})
+	}
+}
+
+func TestContexts(t *testing.T) {
+	a := newRecordedServer(t)
+	defer a.Close()
+	b := newRecordedServer(t)
+	defer b.Close()
+	dir, _, cleanup := testDir(t)
+	defer cleanup()
+
+	var payloads []map[string]interface{}
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := make(map[string]interface{})
+		json.NewDecoder(r.Body).Decode(&payload)
+		payloads = append(payloads, payload)
+	}))
+	defer hook.Close()
+
+	config := writeConfig(t, dir, fmt.Sprintf(`token: config-token
+contexts:
+  a:
+    address: %s
+    token: a-token
+    region: east
+  b:
+    address: %s
+    region: west
+notifiers:
+  - name: hook
+    type: webhook
+    url: %s
+`, a.URL, b.URL, hook.URL))
+
+	output := run(t, config, "scale-in", "--force", "--context", "a,b", "--region", "flag-region")
+
+	headerA := fmt.Sprintf("==> a (%s)", a.URL)
+	headerB := fmt.Sprintf("==> b (%s)", b.URL)
+	first, second := strings.Index(output, headerA), strings.Index(output, headerB)
+	if first < 0 || second < first {
+		t.Fatalf("expected the output grouped under a and then b:\n%s", output)
+	}
+	for _, section := range []string{output[first:second], output[second:]} {
+		if !strings.Contains(section, "Job: couchbase, running") {
+			t.Errorf("expected every cluster to be scaled in:\n%s", section)
+		}
+	}
+	for name, server := range map[string]*recordedServer{"a": a, "b": b} {
+		if got := counts(server.Server); got["demo-webapp"] != 1 {
+			t.Errorf("expected %s to be scaled in, got %v", name, got)
+		}
+	}
+
+	// Flags override the context, the context overrides the top level keys
+	if tokens, regions := a.seen(); fmt.Sprint(tokens) != "[a-token]" || fmt.Sprint(regions) != "[flag-region]" {
+		t.Errorf("expected a to get the context token and the flag region, got %v and %v", tokens, regions)
+	}
+	if tokens, regions := b.seen(); fmt.Sprint(tokens) != "[config-token]" || fmt.Sprint(regions) != "[flag-region]" {
+		t.Errorf("expected b to get the top level token and the flag region, got %v and %v", tokens, regions)
+	}
+
+	if len(payloads) != 2 || payloads[0]["cluster"] != "a" || payloads[1]["cluster"] != "b" {
+		t.Fatalf("expected one notification per cluster, got %v", payloads)
+	}
+	for _, payload := range payloads {
+		if payload["kind"] != "applied" || len(payload["results"].([]interface{})) != 4 {
+			t.Errorf("unexpected notification %v", payload)
+		}
+	}
+
+	// Backups of clusters finishing within the same second do not collide
+	run(t, config, "backup-jobs", "--context", "a,b")
+	for _, name := range []string{"a", "b"} {
+		files, _ := filepath.Glob(filepath.Join(dir, "jobs-backup", "*", name, "*.json"))
+		if len(files) != 4 {
+			t.Errorf("expected 4 backup files for %s, got %v", name, files)
+		}
+	}
+}
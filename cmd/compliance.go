@@ -0,0 +1,82 @@
+// Package cmd handles all CLI calls
+/*
+Copyright © 2020 John Suarez jsuar@users.noreply.github.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// complianceCmd represents the compliance command
+var complianceCmd = &cobra.Command{
+	Use:   "compliance",
+	Short: "Reports jobs missing required meta keys and optionally acts on them",
+	Long: `The compliance command checks every job against the required meta keys
+and allowed values under compliance in the config file and reports the
+violations per job and per team. Depending on --action, violating jobs are
+only reported (notify), have their violations recorded in the
+custodian-violation meta key (mark) or are also marked with the
+custodian-marked-for meta key to be scaled in, stopped or purged once
+--grace-period is over (scale-in, stop, purge). Due marks are acted on by
+this command and by the marked command. The mark is cleared once a job
+complies. Jobs with the custodian-ignore=true meta key value set are left
+unchanged.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		force, _ := cmd.Flags().GetBool("force")
+		verbose, _ := cmd.Flags().GetBool("verbose")
+		approver, err := newApprover(cmd)
+		if err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+		force = force || approver != nil
+
+		var policy nomadhelper.CompliancePolicy
+		if err := viper.UnmarshalKey("compliance", &policy); err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+		policy.Action = viper.GetString("compliance.action")
+		policy.GracePeriod = viper.GetDuration("compliance.grace-period")
+		if err := policy.Validate(); err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+
+		forEachTarget(cmd, func(ctx context.Context, nh *nomadhelper.NomadHelper) *nomadhelper.Report {
+			nh.Approver = approver
+			return nh.CheckCompliance(ctx, policy, force, verbose)
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(complianceCmd)
+
+	complianceCmd.PersistentFlags().BoolP("force", "f", false, "Force action")
+	complianceCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
+	complianceCmd.Flags().BoolP("interactive", "i", false, "Show each change and ask before applying it")
+	complianceCmd.Flags().String("action", nomadhelper.ComplianceNotify, "Action taken on violating jobs: notify, mark, scale-in, stop or purge")
+	complianceCmd.Flags().Duration("grace-period", 72*time.Hour, "How long a job stays marked before it is scaled in, stopped or purged")
+	viper.BindPFlag("compliance.action", complianceCmd.Flags().Lookup("action"))
+	viper.BindPFlag("compliance.grace-period", complianceCmd.Flags().Lookup("grace-period"))
+}
@@ -0,0 +1,68 @@
+// Package cmd handles all CLI calls
+/*
+Copyright © 2020 John Suarez jsuar@users.noreply.github.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// costCmd represents the cost command
+var costCmd = &cobra.Command{
+	Use:   "cost",
+	Short: "Estimates what running jobs cost and what scaling them in saves",
+	Long: `The cost command multiplies the CPU and memory reserved by each task by
+the task group count and the hourly rates under cost in the config file,
+optionally per node class. For every running job it shows the monthly cost,
+the cost if scaled in to count=1, the monthly savings of scaling in and the
+savings realized by previous scale-in windows still in the job history.
+Scaled in jobs are found through the configured --state-store, and with
+--native, or scale-in.native set in the config file, through the scaling
+events of scale-in --native.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		verbose, _ := cmd.Flags().GetBool("verbose")
+		native := viper.GetBool("cost.native") || viper.GetBool("scale-in.native")
+
+		var config nomadhelper.CostConfig
+		if err := viper.UnmarshalKey("cost", &config); err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+		if err := config.Validate(); err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+
+		forEachTarget(cmd, func(ctx context.Context, nh *nomadhelper.NomadHelper) *nomadhelper.Report {
+			nh.NativeScale = native
+			nh.JobCosts(ctx, config, verbose)
+			return nil
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(costCmd)
+
+	costCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
+	costCmd.Flags().Bool("native", false, "Find jobs scaled in with scale-in --native by their scaling events")
+	viper.BindPFlag("cost.native", costCmd.Flags().Lookup("native"))
+}
@@ -17,6 +17,9 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
 	"github.com/spf13/cobra"
 )
@@ -28,16 +31,24 @@ var deleteAllJobsCmd = &cobra.Command{
 	Short:   "Deletes all jobs currently registered with Nomad",
 	Long: `The delete-all-jobs command will loop through all jobs currently registered
 with Nomad and deregister them. If the purge flag is set, then purge=true will be
-passed in the deregistration call.`,
+passed in the deregistration call. Every job is saved to a delete batch
+before it is deregistered so the run can be undone with undelete.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		force, _ := cmd.Flags().GetBool("force")
 		purge, _ := cmd.Flags().GetBool("purge")
 		autoApprove, _ := cmd.Flags().GetBool("auto-approve")
 		verbose, _ := cmd.Flags().GetBool("verbose")
+		approver, err := newApprover(cmd)
+		if err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+		force = force || approver != nil
 
-		nh := new(nomadhelper.NomadHelper)
-		nh.Init()
-		nh.DeleteAllJobs(force, autoApprove, purge, verbose)
+		forEachTarget(cmd, func(ctx context.Context, nh *nomadhelper.NomadHelper) *nomadhelper.Report {
+			nh.Approver = approver
+			return nh.DeleteAllJobs(ctx, force, autoApprove, purge, verbose)
+		})
 	},
 }
 
@@ -53,6 +64,7 @@ func init() {
 	deleteAllJobsCmd.PersistentFlags().BoolP("auto-approve", "", false, "Skip user confirmation")
 	deleteAllJobsCmd.PersistentFlags().BoolP("purge", "p", false, "Purge job data from Nomad after deregister")
 	deleteAllJobsCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
+	deleteAllJobsCmd.Flags().BoolP("interactive", "i", false, "Show each job's changes and ask before applying them")
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
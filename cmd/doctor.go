@@ -0,0 +1,70 @@
+// Package cmd handles all CLI calls
+/*
+Copyright © 2020 John Suarez jsuar@users.noreply.github.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Finds and fixes jobs left in a half scaled state",
+	Long: `The doctor command finds jobs whose scale state, in the configured
+--state-store or in scale-in meta, is inconsistent with their task groups or
+version history, for example a task group added after
+the scale-in without a saved count, counts edited by hand or a revert
+version Nomad no longer keeps. Each problem is explained with a suggested
+fix. With --fix the fixes are planned, and applied with --force:
+* suggested applies the fix suggested for each job
+* clear-meta removes the scale-in meta and leaves the job as it is
+* recompute-counts saves the counts of the revert version again
+* scale-out restores the revert version, or the saved counts when the
+  revert version no longer exists
+Jobs with the custodian-ignore=true meta key value set are never fixed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		force, _ := cmd.Flags().GetBool("force")
+		verbose, _ := cmd.Flags().GetBool("verbose")
+		approver, err := newApprover(cmd)
+		if err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+		force = force || approver != nil
+		fix := viper.GetString("doctor.fix")
+
+		forEachTarget(cmd, func(ctx context.Context, nh *nomadhelper.NomadHelper) *nomadhelper.Report {
+			nh.Approver = approver
+			return nh.Doctor(ctx, fix, force, verbose)
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+
+	doctorCmd.PersistentFlags().BoolP("force", "f", false, "Force action")
+	doctorCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
+	doctorCmd.Flags().BoolP("interactive", "i", false, "Show each fix and ask before applying it")
+	doctorCmd.Flags().String("fix", "", "Fix to apply: suggested, clear-meta, recompute-counts or scale-out")
+	viper.BindPFlag("doctor.fix", doctorCmd.Flags().Lookup("fix"))
+}
@@ -0,0 +1,72 @@
+// Package cmd handles all CLI calls
+/*
+Copyright © 2020 John Suarez jsuar@users.noreply.github.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// expireCmd represents the expire command
+var expireCmd = &cobra.Command{
+	Use:   "expire",
+	Short: "Stops or purges jobs past their custodian-ttl or custodian-expires",
+	Long: `The expire command lists every job with the custodian-ttl meta key
+(a lifetime counted from the job's submit time, e.g. 72h or 3d) or the
+custodian-expires meta key (an RFC 3339 time), warns about jobs expiring
+within --warn-within and stops the jobs that have expired, or purges them
+with --purge. Jobs with the custodian-ignore=true meta key value set are
+skipped. Every job is saved to a delete batch first and can be restored
+with undelete.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		force, _ := cmd.Flags().GetBool("force")
+		verbose, _ := cmd.Flags().GetBool("verbose")
+		approver, err := newApprover(cmd)
+		if err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+		force = force || approver != nil
+
+		opts := nomadhelper.ExpireOptions{
+			WarnWithin: viper.GetDuration("expire.warn-within"),
+			Purge:      viper.GetBool("expire.purge"),
+		}
+
+		forEachTarget(cmd, func(ctx context.Context, nh *nomadhelper.NomadHelper) *nomadhelper.Report {
+			nh.Approver = approver
+			return nh.ExpireJobs(ctx, opts, force, verbose)
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(expireCmd)
+
+	expireCmd.PersistentFlags().BoolP("force", "f", false, "Force action")
+	expireCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
+	expireCmd.Flags().BoolP("interactive", "i", false, "Show each job and ask before stopping it")
+	expireCmd.Flags().BoolP("purge", "p", false, "Purge expired jobs instead of stopping them")
+	expireCmd.Flags().Duration("warn-within", 24*time.Hour, "Warn about jobs expiring within this duration")
+	viper.BindPFlag("expire.purge", expireCmd.Flags().Lookup("purge"))
+	viper.BindPFlag("expire.warn-within", expireCmd.Flags().Lookup("warn-within"))
+}
@@ -0,0 +1,76 @@
+// Package cmd handles all CLI calls
+/*
+Copyright © 2020 John Suarez jsuar@users.noreply.github.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// gcCmd represents the gc command
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Purges stale and dead jobs",
+	Long: `The gc command purges jobs that are no longer useful:
+* Jobs stopped by a user but never purged, for longer than --dead-for
+* Other jobs dead for longer than --dead-for
+* Batch jobs whose last run failed longer than --failed-for ago
+* Periodic and parameterized jobs without a child job for --parent-idle-for;
+  periodic jobs must also be disabled or not due again within that window
+Jobs with the custodian-ignore=true meta key value set are skipped. Every
+job is saved to a delete batch first and can be restored with undelete.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		force, _ := cmd.Flags().GetBool("force")
+		verbose, _ := cmd.Flags().GetBool("verbose")
+		approver, err := newApprover(cmd)
+		if err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+		force = force || approver != nil
+
+		opts := nomadhelper.GCOptions{
+			DeadFor:       viper.GetDuration("gc.dead-for"),
+			FailedFor:     viper.GetDuration("gc.failed-for"),
+			ParentIdleFor: viper.GetDuration("gc.parent-idle-for"),
+		}
+
+		forEachTarget(cmd, func(ctx context.Context, nh *nomadhelper.NomadHelper) *nomadhelper.Report {
+			nh.Approver = approver
+			return nh.GCJobs(ctx, opts, force, verbose)
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+
+	gcCmd.PersistentFlags().BoolP("force", "f", false, "Force action")
+	gcCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
+	gcCmd.Flags().BoolP("interactive", "i", false, "Show each job and ask before purging it")
+	gcCmd.Flags().Duration("dead-for", 7*24*time.Hour, "Purge jobs dead or stopped for longer than this")
+	gcCmd.Flags().Duration("failed-for", 7*24*time.Hour, "Purge batch jobs whose last run failed longer ago than this")
+	gcCmd.Flags().Duration("parent-idle-for", 30*24*time.Hour, "Purge periodic and parameterized jobs without a child job for this long")
+	viper.BindPFlag("gc.dead-for", gcCmd.Flags().Lookup("dead-for"))
+	viper.BindPFlag("gc.failed-for", gcCmd.Flags().Lookup("failed-for"))
+	viper.BindPFlag("gc.parent-idle-for", gcCmd.Flags().Lookup("parent-idle-for"))
+}
@@ -0,0 +1,88 @@
+// Package cmd handles all CLI calls
+/*
+Copyright © 2020 John Suarez jsuar@users.noreply.github.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// idleCmd represents the idle command
+var idleCmd = &cobra.Command{
+	Use:   "idle",
+	Short: "Scales in service jobs that are idle",
+	Long: `The idle command scales in running service jobs that are idle, with the
+same meta bookkeeping as scale-in so scale-out restores them. A job is idle
+when no task of its running allocations uses more than --cpu-threshold MHz,
+or, with --prometheus-url set, when --prometheus-query returns a value at or
+below --traffic-threshold, on every run for --idle-for. A query without data
+leaves the job unknown. The query is a template executed with the job's .ID,
+.Name and .Namespace. Jobs with the custodian-ignore=true meta key value
+set are skipped.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		force, _ := cmd.Flags().GetBool("force")
+		verbose, _ := cmd.Flags().GetBool("verbose")
+		approver, err := newApprover(cmd)
+		if err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+		force = force || approver != nil
+
+		opts := nomadhelper.IdleOptions{
+			CPUThreshold: viper.GetFloat64("idle.cpu-threshold"),
+			IdleFor:      viper.GetDuration("idle.idle-for"),
+		}
+		if url := viper.GetString("idle.prometheus-url"); url != "" {
+			opts.Prometheus = &nomadhelper.PrometheusQuery{
+				URL:       url,
+				Query:     viper.GetString("idle.prometheus-query"),
+				Threshold: viper.GetFloat64("idle.traffic-threshold"),
+			}
+			if opts.Prometheus.Query == "" {
+				fmt.Fprintln(cmd.OutOrStdout(), "--prometheus-url requires --prometheus-query")
+				return
+			}
+		}
+
+		forEachTarget(cmd, func(ctx context.Context, nh *nomadhelper.NomadHelper) *nomadhelper.Report {
+			nh.Approver = approver
+			return nh.DetectIdleJobs(ctx, opts, force, verbose)
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(idleCmd)
+
+	idleCmd.PersistentFlags().BoolP("force", "f", false, "Force action")
+	idleCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
+	idleCmd.Flags().BoolP("interactive", "i", false, "Show each job and ask before scaling it in")
+	idleCmd.Flags().Duration("idle-for", 6*time.Hour, "How long a job must be seen idle before it is scaled in")
+	idleCmd.Flags().Float64("cpu-threshold", 2, "CPU in MHz at or below which a task is idle")
+	idleCmd.Flags().String("prometheus-url", "", "Prometheus server deciding whether jobs are idle instead of CPU usage")
+	idleCmd.Flags().String("prometheus-query", "", "Query returning the traffic of a job, e.g. sum(rate(http_requests_total{service=\"{{.ID}}\"}[6h]))")
+	idleCmd.Flags().Float64("traffic-threshold", 0, "Query value at or below which a job is idle")
+	for _, name := range []string{"idle-for", "cpu-threshold", "prometheus-url", "prometheus-query", "traffic-threshold"} {
+		viper.BindPFlag("idle."+name, idleCmd.Flags().Lookup(name))
+	}
+}
@@ -0,0 +1,46 @@
+// Package cmd handles all CLI calls
+/*
+Copyright © 2020 John Suarez jsuar@users.noreply.github.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+	"github.com/spf13/cobra"
+)
+
+// stdinIsTerminal is replaced in tests
+var stdinIsTerminal = func() bool {
+	return nomadhelper.IsTerminal(os.Stdin)
+}
+
+// newApprover returns the approver for an --interactive run or nil. Approved
+// changes are applied, so an interactive run implies --force.
+func newApprover(cmd *cobra.Command) (*nomadhelper.Approver, error) {
+	interactive, _ := cmd.Flags().GetBool("interactive")
+	if !interactive {
+		return nil, nil
+	}
+	if autoApprove, _ := cmd.Flags().GetBool("auto-approve"); autoApprove {
+		return nil, fmt.Errorf("--interactive cannot be combined with --auto-approve")
+	}
+	if !stdinIsTerminal() {
+		return nil, fmt.Errorf("--interactive requires stdin to be a terminal")
+	}
+	return nomadhelper.NewApprover(cmd.InOrStdin(), cmd.OutOrStdout()), nil
+}
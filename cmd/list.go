@@ -17,6 +17,8 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+
 	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
 	"github.com/spf13/cobra"
 )
@@ -31,9 +33,10 @@ count and meta data relevant to the nomad-custodian CLI.`,
 		jobType, _ := cmd.Flags().GetString("job-type")
 		verbose, _ := cmd.Flags().GetBool("verbose")
 
-		nhelper := new(nomadhelper.NomadHelper)
-		nhelper.Init()
-		nhelper.ListJobs(verbose, jobType)
+		forEachTarget(cmd, func(ctx context.Context, nhelper *nomadhelper.NomadHelper) *nomadhelper.Report {
+			nhelper.ListJobs(ctx, verbose, jobType)
+			return nil
+		})
 	},
 }
 
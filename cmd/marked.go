@@ -0,0 +1,61 @@
+// Package cmd handles all CLI calls
+/*
+Copyright © 2020 John Suarez jsuar@users.noreply.github.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+	"github.com/spf13/cobra"
+)
+
+// markedCmd represents the marked command
+var markedCmd = &cobra.Command{
+	Use:   "marked",
+	Short: "Scales in, stops or purges jobs once their custodian-marked-for mark is due",
+	Long: `The marked command lists every job with the custodian-marked-for meta key,
+e.g. stop@2026-10-25, warns about the marks that are not due yet and scales
+in, stops or purges the jobs whose mark is due. Marks are written by the
+compliance command or by hand. Jobs with the custodian-ignore=true meta key
+value set are skipped. Stopped and purged jobs are saved to a delete batch
+first and can be restored with undelete.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		force, _ := cmd.Flags().GetBool("force")
+		verbose, _ := cmd.Flags().GetBool("verbose")
+		approver, err := newApprover(cmd)
+		if err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+		force = force || approver != nil
+
+		forEachTarget(cmd, func(ctx context.Context, nh *nomadhelper.NomadHelper) *nomadhelper.Report {
+			nh.Approver = approver
+			return nh.ProcessMarks(ctx, time.Now(), force, verbose)
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(markedCmd)
+
+	markedCmd.PersistentFlags().BoolP("force", "f", false, "Force action")
+	markedCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
+	markedCmd.Flags().BoolP("interactive", "i", false, "Show each job and ask before acting on it")
+}
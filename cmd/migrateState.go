@@ -0,0 +1,111 @@
+// Package cmd handles all CLI calls
+/*
+Copyright © 2020 John Suarez jsuar@users.noreply.github.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// stateStoreOptions returns the state store settings from the state section
+// of the config file. The Consul address and token default to the
+// CONSUL_HTTP_ADDR and CONSUL_HTTP_TOKEN environment variables.
+func stateStoreOptions() nomadhelper.StateStoreOptions {
+	opts := nomadhelper.StateStoreOptions{
+		Prefix:        viper.GetString("state.prefix"),
+		Path:          viper.GetString("state.path"),
+		ConsulAddress: viper.GetString("state.consul-address"),
+		ConsulToken:   viper.GetString("state.consul-token"),
+	}
+	if opts.ConsulAddress == "" {
+		opts.ConsulAddress = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if opts.ConsulAddress == "" {
+		opts.ConsulAddress = "http://127.0.0.1:8500"
+	} else if !strings.Contains(opts.ConsulAddress, "://") {
+		opts.ConsulAddress = "http://" + opts.ConsulAddress
+	}
+	if opts.ConsulToken == "" {
+		opts.ConsulToken = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	return opts
+}
+
+// migrateStateCmd represents the migrate-state command
+var migrateStateCmd = &cobra.Command{
+	Use:   "migrate-state",
+	Short: "Moves the state of scaled in jobs between state stores",
+	Long: `The migrate-state command moves the original counts, revert version and
+action of every scaled in job from the --from store to the --to store,
+which defaults to the configured --state-store. Stores are:
+* meta keeps the state in custodian-* job meta keys
+* nomad-variables keeps it in Nomad Variables (Nomad 1.4 or later)
+* consul keeps it in the Consul KV store
+* file keeps it in jobs-backup/scale-state.json
+Moving to or from meta registers each job with the meta keys added or
+removed. The changes are planned, and applied with --force.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		force, _ := cmd.Flags().GetBool("force")
+		verbose, _ := cmd.Flags().GetBool("verbose")
+		approver, err := newApprover(cmd)
+		if err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+		force = force || approver != nil
+
+		from := viper.GetString("migrate-state.from")
+		to := viper.GetString("migrate-state.to")
+		if to == "" {
+			to = viper.GetString("state-store")
+		}
+		opts := stateStoreOptions()
+
+		forEachTarget(cmd, func(ctx context.Context, nh *nomadhelper.NomadHelper) *nomadhelper.Report {
+			fromStore, err := nh.NewStateStore(from, opts)
+			var toStore nomadhelper.StateStore
+			if err == nil {
+				toStore, err = nh.NewStateStore(to, opts)
+			}
+			if err != nil {
+				fmt.Fprintln(cmd.OutOrStdout(), err)
+				return nil
+			}
+			nh.Approver = approver
+			return nh.MigrateState(ctx, fromStore, toStore, force, verbose)
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateStateCmd)
+
+	migrateStateCmd.PersistentFlags().BoolP("force", "f", false, "Force action")
+	migrateStateCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
+	migrateStateCmd.Flags().BoolP("interactive", "i", false, "Show each job's changes and ask before applying them")
+	migrateStateCmd.Flags().String("from", nomadhelper.StoreMeta, "State store to move the state from")
+	migrateStateCmd.Flags().String("to", "", "State store to move the state to (default the configured --state-store)")
+	for _, name := range []string{"from", "to"} {
+		viper.BindPFlag("migrate-state."+name, migrateStateCmd.Flags().Lookup(name))
+	}
+}
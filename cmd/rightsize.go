@@ -0,0 +1,97 @@
+// Package cmd handles all CLI calls
+/*
+Copyright © 2020 John Suarez jsuar@users.noreply.github.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// rightsizeCmd represents the rightsize command
+var rightsizeCmd = &cobra.Command{
+	Use:   "rightsize",
+	Short: "Recommends task resources from the CPU and memory allocations use",
+	Long: `The rightsize command samples the resource usage of every running
+allocation for --window, compares the peak CPU and memory used by each task
+to the resources it reserves and recommends new resources with --headroom
+on top of the peak. Changes smaller than --threshold are not recommended.
+With --update the jobs are planned with the recommended resources and
+--force applies them. Jobs with the custodian-ignore=true meta key value
+set are never updated.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		force, _ := cmd.Flags().GetBool("force")
+		verbose, _ := cmd.Flags().GetBool("verbose")
+		update, _ := cmd.Flags().GetBool("update")
+		approver, err := newApprover(cmd)
+		if err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+		force = force || approver != nil
+
+		plan, err := newPlanFile(cmd, "rightsize")
+		if err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+		update = update || force || plan != nil
+
+		opts := nomadhelper.RightsizeOptions{
+			Window:      viper.GetDuration("rightsize.window"),
+			Interval:    viper.GetDuration("rightsize.interval"),
+			Headroom:    viper.GetFloat64("rightsize.headroom"),
+			Threshold:   viper.GetFloat64("rightsize.threshold"),
+			MinCPU:      viper.GetInt("rightsize.min-cpu"),
+			MinMemoryMB: viper.GetInt("rightsize.min-memory"),
+		}
+
+		forEachTarget(cmd, func(ctx context.Context, nh *nomadhelper.NomadHelper) *nomadhelper.Report {
+			nh.Plan = plan
+			nh.Approver = approver
+			report := nh.RightsizeJobs(ctx, opts, update, force, verbose)
+			if !update {
+				return nil
+			}
+			return report
+		})
+		writePlanFile(cmd, plan)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rightsizeCmd)
+
+	rightsizeCmd.PersistentFlags().BoolP("force", "f", false, "Force action")
+	rightsizeCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
+	rightsizeCmd.Flags().BoolP("interactive", "i", false, "Show each job and ask before updating it")
+	rightsizeCmd.Flags().Bool("update", false, "Plan updating the jobs with the recommended resources")
+	rightsizeCmd.Flags().StringP("out", "o", "", "Save the planned changes to a file for the apply command")
+	rightsizeCmd.Flags().Duration("window", 10*time.Minute, "How long allocation usage is sampled for")
+	rightsizeCmd.Flags().Duration("interval", 30*time.Second, "Time between two samples")
+	rightsizeCmd.Flags().Float64("headroom", 0.2, "Fraction added on top of the peak usage")
+	rightsizeCmd.Flags().Float64("threshold", 0.25, "Smallest relative change to recommend")
+	rightsizeCmd.Flags().Int("min-cpu", 20, "Smallest CPU in MHz to recommend")
+	rightsizeCmd.Flags().Int("min-memory", 32, "Smallest memory in MB to recommend")
+	for _, name := range []string{"window", "interval", "headroom", "threshold", "min-cpu", "min-memory"} {
+		viper.BindPFlag("rightsize."+name, rightsizeCmd.Flags().Lookup(name))
+	}
+}
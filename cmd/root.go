@@ -17,9 +17,17 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+	"github.com/jsuar/nomad-custodian/pkg/notifier"
 	"github.com/spf13/cobra"
 
 	homedir "github.com/mitchellh/go-homedir"
@@ -29,6 +37,10 @@ import (
 var cfgFile string
 var gitCommit string
 
+// nomadFlags are the root flags and config file keys describing how to reach Nomad
+var nomadFlags = []string{"address", "region", "namespace", "token", "ca-cert", "ca-path",
+	"client-cert", "client-key", "tls-server-name", "tls-skip-verify"}
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "nomad-custodian",
@@ -64,13 +76,56 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
-	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.nomad-custodian.yaml)")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.nomad-custodian.yaml)")
+
+	// Nomad connection settings. These take precedence over the config file,
+	// which takes precedence over the NOMAD_* environment variables.
+	rootCmd.PersistentFlags().String("address", "", "Address of the Nomad agent (NOMAD_ADDR)")
+	rootCmd.PersistentFlags().String("region", "", "Region of the Nomad servers to target (NOMAD_REGION)")
+	rootCmd.PersistentFlags().String("namespace", "", "Nomad namespace to target (NOMAD_NAMESPACE)")
+	rootCmd.PersistentFlags().String("token", "", "Nomad ACL token (NOMAD_TOKEN)")
+	rootCmd.PersistentFlags().String("ca-cert", "", "Path to a PEM encoded CA cert file (NOMAD_CACERT)")
+	rootCmd.PersistentFlags().String("ca-path", "", "Path to a directory of PEM encoded CA cert files (NOMAD_CAPATH)")
+	rootCmd.PersistentFlags().String("client-cert", "", "Path to a PEM encoded client certificate (NOMAD_CLIENT_CERT)")
+	rootCmd.PersistentFlags().String("client-key", "", "Path to an unencrypted PEM encoded private key (NOMAD_CLIENT_KEY)")
+	rootCmd.PersistentFlags().String("tls-server-name", "", "Server name to use as the SNI host for TLS (NOMAD_TLS_SERVER_NAME)")
+	rootCmd.PersistentFlags().Bool("tls-skip-verify", false, "Do not verify TLS certificates (NOMAD_SKIP_VERIFY)")
+	for _, name := range nomadFlags {
+		viper.BindPFlag(name, rootCmd.PersistentFlags().Lookup(name))
+	}
+
+	// Named contexts from the config file
+	rootCmd.PersistentFlags().StringSlice("context", nil, "Named context(s) from the config file to run against")
+	rootCmd.PersistentFlags().Bool("all-contexts", false, "Run against every context in the config file")
+	rootCmd.PersistentFlags().Bool("all-regions", false, "Run against every region of each targeted federation")
+	viper.BindPFlag("context", rootCmd.PersistentFlags().Lookup("context"))
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 
 	rootCmd.Flags().BoolP("version", "v", false, "Help message for toggle")
+
+	rootCmd.PersistentFlags().Int("retry-attempts", nomadhelper.DefaultRetryPolicy.Attempts, "Number of tries for Nomad API calls failing with a transient error")
+	rootCmd.PersistentFlags().Duration("retry-delay", nomadhelper.DefaultRetryPolicy.BaseDelay, "Delay before the first retry, doubled on every following retry")
+	viper.BindPFlag("retry-attempts", rootCmd.PersistentFlags().Lookup("retry-attempts"))
+	viper.BindPFlag("retry-delay", rootCmd.PersistentFlags().Lookup("retry-delay"))
+
+	rootCmd.PersistentFlags().Int("concurrency", nomadhelper.DefaultConcurrency, "Number of job details fetched from Nomad in parallel")
+	viper.BindPFlag("concurrency", rootCmd.PersistentFlags().Lookup("concurrency"))
+
+	rootCmd.PersistentFlags().Duration("timeout", 0, "Stop dispatching changes after this duration, e.g. 10m (default no timeout)")
+
+	rootCmd.PersistentFlags().StringSlice("jobs", nil, "Only change jobs whose name matches one of these patterns, e.g. web-*")
+	rootCmd.PersistentFlags().StringSlice("ignore-jobs", nil, "Never change jobs whose name matches one of these patterns")
+	viper.BindPFlag("jobs", rootCmd.PersistentFlags().Lookup("jobs"))
+	viper.BindPFlag("ignore-jobs", rootCmd.PersistentFlags().Lookup("ignore-jobs"))
+
+	rootCmd.PersistentFlags().String("state-store", nomadhelper.StoreMeta, "Where the state of scaled in jobs is kept: meta, nomad-variables, consul or file")
+	viper.BindPFlag("state-store", rootCmd.PersistentFlags().Lookup("state-store"))
+
+	rootCmd.PersistentFlags().String("notify-message", "", "Message to include in notifications sent for this run")
+	viper.BindPFlag("notify-message", rootCmd.PersistentFlags().Lookup("notify-message"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -91,6 +146,10 @@ func initConfig() {
 		viper.SetConfigName(".nomad-custodian")
 	}
 
+	// Only NOMAD_CUSTODIAN_* variables override settings, so unrelated
+	// variables such as TOKEN or ADDRESS are never picked up.
+	viper.SetEnvPrefix("nomad_custodian")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
@@ -98,3 +157,133 @@ func initConfig() {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
 }
+
+// commandContext returns a context that is done once the --timeout flag
+// expires or SIGINT/SIGTERM is received. A second signal exits immediately.
+// The returned function must be called to release the signal handler.
+func commandContext(cmd *cobra.Command) (context.Context, func()) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout, _ := rootCmd.PersistentFlags().GetDuration("timeout"); timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			fmt.Fprintf(cmd.ErrOrStderr(), "\nReceived %s, waiting for in-flight changes to finish. Send again to exit immediately.\n", sig)
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case <-signals:
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+}
+
+// nomadConfig builds the Nomad client config for a named context. Settings
+// are layered from the NOMAD_* environment variables, the top level config
+// file keys, the context and finally any root flags that were set.
+func nomadConfig(context string) (*nomad.Config, error) {
+	config := nomad.DefaultConfig()
+	applyNomadSettings(config, viper.GetString)
+
+	if context != "" {
+		key := "contexts." + context
+		if !viper.IsSet(key) {
+			return nil, fmt.Errorf("context %q not found in the config file", context)
+		}
+		applyNomadSettings(config, func(name string) string {
+			return viper.GetString(key + "." + name)
+		})
+		applyNomadSettings(config, func(name string) string {
+			flag := rootCmd.PersistentFlags().Lookup(name)
+			if flag == nil || !flag.Changed {
+				return ""
+			}
+			return flag.Value.String()
+		})
+	}
+
+	return config, nil
+}
+
+// applyNomadSettings overrides the config with every setting that is not empty
+func applyNomadSettings(config *nomad.Config, get func(name string) string) {
+	if address := get("address"); address != "" {
+		config.Address = address
+	}
+	if region := get("region"); region != "" {
+		config.Region = region
+	}
+	if namespace := get("namespace"); namespace != "" {
+		config.Namespace = namespace
+	}
+	if token := get("token"); token != "" {
+		config.SecretID = token
+	}
+	if caCert := get("ca-cert"); caCert != "" {
+		config.TLSConfig.CACert = caCert
+	}
+	if caPath := get("ca-path"); caPath != "" {
+		config.TLSConfig.CAPath = caPath
+	}
+	if clientCert := get("client-cert"); clientCert != "" {
+		config.TLSConfig.ClientCert = clientCert
+	}
+	if clientKey := get("client-key"); clientKey != "" {
+		config.TLSConfig.ClientKey = clientKey
+	}
+	if serverName := get("tls-server-name"); serverName != "" {
+		config.TLSConfig.TLSServerName = serverName
+	}
+	if skipVerify, _ := strconv.ParseBool(get("tls-skip-verify")); skipVerify {
+		config.TLSConfig.Insecure = true
+	}
+}
+
+// retryPolicy returns the retry policy from the flags or the config file
+func retryPolicy() nomadhelper.RetryPolicy {
+	policy := nomadhelper.DefaultRetryPolicy
+	policy.Attempts = viper.GetInt("retry-attempts")
+	policy.BaseDelay = viper.GetDuration("retry-delay")
+	if policy.Attempts < 1 {
+		policy.Attempts = 1
+	}
+	return policy
+}
+
+// notify sends the run report to all notifiers in the config file
+func notify(report *nomadhelper.Report) {
+	var configs []notifier.Config
+	if err := viper.UnmarshalKey("notifiers", &configs); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(configs) == 0 {
+		return
+	}
+
+	dispatcher, err := notifier.NewDispatcher(configs)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, err := range dispatcher.Dispatch(notifier.NewEvent(report, viper.GetString("notify-message"))) {
+		fmt.Println(err)
+	}
+}
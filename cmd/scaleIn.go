@@ -17,8 +17,14 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
 	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // scaleUpCmd represents the scaleIn command
@@ -31,14 +37,72 @@ jobs registered in Nomad and set count=1 for all tasks
 in the task group. Jobs will be skipped if they:
 * Are already scaled in to count=1
 * Have the custodian-ignore=false meta key value set
-* Are not running`,
+* Are not running
+* Are system or sysbatch jobs, unless --system-constraint is set. System
+  jobs are then constrained to the matching nodes instead, e.g.
+  --system-constraint '${node.class} = always-on'
+
+With --pause-periodic periodic jobs are also disabled so they stop
+launching until scale-out restores them.
+
+With --drain-nodes the client nodes left with at most --drain-max-allocs
+allocations are drained afterwards, which makes them ineligible, so an
+autoscaling group can terminate them. The drained nodes are posted to
+--node-webhook when set. scale-out --restore-nodes makes them eligible again.
+
+With --native task group counts are changed through Nomad's scale endpoint
+instead of registering the job, so the job spec and meta are left as they
+are. The original counts are kept in the scaling events, and scale-out
+--native restores them. Periodic jobs paused with --pause-periodic and
+system jobs are still registered.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		force, _ := cmd.Flags().GetBool("force")
 		verbose, _ := cmd.Flags().GetBool("verbose")
+		approver, err := newApprover(cmd)
+		if err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+		force = force || approver != nil
+
+		plan, err := newPlanFile(cmd, "scale-in")
+		if err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+
+		var systemConstraint *nomad.Constraint
+		if value := viper.GetString("scale-in.system-constraint"); value != "" {
+			systemConstraint, err = nomadhelper.ParseConstraint(value)
+			if err != nil {
+				fmt.Fprintln(cmd.OutOrStdout(), err)
+				return
+			}
+		}
+		pausePeriodic := viper.GetBool("scale-in.pause-periodic")
+		native := viper.GetBool("scale-in.native")
+		drain := viper.GetBool("scale-in.drain-nodes")
+		opts := nomadhelper.DrainOptions{
+			MaxAllocs: viper.GetInt("scale-in.drain-max-allocs"),
+			Deadline:  viper.GetDuration("scale-in.drain-deadline"),
+			MinNodes:  viper.GetInt("scale-in.drain-min-nodes"),
+			Webhook:   viper.GetString("scale-in.node-webhook"),
+		}
 
-		nhelper := new(nomadhelper.NomadHelper)
-		nhelper.Init()
-		nhelper.ScaleInJobs(force, verbose)
+		forEachTarget(cmd, func(ctx context.Context, nhelper *nomadhelper.NomadHelper) *nomadhelper.Report {
+			nhelper.Plan = plan
+			nhelper.Approver = approver
+			nhelper.PausePeriodic = pausePeriodic
+			nhelper.SystemConstraint = systemConstraint
+			nhelper.NativeScale = native
+			report := nhelper.ScaleInJobs(ctx, force, verbose)
+			if drain && ctx.Err() == nil {
+				fmt.Fprintln(cmd.OutOrStdout())
+				report.Merge(nhelper.DrainEmptyNodes(ctx, opts, force, verbose))
+			}
+			return report
+		})
+		writePlanFile(cmd, plan)
 	},
 }
 
@@ -51,6 +115,19 @@ func init() {
 	// and all subcommands, e.g.:
 	scaleInCmd.PersistentFlags().BoolP("force", "f", false, "Force action")
 	scaleInCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
+	scaleInCmd.Flags().BoolP("interactive", "i", false, "Show each job's changes and ask before applying them")
+	scaleInCmd.Flags().StringP("out", "o", "", "Save the planned changes to a file for the apply command")
+	scaleInCmd.Flags().String("system-constraint", "", "Constraint added to system jobs instead of skipping them, e.g. '${node.class} = always-on'")
+	scaleInCmd.Flags().Bool("pause-periodic", false, "Disable periodic jobs until scale-out")
+	scaleInCmd.Flags().Bool("native", false, "Scale task groups through the scale endpoint instead of registering jobs")
+	scaleInCmd.Flags().Bool("drain-nodes", false, "Drain the client nodes left empty or nearly empty")
+	scaleInCmd.Flags().Int("drain-max-allocs", 0, "Allocations a node may still run to be drained, not counting system jobs")
+	scaleInCmd.Flags().Duration("drain-deadline", time.Hour, "How long allocations are given to move off a drained node")
+	scaleInCmd.Flags().Int("drain-min-nodes", 1, "Eligible nodes kept in each datacenter")
+	scaleInCmd.Flags().String("node-webhook", "", "URL the drained nodes are posted to")
+	for _, name := range []string{"system-constraint", "pause-periodic", "native", "drain-nodes", "drain-max-allocs", "drain-deadline", "drain-min-nodes", "node-webhook"} {
+		viper.BindPFlag("scale-in."+name, scaleInCmd.Flags().Lookup(name))
+	}
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
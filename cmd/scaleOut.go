@@ -17,8 +17,12 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // scaleUpCmd represents the scaleOut command
@@ -33,14 +37,49 @@ will revert to their original counts. Jobs will be
 skipped if they:
 * Not in a scaled-in state
 * Have the custodian-ignore=false meta key value set
-* Are not running`,
+* Are not running
+
+With --restore-nodes the client nodes drained by scale-in --drain-nodes
+are made eligible again first, and posted to --node-webhook when set.
+
+With --native jobs scaled in with scale-in --native are found by their
+scaling events and scaled out through Nomad's scale endpoint. Jobs scaled
+in by registering them are reverted as usual.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		force, _ := cmd.Flags().GetBool("force")
 		verbose, _ := cmd.Flags().GetBool("verbose")
+		approver, err := newApprover(cmd)
+		if err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+		force = force || approver != nil
+
+		plan, err := newPlanFile(cmd, "scale-out")
+		if err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+
+		restore := viper.GetBool("scale-out.restore-nodes")
+		native := viper.GetBool("scale-out.native")
+		opts := nomadhelper.DrainOptions{Webhook: viper.GetString("scale-out.node-webhook")}
 
-		nhelper := new(nomadhelper.NomadHelper)
-		nhelper.Init()
-		nhelper.ScaleOutJobs(force, verbose)
+		forEachTarget(cmd, func(ctx context.Context, nhelper *nomadhelper.NomadHelper) *nomadhelper.Report {
+			nhelper.Plan = plan
+			nhelper.Approver = approver
+			nhelper.NativeScale = native
+			if !restore {
+				return nhelper.ScaleOutJobs(ctx, force, verbose)
+			}
+			// Nodes are made eligible first so the scaled out allocations can be placed
+			nodes := nhelper.RestoreDrainedNodes(ctx, opts, force, verbose)
+			fmt.Fprintln(cmd.OutOrStdout())
+			report := nhelper.ScaleOutJobs(ctx, force, verbose)
+			report.Merge(nodes)
+			return report
+		})
+		writePlanFile(cmd, plan)
 	},
 }
 
@@ -53,6 +92,14 @@ func init() {
 	// and all subcommands, e.g.:
 	scaleOutCmd.PersistentFlags().BoolP("force", "f", false, "Force action")
 	scaleOutCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
+	scaleOutCmd.Flags().BoolP("interactive", "i", false, "Show each job's changes and ask before applying them")
+	scaleOutCmd.Flags().StringP("out", "o", "", "Save the planned changes to a file for the apply command")
+	scaleOutCmd.Flags().Bool("native", false, "Scale out jobs scaled in through the scale endpoint")
+	scaleOutCmd.Flags().Bool("restore-nodes", false, "Make the nodes drained by scale-in --drain-nodes eligible again")
+	scaleOutCmd.Flags().String("node-webhook", "", "URL the restored nodes are posted to")
+	for _, name := range []string{"native", "restore-nodes", "node-webhook"} {
+		viper.BindPFlag("scale-out."+name, scaleOutCmd.Flags().Lookup(name))
+	}
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
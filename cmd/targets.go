@@ -0,0 +1,147 @@
+// Package cmd handles all CLI calls
+/*
+Copyright © 2020 John Suarez jsuar@users.noreply.github.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// target is a single cluster and region a command runs against
+type target struct {
+	Name   string
+	Config *nomad.Config
+}
+
+// contextNames returns the contexts selected by the flags or the config file.
+// A single empty name means no context is in use.
+func contextNames() []string {
+	if allContexts, _ := rootCmd.PersistentFlags().GetBool("all-contexts"); allContexts {
+		var names []string
+		for name := range viper.GetStringMap("contexts") {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	names := viper.GetStringSlice("context")
+	if len(names) == 0 {
+		return []string{""}
+	}
+	return names
+}
+
+// targets resolves the contexts and, when requested, the regions of each
+// context into the list of clusters to run against
+func targets() ([]target, error) {
+	allRegions, _ := rootCmd.PersistentFlags().GetBool("all-regions")
+
+	var result []target
+	for _, name := range contextNames() {
+		config, err := nomadConfig(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if !allRegions {
+			result = append(result, target{Name: name, Config: config})
+			continue
+		}
+
+		client, err := nomad.NewClient(config)
+		if err != nil {
+			return nil, err
+		}
+		regions, err := client.Regions().List()
+		if err != nil {
+			return nil, fmt.Errorf("listing regions for %q: %v", name, err)
+		}
+		for _, region := range regions {
+			regionConfig := *config
+			regionConfig.TLSConfig = config.TLSConfig.Copy()
+			regionConfig.Region = region
+			targetName := region
+			if name != "" {
+				targetName = name + "/" + region
+			}
+			result = append(result, target{Name: targetName, Config: &regionConfig})
+		}
+	}
+	return result, nil
+}
+
+// forEachTarget runs the command once per targeted cluster, grouping the
+// output by cluster and sending a notification for every report. When the run
+// is interrupted or times out, a summary of the changed and unchanged jobs is
+// printed and the remaining clusters are skipped.
+func forEachTarget(cmd *cobra.Command, run func(ctx context.Context, nh *nomadhelper.NomadHelper) *nomadhelper.Report) {
+	out := cmd.OutOrStdout()
+	clusters, err := targets()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return
+	}
+
+	ctx, stop := commandContext(cmd)
+	defer stop()
+
+	for i, cluster := range clusters {
+		if len(clusters) > 1 {
+			fmt.Fprintf(out, "==> %s (%s)\n", cluster.Name, cluster.Config.Address)
+		}
+
+		nh := new(nomadhelper.NomadHelper)
+		nh.Retry = retryPolicy()
+		nh.Concurrency = viper.GetInt("concurrency")
+		nh.Selector = nomadhelper.JobSelector{
+			Jobs:   viper.GetStringSlice("jobs"),
+			Ignore: viper.GetStringSlice("ignore-jobs"),
+		}
+		nh.InitConfig(cluster.Config)
+		nh.BindContext(ctx)
+		nh.Out = out
+		nh.Target = cluster.Name
+		nh.State, err = nh.NewStateStore(viper.GetString("state-store"), stateStoreOptions())
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return
+		}
+		report := run(ctx, nh)
+		if report != nil {
+			report.Cluster = cluster.Name
+			notify(report)
+		}
+
+		if err := ctx.Err(); err != nil {
+			fmt.Fprintf(out, "\nRun stopped: %v\n", err)
+			if report != nil {
+				report.WriteSummary(out)
+			}
+			for _, skipped := range clusters[i+1:] {
+				fmt.Fprintf(out, "Cluster %s was not processed\n", skipped.Name)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Package cmd handles all CLI calls
+/*
+Copyright © 2020 John Suarez jsuar@users.noreply.github.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+	"github.com/ryanuber/columnize"
+	"github.com/spf13/cobra"
+)
+
+// undeleteCmd represents the undelete command
+var undeleteCmd = &cobra.Command{
+	Use:   "undelete [batch-id]",
+	Short: "Restores the jobs of a delete-all-jobs run",
+	Long: `The undelete command registers the jobs deregistered by a
+delete-all-jobs run again, exactly as they were saved before being
+deregistered. Without a batch ID the saved delete batches are listed.
+Jobs that are registered and not dead are skipped.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			listDeleteBatches(cmd)
+			return
+		}
+
+		force, _ := cmd.Flags().GetBool("force")
+		verbose, _ := cmd.Flags().GetBool("verbose")
+		approver, err := newApprover(cmd)
+		if err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), err)
+			return
+		}
+		force = force || approver != nil
+
+		forEachTarget(cmd, func(ctx context.Context, nh *nomadhelper.NomadHelper) *nomadhelper.Report {
+			nh.Approver = approver
+			return nh.UndeleteJobs(ctx, args[0], force, verbose)
+		})
+	},
+}
+
+// listDeleteBatches prints the saved delete batches
+func listDeleteBatches(cmd *cobra.Command) {
+	batches, err := nomadhelper.ListDeleteBatches()
+	if err != nil {
+		fmt.Fprintln(cmd.OutOrStdout(), err)
+		return
+	}
+
+	output := []string{"Batch|Address|Region|Namespace|Purged|Jobs"}
+	for _, batch := range batches {
+		region, namespace := batch.Region, batch.Namespace
+		if region == "" {
+			region = "-"
+		}
+		if namespace == "" {
+			namespace = "-"
+		}
+		output = append(output, fmt.Sprintf("%s|%s|%s|%s|%t|%s", batch.ID, batch.Address, region, namespace, batch.Purge,
+			strings.Join(batch.Jobs, ", ")))
+	}
+	if len(batches) == 0 {
+		output = append(output, "None")
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "%s\n", columnize.SimpleFormat(output))
+}
+
+func init() {
+	rootCmd.AddCommand(undeleteCmd)
+
+	undeleteCmd.PersistentFlags().BoolP("force", "f", false, "Force action")
+	undeleteCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
+	undeleteCmd.Flags().BoolP("interactive", "i", false, "Show each job and ask before restoring it")
+}
@@ -3,12 +3,14 @@ module github.com/jsuar/nomad-custodian
 go 1.13
 
 require (
+	github.com/hashicorp/hcl v1.0.0
 	github.com/hashicorp/nomad/api v0.0.0-20191220223628-edc62acd919d
 	github.com/jsuar/go-cron-descriptor v0.1.0
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/ryanuber/columnize v2.1.0+incompatible
 	github.com/spf13/cobra v0.0.5
+	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.6.1
 	go.uber.org/zap v1.15.0
-	golang.org/x/sys v0.0.0-20191008105621-543471e840be // indirect
+	golang.org/x/sys v0.0.0-20191008105621-543471e840be
 )
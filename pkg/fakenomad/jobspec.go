@@ -0,0 +1,192 @@
+package fakenomad
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/hashicorp/hcl"
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+// LoadJobDir parses every .nomad file in a directory
+func LoadJobDir(dir string) ([]*nomad.Job, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.nomad"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var jobs []*nomad.Job
+	for _, path := range paths {
+		job, err := LoadJobFile(path)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// LoadJobFile parses a single .nomad job file
+func LoadJobFile(path string) (*nomad.Job, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	job, err := ParseJob(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return job, nil
+}
+
+// ParseJob parses the subset of the HCL job specification used by the fake
+// server: the job, its groups and tasks, counts, meta, periodic config and
+// task resources. Everything else in the file is ignored.
+func ParseJob(src []byte) (*nomad.Job, error) {
+	var root map[string]interface{}
+	if err := hcl.Unmarshal(src, &root); err != nil {
+		return nil, err
+	}
+
+	jobs := labeledBlocks(root, "job")
+	if len(jobs) != 1 {
+		return nil, fmt.Errorf("expected a single job, found %d", len(jobs))
+	}
+	name, body := jobs[0].label, jobs[0].body
+
+	job := nomad.NewServiceJob(name, name, "", 50)
+	job.Region = nil
+	if v, ok := body["type"].(string); ok {
+		job.Type = &v
+	}
+	if v, ok := body["region"].(string); ok {
+		job.Region = &v
+	}
+	if v, ok := body["namespace"].(string); ok {
+		job.Namespace = &v
+	}
+	if v, ok := body["priority"].(int); ok {
+		job.Priority = &v
+	}
+	for _, dc := range stringList(body, "datacenters") {
+		job.AddDatacenter(dc)
+	}
+	for k, v := range stringMap(body, "meta") {
+		job.SetMeta(k, v)
+	}
+
+	for _, periodic := range blocks(body, "periodic") {
+		config := &nomad.PeriodicConfig{SpecType: stringToPtr("cron")}
+		if v, ok := periodic["cron"].(string); ok {
+			config.Spec = &v
+		}
+		if v, ok := periodic["prohibit_overlap"].(bool); ok {
+			config.ProhibitOverlap = &v
+		}
+		if v, ok := periodic["time_zone"].(string); ok {
+			config.TimeZone = &v
+		}
+		job.AddPeriodicConfig(config)
+	}
+	if len(blocks(body, "parameterized")) > 0 {
+		job.ParameterizedJob = &nomad.ParameterizedJobConfig{}
+	}
+
+	for _, group := range labeledBlocks(body, "group") {
+		count := 1
+		if v, ok := group.body["count"].(int); ok {
+			count = v
+		}
+		taskGroup := nomad.NewTaskGroup(group.label, count)
+		for k, v := range stringMap(group.body, "meta") {
+			taskGroup.SetMeta(k, v)
+		}
+
+		for _, task := range labeledBlocks(group.body, "task") {
+			driver, _ := task.body["driver"].(string)
+			t := nomad.NewTask(task.label, driver)
+			for _, config := range blocks(task.body, "config") {
+				t.Config = config
+			}
+			if env := stringMap(task.body, "env"); len(env) > 0 {
+				t.Env = env
+			}
+			for k, v := range stringMap(task.body, "meta") {
+				t.SetMeta(k, v)
+			}
+			for _, resources := range blocks(task.body, "resources") {
+				r := &nomad.Resources{}
+				if v, ok := resources["cpu"].(int); ok {
+					r.CPU = &v
+				}
+				if v, ok := resources["memory"].(int); ok {
+					r.MemoryMB = &v
+				}
+				t.Require(r)
+			}
+			taskGroup.AddTask(t)
+		}
+		job.AddTaskGroup(taskGroup)
+	}
+
+	job.Canonicalize()
+	return job, nil
+}
+
+// labeledBlock is a block with a single label such as job "example" { }
+type labeledBlock struct {
+	label string
+	body  map[string]interface{}
+}
+
+// blocks returns the bodies of all unlabeled blocks with the given name
+func blocks(m map[string]interface{}, key string) []map[string]interface{} {
+	list, _ := m[key].([]map[string]interface{})
+	return list
+}
+
+// labeledBlocks returns all labeled blocks with the given name
+func labeledBlocks(m map[string]interface{}, key string) []labeledBlock {
+	var result []labeledBlock
+	for _, outer := range blocks(m, key) {
+		var labels []string
+		for label := range outer {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			for _, body := range blocks(outer, label) {
+				result = append(result, labeledBlock{label: label, body: body})
+			}
+		}
+	}
+	return result
+}
+
+// stringMap returns a block of key/value pairs such as meta or env
+func stringMap(m map[string]interface{}, key string) map[string]string {
+	result := make(map[string]string)
+	for _, block := range blocks(m, key) {
+		for k, v := range block {
+			result[k] = fmt.Sprint(v)
+		}
+	}
+	return result
+}
+
+// stringList returns a list of strings attribute
+func stringList(m map[string]interface{}, key string) []string {
+	var result []string
+	list, _ := m[key].([]interface{})
+	for _, v := range list {
+		result = append(result, fmt.Sprint(v))
+	}
+	return result
+}
+
+func stringToPtr(s string) *string {
+	return &s
+}
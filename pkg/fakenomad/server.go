@@ -0,0 +1,335 @@
+// Package fakenomad provides a fake Nomad HTTP API for end-to-end tests
+package fakenomad
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+)
+
+// Server is a fake Nomad agent serving the jobs endpoints used by custodian.
+// Its state is kept in a nomadhelper.FakeClient which tests can inspect.
+type Server struct {
+	Client *nomadhelper.FakeClient
+	URL    string
+
+	http *httptest.Server
+}
+
+// NewServer starts a fake Nomad agent seeded with the given jobs
+func NewServer(jobs ...*nomad.Job) *Server {
+	s := &Server{Client: nomadhelper.NewFakeClient(jobs...)}
+	s.http = httptest.NewServer(s)
+	s.URL = s.http.URL
+	return s
+}
+
+// NewServerFromDir starts a fake Nomad agent seeded with the .nomad job files
+// in a directory
+func NewServerFromDir(dir string) (*Server, error) {
+	jobs, err := LoadJobDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(jobs...), nil
+}
+
+// Close shuts down the server
+func (s *Server) Close() {
+	s.http.Close()
+}
+
+// ServeHTTP routes a request to the matching endpoint
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	switch {
+	case path == "/v1/jobs":
+		s.jobs(w, r)
+	case strings.HasPrefix(path, "/v1/job/"):
+		s.job(w, r, strings.TrimPrefix(path, "/v1/job/"))
+	case path == "/v1/allocations":
+		allocs, _, err := s.Client.Allocations().List(nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if allocs == nil {
+			allocs = make([]*nomad.AllocationListStub, 0)
+		}
+		writeJSON(w, allocs)
+	case strings.HasPrefix(path, "/v1/allocation/"):
+		alloc, _, err := s.Client.Allocations().Info(strings.TrimPrefix(path, "/v1/allocation/"), nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, alloc)
+	case strings.HasPrefix(path, "/v1/client/allocation/") && strings.HasSuffix(path, "/stats"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/v1/client/allocation/"), "/stats")
+		usage, err := s.Client.Allocations().Stats(&nomad.Allocation{ID: id}, nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, usage)
+	case path == "/v1/nodes":
+		nodes, _, err := s.Client.Nodes().List(nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if nodes == nil {
+			nodes = make([]*nomad.NodeListStub, 0)
+		}
+		writeJSON(w, nodes)
+	case strings.HasPrefix(path, "/v1/node/") && strings.HasSuffix(path, "/drain"):
+		var req nomad.NodeUpdateDrainRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/v1/node/"), "/drain")
+		resp, err := s.Client.Nodes().UpdateDrain(id, req.DrainSpec, req.MarkEligible, nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, resp)
+	case strings.HasPrefix(path, "/v1/var/"):
+		s.variable(w, r, strings.TrimPrefix(path, "/v1/var/"))
+	case path == "/v1/regions":
+		writeJSON(w, []string{"global"})
+	case path == "/v1/status/leader":
+		writeJSON(w, "127.0.0.1:4647")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// variable serves /v1/var/<path>
+func (s *Server) variable(w http.ResponseWriter, r *http.Request, path string) {
+	path, err := url.PathUnescape(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	variables := s.Client.Variables()
+	namespace := r.URL.Query().Get("namespace")
+
+	switch r.Method {
+	case http.MethodGet:
+		variable, _, err := variables.Read(path, &nomad.QueryOptions{Namespace: namespace})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if variable == nil {
+			http.Error(w, "variable not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, variable)
+	case http.MethodPut, http.MethodPost:
+		var variable nomadhelper.Variable
+		if !readJSON(w, r, &variable) {
+			return
+		}
+		variable.Path = path
+		if variable.Namespace == "" {
+			variable.Namespace = namespace
+		}
+		result, _, err := variables.Upsert(&variable, nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, result)
+	case http.MethodDelete:
+		if _, err := variables.Delete(path, &nomad.WriteOptions{Namespace: namespace}); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// jobs serves /v1/jobs
+func (s *Server) jobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		stubs, _, err := s.Client.Jobs().List(&nomad.QueryOptions{Prefix: r.URL.Query().Get("prefix")})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if stubs == nil {
+			stubs = make([]*nomad.JobListStub, 0)
+		}
+		writeJSON(w, stubs)
+	case http.MethodPut, http.MethodPost:
+		s.register(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// job serves /v1/job/<id> and its sub resources
+func (s *Server) job(w http.ResponseWriter, r *http.Request, path string) {
+	resource := ""
+	for _, suffix := range []string{"plan", "revert", "versions", "scale"} {
+		if strings.HasSuffix(path, "/"+suffix) {
+			resource = suffix
+			path = strings.TrimSuffix(path, "/"+suffix)
+			break
+		}
+	}
+	jobID, err := url.PathUnescape(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jobs := s.Client.Jobs()
+
+	switch {
+	case resource == "plan":
+		var req nomad.JobPlanRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		resp, _, err := jobs.Plan(req.Job, req.Diff, nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, resp)
+
+	case resource == "revert":
+		var req nomad.JobRevertRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		resp, _, err := jobs.Revert(jobID, req.JobVersion, req.EnforcePriorVersion, nil, req.VaultToken)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, resp)
+
+	case resource == "versions":
+		versions, _, _, err := jobs.Versions(jobID, false, nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, nomad.JobVersionsResponse{Versions: versions})
+
+	case resource == "scale" && r.Method == http.MethodGet:
+		status, _, err := s.Client.Scaling().Status(jobID, nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, status)
+
+	case resource == "scale":
+		var req nomadhelper.ScalingRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		resp, _, err := s.Client.Scaling().Scale(jobID, &req, nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, resp)
+
+	case r.Method == http.MethodGet:
+		job, _, err := jobs.Info(jobID, nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, job)
+
+	case r.Method == http.MethodDelete:
+		purge, _ := strconv.ParseBool(r.URL.Query().Get("purge"))
+		evalID, _, err := jobs.Deregister(jobID, purge, nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, nomad.JobDeregisterResponse{EvalID: evalID})
+
+	case r.Method == http.MethodPut || r.Method == http.MethodPost:
+		s.register(w, r)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// register serves job registration requests
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	var req nomad.RegisterJobRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Job == nil || req.Job.ID == nil {
+		http.Error(w, "missing job", http.StatusBadRequest)
+		return
+	}
+	jobs := s.Client.Jobs()
+	register := jobs.Register
+	if req.EnforceIndex {
+		register = func(job *nomad.Job, q *nomad.WriteOptions) (*nomad.JobRegisterResponse, *nomad.WriteMeta, error) {
+			return jobs.EnforceRegister(job, req.JobModifyIndex, q)
+		}
+	}
+	resp, _, err := register(req.Job, nil)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// readJSON decodes the request body, writing a 400 response on failure
+func readJSON(w http.ResponseWriter, r *http.Request, out interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(out); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// writeJSON writes a successful response with the headers the API client expects
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Nomad-Index", "1")
+	w.Header().Set("X-Nomad-LastContact", "0")
+	w.Header().Set("X-Nomad-KnownLeader", "true")
+	json.NewEncoder(w).Encode(body)
+}
+
+// responseCode matches the errors returned by the fake client
+var responseCode = regexp.MustCompile(`^Unexpected response code: (\d+) \((.*)\)$`)
+
+// writeError converts a fake client error into an HTTP error response
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	msg := err.Error()
+	if m := responseCode.FindStringSubmatch(msg); m != nil {
+		code, _ = strconv.Atoi(m[1])
+		msg = m[2]
+	}
+	w.WriteHeader(code)
+	fmt.Fprint(w, msg)
+}
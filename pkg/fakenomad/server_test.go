@@ -0,0 +1,95 @@
+package fakenomad
+
+import (
+	"testing"
+
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+func TestLoadJobDir(t *testing.T) {
+	jobs, err := LoadJobDir("../../testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{"couchbase": 2, "demo-webapp": 3, "example": 2, "nginx": 2}
+	if len(jobs) != len(counts) {
+		t.Fatalf("expected %d jobs, got %d", len(counts), len(jobs))
+	}
+	for _, job := range jobs {
+		want, ok := counts[*job.ID]
+		if !ok {
+			t.Errorf("unexpected job %s", *job.ID)
+			continue
+		}
+		if got := *job.TaskGroups[0].Count; got != want {
+			t.Errorf("job %s: expected count %d, got %d", *job.ID, want, got)
+		}
+		if *job.ID == "nginx" && job.Meta["custodian-ignore"] != "true" {
+			t.Errorf("expected nginx to be ignored, got meta %v", job.Meta)
+		}
+		if *job.ID == "example" && *job.TaskGroups[0].Tasks[0].Resources.MemoryMB != 256 {
+			t.Errorf("expected example to reserve 256MB")
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	server, err := NewServerFromDir("../../testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	config := nomad.DefaultConfig()
+	config.Address = server.URL
+	client, err := nomad.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := client.Jobs()
+
+	stubs, _, err := jobs.List(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stubs) != 4 {
+		t.Fatalf("expected 4 jobs, got %d", len(stubs))
+	}
+
+	job, _, err := jobs.Info("demo-webapp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 1
+	job.TaskGroups[0].Count = &count
+
+	plan, _, err := jobs.Plan(job, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Diff.TaskGroups) != 1 || plan.Diff.TaskGroups[0].Fields[0].Name != "Count" {
+		t.Errorf("expected a count diff, got %+v", plan.Diff)
+	}
+
+	if _, _, err := jobs.Register(job, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := jobs.Revert("demo-webapp", 0, nil, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	versions, _, _, err := jobs.Versions("demo-webapp", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || *versions[0].TaskGroups[0].Count != 3 {
+		t.Errorf("expected 3 versions with the latest reverted to count 3")
+	}
+
+	if _, _, err := jobs.Deregister("demo-webapp", true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := jobs.Info("demo-webapp", nil); err == nil || err.Error() != "Unexpected response code: 404 (job not found)" {
+		t.Errorf("expected a 404 after purge, got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package nomadhelper
+
+import (
+	"net/url"
+	"strings"
+
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+// JobsAPI is the subset of the Nomad jobs endpoints used by the helper
+type JobsAPI interface {
+	List(q *nomad.QueryOptions) ([]*nomad.JobListStub, *nomad.QueryMeta, error)
+	Info(jobID string, q *nomad.QueryOptions) (*nomad.Job, *nomad.QueryMeta, error)
+	Versions(jobID string, diffs bool, q *nomad.QueryOptions) ([]*nomad.Job, []*nomad.JobDiff, *nomad.QueryMeta, error)
+	Plan(job *nomad.Job, diff bool, q *nomad.WriteOptions) (*nomad.JobPlanResponse, *nomad.WriteMeta, error)
+	Register(job *nomad.Job, q *nomad.WriteOptions) (*nomad.JobRegisterResponse, *nomad.WriteMeta, error)
+	EnforceRegister(job *nomad.Job, modifyIndex uint64, q *nomad.WriteOptions) (*nomad.JobRegisterResponse, *nomad.WriteMeta, error)
+	Revert(jobID string, version uint64, enforcePriorVersion *uint64, q *nomad.WriteOptions,
+		vaultToken string) (*nomad.JobRegisterResponse, *nomad.WriteMeta, error)
+	Deregister(jobID string, purge bool, q *nomad.WriteOptions) (string, *nomad.WriteMeta, error)
+}
+
+// DeploymentsAPI is the subset of the Nomad deployments endpoints used by the helper
+type DeploymentsAPI interface {
+	List(q *nomad.QueryOptions) ([]*nomad.Deployment, *nomad.QueryMeta, error)
+	Info(deploymentID string, q *nomad.QueryOptions) (*nomad.Deployment, *nomad.QueryMeta, error)
+}
+
+// EvaluationsAPI is the subset of the Nomad evaluations endpoints used by the helper
+type EvaluationsAPI interface {
+	Info(evalID string, q *nomad.QueryOptions) (*nomad.Evaluation, *nomad.QueryMeta, error)
+}
+
+// AllocationsAPI is the subset of the Nomad allocations endpoints used by the helper
+type AllocationsAPI interface {
+	List(q *nomad.QueryOptions) ([]*nomad.AllocationListStub, *nomad.QueryMeta, error)
+	Info(allocID string, q *nomad.QueryOptions) (*nomad.Allocation, *nomad.QueryMeta, error)
+	Stats(alloc *nomad.Allocation, q *nomad.QueryOptions) (*nomad.AllocResourceUsage, error)
+}
+
+// NodesAPI is the subset of the Nomad nodes endpoints used by the helper
+type NodesAPI interface {
+	List(q *nomad.QueryOptions) ([]*nomad.NodeListStub, *nomad.QueryMeta, error)
+	UpdateDrain(nodeID string, spec *nomad.DrainSpec, markEligible bool, q *nomad.WriteOptions) (*nomad.NodeDrainUpdateResponse, error)
+}
+
+// ScalingAPI is the job scale endpoint, which the vendored API client
+// predates
+type ScalingAPI interface {
+	Scale(jobID string, req *ScalingRequest, q *nomad.WriteOptions) (*nomad.JobRegisterResponse, *nomad.WriteMeta, error)
+	Status(jobID string, q *nomad.QueryOptions) (*JobScaleStatus, *nomad.QueryMeta, error)
+}
+
+// Variable is a Nomad Variable, a set of string items kept at a path
+type Variable struct {
+	Namespace   string
+	Path        string
+	Items       map[string]string
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+// VariablesAPI is the Nomad Variables endpoint, which the vendored API client
+// predates
+type VariablesAPI interface {
+	// Read returns nil without an error when the variable does not exist
+	Read(path string, q *nomad.QueryOptions) (*Variable, *nomad.QueryMeta, error)
+	Upsert(variable *Variable, q *nomad.WriteOptions) (*Variable, *nomad.WriteMeta, error)
+	Delete(path string, q *nomad.WriteOptions) (*nomad.WriteMeta, error)
+}
+
+// NomadClient is the Nomad API used by the helper. It is satisfied by the
+// real API client through NewClient and by FakeClient in tests.
+type NomadClient interface {
+	Jobs() JobsAPI
+	Deployments() DeploymentsAPI
+	Evaluations() EvaluationsAPI
+	Allocations() AllocationsAPI
+	Nodes() NodesAPI
+	Scaling() ScalingAPI
+	Variables() VariablesAPI
+}
+
+// apiClient adapts the Nomad API client to the NomadClient interface
+type apiClient struct {
+	client *nomad.Client
+}
+
+// NewClient wraps a Nomad API client
+func NewClient(client *nomad.Client) NomadClient {
+	return &apiClient{client: client}
+}
+
+func (c *apiClient) Jobs() JobsAPI {
+	return c.client.Jobs()
+}
+
+func (c *apiClient) Deployments() DeploymentsAPI {
+	return c.client.Deployments()
+}
+
+func (c *apiClient) Evaluations() EvaluationsAPI {
+	return c.client.Evaluations()
+}
+
+func (c *apiClient) Allocations() AllocationsAPI {
+	return c.client.Allocations()
+}
+
+func (c *apiClient) Nodes() NodesAPI {
+	return c.client.Nodes()
+}
+
+func (c *apiClient) Scaling() ScalingAPI {
+	return &apiScaling{raw: c.client.Raw()}
+}
+
+// apiScaling calls the job scale endpoint through the raw API client
+type apiScaling struct {
+	raw *nomad.Raw
+}
+
+func (s *apiScaling) Scale(jobID string, req *ScalingRequest, q *nomad.WriteOptions) (*nomad.JobRegisterResponse, *nomad.WriteMeta, error) {
+	var resp nomad.JobRegisterResponse
+	wm, err := s.raw.Write("/v1/job/"+url.PathEscape(jobID)+"/scale", req, &resp, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &resp, wm, nil
+}
+
+func (s *apiScaling) Status(jobID string, q *nomad.QueryOptions) (*JobScaleStatus, *nomad.QueryMeta, error) {
+	var status JobScaleStatus
+	qm, err := s.raw.Query("/v1/job/"+url.PathEscape(jobID)+"/scale", &status, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &status, qm, nil
+}
+
+func (c *apiClient) Variables() VariablesAPI {
+	return &apiVariables{raw: c.client.Raw()}
+}
+
+// apiVariables calls the Nomad Variables endpoint through the raw API client
+type apiVariables struct {
+	raw *nomad.Raw
+}
+
+// variablePath escapes every segment of a variable path
+func variablePath(path string) string {
+	return "/v1/var/" + (&url.URL{Path: path}).EscapedPath()
+}
+
+func (v *apiVariables) Read(path string, q *nomad.QueryOptions) (*Variable, *nomad.QueryMeta, error) {
+	var variable Variable
+	qm, err := v.raw.Query(variablePath(path), &variable, q)
+	if err != nil && strings.Contains(err.Error(), "response code: 404") {
+		return nil, qm, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return &variable, qm, nil
+}
+
+func (v *apiVariables) Upsert(variable *Variable, q *nomad.WriteOptions) (*Variable, *nomad.WriteMeta, error) {
+	var result Variable
+	wm, err := v.raw.Write(variablePath(variable.Path), variable, &result, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &result, wm, nil
+}
+
+func (v *apiVariables) Delete(path string, q *nomad.WriteOptions) (*nomad.WriteMeta, error) {
+	return v.raw.Delete(variablePath(path), nil, q)
+}
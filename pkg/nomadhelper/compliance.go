@@ -0,0 +1,298 @@
+package nomadhelper
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/ryanuber/columnize"
+)
+
+// Actions CheckCompliance takes on jobs violating the policy
+const (
+	// ComplianceNotify only reports violations
+	ComplianceNotify = "notify"
+	// ComplianceMark records the violations in the job meta
+	ComplianceMark = "mark"
+	// ComplianceScaleIn marks the job to be scaled in like ScaleInJobs once
+	// the grace period is over
+	ComplianceScaleIn = MarkScaleIn
+	// ComplianceStop marks the job to be stopped once the grace period is over
+	ComplianceStop = MarkStop
+	// CompliancePurge marks the job to be purged once the grace period is over
+	CompliancePurge = MarkPurge
+)
+
+// ViolationMetaKey lists the violations found when a job was marked. The
+// custodian-marked-for meta of jobs with this key is managed by
+// CheckCompliance.
+const ViolationMetaKey = "custodian-violation"
+
+// ComplianceRule is a meta key every job must set, optionally restricted to
+// a set of allowed values
+type ComplianceRule struct {
+	Key     string   `mapstructure:"key"`
+	Allowed []string `mapstructure:"allowed"`
+}
+
+// CompliancePolicy is the compliance section of the config file
+type CompliancePolicy struct {
+	Required []ComplianceRule `mapstructure:"required"`
+	// TeamKey is the meta key violations are grouped by, team when empty
+	TeamKey string `mapstructure:"team-key"`
+	// Action is taken on violating jobs, notify when empty
+	Action string `mapstructure:"action"`
+	// GracePeriod is how long a job stays marked before it is acted on
+	GracePeriod time.Duration `mapstructure:"grace-period"`
+	// Now is the time the grace period is measured against, time.Now when zero
+	Now time.Time `mapstructure:"-"`
+}
+
+// Validate checks the policy for unknown actions and rules without a key
+func (p CompliancePolicy) Validate() error {
+	switch p.Action {
+	case "", ComplianceNotify, ComplianceMark, ComplianceScaleIn, ComplianceStop, CompliancePurge:
+	default:
+		return fmt.Errorf("unknown compliance action %q, expected one of %s, %s, %s, %s or %s", p.Action,
+			ComplianceNotify, ComplianceMark, ComplianceScaleIn, ComplianceStop, CompliancePurge)
+	}
+	if len(p.Required) == 0 {
+		return fmt.Errorf("no required meta keys in the compliance policy")
+	}
+	for i, rule := range p.Required {
+		if rule.Key == "" {
+			return fmt.Errorf("compliance rule %d has no key", i+1)
+		}
+	}
+	return nil
+}
+
+// Violations returns every rule of the policy the job's meta breaks
+func (p CompliancePolicy) Violations(job *nomad.Job) []string {
+	var violations []string
+	for _, rule := range p.Required {
+		value := job.Meta[rule.Key]
+		if value == "" {
+			violations = append(violations, fmt.Sprintf("missing %s", rule.Key))
+			continue
+		}
+		if len(rule.Allowed) == 0 {
+			continue
+		}
+		allowed := false
+		for _, a := range rule.Allowed {
+			if value == a {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			violations = append(violations, fmt.Sprintf("%s=%s not allowed", rule.Key, value))
+		}
+	}
+	return violations
+}
+
+// markViolation records the violations and the mark in the job meta. It
+// returns true when the meta changed.
+func markViolation(job *nomad.Job, violations string, mark *Mark) bool {
+	changed := job.Meta[ViolationMetaKey] != violations
+	job.SetMeta(ViolationMetaKey, violations)
+	if mark != nil && job.Meta[MarkedForMetaKey] != mark.String() {
+		job.SetMeta(MarkedForMetaKey, mark.String())
+		changed = true
+	}
+	return changed
+}
+
+// teamCompliance counts the jobs and violations of a single team
+type teamCompliance struct {
+	jobs       int
+	violating  int
+	violations int
+}
+
+// CheckCompliance checks every job against the required meta keys of the
+// policy and reports the violations per job and per team. Violating jobs are
+// reported as warned and, depending on policy.Action, have their violations
+// recorded in their meta or are marked for scale-in, stop or purge once
+// policy.GracePeriod is over. Marks that are due are acted on like
+// ProcessMarks does. Jobs that became compliant have their mark cleared. Jobs
+// with custodian-ignore set are reported but left unchanged, and jobs not
+// selected by n.Selector are skipped.
+func (n *NomadHelper) CheckCompliance(ctx context.Context, policy CompliancePolicy, force bool, verbose bool) *Report {
+	var output []string
+	var jobsSkipped []string
+	var batch *DeleteBatch
+
+	report := NewReport("compliance", force)
+	defer report.Finish()
+
+	now := policy.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	teamKey := policy.TeamKey
+	if teamKey == "" {
+		teamKey = "team"
+	}
+
+	if err := policy.Validate(); err != nil {
+		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "compliance", Status: StatusFailed, Error: err.Error()})
+		n.writeFailures(report)
+		return report
+	}
+
+	// Child jobs of periodic and parameterized jobs carry their parent's meta
+	items, err := n.Inventory().Jobs(ctx, func(stub *nomad.JobListStub) bool {
+		return stub.ParentID == "" && stub.Status != "dead"
+	})
+	if err != nil {
+		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "compliance", Status: StatusFailed, Error: err.Error()})
+		n.writeFailures(report)
+		return report
+	}
+
+	if verbose {
+		n.Logger.Infof("Number of jobs: %d\n", len(items))
+	}
+
+	teams := make(map[string]*teamCompliance)
+	output = append(output, "Job|Team|Violations|State")
+	for _, item := range items {
+		jobStub := item.Stub
+		if item.Job == nil && item.Err == nil {
+			continue
+		}
+		if n.cancelled(ctx, report, jobStub, "compliance") {
+			continue
+		}
+		if reason, detail, skip := n.Selector.Skip(jobStub.Name); skip {
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "compliance", reason, detail))
+			continue
+		}
+		if item.Err != nil {
+			n.failed(report, jobStub, "compliance", item.Err)
+			continue
+		}
+		jobInfo := item.Job
+
+		team := jobInfo.Meta[teamKey]
+		if team == "" {
+			team = "-"
+		}
+		if teams[team] == nil {
+			teams[team] = new(teamCompliance)
+		}
+		teams[team].jobs++
+
+		custodianIgnore, err := strconv.ParseBool(jobInfo.Meta["custodian-ignore"])
+		if err != nil && jobInfo.Meta["custodian-ignore"] != "" {
+			n.Logger.Error(err)
+		}
+
+		violations := policy.Violations(jobInfo)
+		if len(violations) == 0 {
+			// Clear the mark of jobs that were fixed since the last run
+			if jobInfo.Meta[ViolationMetaKey] != "" && !custodianIgnore {
+				delete(jobInfo.Meta, ViolationMetaKey)
+				delete(jobInfo.Meta, MarkedForMetaKey)
+				n.planOrApply(ctx, report, jobStub, "unmark", jobInfo, force)
+			}
+			continue
+		}
+		summary := strings.Join(violations, ", ")
+		teams[team].violating++
+		teams[team].violations += len(violations)
+
+		if custodianIgnore {
+			output = append(output, fmt.Sprintf("%s|%s|%s|ignored", jobStub.Name, team, summary))
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "compliance", SkipIgnoredMeta, summary))
+			continue
+		}
+		if policy.Action == "" || policy.Action == ComplianceNotify {
+			output = append(output, fmt.Sprintf("%s|%s|%s|notified", jobStub.Name, team, summary))
+			report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: "compliance", Status: StatusWarned, Detail: summary})
+			continue
+		}
+		if policy.Action == ComplianceMark {
+			output = append(output, fmt.Sprintf("%s|%s|%s|marked", jobStub.Name, team, summary))
+			report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: "compliance", Status: StatusWarned, Detail: summary})
+			if markViolation(jobInfo, summary, nil) {
+				n.planOrApply(ctx, report, jobStub, "mark", jobInfo, force)
+			}
+			continue
+		}
+		if policy.Action == ComplianceScaleIn && n.scaledIn(jobInfo) {
+			output = append(output, fmt.Sprintf("%s|%s|%s|scaled in", jobStub.Name, team, summary))
+			report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: "compliance", Status: StatusWarned, Detail: summary})
+			continue
+		}
+
+		// A mark for the policy's action keeps its due time across runs
+		mark, ok, err := JobMark(jobInfo)
+		if err != nil {
+			n.Logger.Error(err)
+		}
+		if !ok || mark.Action != policy.Action {
+			mark = Mark{Action: policy.Action, At: now.Add(policy.GracePeriod)}
+			ok = false
+		}
+
+		if ok && !now.Before(mark.At) {
+			output = append(output, fmt.Sprintf("%s|%s|%s|%s due", jobStub.Name, team, summary, mark.Action))
+			report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: "compliance", Status: StatusWarned, Detail: summary})
+			batch = n.actOnMark(ctx, report, jobStub, jobInfo, mark, batch, force)
+			continue
+		}
+
+		due := mark.At.UTC().Format(time.RFC3339)
+		output = append(output, fmt.Sprintf("%s|%s|%s|%s at %s", jobStub.Name, team, summary, mark.Action, due))
+		report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: "compliance", Status: StatusWarned,
+			Detail: fmt.Sprintf("%s; %s at %s", summary, mark.Action, due)})
+		if markViolation(jobInfo, summary, &mark) {
+			n.planOrApply(ctx, report, jobStub, "mark", jobInfo, force)
+		}
+	}
+
+	if len(output) == 1 {
+		output = append(output, "None")
+	}
+	fmt.Fprintf(n.out(), "%s\n\n", columnize.SimpleFormat(output))
+
+	var names []string
+	for name := range teams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	output = []string{"Team|Jobs|Violating Jobs|Violations"}
+	for _, name := range names {
+		team := teams[name]
+		output = append(output, fmt.Sprintf("%s|%d|%d|%d", name, team.jobs, team.violating, team.violations))
+	}
+	if len(names) == 0 {
+		output = append(output, "None")
+	}
+	fmt.Fprintf(n.out(), "%s\n\n", columnize.SimpleFormat(output))
+
+	output = []string{"Jobs Skipped|Reason|Detail"}
+	if len(jobsSkipped) == 0 {
+		output = append(output, "None")
+	} else {
+		output = append(output, jobsSkipped...)
+	}
+	fmt.Fprintf(n.out(), "%s\n", columnize.SimpleFormat(output))
+	n.writeFailures(report)
+	n.writeSkipReasons(report)
+	if batch != nil {
+		fmt.Fprintf(n.out(), "Stopped and purged jobs were saved as batch %s. Restore them with: nomad-custodian undelete %s\n",
+			batch.ID, batch.ID)
+	}
+	return report
+}
@@ -0,0 +1,317 @@
+package nomadhelper
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/ryanuber/columnize"
+)
+
+// HoursPerMonth is the number of hours monthly costs are estimated over
+const HoursPerMonth = 730
+
+// Rates are the hourly prices of reserved resources
+type Rates struct {
+	CPUPerMHz   float64 `mapstructure:"cpu-per-mhz"`
+	MemoryPerMB float64 `mapstructure:"memory-per-mb"`
+}
+
+// CostConfig is the cost section of the config file. Task groups constrained
+// to a node class listed in NodeClasses are priced with that class's rates.
+type CostConfig struct {
+	Currency    string           `mapstructure:"currency"`
+	Rates       Rates            `mapstructure:",squash"`
+	NodeClasses map[string]Rates `mapstructure:"node-classes"`
+	// Now is the end of a scale-in window still in progress, time.Now when zero
+	Now time.Time `mapstructure:"-"`
+}
+
+// Validate checks that at least one rate is set
+func (c CostConfig) Validate() error {
+	if c.Rates != (Rates{}) {
+		return nil
+	}
+	for _, rates := range c.NodeClasses {
+		if rates != (Rates{}) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no cost rates in the config file, set cost.cpu-per-mhz and cost.memory-per-mb")
+}
+
+// format formats an amount in the configured currency
+func (c CostConfig) format(amount float64) string {
+	if c.Currency == "" {
+		return fmt.Sprintf("%.2f", amount)
+	}
+	return fmt.Sprintf("%.2f %s", amount, c.Currency)
+}
+
+// nodeClass returns the node class a task group is constrained to, if any.
+// Task group constraints take precedence over job constraints.
+func nodeClass(job *nomad.Job, taskGroup *nomad.TaskGroup) string {
+	for _, constraints := range [][]*nomad.Constraint{taskGroup.Constraints, job.Constraints} {
+		for _, constraint := range constraints {
+			if constraint.LTarget == "${node.class}" && (constraint.Operand == "=" || constraint.Operand == "==") {
+				return constraint.RTarget
+			}
+		}
+	}
+	return ""
+}
+
+// groupHourlyCost returns the hourly cost of running count allocations of a
+// task group
+func (c CostConfig) groupHourlyCost(job *nomad.Job, taskGroup *nomad.TaskGroup, count int) float64 {
+	rates := c.Rates
+	if classRates, ok := c.NodeClasses[nodeClass(job, taskGroup)]; ok {
+		rates = classRates
+	}
+	var cost float64
+	for _, task := range taskGroup.Tasks {
+		if task.Resources == nil {
+			continue
+		}
+		if task.Resources.CPU != nil {
+			cost += float64(*task.Resources.CPU) * rates.CPUPerMHz
+		}
+		if task.Resources.MemoryMB != nil {
+			cost += float64(*task.Resources.MemoryMB) * rates.MemoryPerMB
+		}
+	}
+	return cost * float64(count)
+}
+
+// hourlyCost returns the hourly cost of a job. count returns the count of
+// each task group.
+func (c CostConfig) hourlyCost(job *nomad.Job, count func(taskGroup *nomad.TaskGroup) int) float64 {
+	var cost float64
+	for _, taskGroup := range job.TaskGroups {
+		cost += c.groupHourlyCost(job, taskGroup, count(taskGroup))
+	}
+	return cost
+}
+
+// currentCount is the count a task group is running at
+func currentCount(taskGroup *nomad.TaskGroup) int {
+	if taskGroup.Count == nil {
+		return 1
+	}
+	return *taskGroup.Count
+}
+
+// originalCount returns the count a task group had before it was scaled in,
+// from the scale state or from the task groups scaled in through the scale
+// endpoint, or its current count when it was not scaled in
+func originalCount(state *ScaleState, native []GroupScale) func(taskGroup *nomad.TaskGroup) int {
+	return func(taskGroup *nomad.TaskGroup) int {
+		if state.ScaledIn() {
+			if count, ok := state.Counts[*taskGroup.Name]; ok {
+				return count
+			}
+		}
+		for _, change := range native {
+			if change.Group == *taskGroup.Name {
+				return change.Count
+			}
+		}
+		return currentCount(taskGroup)
+	}
+}
+
+// versionState reads the scale state kept in the meta of a job version
+func versionState(version *nomad.Job) *ScaleState {
+	state, _ := MetaStore{}.Load(version)
+	return state
+}
+
+// realizedSavings adds up what every scaled in version of a job saved from
+// its submit time until the next version was submitted, or until now for the
+// current version. Only the versions Nomad still keeps are counted. Versions
+// are scaled in when their meta says so or, for a state kept in another
+// store, from the first version after the revert version without scale-in
+// meta.
+func (c CostConfig) realizedSavings(job *nomad.Job, versions []*nomad.Job, state *ScaleState, store StateStore,
+	now time.Time) (float64, time.Duration) {
+	sorted := append([]*nomad.Job(nil), versions...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return *sorted[i].Version < *sorted[j].Version
+	})
+
+	inStore := state.ScaledIn() && store != nil && !inMeta(store)
+	var saved float64
+	var scaledIn time.Duration
+	for i, version := range sorted {
+		if version.SubmitTime == nil {
+			continue
+		}
+		end := now
+		if i+1 < len(sorted) && sorted[i+1].SubmitTime != nil {
+			end = time.Unix(0, *sorted[i+1].SubmitTime)
+		}
+
+		priced, count, last := version, originalCount(versionState(version), nil), false
+		switch {
+		case versionState(version).ScaledIn():
+		case inStore && (state.RevertVersion == nil && i == len(sorted)-1 ||
+			state.RevertVersion != nil && *version.Version > *state.RevertVersion):
+			// Kept outside of the job, the state is only known for the
+			// current scale-in, which lasts until now
+			priced, count, last, end = job, originalCount(state, nil), true, now
+		default:
+			continue
+		}
+
+		window := end.Sub(time.Unix(0, *version.SubmitTime))
+		if window > 0 {
+			perHour := c.hourlyCost(priced, count) - c.hourlyCost(priced, currentCount)
+			saved += perHour * window.Hours()
+			scaledIn += window
+		}
+		if last {
+			break
+		}
+	}
+	return saved, scaledIn
+}
+
+// nativeSavings adds up what every task group scaled in through the scale
+// endpoint saved, from its scale-in event until the next custodian scaling
+// event, or until now. Only the events Nomad still keeps are counted.
+func (c CostConfig) nativeSavings(job *nomad.Job, status *JobScaleStatus, now time.Time) (float64, time.Duration) {
+	var saved float64
+	var scaledIn time.Duration
+	for _, taskGroup := range job.TaskGroups {
+		var events []*ScalingEvent
+		for _, event := range status.TaskGroups[*taskGroup.Name].Events {
+			if _, ok := event.Meta["custodian-action"]; ok {
+				events = append(events, event)
+			}
+		}
+		sort.Slice(events, func(i, j int) bool { return events[i].CreateIndex < events[j].CreateIndex })
+
+		for i, event := range events {
+			value, _ := event.Meta["custodian-count"].(string)
+			original, err := strconv.Atoi(value)
+			if event.Meta["custodian-action"] != "scaled-in" || event.Count == nil || err != nil {
+				continue
+			}
+			end := now
+			if i+1 < len(events) {
+				end = time.Unix(0, int64(events[i+1].Time))
+			}
+			window := end.Sub(time.Unix(0, int64(event.Time)))
+			if window <= 0 {
+				continue
+			}
+			perHour := c.groupHourlyCost(job, taskGroup, original) - c.groupHourlyCost(job, taskGroup, int(*event.Count))
+			saved += perHour * window.Hours()
+			if window > scaledIn {
+				scaledIn = window
+			}
+		}
+	}
+	return saved, scaledIn
+}
+
+// JobCosts prints the estimated monthly cost of every running job, what it
+// would cost scaled in to count=1, what scaling in saves per month and what
+// previous scale-in windows have saved so far. The scale state is read from
+// the configured store, and from the scaling events in native scale mode. Costs are computed from the
+// CPU and memory reserved by each task times the task group count.
+func (n *NomadHelper) JobCosts(ctx context.Context, config CostConfig, verbose bool) {
+	now := config.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	items, err := n.Inventory().Jobs(ctx, Running)
+	if err != nil {
+		n.Logger.Error(err)
+		return
+	}
+
+	var totalCurrent, totalScaledIn, totalRealized float64
+	output := []string{"Job|State|Monthly Cost|Scaled In|Savings|Realized Savings|Scaled In For"}
+	var failures []string
+	for _, item := range items {
+		if item.Job == nil && item.Err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if item.Err != nil {
+			n.Logger.Error(item.Err)
+			failures = append(failures, fmt.Sprintf("%s|%s", item.Stub.Name, item.Err))
+			continue
+		}
+		jobInfo := item.Job
+
+		custodianIgnore, err := strconv.ParseBool(jobInfo.Meta["custodian-ignore"])
+		if err != nil && jobInfo.Meta["custodian-ignore"] != "" {
+			n.Logger.Error(err)
+		}
+
+		state, store, err := n.loadState(jobInfo)
+		var scaleStatus *JobScaleStatus
+		var native []GroupScale
+		if err == nil && n.NativeScale {
+			scaleStatus, _, err = n.Client.Scaling().Status(item.Stub.ID, nil)
+			if err == nil {
+				native, err = scaledInGroups(jobInfo, scaleStatus)
+			}
+		}
+		var versions []*nomad.Job
+		if err == nil {
+			versions, _, _, err = n.Client.Jobs().Versions(item.Stub.ID, false, nil)
+		}
+		if err != nil {
+			n.Logger.Error(err)
+			failures = append(failures, fmt.Sprintf("%s|%s", item.Stub.Name, err))
+			continue
+		}
+
+		current := config.hourlyCost(jobInfo, currentCount) * HoursPerMonth
+		scaledIn := config.hourlyCost(jobInfo, func(*nomad.TaskGroup) int { return 1 }) * HoursPerMonth
+		jobState := "running"
+		switch {
+		case state.ScaledIn() || len(native) > 0:
+			jobState = "scaled in"
+			current = config.hourlyCost(jobInfo, originalCount(state, native)) * HoursPerMonth
+		case custodianIgnore:
+			jobState = "ignored"
+			scaledIn = current
+		}
+
+		realized, window := config.realizedSavings(jobInfo, versions, state, store, now)
+		if scaleStatus != nil {
+			nativeRealized, nativeWindow := config.nativeSavings(jobInfo, scaleStatus, now)
+			realized += nativeRealized
+			window += nativeWindow
+		}
+
+		totalCurrent += current
+		totalScaledIn += scaledIn
+		totalRealized += realized
+		output = append(output, fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s", *jobInfo.Name, jobState, config.format(current),
+			config.format(scaledIn), config.format(current-scaledIn), config.format(realized), window.Round(time.Minute)))
+	}
+	output = append(output, fmt.Sprintf("Total|-|%s|%s|%s|%s|-", config.format(totalCurrent), config.format(totalScaledIn),
+		config.format(totalCurrent-totalScaledIn), config.format(totalRealized)))
+
+	if verbose {
+		n.Logger.Infof("Number of jobs: %d\n", len(output)-2)
+	}
+	fmt.Fprintf(n.out(), "%s\n", columnize.SimpleFormat(output))
+	fmt.Fprintf(n.out(), "\nMonthly costs assume %d hours at full count. Scaled in jobs are priced at their original count.\n", HoursPerMonth)
+
+	if len(failures) > 0 {
+		output = append([]string{"Jobs Failed|Error"}, failures...)
+		fmt.Fprintf(n.out(), "\n%s\n", columnize.SimpleFormat(output))
+	}
+}
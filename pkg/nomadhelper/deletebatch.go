@@ -0,0 +1,249 @@
+package nomadhelper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/ryanuber/columnize"
+)
+
+// BackupDir is the directory job backups and delete batches are written to
+const BackupDir = "jobs-backup"
+
+// deleteBatchDir holds one directory per delete batch
+var deleteBatchDir = filepath.Join(BackupDir, "deleted")
+
+// DeleteBatch is the set of jobs deregistered by a single delete run. Every
+// job is saved before it is deregistered so the batch can be restored with
+// UndeleteJobs.
+type DeleteBatch struct {
+	ID        string    `json:"id"`
+	Address   string    `json:"address"`
+	Region    string    `json:"region,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	Purge     bool      `json:"purge"`
+	CreatedAt time.Time `json:"created_at"`
+	Jobs      []string  `json:"jobs"`
+}
+
+// newDeleteBatch creates the directory for a new delete batch of the
+// cluster a config points at
+func newDeleteBatch(config *nomad.Config, purge bool) (*DeleteBatch, error) {
+	now := time.Now().UTC()
+	batch := &DeleteBatch{
+		ID:        now.Format("20060102-150405.000"),
+		Purge:     purge,
+		CreatedAt: now,
+	}
+	if config != nil {
+		batch.Address, batch.Region, batch.Namespace = config.Address, config.Region, config.Namespace
+	}
+	if err := os.MkdirAll(batch.dir(), 0755); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// ReadDeleteBatch loads the manifest of a delete batch
+func ReadDeleteBatch(id string) (*DeleteBatch, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) {
+		return nil, fmt.Errorf("invalid delete batch ID %q", id)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(deleteBatchDir, id, "batch.json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("delete batch %s not found", id)
+	} else if err != nil {
+		return nil, err
+	}
+	batch := new(DeleteBatch)
+	if err := json.Unmarshal(data, batch); err != nil {
+		return nil, fmt.Errorf("delete batch %s: %v", id, err)
+	}
+	return batch, nil
+}
+
+// ListDeleteBatches returns every delete batch, oldest first
+func ListDeleteBatches() ([]*DeleteBatch, error) {
+	dirs, err := ioutil.ReadDir(deleteBatchDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var batches []*DeleteBatch
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		batch, err := ReadDeleteBatch(dir.Name())
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, batch)
+	}
+	sort.Slice(batches, func(i, j int) bool {
+		return batches[i].CreatedAt.Before(batches[j].CreatedAt)
+	})
+	return batches, nil
+}
+
+// dir returns the directory the batch is stored in
+func (b *DeleteBatch) dir() string {
+	return filepath.Join(deleteBatchDir, b.ID)
+}
+
+// save writes a job to the batch and updates the manifest. It must succeed
+// before the job is deregistered.
+func (b *DeleteBatch) save(job *nomad.Job) error {
+	if _, err := writeJobFile(b.dir(), *job.ID, job); err != nil {
+		return err
+	}
+	b.Jobs = append(b.Jobs, *job.ID)
+
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(b.dir(), "batch.json"), data, 0644)
+}
+
+// saveBeforeDelete saves a job to the run's delete batch, creating the batch
+// on first use. The batch is returned even when saving the job failed.
+func (n *NomadHelper) saveBeforeDelete(batch *DeleteBatch, purge bool, job *nomad.Job) (*DeleteBatch, error) {
+	if batch == nil {
+		var err error
+		if batch, err = newDeleteBatch(n.Config, purge); err != nil {
+			return nil, err
+		}
+	}
+	if err := batch.save(job); err != nil {
+		return batch, fmt.Errorf("saving job before deregister: %v", err)
+	}
+	return batch, nil
+}
+
+// job reads a saved job from the batch
+func (b *DeleteBatch) job(id string) (*nomad.Job, error) {
+	data, err := ioutil.ReadFile(jobFilePath(b.dir(), id))
+	if err != nil {
+		return nil, err
+	}
+	job := new(nomad.Job)
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// jobFilePath returns the path a job is backed up to in a directory
+func jobFilePath(dir string, name string) string {
+	return filepath.Join(dir, filepath.Base(fmt.Sprintf("%s.json", name)))
+}
+
+// writeJobFile writes a job as JSON to <dir>/<name>.json and returns the
+// path. Job specs often hold secrets, so the file is only readable by its
+// owner.
+func writeJobFile(dir string, name string, job *nomad.Job) (string, error) {
+	jobJSON, err := json.Marshal(job)
+	if err != nil {
+		return "", err
+	}
+	path := jobFilePath(dir, name)
+	if err := ioutil.WriteFile(path, jobJSON, 0600); err != nil {
+		return path, err
+	}
+	return path, os.Chmod(path, 0600)
+}
+
+// UndeleteJobs registers the jobs of a delete batch again, exactly as they
+// were saved before being deregistered. Jobs that are registered and not
+// dead, or not selected by n.Selector, are skipped. Once ctx is done no further jobs are registered.
+func (n *NomadHelper) UndeleteJobs(ctx context.Context, batchID string, force bool, verbose bool) *Report {
+	var output []string
+	var jobsSkipped []string
+
+	report := NewReport("undelete", force)
+	defer report.Finish()
+
+	batch, err := ReadDeleteBatch(batchID)
+	if err == nil {
+		err = n.checkTarget("delete batch "+batch.ID, batch.Address, batch.Region, batch.Namespace)
+	}
+	if err != nil {
+		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "undelete", Status: StatusFailed, Error: err.Error()})
+		n.writeFailures(report)
+		return report
+	}
+
+	if verbose {
+		n.Logger.Infof("Number of jobs in batch %s: %d\n", batch.ID, len(batch.Jobs))
+	}
+
+	jobs := n.Client.Jobs()
+	for _, id := range batch.Jobs {
+		stub := &nomad.JobListStub{ID: id, Name: id}
+		if n.cancelled(ctx, report, stub, "undelete") {
+			continue
+		}
+
+		job, err := batch.job(id)
+		if err != nil {
+			n.failed(report, stub, "undelete", err)
+			continue
+		}
+		stub.Name = *job.Name
+		if reason, detail, skip := n.Selector.Skip(stub.Name); skip {
+			jobsSkipped = append(jobsSkipped, skipped(report, stub, "undelete", reason, detail))
+			continue
+		}
+
+		current, _, err := jobs.Info(id, nil)
+		if err != nil && !strings.Contains(err.Error(), "404") {
+			n.failed(report, stub, "undelete", err)
+			continue
+		}
+		if current != nil && *current.Status != "dead" {
+			jobsSkipped = append(jobsSkipped, skipped(report, stub, "undelete", SkipRegistered, *current.Status))
+			continue
+		}
+
+		fmt.Fprintf(n.out(), "Job: %s, %s\n", *job.Name, batch.ID)
+		if force {
+			if !n.approved(ctx, report, stub, "undelete") {
+				continue
+			}
+			resp, _, err := jobs.Register(job, nil)
+			n.Inventory().Invalidate(id)
+			if err != nil {
+				n.Logger.Error(err)
+			} else if resp.Warnings != "" {
+				n.Logger.Infof("Warnings: %s\n", resp.Warnings)
+			}
+			report.Add(n.applyResult(job, "undelete", err))
+		} else {
+			report.Add(JobResult{JobID: id, Name: *job.Name, Action: "undelete", Status: StatusPlanned})
+		}
+	}
+
+	output = append(output, "Jobs Skipped|Reason|Detail")
+	if len(jobsSkipped) == 0 {
+		output = append(output, "None")
+	} else {
+		output = append(output, jobsSkipped...)
+	}
+	result := columnize.SimpleFormat(output)
+	fmt.Fprintf(n.out(), "%s\n", result)
+	n.writeFailures(report)
+	n.writeSkipReasons(report)
+	return report
+}
@@ -0,0 +1,452 @@
+package nomadhelper
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/ryanuber/columnize"
+)
+
+// Fixes Doctor applies to jobs with inconsistent custodian meta
+const (
+	// FixSuggested applies the fix suggested for each job
+	FixSuggested = "suggested"
+	// FixClearMeta removes the scale-in meta and leaves the job as it is
+	FixClearMeta = "clear-meta"
+	// FixRecomputeCounts saves the counts of the revert version again
+	FixRecomputeCounts = "recompute-counts"
+	// FixScaleOut restores the revert version, or the saved counts when the
+	// revert version no longer exists, and removes the scale-in meta
+	FixScaleOut = "scale-out"
+)
+
+// Diagnosis is what is wrong with the scale state of a job
+type Diagnosis struct {
+	Problems []string
+	// Fix is the suggested fix
+	Fix string
+
+	// state is the scale state the diagnosis was made from
+	state *ScaleState
+	// revertTo is the revert version, nil when it no longer exists
+	revertTo *nomad.Job
+}
+
+// isCountKey reports whether a meta key is a count saved by scaleInJob and
+// returns the task group it belongs to
+func isCountKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, "custodian-") || !strings.HasSuffix(key, "-count") {
+		return "", false
+	}
+	group := strings.TrimSuffix(strings.TrimPrefix(key, "custodian-"), "-count")
+	return group, group != ""
+}
+
+// scaleMetaKeys returns the keys of a job's meta written by ScaleInJobs
+func scaleMetaKeys(job *nomad.Job) []string {
+	var keys []string
+	for key := range job.Meta {
+		_, count := isCountKey(key)
+		if count || key == "custodian-action" || key == "custodian-revert-version" || key == PeriodicSpecMetaKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// clearScaleMeta removes the meta written by ScaleInJobs
+func clearScaleMeta(job *nomad.Job) {
+	for _, key := range scaleMetaKeys(job) {
+		delete(job.Meta, key)
+	}
+}
+
+// Diagnose checks the scale-in meta of a job against its task groups and its
+// versions. A job without problems gets an empty diagnosis.
+func Diagnose(job *nomad.Job, versions []*nomad.Job) Diagnosis {
+	keys := scaleMetaKeys(job)
+	if job.Meta["custodian-action"] == "" {
+		var d Diagnosis
+		if len(keys) > 0 {
+			d.Problems = append(d.Problems, fmt.Sprintf("%s left without custodian-action", strings.Join(keys, ", ")))
+			d.Fix = FixClearMeta
+		}
+		return d
+	}
+
+	// MetaStore leaves invalid values out of the state, they are explained
+	// with their raw value instead
+	invalid := make(map[string]string)
+	for _, key := range keys {
+		if _, ok := isCountKey(key); ok {
+			if _, err := strconv.Atoi(job.Meta[key]); err != nil {
+				invalid[key] = job.Meta[key]
+			}
+		}
+	}
+	if _, err := strconv.ParseUint(job.Meta["custodian-revert-version"], 10, 64); err != nil {
+		invalid["custodian-revert-version"] = job.Meta["custodian-revert-version"]
+	}
+	state, _ := MetaStore{}.Load(job)
+	return diagnose(job, state, invalid, versions)
+}
+
+// DiagnoseState checks the scale state of a job kept in a store other than
+// job meta against its task groups and its versions. The problems name the
+// state like list does, e.g. custodian-web-count.
+func DiagnoseState(job *nomad.Job, state *ScaleState, versions []*nomad.Job) Diagnosis {
+	if state == nil {
+		return Diagnosis{}
+	}
+	return diagnose(job, state, nil, versions)
+}
+
+// diagnose checks a scale state. invalid holds the raw values of state keys
+// that could not be read.
+func diagnose(job *nomad.Job, state *ScaleState, invalid map[string]string, versions []*nomad.Job) Diagnosis {
+	d := Diagnosis{state: state}
+	if !state.ScaledIn() {
+		d.Problems = append(d.Problems, fmt.Sprintf("unknown custodian-action %q", state.Action))
+		d.Fix = FixClearMeta
+		return d
+	}
+
+	if value, ok := invalid["custodian-revert-version"]; ok {
+		d.Problems = append(d.Problems, fmt.Sprintf("invalid custodian-revert-version %q", value))
+	} else if state.RevertVersion == nil {
+		d.Problems = append(d.Problems, "no custodian-revert-version")
+	} else {
+		for _, v := range versions {
+			if *v.Version == *state.RevertVersion {
+				d.revertTo = v
+			}
+		}
+		if d.revertTo == nil {
+			d.Problems = append(d.Problems, fmt.Sprintf("revert version %d no longer exists", *state.RevertVersion))
+		}
+	}
+
+	// System jobs are constrained instead of scaled in and have no counts
+	manuallyScaled := false
+	if *job.Type != "system" {
+		groups := make(map[string]bool)
+		for _, taskGroup := range job.TaskGroups {
+			name := *taskGroup.Name
+			groups[name] = true
+			key := fmt.Sprintf("custodian-%s-count", name)
+			count, ok := state.Counts[name]
+			value, isInvalid := invalid[key]
+			switch {
+			case isInvalid:
+				d.Problems = append(d.Problems, fmt.Sprintf("invalid %s %q", key, value))
+			case !ok:
+				d.Problems = append(d.Problems, fmt.Sprintf("group %s has no saved count", name))
+			case d.revertTo != nil:
+				if original := findTaskGroup(d.revertTo, name); original != nil && currentCount(original) != count {
+					d.Problems = append(d.Problems, fmt.Sprintf("%s is %d, version %d has %d", key, count,
+						*d.revertTo.Version, currentCount(original)))
+				}
+			}
+			if currentCount(taskGroup) > 1 {
+				manuallyScaled = true
+				d.Problems = append(d.Problems, fmt.Sprintf("group %s runs %d while scaled in", name, currentCount(taskGroup)))
+			}
+		}
+		var saved []string
+		for group := range state.Counts {
+			saved = append(saved, group)
+		}
+		for key := range invalid {
+			if group, ok := isCountKey(key); ok {
+				saved = append(saved, group)
+			}
+		}
+		sort.Strings(saved)
+		for _, group := range saved {
+			if !groups[group] {
+				d.Problems = append(d.Problems, fmt.Sprintf("custodian-%s-count saved for a group that no longer exists", group))
+			}
+		}
+	}
+
+	switch {
+	case len(d.Problems) == 0:
+	case d.revertTo == nil || manuallyScaled:
+		d.Fix = FixScaleOut
+	default:
+		d.Fix = FixRecomputeCounts
+	}
+	return d
+}
+
+// findTaskGroup returns a task group of a job by name
+func findTaskGroup(job *nomad.Job, name string) *nomad.TaskGroup {
+	for _, taskGroup := range job.TaskGroups {
+		if taskGroup.Name != nil && *taskGroup.Name == name {
+			return taskGroup
+		}
+	}
+	return nil
+}
+
+// recomputedState returns the state with the counts of the revert version
+func (d Diagnosis) recomputedState(job *nomad.Job) (*ScaleState, error) {
+	if d.revertTo == nil {
+		return nil, fmt.Errorf("no revert version to recompute the counts from")
+	}
+	state := *d.state
+	state.Counts = make(map[string]int)
+	for _, taskGroup := range job.TaskGroups {
+		count := currentCount(taskGroup)
+		if original := findTaskGroup(d.revertTo, *taskGroup.Name); original != nil {
+			count = currentCount(original)
+		}
+		state.Counts[*taskGroup.Name] = count
+	}
+	return &state, nil
+}
+
+// applyFix changes the job as the fix requires and returns the job to
+// register. The scale-in meta is removed or rewritten, a state kept in
+// another store is changed by fixState.
+func (d Diagnosis) applyFix(job *nomad.Job, fix string) (*nomad.Job, error) {
+	switch fix {
+	case FixClearMeta:
+		clearScaleMeta(job)
+		return job, nil
+	case FixRecomputeCounts:
+		state, err := d.recomputedState(job)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range scaleMetaKeys(job) {
+			if _, ok := isCountKey(key); ok {
+				delete(job.Meta, key)
+			}
+		}
+		for group, count := range state.Counts {
+			job.SetMeta(fmt.Sprintf("custodian-%s-count", group), fmt.Sprint(count))
+		}
+		return job, nil
+	case FixScaleOut:
+		if d.revertTo != nil && d.revertTo.Meta["custodian-action"] != "scaled-in" {
+			// Registering the revert version is what ScaleOutJobs' revert does
+			restored := copyJob(d.revertTo)
+			restored.JobModifyIndex = job.JobModifyIndex
+			return restored, nil
+		}
+		for _, taskGroup := range job.TaskGroups {
+			if count, ok := d.state.Counts[*taskGroup.Name]; ok {
+				taskGroup.Count = intToPtr(count)
+			}
+		}
+		clearScaleMeta(job)
+		return job, nil
+	}
+	return nil, checkFix(fix)
+}
+
+// fixState applies a fix to a job whose state is kept in a store other than
+// job meta. Scale-out registers the job and then removes the state, the
+// other fixes only change the store.
+func (n *NomadHelper) fixState(ctx context.Context, report *Report, jobStub *nomad.JobListStub, fix string,
+	job *nomad.Job, d Diagnosis, store StateStore, force bool) {
+	if fix == FixScaleOut {
+		restored, err := d.applyFix(job, fix)
+		if err != nil {
+			n.failed(report, jobStub, fix, err)
+			return
+		}
+		if n.planOrApply(ctx, report, jobStub, fix, restored, force) && force {
+			if err := dropState(job, store); err != nil {
+				n.Logger.Error(err)
+			}
+		}
+		return
+	}
+
+	var state *ScaleState
+	if fix == FixRecomputeCounts {
+		var err error
+		if state, err = d.recomputedState(job); err != nil {
+			n.failed(report, jobStub, fix, err)
+			return
+		}
+	} else if err := checkFix(fix); err != nil {
+		n.failed(report, jobStub, fix, err)
+		return
+	}
+	fmt.Fprintf(n.out(), "Job: %s, %s in %s\n", *job.Name, fix, store.Name())
+	if !force {
+		report.Add(JobResult{JobID: *job.ID, Name: *job.Name, Action: fix, Status: StatusPlanned})
+		return
+	}
+	if !n.approved(ctx, report, jobStub, fix) {
+		return
+	}
+	var err error
+	if state != nil {
+		err = store.Save(job, state)
+	} else {
+		err = store.Delete(job)
+	}
+	report.Add(n.applyResult(job, fix, err))
+}
+
+// checkFix returns an error for unknown fixes
+func checkFix(fix string) error {
+	switch fix {
+	case FixSuggested, FixClearMeta, FixRecomputeCounts, FixScaleOut:
+		return nil
+	}
+	return fmt.Errorf("unknown fix %q, expected one of %s, %s, %s or %s", fix,
+		FixSuggested, FixClearMeta, FixRecomputeCounts, FixScaleOut)
+}
+
+// Doctor finds jobs whose scale state is inconsistent with their task groups
+// or versions, e.g. a task group added without a saved count or counts
+// edited by hand, and explains the problems with a suggested fix. The state
+// is read from the configured store, and from job meta for jobs scaled in
+// before it was configured.
+// With fix set to FixSuggested each job gets its suggested fix, otherwise
+// every inconsistent job gets the named fix. With fix empty the problems are
+// only reported. Fixes are planned unless force is set. Jobs with
+// custodian-ignore set or not selected by n.Selector are reported but never
+// fixed.
+func (n *NomadHelper) Doctor(ctx context.Context, fix string, force bool, verbose bool) *Report {
+	var output []string
+	var jobsSkipped []string
+
+	report := NewReport("doctor", force)
+	defer report.Finish()
+
+	if fix != "" {
+		if err := checkFix(fix); err != nil {
+			n.Logger.Error(err)
+			report.Add(JobResult{Name: "*", Action: "doctor", Status: StatusFailed, Error: err.Error()})
+			n.writeFailures(report)
+			return report
+		}
+	}
+
+	items, err := n.Inventory().Jobs(ctx, func(stub *nomad.JobListStub) bool {
+		return stub.ParentID == "" && stub.Status != "dead"
+	})
+	if err != nil {
+		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "doctor", Status: StatusFailed, Error: err.Error()})
+		n.writeFailures(report)
+		return report
+	}
+
+	if verbose {
+		n.Logger.Infof("Number of jobs: %d\n", len(items))
+	}
+
+	output = append(output, "Job|Problem|Suggested Fix")
+	for _, item := range items {
+		jobStub := item.Stub
+		if item.Job == nil && item.Err == nil {
+			continue
+		}
+		if n.cancelled(ctx, report, jobStub, "doctor") {
+			continue
+		}
+		if item.Err != nil {
+			n.failed(report, jobStub, "doctor", item.Err)
+			continue
+		}
+		jobInfo := item.Job
+
+		// Jobs without a state in the configured store are checked for
+		// scale-in meta left from before the store was configured
+		state, store, err := n.loadState(jobInfo)
+		if err != nil {
+			n.failed(report, jobStub, "doctor", err)
+			continue
+		}
+		if inMeta(store) && len(scaleMetaKeys(jobInfo)) == 0 {
+			continue
+		}
+
+		var versions []*nomad.Job
+		if state.ScaledIn() {
+			versions, _, _, err = n.Client.Jobs().Versions(jobStub.ID, false, nil)
+			if err != nil {
+				n.failed(report, jobStub, "doctor", err)
+				continue
+			}
+		}
+		var diagnosis Diagnosis
+		if inMeta(store) {
+			diagnosis = Diagnose(jobInfo, versions)
+		} else {
+			diagnosis = DiagnoseState(jobInfo, state, versions)
+		}
+		if len(diagnosis.Problems) == 0 {
+			continue
+		}
+		for i, problem := range diagnosis.Problems {
+			name, suggested := jobStub.Name, diagnosis.Fix
+			if i > 0 {
+				name, suggested = "", ""
+			}
+			output = append(output, fmt.Sprintf("%s|%s|%s", name, problem, suggested))
+		}
+
+		custodianIgnore, err := strconv.ParseBool(jobInfo.Meta["custodian-ignore"])
+		if err != nil && jobInfo.Meta["custodian-ignore"] != "" {
+			n.Logger.Error(err)
+		}
+		summary := strings.Join(diagnosis.Problems, "; ")
+		if fix == "" {
+			report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: "doctor", Status: StatusWarned, Detail: summary})
+			continue
+		}
+		if reason, detail, skip := n.Selector.Skip(jobStub.Name); skip {
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "doctor", reason, detail))
+			continue
+		}
+		if custodianIgnore {
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "doctor", SkipIgnoredMeta, "custodian-ignore"))
+			continue
+		}
+
+		apply := fix
+		if apply == FixSuggested {
+			apply = diagnosis.Fix
+		}
+		if !inMeta(store) {
+			n.fixState(ctx, report, jobStub, apply, jobInfo, diagnosis, store, force)
+			continue
+		}
+		fixed, err := diagnosis.applyFix(jobInfo, apply)
+		if err != nil {
+			n.failed(report, jobStub, apply, err)
+			continue
+		}
+		n.planOrApply(ctx, report, jobStub, apply, fixed, force)
+	}
+	if len(output) == 1 {
+		output = append(output, "None")
+	}
+	fmt.Fprintf(n.out(), "%s\n", columnize.SimpleFormat(output))
+
+	if fix != "" {
+		output = []string{"Jobs Skipped|Reason|Detail"}
+		if len(jobsSkipped) == 0 {
+			output = append(output, "None")
+		} else {
+			output = append(output, jobsSkipped...)
+		}
+		fmt.Fprintf(n.out(), "\n%s\n", columnize.SimpleFormat(output))
+	}
+	n.writeFailures(report)
+	n.writeSkipReasons(report)
+	return report
+}
@@ -0,0 +1,354 @@
+package nomadhelper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/ryanuber/columnize"
+)
+
+// drainedNodesPath keeps the nodes DrainEmptyNodes drained, per cluster
+// address and region, so RestoreDrainedNodes only restores those
+var drainedNodesPath = filepath.Join(BackupDir, "drained-nodes.json")
+
+// DrainOptions controls which client nodes DrainEmptyNodes drains
+type DrainOptions struct {
+	// MaxAllocs is the number of allocations a node may still run to be
+	// drained. Allocations of system jobs are not counted.
+	MaxAllocs int
+	// Deadline is how long allocations are given to move off a node
+	Deadline time.Duration
+	// MinNodes is the number of eligible nodes kept in each datacenter
+	MinNodes int
+	// Webhook is posted the drained or restored nodes when set
+	Webhook string
+	Client  *http.Client
+	// Now is the time recorded for drained nodes, time.Now when zero
+	Now time.Time
+}
+
+// DrainedNode is a client node drained by DrainEmptyNodes
+type DrainedNode struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Address    string    `json:"address"`
+	Datacenter string    `json:"datacenter"`
+	NodeClass  string    `json:"node_class"`
+	Allocs     int       `json:"allocs"`
+	DrainedAt  time.Time `json:"drained_at"`
+}
+
+// nodeWebhookPayload is posted to DrainOptions.Webhook
+type nodeWebhookPayload struct {
+	Cluster string        `json:"cluster"`
+	Action  string        `json:"action"`
+	Nodes   []DrainedNode `json:"nodes"`
+}
+
+// readDrainedNodes loads the drained nodes of every cluster address and region
+func readDrainedNodes() (map[string][]DrainedNode, error) {
+	state := make(map[string][]DrainedNode)
+	data, err := ioutil.ReadFile(drainedNodesPath)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("%s: %v", drainedNodesPath, err)
+	}
+	return state, nil
+}
+
+// writeDrainedNodes saves the state loaded with readDrainedNodes
+func writeDrainedNodes(state map[string][]DrainedNode) error {
+	if err := os.MkdirAll(filepath.Dir(drainedNodesPath), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(drainedNodesPath, data, 0644)
+}
+
+// postNodes sends the nodes to the webhook
+func (o DrainOptions) postNodes(cluster string, action string, nodes []DrainedNode) error {
+	if nodes == nil {
+		nodes = make([]DrainedNode, 0)
+	}
+	body, err := json.Marshal(nodeWebhookPayload{Cluster: cluster, Action: action, Nodes: nodes})
+	if err != nil {
+		return err
+	}
+	client := o.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Post(o.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("node webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// nodeStub names a node in approvals and failures
+func nodeStub(node *nomad.NodeListStub) *nomad.JobListStub {
+	return &nomad.JobListStub{ID: node.ID, Name: node.Name}
+}
+
+// countNodeAllocs counts the allocations placed on every node that are
+// running or about to run. Allocations of system jobs run on every node and
+// are left out.
+func countNodeAllocs(allocs []*nomad.AllocationListStub) map[string]int {
+	counts := make(map[string]int)
+	for _, alloc := range allocs {
+		if alloc.JobType == "system" || alloc.DesiredStatus != "run" {
+			continue
+		}
+		if alloc.ClientStatus != "running" && alloc.ClientStatus != "pending" {
+			continue
+		}
+		counts[alloc.NodeID]++
+	}
+	return counts
+}
+
+// DrainEmptyNodes drains the ready and eligible client nodes that run at most
+// opts.MaxAllocs allocations, which makes them ineligible for scheduling. It
+// is meant to run after ScaleInJobs so the freed nodes can be terminated.
+// At least opts.MinNodes eligible nodes are kept in each datacenter. The
+// drained nodes are printed, posted to opts.Webhook when set and recorded in
+// jobs-backup/drained-nodes.json for RestoreDrainedNodes.
+func (n *NomadHelper) DrainEmptyNodes(ctx context.Context, opts DrainOptions, force bool, verbose bool) *Report {
+	report := NewReport("drain-nodes", force)
+	defer report.Finish()
+
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	address := ""
+	if n.Config != nil {
+		address = n.Config.Address
+	}
+	key := n.localStateKey(false)
+
+	nodes, _, err := n.Client.Nodes().List(nil)
+	var allocs []*nomad.AllocationListStub
+	if err == nil {
+		allocs, _, err = n.Client.Allocations().List(nil)
+	}
+	var state map[string][]DrainedNode
+	if err == nil {
+		state, err = readDrainedNodes()
+	}
+	if err != nil {
+		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "drain", Status: StatusFailed, Error: err.Error()})
+		n.writeFailures(report)
+		return report
+	}
+	counts := countNodeAllocs(allocs)
+
+	// Emptiest nodes first, so the nodes kept are the busiest ones
+	var candidates []*nomad.NodeListStub
+	eligible := make(map[string]int)
+	for _, node := range nodes {
+		if node.Status != "ready" || node.Drain || node.SchedulingEligibility != nomad.NodeSchedulingEligible {
+			continue
+		}
+		eligible[node.Datacenter]++
+		if counts[node.ID] <= opts.MaxAllocs {
+			candidates = append(candidates, node)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if counts[candidates[i].ID] != counts[candidates[j].ID] {
+			return counts[candidates[i].ID] < counts[candidates[j].ID]
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+
+	if verbose {
+		n.Logger.Infof("Number of nodes: %d, drain candidates: %d\n", len(nodes), len(candidates))
+	}
+
+	var drained []DrainedNode
+	var nodesSkipped []string
+	output := []string{"Node|Datacenter|Class|Allocations|State"}
+	for _, node := range candidates {
+		stub := nodeStub(node)
+		if n.cancelled(ctx, report, stub, "drain") {
+			continue
+		}
+		if eligible[node.Datacenter] <= opts.MinNodes {
+			nodesSkipped = append(nodesSkipped, skipped(report, stub, "drain", SkipMinNodes,
+				fmt.Sprintf("min %d nodes in %s", opts.MinNodes, node.Datacenter)))
+			continue
+		}
+		eligible[node.Datacenter]--
+
+		detail := fmt.Sprintf("%d allocations", counts[node.ID])
+		if !force {
+			output = append(output, fmt.Sprintf("%s|%s|%s|%d|drain", node.Name, node.Datacenter, node.NodeClass, counts[node.ID]))
+			report.Add(JobResult{JobID: node.ID, Name: node.Name, Action: "drain", Status: StatusPlanned, Detail: detail})
+			continue
+		}
+		if !n.approved(ctx, report, stub, "drain") {
+			eligible[node.Datacenter]++
+			continue
+		}
+		spec := &nomad.DrainSpec{Deadline: opts.Deadline, IgnoreSystemJobs: true}
+		if _, err := n.Client.Nodes().UpdateDrain(node.ID, spec, false, nil); err != nil {
+			eligible[node.Datacenter]++
+			n.failed(report, stub, "drain", err)
+			continue
+		}
+		output = append(output, fmt.Sprintf("%s|%s|%s|%d|drained", node.Name, node.Datacenter, node.NodeClass, counts[node.ID]))
+		report.Add(JobResult{JobID: node.ID, Name: node.Name, Action: "drain", Status: StatusApplied, Detail: detail})
+		drained = append(drained, DrainedNode{ID: node.ID, Name: node.Name, Address: node.Address,
+			Datacenter: node.Datacenter, NodeClass: node.NodeClass, Allocs: counts[node.ID], DrainedAt: now})
+	}
+	if len(output) == 1 {
+		output = append(output, "None")
+	}
+	fmt.Fprintf(n.out(), "%s\n", columnize.SimpleFormat(output))
+	n.writeNodesSkipped(nodesSkipped)
+
+	if len(drained) > 0 {
+		state[key] = append(state[key], drained...)
+		if err := writeDrainedNodes(state); err != nil {
+			n.Logger.Error(err)
+		}
+		if opts.Webhook != "" {
+			if err := opts.postNodes(address, "drain", drained); err != nil {
+				n.Logger.Error(err)
+				report.Add(JobResult{Name: "*", Action: "drain", Status: StatusFailed, Error: err.Error()})
+			}
+		}
+	}
+	n.writeFailures(report)
+	n.writeSkipReasons(report)
+	return report
+}
+
+// writeNodesSkipped prints the skipped nodes, if any
+func (n *NomadHelper) writeNodesSkipped(nodesSkipped []string) {
+	if len(nodesSkipped) == 0 {
+		return
+	}
+	output := append([]string{"Nodes Skipped|Reason|Detail"}, nodesSkipped...)
+	fmt.Fprintf(n.out(), "\n%s\n", columnize.SimpleFormat(output))
+}
+
+// RestoreDrainedNodes cancels the drain of the nodes DrainEmptyNodes drained
+// and marks them eligible again. It is meant to run with ScaleOutJobs. Nodes
+// that no longer exist, e.g. because they were terminated, are forgotten.
+// The restored nodes are posted to opts.Webhook when set.
+func (n *NomadHelper) RestoreDrainedNodes(ctx context.Context, opts DrainOptions, force bool, verbose bool) *Report {
+	report := NewReport("restore-nodes", force)
+	defer report.Finish()
+
+	address := ""
+	if n.Config != nil {
+		address = n.Config.Address
+	}
+	// Every region has its own nodes, so only those drained in the region
+	// of this target are looked for in its node list
+	key := n.localStateKey(false)
+
+	state, err := readDrainedNodes()
+	var nodes []*nomad.NodeListStub
+	if err == nil && len(state[key]) > 0 {
+		nodes, _, err = n.Client.Nodes().List(nil)
+	}
+	if err != nil {
+		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "restore", Status: StatusFailed, Error: err.Error()})
+		n.writeFailures(report)
+		return report
+	}
+	current := make(map[string]*nomad.NodeListStub)
+	for _, node := range nodes {
+		current[node.ID] = node
+	}
+
+	if verbose {
+		n.Logger.Infof("Number of drained nodes: %d\n", len(state[key]))
+	}
+
+	var remaining, restored []DrainedNode
+	var nodesSkipped []string
+	output := []string{"Node|Datacenter|Class|Drained At|State"}
+	for _, drained := range state[key] {
+		node, ok := current[drained.ID]
+		drainedAt := drained.DrainedAt.UTC().Format(time.RFC3339)
+		if !ok {
+			nodesSkipped = append(nodesSkipped, skipped(report, &nomad.JobListStub{ID: drained.ID, Name: drained.Name},
+				"restore", SkipNodeGone, "drained at "+drainedAt))
+			continue
+		}
+		stub := nodeStub(node)
+		if n.cancelled(ctx, report, stub, "restore") {
+			remaining = append(remaining, drained)
+			continue
+		}
+		if !force {
+			remaining = append(remaining, drained)
+			output = append(output, fmt.Sprintf("%s|%s|%s|%s|restore", drained.Name, drained.Datacenter, drained.NodeClass, drainedAt))
+			report.Add(JobResult{JobID: node.ID, Name: node.Name, Action: "restore", Status: StatusPlanned})
+			continue
+		}
+		if !n.approved(ctx, report, stub, "restore") {
+			remaining = append(remaining, drained)
+			continue
+		}
+		if _, err := n.Client.Nodes().UpdateDrain(node.ID, nil, true, nil); err != nil {
+			remaining = append(remaining, drained)
+			n.failed(report, stub, "restore", err)
+			continue
+		}
+		output = append(output, fmt.Sprintf("%s|%s|%s|%s|restored", drained.Name, drained.Datacenter, drained.NodeClass, drainedAt))
+		report.Add(JobResult{JobID: node.ID, Name: node.Name, Action: "restore", Status: StatusApplied})
+		restored = append(restored, drained)
+	}
+	if len(output) == 1 {
+		output = append(output, "None")
+	}
+	fmt.Fprintf(n.out(), "%s\n", columnize.SimpleFormat(output))
+	n.writeNodesSkipped(nodesSkipped)
+
+	if len(remaining) != len(state[key]) {
+		if len(remaining) == 0 {
+			delete(state, key)
+		} else {
+			state[key] = remaining
+		}
+		if err := writeDrainedNodes(state); err != nil {
+			n.Logger.Error(err)
+		}
+	}
+	if len(restored) > 0 && opts.Webhook != "" {
+		if err := opts.postNodes(address, "restore", restored); err != nil {
+			n.Logger.Error(err)
+			report.Add(JobResult{Name: "*", Action: "restore", Status: StatusFailed, Error: err.Error()})
+		}
+	}
+	n.writeFailures(report)
+	n.writeSkipReasons(report)
+	return report
+}
@@ -0,0 +1,261 @@
+package nomadhelper
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/ryanuber/columnize"
+)
+
+// Meta keys setting when a job expires
+const (
+	// TTLMetaKey is a lifetime counted from the submit time of the first
+	// version that set it, e.g. 72h or 3d
+	TTLMetaKey = "custodian-ttl"
+	// ExpiresMetaKey is an RFC 3339 time, e.g. 2026-11-01T00:00:00Z
+	ExpiresMetaKey = "custodian-expires"
+)
+
+// ExpireOptions controls what ExpireJobs does with expiring jobs
+type ExpireOptions struct {
+	// WarnWithin warns about jobs expiring within this duration
+	WarnWithin time.Duration
+	// Purge purges expired jobs instead of stopping them
+	Purge bool
+	// Now is the time expiry is measured against, time.Now when zero
+	Now time.Time
+}
+
+// ParseTTL parses a custodian-ttl value. On top of Go durations such as
+// 72h it accepts a whole number of days such as 3d.
+func ParseTTL(value string) (time.Duration, error) {
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q", TTLMetaKey, value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", TTLMetaKey, value)
+	}
+	return ttl, nil
+}
+
+// JobExpiry returns when a job expires according to its custodian-ttl and
+// custodian-expires meta, whichever is earlier. ok is false for jobs without
+// either key. The TTL counts from the submit time of the oldest version in
+// versions, newest first as Nomad returns them, that carries the same TTL
+// without a different one in between. Registering the job again, as a
+// scale-in or a meta change does, therefore does not extend it, while
+// changing the TTL starts it over.
+func JobExpiry(job *nomad.Job, versions []*nomad.Job) (expires time.Time, ok bool, err error) {
+	if value := job.Meta[TTLMetaKey]; value != "" {
+		ttl, err := ParseTTL(value)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		expires, ok = ttlStart(job, versions).Add(ttl), true
+	}
+	if value := job.Meta[ExpiresMetaKey]; value != "" {
+		at, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("invalid %s %q", ExpiresMetaKey, value)
+		}
+		if !ok || at.Before(expires) {
+			expires, ok = at, true
+		}
+	}
+	return expires, ok, nil
+}
+
+// ttlStart returns the submit time of the oldest version with the job's
+// current custodian-ttl, or now when no submit time is known
+func ttlStart(job *nomad.Job, versions []*nomad.Job) time.Time {
+	submitTime := job.SubmitTime
+	for _, version := range versions {
+		if job.Version != nil && version.Version != nil && *version.Version > *job.Version {
+			continue
+		}
+		if version.Meta[TTLMetaKey] != job.Meta[TTLMetaKey] {
+			break
+		}
+		if version.SubmitTime != nil {
+			submitTime = version.SubmitTime
+		}
+	}
+	if submitTime == nil {
+		return time.Now()
+	}
+	return time.Unix(0, *submitTime)
+}
+
+// formatRemaining formats the time left before a job expires in days and
+// hours, or hours and minutes when less than a day is left
+func formatRemaining(d time.Duration) string {
+	if d >= 24*time.Hour {
+		return fmt.Sprintf("%dd %dh", d/(24*time.Hour), d%(24*time.Hour)/time.Hour)
+	}
+	return fmt.Sprintf("%dh %dm", d/time.Hour, d%time.Hour/time.Minute)
+}
+
+// expiringJob is a job with an expiry time
+type expiringJob struct {
+	stub    *nomad.JobListStub
+	job     *nomad.Job
+	expires time.Time
+}
+
+// ExpireJobs lists every job with custodian-ttl or custodian-expires meta,
+// warns about jobs expiring within opts.WarnWithin and stops or purges the
+// jobs that have expired. Jobs with custodian-ignore set or not selected by
+// n.Selector are skipped and
+// every job is saved to a delete batch before it is stopped or purged.
+func (n *NomadHelper) ExpireJobs(ctx context.Context, opts ExpireOptions, force bool, verbose bool) *Report {
+	var output []string
+	var jobsSkipped []string
+	var batch *DeleteBatch
+
+	report := NewReport("expire", force)
+	defer report.Finish()
+
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	action := "stop"
+	if opts.Purge {
+		action = "purge"
+	}
+
+	// Child jobs of periodic and parameterized jobs carry their parent's
+	// meta and expire with it. Stopped jobs only matter when purging.
+	items, err := n.Inventory().Jobs(ctx, func(stub *nomad.JobListStub) bool {
+		return stub.ParentID == "" && (opts.Purge || stub.Status != "dead")
+	})
+	if err != nil {
+		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: action, Status: StatusFailed, Error: err.Error()})
+		n.writeFailures(report)
+		return report
+	}
+
+	var expiring []expiringJob
+	for _, item := range items {
+		if item.Job == nil && item.Err == nil {
+			continue
+		}
+		if item.Err != nil {
+			n.failed(report, item.Stub, action, item.Err)
+			continue
+		}
+		var versions []*nomad.Job
+		if item.Job.Meta[TTLMetaKey] != "" {
+			versions, _, _, err = n.Client.Jobs().Versions(item.Stub.ID, false, nil)
+			if err != nil {
+				n.failed(report, item.Stub, action, err)
+				continue
+			}
+		}
+		expires, ok, err := JobExpiry(item.Job, versions)
+		if err != nil {
+			n.failed(report, item.Stub, action, err)
+			continue
+		}
+		if ok {
+			expiring = append(expiring, expiringJob{stub: item.Stub, job: item.Job, expires: expires})
+		}
+	}
+	sort.SliceStable(expiring, func(i, j int) bool {
+		return expiring[i].expires.Before(expiring[j].expires)
+	})
+
+	if verbose {
+		n.Logger.Infof("Number of jobs with an expiry: %d\n", len(expiring))
+	}
+
+	output = append(output, "Job|Status|Expires|State")
+	jobs := n.Client.Jobs()
+	for _, e := range expiring {
+		jobStub, jobInfo := e.stub, e.job
+		if n.cancelled(ctx, report, jobStub, action) {
+			continue
+		}
+		if reason, detail, skip := n.Selector.Skip(jobStub.Name); skip {
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, action, reason, detail))
+			continue
+		}
+
+		custodianIgnore, err := strconv.ParseBool(jobInfo.Meta["custodian-ignore"])
+		if err != nil && jobInfo.Meta["custodian-ignore"] != "" {
+			n.Logger.Error(err)
+		}
+		remaining := e.expires.Sub(now)
+		expires := e.expires.UTC().Format(time.RFC3339)
+
+		switch {
+		case remaining > opts.WarnWithin:
+			output = append(output, fmt.Sprintf("%s|%s|%s|expires in %s", jobStub.Name, jobStub.Status, expires, formatRemaining(remaining)))
+			continue
+		case remaining > 0:
+			output = append(output, fmt.Sprintf("%s|%s|%s|expiring soon", jobStub.Name, jobStub.Status, expires))
+			if !custodianIgnore {
+				report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: action, Status: StatusWarned,
+					Detail: fmt.Sprintf("expires at %s", expires)})
+			}
+			continue
+		}
+
+		output = append(output, fmt.Sprintf("%s|%s|%s|expired", jobStub.Name, jobStub.Status, expires))
+		if custodianIgnore {
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, action, SkipIgnoredMeta, "expired at "+expires))
+			continue
+		}
+		if !force {
+			report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: action, Status: StatusPlanned, Detail: "expired"})
+			continue
+		}
+
+		if !n.approved(ctx, report, jobStub, action) {
+			continue
+		}
+		if batch, err = n.saveBeforeDelete(batch, opts.Purge, jobInfo); err != nil {
+			n.failed(report, jobStub, action, err)
+			continue
+		}
+		_, _, err = jobs.Deregister(jobStub.ID, opts.Purge, nil)
+		n.Inventory().Invalidate(jobStub.ID)
+		if err != nil {
+			n.Logger.Error(err)
+		}
+		result := n.applyResult(jobInfo, action, err)
+		result.Detail = "expired"
+		report.Add(result)
+	}
+
+	if len(output) == 1 {
+		output = append(output, "None")
+	}
+	fmt.Fprintf(n.out(), "%s\n\n", columnize.SimpleFormat(output))
+
+	output = []string{"Jobs Skipped|Reason|Detail"}
+	if len(jobsSkipped) == 0 {
+		output = append(output, "None")
+	} else {
+		output = append(output, jobsSkipped...)
+	}
+	fmt.Fprintf(n.out(), "%s\n", columnize.SimpleFormat(output))
+	n.writeFailures(report)
+	n.writeSkipReasons(report)
+	if batch != nil {
+		fmt.Fprintf(n.out(), "Expired jobs were saved as batch %s. Restore them with: nomad-custodian undelete %s\n",
+			batch.ID, batch.ID)
+	}
+	return report
+}
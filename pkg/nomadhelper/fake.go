@@ -0,0 +1,941 @@
+package nomadhelper
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+// FakeClient is an in-memory NomadClient used to test the helper without a
+// Nomad agent. It keeps every registered version of each job and produces
+// plan diffs by comparing the submitted job with the latest version.
+type FakeClient struct {
+	mu          sync.Mutex
+	index       uint64
+	jobs        map[string][]*nomad.Job
+	evals       map[string]*nomad.Evaluation
+	deployments map[string]*nomad.Deployment
+	allocs      map[string]*nomad.Allocation
+	stats       map[string]*nomad.AllocResourceUsage
+	nodes       map[string]*nomad.NodeListStub
+	scaling     map[string]map[string][]*ScalingEvent
+	variables   map[string]*Variable
+	failures    []*fakeFailure
+	calls       map[string]int
+}
+
+// fakeFailure is an error injected with FailNext
+type fakeFailure struct {
+	method string
+	id     string
+	times  int
+	err    error
+}
+
+// NewFakeClient returns a fake client seeded with the given jobs
+func NewFakeClient(jobs ...*nomad.Job) *FakeClient {
+	f := &FakeClient{
+		jobs:        make(map[string][]*nomad.Job),
+		evals:       make(map[string]*nomad.Evaluation),
+		deployments: make(map[string]*nomad.Deployment),
+		allocs:      make(map[string]*nomad.Allocation),
+		stats:       make(map[string]*nomad.AllocResourceUsage),
+		nodes:       make(map[string]*nomad.NodeListStub),
+		scaling:     make(map[string]map[string][]*ScalingEvent),
+		variables:   make(map[string]*Variable),
+		calls:       make(map[string]int),
+	}
+	for _, job := range jobs {
+		f.AddJob(job)
+	}
+	return f
+}
+
+// AddJob stores the job as a new version without going through Register.
+// The job status is kept when set and defaults to running.
+func (f *FakeClient) AddJob(job *nomad.Job) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	job = copyJob(job)
+	job.Canonicalize()
+	if job.Status == nil || *job.Status == "" {
+		job.Status = stringToPtr("running")
+	}
+	f.store(job)
+}
+
+// AddAllocation stores an allocation and the resource usage returned by Stats
+func (f *FakeClient) AddAllocation(alloc *nomad.Allocation, usage *nomad.AllocResourceUsage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.allocs[alloc.ID] = alloc
+	if usage != nil {
+		f.stats[alloc.ID] = usage
+	}
+}
+
+// AddDeployment stores a deployment
+func (f *FakeClient) AddDeployment(deployment *nomad.Deployment) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.deployments[deployment.ID] = deployment
+}
+
+// AddNode stores a client node
+func (f *FakeClient) AddNode(node *nomad.NodeListStub) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	copied := *node
+	f.nodes[node.ID] = &copied
+}
+
+// Node returns a copy of a client node or nil when it does not exist
+func (f *FakeClient) Node(nodeID string) *nomad.NodeListStub {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	node, ok := f.nodes[nodeID]
+	if !ok {
+		return nil
+	}
+	copied := *node
+	return &copied
+}
+
+// Job returns a copy of the latest version of a job or nil when it does not exist
+func (f *FakeClient) Job(jobID string) *nomad.Job {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	versions := f.jobs[jobID]
+	if len(versions) == 0 {
+		return nil
+	}
+	return copyJob(versions[len(versions)-1])
+}
+
+// FailNext makes the next calls to a method return err. The method is named
+// after the endpoint, e.g. "Jobs.Info". An empty id matches every job.
+func (f *FakeClient) FailNext(method string, id string, times int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures = append(f.failures, &fakeFailure{method: method, id: id, times: times, err: err})
+}
+
+// Calls returns the number of times a method has been called
+func (f *FakeClient) Calls(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls[method]
+}
+
+// Jobs returns the fake jobs endpoints
+func (f *FakeClient) Jobs() JobsAPI {
+	return &fakeJobs{f}
+}
+
+// Deployments returns the fake deployments endpoints
+func (f *FakeClient) Deployments() DeploymentsAPI {
+	return &fakeDeployments{f}
+}
+
+// Evaluations returns the fake evaluations endpoints
+func (f *FakeClient) Evaluations() EvaluationsAPI {
+	return &fakeEvaluations{f}
+}
+
+// Allocations returns the fake allocations endpoints
+func (f *FakeClient) Allocations() AllocationsAPI {
+	return &fakeAllocations{f}
+}
+
+// Nodes returns the fake nodes endpoints
+func (f *FakeClient) Nodes() NodesAPI {
+	return &fakeNodes{f}
+}
+
+// Scaling returns the fake job scale endpoint
+func (f *FakeClient) Scaling() ScalingAPI {
+	return &fakeScaling{f}
+}
+
+// Variables returns the fake Nomad Variables endpoint
+func (f *FakeClient) Variables() VariablesAPI {
+	return &fakeVariables{f}
+}
+
+// call records a call and returns any injected failure. The lock must be held.
+func (f *FakeClient) call(method string, id string) error {
+	f.calls[method]++
+	for _, failure := range f.failures {
+		if failure.times > 0 && failure.method == method && (failure.id == "" || failure.id == id) {
+			failure.times--
+			return failure.err
+		}
+	}
+	return nil
+}
+
+// store appends the job as the next version. The lock must be held.
+func (f *FakeClient) store(job *nomad.Job) *nomad.Evaluation {
+	f.index++
+	versions := f.jobs[*job.ID]
+
+	job.Version = uint64ToPtr(0)
+	job.CreateIndex = uint64ToPtr(f.index)
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		job.Version = uint64ToPtr(*latest.Version + 1)
+		job.CreateIndex = latest.CreateIndex
+	}
+	job.ModifyIndex = uint64ToPtr(f.index)
+	job.JobModifyIndex = uint64ToPtr(f.index)
+	if job.SubmitTime == nil {
+		job.SubmitTime = int64ToPtr(time.Now().UnixNano())
+	}
+	job.Stable = boolToPtr(false)
+	f.jobs[*job.ID] = append(versions, job)
+
+	eval := &nomad.Evaluation{
+		ID:             f.newID(),
+		JobID:          *job.ID,
+		JobModifyIndex: f.index,
+		TriggeredBy:    "job-register",
+		Status:         "complete",
+		CreateIndex:    f.index,
+		ModifyIndex:    f.index,
+	}
+	f.evals[eval.ID] = eval
+	return eval
+}
+
+// register stores a submitted job and updates its status. The lock must be held.
+func (f *FakeClient) register(job *nomad.Job) *nomad.JobRegisterResponse {
+	job.Canonicalize()
+	job.SubmitTime = int64ToPtr(time.Now().UnixNano())
+	job.Status = stringToPtr("running")
+	if job.Stop != nil && *job.Stop {
+		job.Status = stringToPtr("dead")
+	}
+
+	eval := f.store(job)
+	return &nomad.JobRegisterResponse{
+		EvalID:          eval.ID,
+		EvalCreateIndex: eval.CreateIndex,
+		JobModifyIndex:  eval.JobModifyIndex,
+	}
+}
+
+// latest returns the latest version of a job. The lock must be held.
+func (f *FakeClient) latest(jobID string) (*nomad.Job, error) {
+	versions := f.jobs[jobID]
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("Unexpected response code: 404 (job not found)")
+	}
+	return versions[len(versions)-1], nil
+}
+
+// newID returns a unique UUID formatted ID. The lock must be held.
+func (f *FakeClient) newID() string {
+	f.index++
+	return fmt.Sprintf("%08x-0000-4000-8000-%012x", f.index, f.index)
+}
+
+type fakeJobs struct {
+	f *FakeClient
+}
+
+func (j *fakeJobs) List(q *nomad.QueryOptions) ([]*nomad.JobListStub, *nomad.QueryMeta, error) {
+	j.f.mu.Lock()
+	defer j.f.mu.Unlock()
+
+	if err := j.f.call("Jobs.List", ""); err != nil {
+		return nil, nil, err
+	}
+
+	var ids []string
+	for id := range j.f.jobs {
+		if q != nil && q.Prefix != "" && !strings.HasPrefix(id, q.Prefix) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var stubs []*nomad.JobListStub
+	for _, id := range ids {
+		job, _ := j.f.latest(id)
+		stubs = append(stubs, jobStub(job))
+	}
+	return stubs, &nomad.QueryMeta{LastIndex: j.f.index}, nil
+}
+
+func (j *fakeJobs) Info(jobID string, q *nomad.QueryOptions) (*nomad.Job, *nomad.QueryMeta, error) {
+	j.f.mu.Lock()
+	defer j.f.mu.Unlock()
+
+	if err := j.f.call("Jobs.Info", jobID); err != nil {
+		return nil, nil, err
+	}
+	job, err := j.f.latest(jobID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return copyJob(job), &nomad.QueryMeta{LastIndex: j.f.index}, nil
+}
+
+func (j *fakeJobs) Versions(jobID string, diffs bool, q *nomad.QueryOptions) ([]*nomad.Job, []*nomad.JobDiff, *nomad.QueryMeta, error) {
+	j.f.mu.Lock()
+	defer j.f.mu.Unlock()
+
+	if err := j.f.call("Jobs.Versions", jobID); err != nil {
+		return nil, nil, nil, err
+	}
+	versions := j.f.jobs[jobID]
+	if len(versions) == 0 {
+		return nil, nil, nil, fmt.Errorf("Unexpected response code: 404 (job not found)")
+	}
+
+	// Nomad returns the newest version first
+	var result []*nomad.Job
+	for i := len(versions) - 1; i >= 0; i-- {
+		result = append(result, copyJob(versions[i]))
+	}
+	return result, nil, &nomad.QueryMeta{LastIndex: j.f.index}, nil
+}
+
+func (j *fakeJobs) Plan(job *nomad.Job, diff bool, q *nomad.WriteOptions) (*nomad.JobPlanResponse, *nomad.WriteMeta, error) {
+	j.f.mu.Lock()
+	defer j.f.mu.Unlock()
+
+	if err := j.f.call("Jobs.Plan", *job.ID); err != nil {
+		return nil, nil, err
+	}
+
+	var old *nomad.Job
+	var modifyIndex uint64
+	if versions := j.f.jobs[*job.ID]; len(versions) > 0 {
+		old = versions[len(versions)-1]
+		modifyIndex = *old.JobModifyIndex
+	}
+
+	resp := &nomad.JobPlanResponse{JobModifyIndex: modifyIndex}
+	if diff {
+		resp.Diff = DiffJobs(old, job)
+	}
+	return resp, &nomad.WriteMeta{LastIndex: j.f.index}, nil
+}
+
+func (j *fakeJobs) Register(job *nomad.Job, q *nomad.WriteOptions) (*nomad.JobRegisterResponse, *nomad.WriteMeta, error) {
+	j.f.mu.Lock()
+	defer j.f.mu.Unlock()
+
+	if err := j.f.call("Jobs.Register", *job.ID); err != nil {
+		return nil, nil, err
+	}
+	resp := j.f.register(copyJob(job))
+	return resp, &nomad.WriteMeta{LastIndex: j.f.index}, nil
+}
+
+func (j *fakeJobs) EnforceRegister(job *nomad.Job, modifyIndex uint64, q *nomad.WriteOptions) (*nomad.JobRegisterResponse, *nomad.WriteMeta, error) {
+	j.f.mu.Lock()
+	defer j.f.mu.Unlock()
+
+	if err := j.f.call("Jobs.EnforceRegister", *job.ID); err != nil {
+		return nil, nil, err
+	}
+	latest, _ := j.f.latest(*job.ID)
+	switch {
+	case latest == nil && modifyIndex != 0:
+		return nil, nil, fmt.Errorf("Unexpected response code: 500 (Enforcing job modify index %d: job does not exist)", modifyIndex)
+	case latest != nil && *latest.JobModifyIndex != modifyIndex:
+		return nil, nil, fmt.Errorf("Unexpected response code: 500 (Enforcing job modify index %d: job exists with conflicting job modify index: %d)",
+			modifyIndex, *latest.JobModifyIndex)
+	}
+	resp := j.f.register(copyJob(job))
+	return resp, &nomad.WriteMeta{LastIndex: j.f.index}, nil
+}
+
+func (j *fakeJobs) Revert(jobID string, version uint64, enforcePriorVersion *uint64, q *nomad.WriteOptions,
+	vaultToken string) (*nomad.JobRegisterResponse, *nomad.WriteMeta, error) {
+	j.f.mu.Lock()
+	defer j.f.mu.Unlock()
+
+	if err := j.f.call("Jobs.Revert", jobID); err != nil {
+		return nil, nil, err
+	}
+	latest, err := j.f.latest(jobID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if enforcePriorVersion != nil && *latest.Version != *enforcePriorVersion {
+		return nil, nil, fmt.Errorf("Unexpected response code: 500 (current job has version %d; enforcing version %d)",
+			*latest.Version, *enforcePriorVersion)
+	}
+
+	for _, past := range j.f.jobs[jobID] {
+		if *past.Version == version {
+			job := copyJob(past)
+			job.Stop = boolToPtr(false)
+			resp := j.f.register(job)
+			return resp, &nomad.WriteMeta{LastIndex: j.f.index}, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("Unexpected response code: 500 (job %q at version %d not found)", jobID, version)
+}
+
+func (j *fakeJobs) Deregister(jobID string, purge bool, q *nomad.WriteOptions) (string, *nomad.WriteMeta, error) {
+	j.f.mu.Lock()
+	defer j.f.mu.Unlock()
+
+	if err := j.f.call("Jobs.Deregister", jobID); err != nil {
+		return "", nil, err
+	}
+	latest, err := j.f.latest(jobID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if purge {
+		delete(j.f.jobs, jobID)
+		eval := &nomad.Evaluation{ID: j.f.newID(), JobID: jobID, TriggeredBy: "job-deregister", Status: "complete"}
+		j.f.evals[eval.ID] = eval
+		return eval.ID, &nomad.WriteMeta{LastIndex: j.f.index}, nil
+	}
+
+	job := copyJob(latest)
+	job.Stop = boolToPtr(true)
+	resp := j.f.register(job)
+	return resp.EvalID, &nomad.WriteMeta{LastIndex: j.f.index}, nil
+}
+
+type fakeDeployments struct {
+	f *FakeClient
+}
+
+func (d *fakeDeployments) List(q *nomad.QueryOptions) ([]*nomad.Deployment, *nomad.QueryMeta, error) {
+	d.f.mu.Lock()
+	defer d.f.mu.Unlock()
+
+	if err := d.f.call("Deployments.List", ""); err != nil {
+		return nil, nil, err
+	}
+	var deployments []*nomad.Deployment
+	for _, deployment := range d.f.deployments {
+		deployments = append(deployments, deployment)
+	}
+	sort.Slice(deployments, func(a, b int) bool { return deployments[a].ID < deployments[b].ID })
+	return deployments, &nomad.QueryMeta{LastIndex: d.f.index}, nil
+}
+
+func (d *fakeDeployments) Info(deploymentID string, q *nomad.QueryOptions) (*nomad.Deployment, *nomad.QueryMeta, error) {
+	d.f.mu.Lock()
+	defer d.f.mu.Unlock()
+
+	if err := d.f.call("Deployments.Info", deploymentID); err != nil {
+		return nil, nil, err
+	}
+	deployment, ok := d.f.deployments[deploymentID]
+	if !ok {
+		return nil, nil, fmt.Errorf("Unexpected response code: 404 (deployment not found)")
+	}
+	return deployment, &nomad.QueryMeta{LastIndex: d.f.index}, nil
+}
+
+type fakeEvaluations struct {
+	f *FakeClient
+}
+
+func (e *fakeEvaluations) Info(evalID string, q *nomad.QueryOptions) (*nomad.Evaluation, *nomad.QueryMeta, error) {
+	e.f.mu.Lock()
+	defer e.f.mu.Unlock()
+
+	if err := e.f.call("Evaluations.Info", evalID); err != nil {
+		return nil, nil, err
+	}
+	eval, ok := e.f.evals[evalID]
+	if !ok {
+		return nil, nil, fmt.Errorf("Unexpected response code: 404 (eval not found)")
+	}
+	return eval, &nomad.QueryMeta{LastIndex: e.f.index}, nil
+}
+
+type fakeAllocations struct {
+	f *FakeClient
+}
+
+func (a *fakeAllocations) List(q *nomad.QueryOptions) ([]*nomad.AllocationListStub, *nomad.QueryMeta, error) {
+	a.f.mu.Lock()
+	defer a.f.mu.Unlock()
+
+	if err := a.f.call("Allocations.List", ""); err != nil {
+		return nil, nil, err
+	}
+	var stubs []*nomad.AllocationListStub
+	for _, alloc := range a.f.allocs {
+		stubs = append(stubs, &nomad.AllocationListStub{
+			ID:            alloc.ID,
+			EvalID:        alloc.EvalID,
+			Name:          alloc.Name,
+			Namespace:     alloc.Namespace,
+			NodeID:        alloc.NodeID,
+			NodeName:      alloc.NodeName,
+			JobID:         alloc.JobID,
+			JobType:       allocJobType(alloc),
+			TaskGroup:     alloc.TaskGroup,
+			DesiredStatus: alloc.DesiredStatus,
+			ClientStatus:  alloc.ClientStatus,
+			CreateIndex:   alloc.CreateIndex,
+			ModifyIndex:   alloc.ModifyIndex,
+			CreateTime:    alloc.CreateTime,
+			ModifyTime:    alloc.ModifyTime,
+		})
+	}
+	sort.Slice(stubs, func(i, j int) bool { return stubs[i].ID < stubs[j].ID })
+	return stubs, &nomad.QueryMeta{LastIndex: a.f.index}, nil
+}
+
+func (a *fakeAllocations) Info(allocID string, q *nomad.QueryOptions) (*nomad.Allocation, *nomad.QueryMeta, error) {
+	a.f.mu.Lock()
+	defer a.f.mu.Unlock()
+
+	if err := a.f.call("Allocations.Info", allocID); err != nil {
+		return nil, nil, err
+	}
+	alloc, ok := a.f.allocs[allocID]
+	if !ok {
+		return nil, nil, fmt.Errorf("Unexpected response code: 404 (alloc not found)")
+	}
+	return alloc, &nomad.QueryMeta{LastIndex: a.f.index}, nil
+}
+
+func (a *fakeAllocations) Stats(alloc *nomad.Allocation, q *nomad.QueryOptions) (*nomad.AllocResourceUsage, error) {
+	a.f.mu.Lock()
+	defer a.f.mu.Unlock()
+
+	if err := a.f.call("Allocations.Stats", alloc.ID); err != nil {
+		return nil, err
+	}
+	usage, ok := a.f.stats[alloc.ID]
+	if !ok {
+		return nil, fmt.Errorf("Unexpected response code: 404 (no stats for alloc %s)", alloc.ID)
+	}
+	return usage, nil
+}
+
+// allocJobType returns the type of the job an allocation belongs to
+func allocJobType(alloc *nomad.Allocation) string {
+	if alloc.Job == nil || alloc.Job.Type == nil {
+		return ""
+	}
+	return *alloc.Job.Type
+}
+
+type fakeNodes struct {
+	f *FakeClient
+}
+
+func (n *fakeNodes) List(q *nomad.QueryOptions) ([]*nomad.NodeListStub, *nomad.QueryMeta, error) {
+	n.f.mu.Lock()
+	defer n.f.mu.Unlock()
+
+	if err := n.f.call("Nodes.List", ""); err != nil {
+		return nil, nil, err
+	}
+	var stubs []*nomad.NodeListStub
+	for _, node := range n.f.nodes {
+		copied := *node
+		stubs = append(stubs, &copied)
+	}
+	sort.Slice(stubs, func(i, j int) bool { return stubs[i].ID < stubs[j].ID })
+	return stubs, &nomad.QueryMeta{LastIndex: n.f.index}, nil
+}
+
+// UpdateDrain starts or cancels the drain of a node. Like Nomad, a draining
+// node is ineligible for scheduling.
+func (n *fakeNodes) UpdateDrain(nodeID string, spec *nomad.DrainSpec, markEligible bool,
+	q *nomad.WriteOptions) (*nomad.NodeDrainUpdateResponse, error) {
+	n.f.mu.Lock()
+	defer n.f.mu.Unlock()
+
+	if err := n.f.call("Nodes.UpdateDrain", nodeID); err != nil {
+		return nil, err
+	}
+	node, ok := n.f.nodes[nodeID]
+	if !ok {
+		return nil, fmt.Errorf("Unexpected response code: 404 (node not found)")
+	}
+	n.f.index++
+	node.Drain = spec != nil
+	if node.Drain {
+		node.SchedulingEligibility = nomad.NodeSchedulingIneligible
+	} else if markEligible {
+		node.SchedulingEligibility = nomad.NodeSchedulingEligible
+	}
+	node.ModifyIndex = n.f.index
+	return &nomad.NodeDrainUpdateResponse{NodeModifyIndex: n.f.index}, nil
+}
+
+type fakeScaling struct {
+	f *FakeClient
+}
+
+// Scale stores the job with the new task group count as the next version and
+// records a scaling event, like Nomad
+func (s *fakeScaling) Scale(jobID string, req *ScalingRequest, q *nomad.WriteOptions) (*nomad.JobRegisterResponse, *nomad.WriteMeta, error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+
+	if err := s.f.call("Scaling.Scale", jobID); err != nil {
+		return nil, nil, err
+	}
+	latest, err := s.f.latest(jobID)
+	if err != nil {
+		return nil, nil, err
+	}
+	job := copyJob(latest)
+	group := req.Target["Group"]
+	var taskGroup *nomad.TaskGroup
+	for _, tg := range job.TaskGroups {
+		if *tg.Name == group {
+			taskGroup = tg
+		}
+	}
+	if taskGroup == nil {
+		return nil, nil, fmt.Errorf("Unexpected response code: 400 (task group %q not found)", group)
+	}
+	previous := int64(*taskGroup.Count)
+	if req.Count != nil {
+		taskGroup.Count = intToPtr(int(*req.Count))
+	}
+	eval := s.f.store(job)
+
+	if s.f.scaling[jobID] == nil {
+		s.f.scaling[jobID] = make(map[string][]*ScalingEvent)
+	}
+	// Nomad returns the newest event first
+	event := &ScalingEvent{
+		Count:         req.Count,
+		PreviousCount: previous,
+		Message:       req.Message,
+		Error:         req.Error,
+		Meta:          req.Meta,
+		EvalID:        stringToPtr(eval.ID),
+		Time:          uint64(time.Now().UnixNano()),
+		CreateIndex:   s.f.index,
+	}
+	s.f.scaling[jobID][group] = append([]*ScalingEvent{event}, s.f.scaling[jobID][group]...)
+	return &nomad.JobRegisterResponse{EvalID: eval.ID, EvalCreateIndex: eval.CreateIndex,
+		JobModifyIndex: eval.JobModifyIndex}, &nomad.WriteMeta{LastIndex: s.f.index}, nil
+}
+
+// Status returns the count and scaling events of every task group
+func (s *fakeScaling) Status(jobID string, q *nomad.QueryOptions) (*JobScaleStatus, *nomad.QueryMeta, error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+
+	if err := s.f.call("Scaling.Status", jobID); err != nil {
+		return nil, nil, err
+	}
+	job, err := s.f.latest(jobID)
+	if err != nil {
+		return nil, nil, err
+	}
+	status := &JobScaleStatus{
+		JobID:          jobID,
+		JobCreateIndex: *job.CreateIndex,
+		JobModifyIndex: *job.JobModifyIndex,
+		JobStopped:     job.Stop != nil && *job.Stop,
+		TaskGroups:     make(map[string]TaskGroupScaleStatus),
+	}
+	for _, taskGroup := range job.TaskGroups {
+		status.TaskGroups[*taskGroup.Name] = TaskGroupScaleStatus{
+			Desired: *taskGroup.Count,
+			Events:  s.f.scaling[jobID][*taskGroup.Name],
+		}
+	}
+	return status, &nomad.QueryMeta{LastIndex: s.f.index}, nil
+}
+
+type fakeVariables struct {
+	f *FakeClient
+}
+
+// variableKey identifies a variable by namespace and path
+func variableKey(namespace string, path string) string {
+	if namespace == "" {
+		namespace = "default"
+	}
+	return namespace + "/" + path
+}
+
+func (v *fakeVariables) Read(path string, q *nomad.QueryOptions) (*Variable, *nomad.QueryMeta, error) {
+	v.f.mu.Lock()
+	defer v.f.mu.Unlock()
+
+	if err := v.f.call("Variables.Read", path); err != nil {
+		return nil, nil, err
+	}
+	namespace := ""
+	if q != nil {
+		namespace = q.Namespace
+	}
+	variable, ok := v.f.variables[variableKey(namespace, path)]
+	if !ok {
+		return nil, &nomad.QueryMeta{LastIndex: v.f.index}, nil
+	}
+	copied := *variable
+	return &copied, &nomad.QueryMeta{LastIndex: v.f.index}, nil
+}
+
+func (v *fakeVariables) Upsert(variable *Variable, q *nomad.WriteOptions) (*Variable, *nomad.WriteMeta, error) {
+	v.f.mu.Lock()
+	defer v.f.mu.Unlock()
+
+	if err := v.f.call("Variables.Upsert", variable.Path); err != nil {
+		return nil, nil, err
+	}
+	v.f.index++
+	stored := *variable
+	if stored.Namespace == "" {
+		stored.Namespace = "default"
+	}
+	key := variableKey(stored.Namespace, stored.Path)
+	stored.CreateIndex = v.f.index
+	if existing, ok := v.f.variables[key]; ok {
+		stored.CreateIndex = existing.CreateIndex
+	}
+	stored.ModifyIndex = v.f.index
+	v.f.variables[key] = &stored
+	copied := stored
+	return &copied, &nomad.WriteMeta{LastIndex: v.f.index}, nil
+}
+
+func (v *fakeVariables) Delete(path string, q *nomad.WriteOptions) (*nomad.WriteMeta, error) {
+	v.f.mu.Lock()
+	defer v.f.mu.Unlock()
+
+	if err := v.f.call("Variables.Delete", path); err != nil {
+		return nil, err
+	}
+	namespace := ""
+	if q != nil {
+		namespace = q.Namespace
+	}
+	v.f.index++
+	delete(v.f.variables, variableKey(namespace, path))
+	return &nomad.WriteMeta{LastIndex: v.f.index}, nil
+}
+
+// jobStub builds the list stub Nomad returns for a job
+func jobStub(job *nomad.Job) *nomad.JobListStub {
+	stub := &nomad.JobListStub{
+		ID:               *job.ID,
+		Name:             *job.Name,
+		Datacenters:      job.Datacenters,
+		Type:             *job.Type,
+		Periodic:         job.IsPeriodic(),
+		ParameterizedJob: job.IsParameterized(),
+		Status:           *job.Status,
+		CreateIndex:      *job.CreateIndex,
+		ModifyIndex:      *job.ModifyIndex,
+		JobModifyIndex:   *job.JobModifyIndex,
+		SubmitTime:       *job.SubmitTime,
+	}
+	if job.ParentID != nil {
+		stub.ParentID = *job.ParentID
+	}
+	if job.Priority != nil {
+		stub.Priority = *job.Priority
+	}
+	if job.Stop != nil {
+		stub.Stop = *job.Stop
+	}
+	return stub
+}
+
+// diffIgnoredFields are job fields managed by Nomad that never show up in a plan
+var diffIgnoredFields = map[string]bool{
+	"Status":            true,
+	"StatusDescription": true,
+	"Stable":            true,
+	"Version":           true,
+	"SubmitTime":        true,
+	"CreateIndex":       true,
+	"ModifyIndex":       true,
+	"JobModifyIndex":    true,
+}
+
+// DiffJobs builds a plan style diff between two versions of a job. Job level
+// changes are reported as fields and task group changes are reported per group.
+func DiffJobs(old *nomad.Job, new *nomad.Job) *nomad.JobDiff {
+	oldJob := flattenJob(old)
+	newJob := flattenJob(new)
+
+	diff := &nomad.JobDiff{Type: "None", ID: *new.ID}
+	diff.Fields = diffFields(oldJob[""], newJob[""])
+
+	var groups []string
+	for name := range oldJob {
+		groups = append(groups, name)
+	}
+	for name := range newJob {
+		if _, ok := oldJob[name]; !ok {
+			groups = append(groups, name)
+		}
+	}
+	sort.Strings(groups)
+
+	for _, name := range groups {
+		if name == "" {
+			continue
+		}
+		fields := diffFields(oldJob[name], newJob[name])
+		if len(fields) == 0 {
+			continue
+		}
+		diff.TaskGroups = append(diff.TaskGroups, &nomad.TaskGroupDiff{
+			Type:   diffType(oldJob[name] != nil, newJob[name] != nil),
+			Name:   name,
+			Fields: fields,
+		})
+	}
+
+	if old == nil {
+		diff.Type = "Added"
+	} else if len(diff.Fields) > 0 || len(diff.TaskGroups) > 0 {
+		diff.Type = "Edited"
+	}
+	return diff
+}
+
+// flattenJob flattens a job into field name/value maps keyed by task group
+// name, with the job level fields under the empty key
+func flattenJob(job *nomad.Job) map[string]map[string]string {
+	result := make(map[string]map[string]string)
+	if job == nil {
+		return result
+	}
+
+	var data map[string]interface{}
+	raw, _ := json.Marshal(job)
+	json.Unmarshal(raw, &data)
+
+	groups, _ := data["TaskGroups"].([]interface{})
+	delete(data, "TaskGroups")
+	for field := range diffIgnoredFields {
+		delete(data, field)
+	}
+
+	result[""] = make(map[string]string)
+	flatten("", data, result[""])
+	for _, group := range groups {
+		groupData, _ := group.(map[string]interface{})
+		name, _ := groupData["Name"].(string)
+		result[name] = make(map[string]string)
+		flatten("", groupData, result[name])
+	}
+	return result
+}
+
+// flatten walks decoded JSON and records every leaf value by its path
+func flatten(path string, value interface{}, out map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			childPath := key
+			if strings.HasSuffix(path, "Meta") {
+				childPath = fmt.Sprintf("%s[%s]", path, key)
+			} else if path != "" {
+				childPath = path + "." + key
+			}
+			flatten(childPath, child, out)
+		}
+	case []interface{}:
+		for i, child := range v {
+			key := fmt.Sprint(i)
+			if m, ok := child.(map[string]interface{}); ok {
+				if name, ok := m["Name"].(string); ok && name != "" {
+					key = name
+				}
+			}
+			flatten(fmt.Sprintf("%s[%s]", path, key), child, out)
+		}
+	case nil:
+	default:
+		out[path] = fmt.Sprint(v)
+	}
+}
+
+// diffFields compares two flattened field maps
+func diffFields(old map[string]string, new map[string]string) []*nomad.FieldDiff {
+	var names []string
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range new {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var fields []*nomad.FieldDiff
+	for _, name := range names {
+		oldValue, oldOk := old[name]
+		newValue, newOk := new[name]
+		if oldValue == newValue && oldOk == newOk {
+			continue
+		}
+		fields = append(fields, &nomad.FieldDiff{
+			Type: diffType(oldOk, newOk),
+			Name: name,
+			Old:  oldValue,
+			New:  newValue,
+		})
+	}
+	return fields
+}
+
+// diffType returns the Nomad diff type for a field present in old and/or new
+func diffType(old bool, new bool) string {
+	switch {
+	case !old && new:
+		return "Added"
+	case old && !new:
+		return "Deleted"
+	default:
+		return "Edited"
+	}
+}
+
+func stringToPtr(s string) *string {
+	return &s
+}
+
+func intToPtr(i int) *int {
+	return &i
+}
+
+func boolToPtr(b bool) *bool {
+	return &b
+}
+
+func int64ToPtr(i int64) *int64 {
+	return &i
+}
+
+func uint64ToPtr(u uint64) *uint64 {
+	return &u
+}
@@ -0,0 +1,254 @@
+package nomadhelper
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/ryanuber/columnize"
+)
+
+// Reasons a job is collected by GCJobs
+const (
+	GCStopped    = "stopped"
+	GCFailed     = "failed"
+	GCDead       = "dead"
+	GCIdleParent = "idle parent"
+)
+
+// GCOptions controls which jobs GCJobs collects
+type GCOptions struct {
+	// DeadFor is how long a job must have been dead, including jobs stopped
+	// by a user
+	DeadFor time.Duration
+	// FailedFor is how long ago the last run of a failed batch job must have ended
+	FailedFor time.Duration
+	// ParentIdleFor is how long a periodic or parameterized job must have
+	// gone without launching a child job. A periodic job is only idle when it
+	// is also disabled or not due to launch again within this window.
+	ParentIdleFor time.Duration
+	// Now is the time ages are measured against, time.Now when zero
+	Now time.Time
+}
+
+// gcCandidate is a job to collect and why
+type gcCandidate struct {
+	reason string
+	since  time.Time
+}
+
+// gcCandidates picks the jobs to collect from the job list and the
+// allocation list. A job stopped by a user is reported as stopped before any
+// other reason applies, and only jobs past their threshold are returned.
+// Periodic parents returned here are checked against their schedule by
+// periodicIdle once the full job is known.
+func gcCandidates(stubs []*nomad.JobListStub, allocs []*nomad.AllocationListStub, opts GCOptions) map[string]gcCandidate {
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	// The most recent allocation of every job
+	latestAlloc := make(map[string]*nomad.AllocationListStub)
+	for _, alloc := range allocs {
+		if latest, ok := latestAlloc[alloc.JobID]; !ok || alloc.ModifyTime > latest.ModifyTime {
+			latestAlloc[alloc.JobID] = alloc
+		}
+	}
+
+	// The most recent child launched by every periodic or parameterized job
+	// and the parents with a child still pending or running
+	latestChild := make(map[string]int64)
+	activeChild := make(map[string]bool)
+	for _, stub := range stubs {
+		if stub.ParentID == "" {
+			continue
+		}
+		if stub.SubmitTime > latestChild[stub.ParentID] {
+			latestChild[stub.ParentID] = stub.SubmitTime
+		}
+		if stub.Status != "dead" {
+			activeChild[stub.ParentID] = true
+		}
+	}
+
+	candidates := make(map[string]gcCandidate)
+	for _, stub := range stubs {
+		// Dead since the job was stopped or its last allocation ended
+		since := time.Unix(0, stub.SubmitTime)
+		alloc := latestAlloc[stub.ID]
+		if alloc != nil && alloc.ModifyTime > stub.SubmitTime {
+			since = time.Unix(0, alloc.ModifyTime)
+		}
+
+		switch {
+		case stub.Status == "dead" && stub.Stop && now.Sub(since) >= opts.DeadFor:
+			candidates[stub.ID] = gcCandidate{GCStopped, since}
+		case stub.Type == "batch" && alloc != nil && alloc.ClientStatus == "failed" && stub.Status != "running" &&
+			now.Sub(since) >= opts.FailedFor:
+			candidates[stub.ID] = gcCandidate{GCFailed, since}
+		case stub.Status == "dead" && now.Sub(since) >= opts.DeadFor:
+			candidates[stub.ID] = gcCandidate{GCDead, since}
+		case (stub.Periodic || stub.ParameterizedJob) && stub.ParentID == "" && !stub.Stop && !activeChild[stub.ID]:
+			lastChild := time.Unix(0, stub.SubmitTime)
+			if child, ok := latestChild[stub.ID]; ok && child > stub.SubmitTime {
+				lastChild = time.Unix(0, child)
+			}
+			if now.Sub(lastChild) >= opts.ParentIdleFor {
+				candidates[stub.ID] = gcCandidate{GCIdleParent, lastChild}
+			}
+		}
+	}
+	return candidates
+}
+
+// periodicIdle reports whether a periodic job is idle: disabled, or not due
+// to launch again within the window. Nomad garbage collects dead child jobs
+// after a few hours, so a missing child says nothing about a periodic job
+// that still fires on schedule. A schedule that cannot be evaluated is never
+// idle.
+func periodicIdle(job *nomad.Job, now time.Time, window time.Duration) bool {
+	periodic := job.Periodic
+	if periodic == nil || periodic.Spec == nil || periodic.SpecType == nil {
+		return false
+	}
+	if periodic.Enabled != nil && !*periodic.Enabled {
+		return true
+	}
+	loc, err := periodic.GetLocation()
+	if err != nil {
+		return false
+	}
+	next, err := periodic.Next(now.In(loc))
+	if err != nil {
+		return false
+	}
+	return next.IsZero() || next.Sub(now) > window
+}
+
+// GCJobs purges stale jobs: jobs dead for longer than opts.DeadFor, batch
+// jobs whose last run failed longer than opts.FailedFor ago, periodic and
+// parameterized jobs without a child job for opts.ParentIdleFor, periodic
+// jobs only when disabled or not due within that window, and jobs stopped
+// but never purged once they have been dead for opts.DeadFor too. Jobs with custodian-ignore set or not selected by
+// n.Selector are skipped and every job is saved to a delete batch before it is purged.
+func (n *NomadHelper) GCJobs(ctx context.Context, opts GCOptions, force bool, verbose bool) *Report {
+	var output []string
+	var jobsSkipped []string
+	var batch *DeleteBatch
+
+	report := NewReport("gc", force)
+	defer report.Finish()
+
+	stubs, err := n.Inventory().Stubs()
+	var allocs []*nomad.AllocationListStub
+	if err == nil {
+		allocs, _, err = n.Client.Allocations().List(nil)
+	}
+	if err != nil {
+		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "gc", Status: StatusFailed, Error: err.Error()})
+		n.writeFailures(report)
+		return report
+	}
+
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	candidates := gcCandidates(stubs, allocs, opts)
+	if verbose {
+		n.Logger.Infof("Number of jobs to collect: %d\n", len(candidates))
+	}
+
+	items, err := n.Inventory().Jobs(ctx, func(stub *nomad.JobListStub) bool {
+		_, ok := candidates[stub.ID]
+		return ok
+	})
+	if err != nil {
+		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "gc", Status: StatusFailed, Error: err.Error()})
+		n.writeFailures(report)
+		return report
+	}
+
+	output = append(output, "Job|Type|Reason|Since")
+	jobs := n.Client.Jobs()
+	for _, item := range items {
+		jobStub := item.Stub
+		candidate, ok := candidates[jobStub.ID]
+		if !ok {
+			continue
+		}
+		if n.cancelled(ctx, report, jobStub, "gc") {
+			continue
+		}
+		if reason, detail, skip := n.Selector.Skip(jobStub.Name); skip {
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "gc", reason, detail))
+			continue
+		}
+		if item.Err != nil {
+			n.failed(report, jobStub, "gc", item.Err)
+			continue
+		}
+		jobInfo := item.Job
+		if candidate.reason == GCIdleParent && jobInfo.IsPeriodic() && !periodicIdle(jobInfo, now, opts.ParentIdleFor) {
+			continue
+		}
+
+		custodianIgnore, err := strconv.ParseBool(jobInfo.Meta["custodian-ignore"])
+		if err != nil && jobInfo.Meta["custodian-ignore"] != "" {
+			n.Logger.Error(err)
+		}
+		if custodianIgnore {
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "gc", SkipIgnoredMeta, candidate.reason))
+			continue
+		}
+
+		output = append(output, fmt.Sprintf("%s|%s|%s|%s", jobStub.Name, jobStub.Type, candidate.reason,
+			candidate.since.Format(time.RFC3339)))
+		if !force {
+			report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: "gc", Status: StatusPlanned, Detail: candidate.reason})
+			continue
+		}
+
+		if !n.approved(ctx, report, jobStub, "gc") {
+			continue
+		}
+		if batch, err = n.saveBeforeDelete(batch, true, jobInfo); err != nil {
+			n.failed(report, jobStub, "gc", err)
+			continue
+		}
+
+		_, _, err = jobs.Deregister(jobStub.ID, true, nil)
+		n.Inventory().Invalidate(jobStub.ID)
+		if err != nil {
+			n.Logger.Error(err)
+		}
+		result := n.applyResult(jobInfo, "gc", err)
+		result.Detail = candidate.reason
+		report.Add(result)
+	}
+
+	if len(output) == 1 {
+		output = append(output, "None")
+	}
+	fmt.Fprintf(n.out(), "%s\n\n", columnize.SimpleFormat(output))
+
+	output = []string{"Jobs Skipped|Reason|Detail"}
+	if len(jobsSkipped) == 0 {
+		output = append(output, "None")
+	} else {
+		output = append(output, jobsSkipped...)
+	}
+	fmt.Fprintf(n.out(), "%s\n", columnize.SimpleFormat(output))
+	n.writeFailures(report)
+	n.writeSkipReasons(report)
+	if batch != nil {
+		fmt.Fprintf(n.out(), "Purged jobs were saved as batch %s. Restore them with: nomad-custodian undelete %s\n",
+			batch.ID, batch.ID)
+	}
+	return report
+}
@@ -0,0 +1,349 @@
+package nomadhelper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/template"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/ryanuber/columnize"
+)
+
+// idleStatePath keeps the time each job was first seen idle across runs
+var idleStatePath = filepath.Join(BackupDir, "idle.json")
+
+// IdleOptions controls how DetectIdleJobs decides a job is idle
+type IdleOptions struct {
+	// CPUThreshold is the CPU in MHz every task must stay at or below
+	CPUThreshold float64
+	// IdleFor is how long a job must have been seen idle before it is scaled in
+	IdleFor time.Duration
+	// Prometheus replaces the CPU check with a query when set
+	Prometheus *PrometheusQuery
+	// Now is the time idle periods are measured against, time.Now when zero
+	Now time.Time
+}
+
+// PrometheusQuery decides a job is idle when the query returns a value at
+// or below Threshold. A query without samples leaves the job unknown. Query is a text/template executed
+// with the job, e.g. sum(rate(http_requests_total{service="{{.ID}}"}[6h])).
+type PrometheusQuery struct {
+	URL       string
+	Query     string
+	Threshold float64
+	Client    *http.Client
+}
+
+// prometheusResponse is the part of a Prometheus instant query response
+// that is used
+type prometheusResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Value []interface{} `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// jobTemplateData is what the query template is executed with
+type jobTemplateData struct {
+	ID        string
+	Name      string
+	Namespace string
+}
+
+// Value runs the query for a job and returns the sum of the returned
+// samples. ok is false when the query returned no samples.
+func (p *PrometheusQuery) Value(job *nomad.Job) (value float64, ok bool, err error) {
+	tmpl, err := template.New("query").Parse(p.Query)
+	if err != nil {
+		return 0, false, fmt.Errorf("prometheus query: %v", err)
+	}
+	data := jobTemplateData{ID: *job.ID, Name: *job.Name}
+	if job.Namespace != nil {
+		data.Namespace = *job.Namespace
+	}
+	var query bytes.Buffer
+	if err := tmpl.Execute(&query, data); err != nil {
+		return 0, false, fmt.Errorf("prometheus query: %v", err)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Get(p.URL + "/api/v1/query?" + url.Values{"query": {query.String()}}.Encode())
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var result prometheusResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return 0, false, fmt.Errorf("prometheus returned %s: %s", resp.Status, body)
+	}
+	if result.Status != "success" {
+		return 0, false, fmt.Errorf("prometheus query failed: %s", result.Error)
+	}
+	if result.Data.ResultType != "vector" {
+		return 0, false, fmt.Errorf("prometheus query returned a %s, expected a vector", result.Data.ResultType)
+	}
+	for _, sample := range result.Data.Result {
+		if len(sample.Value) != 2 {
+			return 0, false, fmt.Errorf("prometheus returned an invalid sample %v", sample.Value)
+		}
+		s, _ := sample.Value[1].(string)
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("prometheus returned an invalid value %q", s)
+		}
+		value += v
+		ok = true
+	}
+	return value, ok, nil
+}
+
+// readIdleState loads the time every job was first seen idle, per cluster
+// address, region and namespace
+func readIdleState() (map[string]map[string]time.Time, error) {
+	state := make(map[string]map[string]time.Time)
+	data, err := ioutil.ReadFile(idleStatePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("%s: %v", idleStatePath, err)
+	}
+	return state, nil
+}
+
+// writeIdleState saves the state loaded with readIdleState
+func writeIdleState(state map[string]map[string]time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(idleStatePath), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(idleStatePath, data, 0644)
+}
+
+// allTaskGroupsScaledIn reports whether every task group already runs at
+// count=1 or less
+func allTaskGroupsScaledIn(job *nomad.Job) bool {
+	for _, taskGroup := range job.TaskGroups {
+		if currentCount(taskGroup) > 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// DetectIdleJobs finds running service jobs that are idle and scales them in
+// like ScaleInJobs, so ScaleOutJobs restores them. By default a job is idle
+// when no task of its running allocations uses more than opts.CPUThreshold,
+// and it is scaled in once it has been seen idle on every run for
+// opts.IdleFor. The time a job was first seen idle is kept in
+// jobs-backup/idle.json. With opts.Prometheus set the query decides instead
+// of CPU usage, with the same opts.IdleFor wait. A job whose usage or query
+// result is missing is unknown and never scaled in. Jobs with custodian-ignore set are skipped.
+func (n *NomadHelper) DetectIdleJobs(ctx context.Context, opts IdleOptions, force bool, verbose bool) *Report {
+	var output []string
+	var jobsSkipped []string
+
+	report := NewReport("idle", force)
+	defer report.Finish()
+
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	key := n.localStateKey(true)
+
+	items, err := n.Inventory().Jobs(ctx, func(stub *nomad.JobListStub) bool {
+		return stub.Status == "running" && stub.Type == "service"
+	})
+	var state map[string]map[string]time.Time
+	if err == nil {
+		state, err = readIdleState()
+	}
+	var allocStubs []*nomad.AllocationListStub
+	if err == nil && opts.Prometheus == nil {
+		allocStubs, _, err = n.Client.Allocations().List(nil)
+	}
+	if err != nil {
+		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "scale-in", Status: StatusFailed, Error: err.Error()})
+		n.writeFailures(report)
+		return report
+	}
+	// Jobs that are not idle any more, or were removed, are left out
+	previous := state[key]
+	idleSince := make(map[string]time.Time)
+	state[key] = idleSince
+
+	if verbose {
+		n.Logger.Infof("Number of jobs: %d\n", len(items))
+	}
+
+	output = append(output, "Job|Signal|Idle Since|State")
+	for _, item := range items {
+		jobStub := item.Stub
+		if item.Job == nil && item.Err == nil {
+			continue
+		}
+		if reason, detail, skip := n.Selector.Skip(jobStub.Name); skip {
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "scale-in", reason, detail))
+			continue
+		}
+		if n.cancelled(ctx, report, jobStub, "scale-in") || item.Err != nil {
+			if since, ok := previous[jobStub.ID]; ok {
+				idleSince[jobStub.ID] = since
+			}
+			if item.Err != nil {
+				n.failed(report, jobStub, "scale-in", item.Err)
+			}
+			continue
+		}
+		jobInfo := item.Job
+
+		custodianIgnore, err := strconv.ParseBool(jobInfo.Meta["custodian-ignore"])
+		if err != nil && jobInfo.Meta["custodian-ignore"] != "" {
+			n.Logger.Error(err)
+		}
+		state, _, err := n.loadState(jobInfo)
+		if err != nil {
+			n.failed(report, jobStub, "scale-in", err)
+			continue
+		}
+		switch {
+		case custodianIgnore:
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "scale-in", SkipIgnoredMeta, "custodian-ignore"))
+			continue
+		case state.ScaledIn():
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "scale-in", SkipScaledIn, ""))
+			continue
+		case allTaskGroupsScaledIn(jobInfo):
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "scale-in", SkipScaledIn, "count=1"))
+			continue
+		}
+
+		// Decide whether the job is idle right now
+		var idle bool
+		var signal string
+		if opts.Prometheus != nil {
+			value, ok, err := opts.Prometheus.Value(jobInfo)
+			if err != nil {
+				n.failed(report, jobStub, "scale-in", err)
+				continue
+			}
+			if !ok {
+				// No samples is a broken query or a scrape gap, not a job without traffic
+				output = append(output, fmt.Sprintf("%s|no data|-|unknown", jobStub.Name))
+				continue
+			}
+			idle = value <= opts.Prometheus.Threshold
+			signal = fmt.Sprintf("%g", value)
+		} else {
+			var allocs []*nomad.Allocation
+			var errs []error
+			for _, stub := range allocStubs {
+				if stub.JobID != jobStub.ID || stub.ClientStatus != "running" {
+					continue
+				}
+				alloc, _, err := n.Client.Allocations().Info(stub.ID, nil)
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				allocs = append(allocs, alloc)
+			}
+			usage, sampleErrs := n.sampleUsage(ctx, allocs, RightsizeOptions{})
+			errs = append(errs, sampleErrs...)
+			if len(errs) > 0 || len(usage) == 0 {
+				// Without the usage of every allocation the job is not known to be idle
+				for _, err := range errs {
+					n.Logger.Error(err)
+				}
+				output = append(output, fmt.Sprintf("%s|no usage|-|unknown", jobStub.Name))
+				continue
+			}
+			var peak float64
+			unmeasured := false
+			for _, u := range usage {
+				if u.cpuSamples == 0 {
+					unmeasured = true
+				}
+				if u.peakCPU > peak {
+					peak = u.peakCPU
+				}
+			}
+			if unmeasured {
+				// A task without CPU stats is not a task without CPU usage
+				output = append(output, fmt.Sprintf("%s|cpu unmeasured|-|unknown", jobStub.Name))
+				continue
+			}
+			idle = peak <= opts.CPUThreshold
+			signal = fmt.Sprintf("cpu %.1f MHz", peak)
+		}
+
+		if !idle {
+			output = append(output, fmt.Sprintf("%s|%s|-|busy", jobStub.Name, signal))
+			continue
+		}
+
+		since, seen := previous[jobStub.ID]
+		if !seen {
+			since = now
+		}
+		idleSince[jobStub.ID] = since
+		if now.Sub(since) < opts.IdleFor {
+			output = append(output, fmt.Sprintf("%s|%s|%s|idle, scale in after %s", jobStub.Name, signal,
+				since.UTC().Format(time.RFC3339), since.Add(opts.IdleFor).UTC().Format(time.RFC3339)))
+			continue
+		}
+
+		output = append(output, fmt.Sprintf("%s|%s|%s|idle", jobStub.Name, signal, since.UTC().Format(time.RFC3339)))
+		if n.planOrApplyState(ctx, report, jobStub, "scale-in", jobInfo, scaleInState(jobInfo), force) && force {
+			delete(idleSince, jobStub.ID)
+		}
+	}
+
+	if err := writeIdleState(state); err != nil {
+		n.Logger.Error(err)
+	}
+
+	if len(output) == 1 {
+		output = append(output, "None")
+	}
+	fmt.Fprintf(n.out(), "%s\n\n", columnize.SimpleFormat(output))
+
+	output = []string{"Jobs Skipped|Reason|Detail"}
+	if len(jobsSkipped) == 0 {
+		output = append(output, "None")
+	} else {
+		output = append(output, jobsSkipped...)
+	}
+	fmt.Fprintf(n.out(), "%s\n", columnize.SimpleFormat(output))
+	n.writeFailures(report)
+	n.writeSkipReasons(report)
+	return report
+}
@@ -0,0 +1,152 @@
+package nomadhelper
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+// DefaultConcurrency is the number of job details fetched in parallel when
+// no concurrency is configured
+const DefaultConcurrency = 8
+
+// InventoryItem is a job from the inventory. Job is nil when Err is set.
+type InventoryItem struct {
+	Stub *nomad.JobListStub
+	Job  *nomad.Job
+	Err  error
+}
+
+// StubFilter decides from the list stub alone whether a job's details are needed
+type StubFilter func(stub *nomad.JobListStub) bool
+
+// Inventory is a snapshot of the jobs registered with Nomad, taken once per
+// run. The job list is fetched once, details are only fetched for jobs that
+// pass the stub filter, and both are cached so every phase of a run works on
+// the same snapshot. Jobs handed out are copies and can be modified freely.
+type Inventory struct {
+	client      NomadClient
+	concurrency int
+
+	mu    sync.Mutex
+	stubs []*nomad.JobListStub
+	jobs  map[string]*nomad.Job
+}
+
+// NewInventory returns an empty inventory. Concurrency bounds the number of
+// parallel Info calls; values below 1 use DefaultConcurrency.
+func NewInventory(client NomadClient, concurrency int) *Inventory {
+	if concurrency < 1 {
+		concurrency = DefaultConcurrency
+	}
+	return &Inventory{
+		client:      client,
+		concurrency: concurrency,
+		jobs:        make(map[string]*nomad.Job),
+	}
+}
+
+// Stubs returns the job list, fetching it on first use
+func (i *Inventory) Stubs() ([]*nomad.JobListStub, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.stubs != nil {
+		return i.stubs, nil
+	}
+	stubs, _, err := i.client.Jobs().List(nil)
+	if err != nil {
+		return nil, err
+	}
+	if stubs == nil {
+		stubs = make([]*nomad.JobListStub, 0)
+	}
+	i.stubs = stubs
+	return stubs, nil
+}
+
+// Job returns the details of a single job, fetching them on first use
+func (i *Inventory) Job(id string) (*nomad.Job, error) {
+	i.mu.Lock()
+	job, ok := i.jobs[id]
+	i.mu.Unlock()
+	if ok {
+		return copyJob(job), nil
+	}
+
+	job, _, err := i.client.Jobs().Info(id, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	i.mu.Lock()
+	i.jobs[id] = job
+	i.mu.Unlock()
+	return copyJob(job), nil
+}
+
+// Jobs returns an item for every stub in list order. Details are fetched
+// concurrently for the stubs passing the filter; a nil filter passes all.
+// Stubs rejected by the filter are returned without a Job. Once ctx is done
+// no further details are fetched and the remaining items carry ctx.Err().
+func (i *Inventory) Jobs(ctx context.Context, filter StubFilter) ([]InventoryItem, error) {
+	stubs, err := i.Stubs()
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]InventoryItem, len(stubs))
+	sem := make(chan struct{}, i.concurrency)
+	var wg sync.WaitGroup
+	for idx, stub := range stubs {
+		items[idx].Stub = stub
+		if filter != nil && !filter(stub) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(item *InventoryItem) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if err := ctx.Err(); err != nil {
+				item.Err = err
+				return
+			}
+			item.Job, item.Err = i.Job(item.Stub.ID)
+		}(&items[idx])
+	}
+	wg.Wait()
+	return items, nil
+}
+
+// Invalidate drops a job changed during the run from the snapshot. The job
+// list is fetched again on next use since the job's status may have changed.
+func (i *Inventory) Invalidate(id string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	delete(i.jobs, id)
+	i.stubs = nil
+}
+
+// Running is a StubFilter passing jobs with status running
+func Running(stub *nomad.JobListStub) bool {
+	return stub.Status == "running"
+}
+
+// copyJob returns a deep copy of a job
+func copyJob(job *nomad.Job) *nomad.Job {
+	data, err := json.Marshal(job)
+	if err != nil {
+		panic(err)
+	}
+	copied := new(nomad.Job)
+	if err := json.Unmarshal(data, copied); err != nil {
+		panic(err)
+	}
+	return copied
+}
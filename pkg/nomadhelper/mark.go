@@ -0,0 +1,239 @@
+package nomadhelper
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/ryanuber/columnize"
+)
+
+// MarkedForMetaKey marks a job for an action once a grace period is over,
+// e.g. stop@2026-10-25
+const MarkedForMetaKey = "custodian-marked-for"
+
+// Actions a job can be marked for
+const (
+	MarkScaleIn = "scale-in"
+	MarkStop    = "stop"
+	MarkPurge   = "purge"
+)
+
+// markDateFormat is used for marks due at midnight UTC
+const markDateFormat = "2006-01-02"
+
+// Mark is an action custodian takes on a job on the first run after At
+type Mark struct {
+	Action string
+	At     time.Time
+}
+
+// ParseMark parses a custodian-marked-for value of the form action@time,
+// where time is a date such as 2026-10-25 (midnight UTC) or an RFC 3339 time
+func ParseMark(value string) (Mark, error) {
+	i := strings.LastIndex(value, "@")
+	if i < 0 {
+		return Mark{}, fmt.Errorf("invalid %s %q, expected action@time", MarkedForMetaKey, value)
+	}
+	mark := Mark{Action: value[:i]}
+	switch mark.Action {
+	case MarkScaleIn, MarkStop, MarkPurge:
+	default:
+		return Mark{}, fmt.Errorf("invalid %s %q, unknown action %q", MarkedForMetaKey, value, mark.Action)
+	}
+	at, err := time.Parse(markDateFormat, value[i+1:])
+	if err != nil {
+		at, err = time.Parse(time.RFC3339, value[i+1:])
+	}
+	if err != nil {
+		return Mark{}, fmt.Errorf("invalid %s %q, expected a date or an RFC 3339 time", MarkedForMetaKey, value)
+	}
+	mark.At = at
+	return mark, nil
+}
+
+// String formats the mark as a custodian-marked-for value
+func (m Mark) String() string {
+	at := m.At.UTC()
+	if at.Equal(at.Truncate(24 * time.Hour)) {
+		return fmt.Sprintf("%s@%s", m.Action, at.Format(markDateFormat))
+	}
+	return fmt.Sprintf("%s@%s", m.Action, at.Format(time.RFC3339))
+}
+
+// JobMark returns the mark of a job. ok is false for jobs without one.
+func JobMark(job *nomad.Job) (mark Mark, ok bool, err error) {
+	value := job.Meta[MarkedForMetaKey]
+	if value == "" {
+		return Mark{}, false, nil
+	}
+	mark, err = ParseMark(value)
+	return mark, err == nil, err
+}
+
+// actOnMark carries out the action a job was marked for, or plans it when
+// force is not set. The mark is removed from the job first so a scaled in
+// job, or a stopped job restored with undelete, is not acted on again. Jobs
+// that are stopped or purged are saved to the run's delete batch, which is
+// returned.
+func (n *NomadHelper) actOnMark(ctx context.Context, report *Report, jobStub *nomad.JobListStub, job *nomad.Job,
+	mark Mark, batch *DeleteBatch, force bool) *DeleteBatch {
+	delete(job.Meta, MarkedForMetaKey)
+
+	if mark.Action == MarkScaleIn {
+		state, _, err := n.loadState(job)
+		if err != nil {
+			n.failed(report, jobStub, mark.Action, err)
+			return batch
+		}
+		if state.ScaledIn() {
+			state = nil
+		} else {
+			state = scaleInState(job)
+		}
+		n.planOrApplyState(ctx, report, jobStub, mark.Action, job, state, force)
+		return batch
+	}
+
+	purge := mark.Action == MarkPurge
+	if !force {
+		report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: mark.Action, Status: StatusPlanned, Detail: mark.String()})
+		return batch
+	}
+	if !n.approved(ctx, report, jobStub, mark.Action) {
+		return batch
+	}
+	var err error
+	if batch, err = n.saveBeforeDelete(batch, purge, job); err != nil {
+		n.failed(report, jobStub, mark.Action, err)
+		return batch
+	}
+	_, _, err = n.Client.Jobs().Deregister(jobStub.ID, purge, nil)
+	n.Inventory().Invalidate(jobStub.ID)
+	if err != nil {
+		n.Logger.Error(err)
+	}
+	result := n.applyResult(job, mark.Action, err)
+	result.Detail = mark.String()
+	report.Add(result)
+	return batch
+}
+
+// markedJob is a job with a mark
+type markedJob struct {
+	stub *nomad.JobListStub
+	job  *nomad.Job
+	mark Mark
+}
+
+// ProcessMarks lists every job with custodian-marked-for meta, warns about
+// the jobs whose mark is not due yet and scales in, stops or purges the jobs
+// whose mark is due as of now, time.Now when zero. Jobs with
+// custodian-ignore set or not selected by n.Selector are skipped.
+func (n *NomadHelper) ProcessMarks(ctx context.Context, now time.Time, force bool, verbose bool) *Report {
+	var output []string
+	var jobsSkipped []string
+	var batch *DeleteBatch
+
+	report := NewReport("marked", force)
+	defer report.Finish()
+
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	items, err := n.Inventory().Jobs(ctx, func(stub *nomad.JobListStub) bool {
+		return stub.ParentID == "" && stub.Status != "dead"
+	})
+	if err != nil {
+		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "marked", Status: StatusFailed, Error: err.Error()})
+		n.writeFailures(report)
+		return report
+	}
+
+	var marked []markedJob
+	for _, item := range items {
+		if item.Job == nil && item.Err == nil {
+			continue
+		}
+		if item.Err != nil {
+			n.failed(report, item.Stub, "marked", item.Err)
+			continue
+		}
+		mark, ok, err := JobMark(item.Job)
+		if err != nil {
+			n.failed(report, item.Stub, "marked", err)
+			continue
+		}
+		if ok {
+			marked = append(marked, markedJob{stub: item.Stub, job: item.Job, mark: mark})
+		}
+	}
+	sort.SliceStable(marked, func(i, j int) bool {
+		return marked[i].mark.At.Before(marked[j].mark.At)
+	})
+
+	if verbose {
+		n.Logger.Infof("Number of marked jobs: %d\n", len(marked))
+	}
+
+	output = append(output, "Job|Status|Marked For|Due|State")
+	for _, m := range marked {
+		jobStub, jobInfo := m.stub, m.job
+		if n.cancelled(ctx, report, jobStub, m.mark.Action) {
+			continue
+		}
+		if reason, detail, skip := n.Selector.Skip(jobStub.Name); skip {
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, m.mark.Action, reason, detail))
+			continue
+		}
+
+		custodianIgnore, err := strconv.ParseBool(jobInfo.Meta["custodian-ignore"])
+		if err != nil && jobInfo.Meta["custodian-ignore"] != "" {
+			n.Logger.Error(err)
+		}
+		due := m.mark.At.UTC().Format(time.RFC3339)
+
+		if now.Before(m.mark.At) {
+			output = append(output, fmt.Sprintf("%s|%s|%s|%s|due in %s", jobStub.Name, jobStub.Status, m.mark.Action, due,
+				formatRemaining(m.mark.At.Sub(now))))
+			if !custodianIgnore {
+				report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: m.mark.Action, Status: StatusWarned,
+					Detail: fmt.Sprintf("%s at %s", m.mark.Action, due)})
+			}
+			continue
+		}
+
+		output = append(output, fmt.Sprintf("%s|%s|%s|%s|due", jobStub.Name, jobStub.Status, m.mark.Action, due))
+		if custodianIgnore {
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, m.mark.Action, SkipIgnoredMeta, m.mark.String()))
+			continue
+		}
+		batch = n.actOnMark(ctx, report, jobStub, jobInfo, m.mark, batch, force)
+	}
+
+	if len(output) == 1 {
+		output = append(output, "None")
+	}
+	fmt.Fprintf(n.out(), "%s\n\n", columnize.SimpleFormat(output))
+
+	output = []string{"Jobs Skipped|Reason|Detail"}
+	if len(jobsSkipped) == 0 {
+		output = append(output, "None")
+	} else {
+		output = append(output, jobsSkipped...)
+	}
+	fmt.Fprintf(n.out(), "%s\n", columnize.SimpleFormat(output))
+	n.writeFailures(report)
+	n.writeSkipReasons(report)
+	if batch != nil {
+		fmt.Fprintf(n.out(), "Stopped and purged jobs were saved as batch %s. Restore them with: nomad-custodian undelete %s\n",
+			batch.ID, batch.ID)
+	}
+	return report
+}
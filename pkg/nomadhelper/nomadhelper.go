@@ -1,9 +1,10 @@
 package nomadhelper
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -19,9 +20,51 @@ import (
 
 // NomadHelper provides custodian helper functions
 type NomadHelper struct {
-	Client *nomad.Client
+	Client NomadClient
 	Config *nomad.Config
 	Logger *zap.SugaredLogger
+	Out    io.Writer
+
+	// Retry is applied to every Nomad API call made through Client. The
+	// DefaultRetryPolicy is used when it is not set before InitConfig.
+	Retry RetryPolicy
+
+	// Concurrency bounds the number of job details fetched in parallel
+	Concurrency int
+
+	// Plan collects the planned changes of scale-in and scale-out runs
+	// without --force so they can be saved and applied later
+	Plan *PlanFile
+
+	// Approver asks for approval of every job change when set
+	Approver *Approver
+
+	// Selector limits the jobs ScaleInJobs, ScaleOutJobs, DetectIdleJobs and
+	// DeleteAllJobs change by name
+	Selector JobSelector
+
+	// PausePeriodic disables periodic jobs when ScaleInJobs scales them in,
+	// so they stop launching until ScaleOutJobs restores them
+	PausePeriodic bool
+
+	// SystemConstraint is added to system jobs by ScaleInJobs so they run on
+	// fewer nodes off-hours. System jobs are skipped when it is nil.
+	SystemConstraint *nomad.Constraint
+
+	// NativeScale makes ScaleInJobs and ScaleOutJobs change task group counts
+	// through the scale endpoint instead of registering the job. The original
+	// counts are kept in the scaling events rather than the job meta.
+	NativeScale bool
+
+	// State keeps the original counts, revert version and action of scaled
+	// in jobs. The job meta is used when it is nil.
+	State StateStore
+
+	// Target names the context and region the helper runs against when a
+	// command runs against several of them, e.g. prod/us-east
+	Target string
+
+	inventory *Inventory
 }
 
 // ScaleType specifies scaling in or out
@@ -74,14 +117,68 @@ func (n *NomadHelper) InitConfig(config *nomad.Config) {
 		logger.Info("Nomad config is nil. Using default config instead.")
 		n.Config = nomad.DefaultConfig()
 	}
-	n.Client, err = nomad.NewClient(n.Config)
+	client, err := nomad.NewClient(n.Config)
 	if err != nil {
 		logger.Panic(err.Error())
 	}
+	if n.Retry.Attempts == 0 {
+		n.Retry = DefaultRetryPolicy
+	}
+	n.Client = NewRetryClient(NewClient(client), n.Retry, n.Logger)
+}
+
+// BindContext stops the backoff between retries of Client when ctx is done,
+// so an interrupted or timed out run does not wait for the next attempt
+func (n *NomadHelper) BindContext(ctx context.Context) {
+	if c, ok := n.Client.(*retryClient); ok {
+		n.Client = c.withContext(ctx)
+	}
+}
+
+// Inventory returns the job snapshot shared by every phase of the run
+func (n *NomadHelper) Inventory() *Inventory {
+	if n.inventory == nil {
+		n.inventory = NewInventory(n.Client, n.Concurrency)
+	}
+	return n.inventory
+}
+
+// out returns the writer command output is printed to
+func (n *NomadHelper) out() io.Writer {
+	if n.Out == nil {
+		return os.Stdout
+	}
+	return n.Out
+}
+
+// localStateKey returns the key the local state files keep the state of the
+// target under: the address, with the region and, when withNamespace is
+// set, the namespace added so targets sharing an address keep their own
+// state, e.g. http://127.0.0.1:4646?region=eu
+func (n *NomadHelper) localStateKey(withNamespace bool) string {
+	if n.Config == nil {
+		return ""
+	}
+	query := url.Values{}
+	if n.Config.Region != "" {
+		query.Set("region", n.Config.Region)
+	}
+	if withNamespace && n.Config.Namespace != "" {
+		query.Set("namespace", n.Config.Namespace)
+	}
+	if len(query) == 0 {
+		return n.Config.Address
+	}
+	return n.Config.Address + "?" + query.Encode()
 }
 
 // DisplayJobDiff prints the simplified diff between job versions
 func DisplayJobDiff(diff nomad.JobDiff) {
+	FprintJobDiff(os.Stdout, diff)
+}
+
+// FprintJobDiff writes the simplified diff between job versions to w
+func FprintJobDiff(w io.Writer, diff nomad.JobDiff) {
 	var output []string
 
 	// Display job plan diff
@@ -97,38 +194,59 @@ func DisplayJobDiff(diff nomad.JobDiff) {
 		}
 	}
 	for _, object := range diff.Objects {
-		fmt.Printf(object.Name, "\n")
+		fmt.Fprintf(w, "%s\n", object.Name)
 	}
 	result := columnize.SimpleFormat(output)
-	fmt.Printf("%s\n\n", result)
+	fmt.Fprintf(w, "%s\n\n", result)
 }
 
-// ScaleInJobs scales all jobs in to count=1
-func (n *NomadHelper) ScaleInJobs(force bool, verbose bool) {
+// ScaleInJobs scales all jobs in to count=1. Once ctx is done no further jobs
+// are changed, changes already dispatched are waited for and the remaining
+// jobs are reported as cancelled.
+func (n *NomadHelper) ScaleInJobs(ctx context.Context, force bool, verbose bool) *Report {
 	var output []string
 	var jobsSkipped []string
 	var wg sync.WaitGroup
 
+	report := NewReport("scale-in", force)
+	defer report.Finish()
+
 	if !force && verbose {
 		n.Logger.Info("Running a plan scale down action.")
 	}
 
 	jobs := n.Client.Jobs()
-	jobStubList, _, err := jobs.List(nil)
+	items, err := n.Inventory().Jobs(ctx, Running)
 	if err != nil {
 		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "scale-in", Status: StatusFailed, Error: err.Error()})
+		return report
 	}
 
 	if verbose {
-		n.Logger.Info("Number of jobs running: %d\n", len(jobStubList))
+		n.Logger.Infof("Number of jobs: %d\n", len(items))
 	}
 
-	for _, jobStub := range jobStubList {
+	for _, item := range items {
+		jobStub := item.Stub
+		if n.cancelled(ctx, report, jobStub, "scale-in") {
+			continue
+		}
+		if reason, detail, skip := n.Selector.Skip(jobStub.Name); skip {
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "scale-in", reason, detail))
+			continue
+		}
+		if item.Job == nil && item.Err == nil {
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "scale-in", SkipNotRunning, jobStub.Status))
+			continue
+		}
+
 		// Get the jobs object
-		jobInfo, _, err := jobs.Info(jobStub.ID, nil)
-		if err != nil {
-			n.Logger.Error(err)
+		if item.Err != nil {
+			n.failed(report, jobStub, "scale-in", item.Err)
+			continue
 		}
+		jobInfo := item.Job
 
 		custodianIgnore, err := strconv.ParseBool(jobInfo.Meta["custodian-ignore"])
 		if err != nil {
@@ -137,77 +255,203 @@ func (n *NomadHelper) ScaleInJobs(force bool, verbose bool) {
 			}
 		}
 
-		alreadyScaledIn := jobInfo.Meta["custodian-action"] == "scaled-in"
-		jobIsRunning := *jobInfo.Status == "running"
-		criteriaToScaleIn := !alreadyScaledIn && !custodianIgnore && jobIsRunning
-
-		if criteriaToScaleIn {
-			// Update job count
-			scaledDownJobCount := new(int)
-			*scaledDownJobCount = 1
-			for _, taskGroup := range jobInfo.TaskGroups {
-				key := fmt.Sprintf("custodian-%s-count", *taskGroup.Name)
-				jobInfo.SetMeta(key, fmt.Sprint(*taskGroup.Count))
-				taskGroup.Count = scaledDownJobCount
+		// Counts mean nothing to system and sysbatch jobs, which run on every node
+		jobType := *jobInfo.Type
+		systemJob := jobType == "system" || jobType == "sysbatch"
+
+		state, _, err := n.loadState(jobInfo)
+		if err != nil {
+			n.failed(report, jobStub, "scale-in", err)
+			continue
+		}
+		var nativeScaledIn []GroupScale
+		if n.NativeScale && !systemJob && !custodianIgnore {
+			nativeScaledIn, err = n.nativeScaledIn(jobInfo)
+			if err != nil {
+				n.failed(report, jobStub, "scale-in", err)
+				continue
 			}
-			// Update meta kv
-			jobInfo.SetMeta("custodian-action", "scaled-in")
-			jobInfo.SetMeta("custodian-revert-version", fmt.Sprint(*jobInfo.Version))
+		}
 
-		} else {
-			jobsSkipped = append(jobsSkipped, fmt.Sprintf("%s|%s|%t", *jobInfo.Name,
-				jobInfo.Meta["custodian-action"], custodianIgnore))
+		switch {
+		case custodianIgnore:
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "scale-in", SkipIgnoredMeta, "custodian-ignore"))
+			continue
+		case state.ScaledIn():
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "scale-in", SkipScaledIn, ""))
 			continue
+		case len(nativeScaledIn) > 0:
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "scale-in", SkipScaledIn, "scaling events"))
+			continue
+		case *jobInfo.Status != "running":
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "scale-in", SkipNotRunning, *jobInfo.Status))
+			continue
+		case systemJob && (jobType != "system" || n.SystemConstraint == nil):
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "scale-in", SkipWrongType, jobType+" job"))
+			continue
+		case systemJob:
+			state = constrainSystemJob(jobInfo, n.SystemConstraint)
+		default:
+			// Pausing a periodic job changes its spec, so it is always registered
+			paused := n.PausePeriodic && pausePeriodic(jobInfo)
+			if n.NativeScale && !paused {
+				if changes := nativeScaleIn(jobInfo); len(changes) == 0 {
+					jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "scale-in", SkipScaledIn, "count=1"))
+				} else {
+					n.planOrScale(ctx, report, jobStub, "scale-in", jobInfo, changes, force)
+				}
+				continue
+			}
+			state = scaleInState(jobInfo)
+			if paused {
+				state.PeriodicSpec = *jobInfo.Periodic.Spec
+			}
 		}
+		n.stageState(jobInfo, state)
 
 		// Plan the change and get the response/diff
 		jobPlanResponse, _, err := jobs.Plan(jobInfo, true, nil)
 		if err != nil {
-			n.Logger.Error(err)
+			n.failed(report, jobStub, "scale-in", err)
+			continue
 		}
 		diff := *jobPlanResponse.Diff
-		n.Logger.Infof("Job: %s, %s\n", *jobInfo.Name, *jobInfo.Status)
-		DisplayJobDiff(diff)
+		fmt.Fprintf(n.out(), "Job: %s, %s\n", *jobInfo.Name, *jobInfo.Status)
+		FprintJobDiff(n.out(), diff)
 
 		if force {
+			if !n.approved(ctx, report, jobStub, "scale-in") {
+				continue
+			}
 			wg.Add(1)
-			go n.ApplyChanges(jobInfo, &wg)
+			go func(job *nomad.Job, state *ScaleState) {
+				defer wg.Done()
+				report.Add(n.applyResult(job, "scale-in", n.applyScaleIn(ctx, job, state)))
+			}(jobInfo, state)
+		} else {
+			if change := n.recordPlan("scale-in", jobInfo, *jobInfo.JobModifyIndex, &diff); change != nil {
+				change.State = state
+			}
+			report.Add(JobResult{JobID: *jobInfo.ID, Name: *jobInfo.Name, Action: "scale-in", Status: StatusPlanned})
 		}
 	}
 
-	output = append(output, "Jobs Skipped|Scale Status|Ignore")
+	wg.Wait()
+
+	output = append(output, "Jobs Skipped|Reason|Detail")
 	if len(jobsSkipped) == 0 {
 		output = append(output, "None")
 	} else {
 		output = append(output, jobsSkipped...)
 	}
 	result := columnize.SimpleFormat(output)
-	fmt.Printf("%s\n", result)
+	fmt.Fprintf(n.out(), "%s\n", result)
+	n.writeFailures(report)
+	n.writeSkipReasons(report)
+	return report
+}
 
-	wg.Wait()
+// scaleInState sets every task group count of the job to 1 and returns the
+// original counts and version for ScaleOutJobs
+func scaleInState(job *nomad.Job) *ScaleState {
+	state := &ScaleState{Action: "scaled-in", RevertVersion: uint64ToPtr(*job.Version), Counts: make(map[string]int)}
+	for _, taskGroup := range job.TaskGroups {
+		state.Counts[*taskGroup.Name] = *taskGroup.Count
+		taskGroup.Count = intToPtr(1)
+	}
+	return state
 }
 
-// ScaleOutJobs scales all jobs the original count
-func (n *NomadHelper) ScaleOutJobs(force bool, verbose bool) {
+// scaleInJob scales the job in and records the state in its meta
+func scaleInJob(job *nomad.Job) {
+	MetaStore{}.Save(job, scaleInState(job))
+}
+
+// constrainSystemJob adds the constraint to a system job so it runs on fewer
+// nodes and returns the version for ScaleOutJobs, which reverts to it
+func constrainSystemJob(job *nomad.Job, constraint *nomad.Constraint) *ScaleState {
+	job.Constrain(nomad.NewConstraint(constraint.LTarget, constraint.Operand, constraint.RTarget))
+	return &ScaleState{Action: "scaled-in", RevertVersion: uint64ToPtr(*job.Version)}
+}
+
+// ParseConstraint parses a constraint of the form "attribute operator value",
+// e.g. "${node.class} = always-on"
+func ParseConstraint(value string) (*nomad.Constraint, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid constraint %q, expected attribute, operator and value", value)
+	}
+	return nomad.NewConstraint(fields[0], fields[1], fields[2]), nil
+}
+
+// PeriodicSpecMetaKey keeps the spec of a periodic job paused by ScaleInJobs
+// when the state is kept in the job meta. ScaleOutJobs reverts to the version
+// before the pause, which restores it.
+const PeriodicSpecMetaKey = "custodian-periodic-spec"
+
+// pausePeriodic disables an enabled periodic job. It returns false for jobs
+// that are not periodic or already disabled.
+func pausePeriodic(job *nomad.Job) bool {
+	if !job.IsPeriodic() || (job.Periodic.Enabled != nil && !*job.Periodic.Enabled) || job.Periodic.Spec == nil {
+		return false
+	}
+	job.Periodic.Enabled = boolToPtr(false)
+	return true
+}
+
+// PeriodicPaused reports whether a periodic job was paused by ScaleInJobs
+// with the state kept in the job meta
+func PeriodicPaused(job *nomad.Job) bool {
+	return periodicPaused(job, job.Meta[PeriodicSpecMetaKey])
+}
+
+// periodicPaused reports whether a periodic job is disabled with the spec
+// saved by ScaleInJobs
+func periodicPaused(job *nomad.Job, savedSpec string) bool {
+	return job.IsPeriodic() && job.Periodic.Enabled != nil && !*job.Periodic.Enabled && savedSpec != ""
+}
+
+// ScaleOutJobs scales all jobs the original count. Once ctx is done no further
+// jobs are reverted and the remaining jobs are reported as cancelled.
+func (n *NomadHelper) ScaleOutJobs(ctx context.Context, force bool, verbose bool) *Report {
 	var output []string
 	var jobsSkipped []string
 
+	report := NewReport("scale-out", force)
+	defer report.Finish()
+
 	jobs := n.Client.Jobs()
-	jobStubList, _, err := jobs.List(nil)
+	items, err := n.Inventory().Jobs(ctx, Running)
 	if err != nil {
 		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "scale-out", Status: StatusFailed, Error: err.Error()})
+		return report
 	}
 
 	if verbose {
-		n.Logger.Infof("Number of jobs running: %d\n", len(jobStubList))
+		n.Logger.Infof("Number of jobs: %d\n", len(items))
 	}
 
-	for _, jobStub := range jobStubList {
+	for _, item := range items {
+		jobStub := item.Stub
+		if n.cancelled(ctx, report, jobStub, "scale-out") {
+			continue
+		}
+		if reason, detail, skip := n.Selector.Skip(jobStub.Name); skip {
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "scale-out", reason, detail))
+			continue
+		}
+		if item.Job == nil && item.Err == nil {
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "scale-out", SkipNotRunning, jobStub.Status))
+			continue
+		}
+
 		// Get the jobs object
-		jobInfo, _, err := jobs.Info(jobStub.ID, nil)
-		if err != nil {
-			n.Logger.Error(err)
+		if item.Err != nil {
+			n.failed(report, jobStub, "scale-out", item.Err)
+			continue
 		}
+		jobInfo := item.Job
 
 		custodianIgnore, err := strconv.ParseBool(jobInfo.Meta["custodian-ignore"])
 		if err != nil {
@@ -216,92 +460,234 @@ func (n *NomadHelper) ScaleOutJobs(force bool, verbose bool) {
 			}
 		}
 
-		alreadyScaledIn := jobInfo.Meta["custodian-action"] == "scaled-in"
+		state, store, err := n.loadState(jobInfo)
+		if err != nil {
+			n.failed(report, jobStub, "scale-out", err)
+			continue
+		}
+		alreadyScaledIn := state.ScaledIn()
 		jobIsRunning := *jobInfo.Status == "running"
 		criteriaToScaleOut := alreadyScaledIn && !custodianIgnore && jobIsRunning
 
+		// Jobs scaled in through the scale endpoint are found by their scaling events
+		if n.NativeScale && !alreadyScaledIn && !custodianIgnore && jobIsRunning {
+			changes, err := n.nativeScaledIn(jobInfo)
+			if err != nil {
+				n.failed(report, jobStub, "scale-out", err)
+				continue
+			}
+			if len(changes) > 0 {
+				n.planOrScale(ctx, report, jobStub, "scale-out", jobInfo, changes, force)
+				continue
+			}
+		}
+
 		// Only proceed if job was scaled in using the tooling
 		if criteriaToScaleOut {
-			// Convert to uint64 for revert function
-			previousVer, err := strconv.ParseUint(jobInfo.Meta["custodian-revert-version"], 10, 64)
-			if err != nil {
-				n.Logger.Error(err)
+			if state.RevertVersion == nil {
+				n.failed(report, jobStub, "scale-out", fmt.Errorf("no valid revert version in the %s state store", store.Name()))
+				continue
 			}
+			if err := state.Drift(jobInfo); err != nil {
+				n.failed(report, jobStub, "scale-out", fmt.Errorf("%v, not reverting to version %d", err, *state.RevertVersion))
+				continue
+			}
+			previousVer := *state.RevertVersion
 
 			includeDiffs := false
 			pastJobs, _, _, err := jobs.Versions(jobStub.ID, includeDiffs, nil)
 			if err != nil {
-				n.Logger.Error(err)
+				n.failed(report, jobStub, "scale-out", err)
+				continue
 			}
 
+			planErr := fmt.Errorf("version %d not found", previousVer)
+			var revertTo *nomad.Job
+			var diff nomad.JobDiff
 			for _, pastJob := range pastJobs {
 				if *pastJob.Version == previousVer {
 					// Plan the change and get the response/diff
-					jobPlanResponse, _, err := jobs.Plan(pastJob, true, nil)
-					if err != nil {
-						n.Logger.Error(err)
+					var jobPlanResponse *nomad.JobPlanResponse
+					jobPlanResponse, _, planErr = jobs.Plan(pastJob, true, nil)
+					if planErr != nil {
+						break
 					}
-					diff := *jobPlanResponse.Diff
-					n.Logger.Infof("Job: %s, %s\n", *jobInfo.Name, *jobInfo.Status)
-					DisplayJobDiff(diff)
+					revertTo = pastJob
+					diff = *jobPlanResponse.Diff
+					fmt.Fprintf(n.out(), "Job: %s, %s\n", *jobInfo.Name, *jobInfo.Status)
+					FprintJobDiff(n.out(), diff)
 					break
 				}
 			}
+			if planErr != nil {
+				n.failed(report, jobStub, "scale-out", planErr)
+				continue
+			}
 
 			if force {
+				if !n.approved(ctx, report, jobStub, "scale-out") {
+					continue
+				}
+
 				// Handle revert response
-				jobRegisterResponse, _, err := jobs.Revert(*jobInfo.ID, previousVer, nil, nil, "")
+				// Nomad refuses the revert when the job changed since the
+				// scaled in version was checked above
+				jobRegisterResponse, _, err := jobs.Revert(*jobInfo.ID, previousVer, state.Version, nil, "")
+				n.Inventory().Invalidate(*jobInfo.ID)
 				if err != nil {
 					n.Logger.Error(err)
+				} else {
+					if jobRegisterResponse.Warnings != "" {
+						n.Logger.Infof("Warnings: %s\n", jobRegisterResponse.Warnings)
+					}
+					err = dropState(jobInfo, store)
 				}
-				if jobRegisterResponse.Warnings != "" {
-					n.Logger.Infof("Warnings: %s\n", jobRegisterResponse.Warnings)
+				report.Add(n.applyResult(jobInfo, "scale-out", err))
+			} else {
+				if change := n.recordPlan("scale-out", revertTo, *jobInfo.JobModifyIndex, &diff); change != nil {
+					change.ClearState = true
 				}
+				report.Add(JobResult{JobID: *jobInfo.ID, Name: *jobInfo.Name, Action: "scale-out", Status: StatusPlanned})
 			}
 		} else {
-			jobsSkipped = append(jobsSkipped, fmt.Sprintf("%s|%s|%t", *jobInfo.Name,
-				jobInfo.Meta["custodian-action"], custodianIgnore))
+			reason, detail := SkipNotScaledIn, ""
+			if state != nil {
+				detail = state.Action
+			}
+			switch {
+			case custodianIgnore:
+				reason, detail = SkipIgnoredMeta, "custodian-ignore"
+			case !jobIsRunning:
+				reason, detail = SkipNotRunning, *jobInfo.Status
+			}
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "scale-out", reason, detail))
 		}
 	}
 
-	output = append(output, "Jobs Skipped|Scale Status|Ignore")
+	output = append(output, "Jobs Skipped|Reason|Detail")
 	if len(jobsSkipped) == 0 {
 		output = append(output, "None")
 	} else {
 		output = append(output, jobsSkipped...)
 	}
 	result := columnize.SimpleFormat(output)
-	fmt.Printf("%s\n", result)
+	fmt.Fprintf(n.out(), "%s\n", result)
+	n.writeFailures(report)
+	n.writeSkipReasons(report)
+	return report
 }
 
 // ApplyChanges will register the job and any changes it has with Nomad
-func (n *NomadHelper) ApplyChanges(job *nomad.Job, wg *sync.WaitGroup) {
+func (n *NomadHelper) ApplyChanges(ctx context.Context, job *nomad.Job) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	jobs := n.Client.Jobs()
 
 	// n.Logger.Infof("\nApplying changes to job %s\n", *job.Name)
 	jobRegisterResponse, _, err := jobs.Register(job, nil)
+	n.Inventory().Invalidate(*job.ID)
 	if err != nil {
 		n.Logger.Error(err)
+		return err
 	}
 	if jobRegisterResponse.Warnings != "" {
 		n.Logger.Infof("Warnings: %s\n", jobRegisterResponse.Warnings)
 	}
+	return nil
+}
 
-	wg.Done()
+// planOrApply registers a changed job when force is set and it is approved,
+// or records the change as planned otherwise. The diff is printed either way.
+// It returns false when the change could not be planned or was not approved.
+func (n *NomadHelper) planOrApply(ctx context.Context, report *Report, jobStub *nomad.JobListStub, action string,
+	job *nomad.Job, force bool) bool {
+	return n.planOrApplyState(ctx, report, jobStub, action, job, nil, force)
 }
 
-// ListJobs scales all jobs in to count=1 or out to the jobs original count
-func (n *NomadHelper) ListJobs(verbose bool, jobType string) {
-	var output []string
+// planOrApplyState is planOrApply for a job being scaled in, whose state is
+// saved to the configured state store when it is registered
+func (n *NomadHelper) planOrApplyState(ctx context.Context, report *Report, jobStub *nomad.JobListStub, action string,
+	job *nomad.Job, state *ScaleState, force bool) bool {
+	if state != nil {
+		n.stageState(job, state)
+	}
+	jobPlanResponse, _, err := n.Client.Jobs().Plan(job, true, nil)
+	if err != nil {
+		n.failed(report, jobStub, action, err)
+		return false
+	}
+	diff := *jobPlanResponse.Diff
+	fmt.Fprintf(n.out(), "Job: %s, %s\n", *job.Name, action)
+	FprintJobDiff(n.out(), diff)
+
+	if !force {
+		if change := n.recordPlan(action, job, *job.JobModifyIndex, &diff); change != nil {
+			change.State = state
+		}
+		report.Add(JobResult{JobID: *job.ID, Name: *job.Name, Action: action, Status: StatusPlanned})
+		return true
+	}
+	if !n.approved(ctx, report, jobStub, action) {
+		return false
+	}
+	if state != nil {
+		err = n.applyScaleIn(ctx, job, state)
+	} else {
+		err = n.ApplyChanges(ctx, job)
+	}
+	report.Add(n.applyResult(job, action, err))
+	return err == nil
+}
 
-	nomadConfig := nomad.DefaultConfig()
-	nomadClient, err := nomad.NewClient(nomadConfig)
+// applyResult builds the job result for an applied action
+func (n *NomadHelper) applyResult(job *nomad.Job, action string, err error) JobResult {
+	result := JobResult{JobID: *job.ID, Name: *job.Name, Action: action, Status: StatusApplied}
 	if err != nil {
-		n.Logger.Error(err)
+		result.Status = StatusFailed
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// failed records a job the action could not be carried out for. The run
+// continues with the next job.
+func (n *NomadHelper) failed(report *Report, jobStub *nomad.JobListStub, action string, err error) {
+	n.Logger.Error(err)
+	report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: action, Status: StatusFailed, Error: err.Error()})
+}
+
+// writeFailures prints the jobs that failed during the run, if any
+func (n *NomadHelper) writeFailures(report *Report) {
+	failures := report.Filter(StatusFailed)
+	if len(failures) == 0 {
+		return
+	}
+	output := []string{"Jobs Failed|Action|Error"}
+	for _, result := range failures {
+		output = append(output, fmt.Sprintf("%s|%s|%s", result.Name, result.Action, result.Error))
 	}
+	fmt.Fprintf(n.out(), "%s\n", columnize.SimpleFormat(output))
+}
+
+// cancelled records the job as unchanged and returns true once ctx is done
+func (n *NomadHelper) cancelled(ctx context.Context, report *Report, jobStub *nomad.JobListStub, action string) bool {
+	err := ctx.Err()
+	if err == nil {
+		return false
+	}
+	report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: action, Status: StatusCancelled, Error: err.Error()})
+	return true
+}
 
-	jobs := nomadClient.Jobs()
-	jobStubList, _, err := jobs.List(nil)
+// ListJobs scales all jobs in to count=1 or out to the jobs original count
+func (n *NomadHelper) ListJobs(ctx context.Context, verbose bool, jobType string) {
+	var output []string
+
+	// Only live jobs of the requested type need their details fetched
+	items, err := n.Inventory().Jobs(ctx, func(stub *nomad.JobListStub) bool {
+		return stub.Type == jobType && stub.Status != "dead"
+	})
 	if err != nil {
 		n.Logger.Error(err)
 	}
@@ -315,20 +701,22 @@ func (n *NomadHelper) ListJobs(verbose bool, jobType string) {
 	}
 
 	jobCount := 0
-	for _, jobStub := range jobStubList {
-		// Get the jobs object
-		jobInfo, _, err := jobs.Info(jobStub.ID, nil)
-		if err != nil {
-			n.Logger.Error(err)
+	for _, item := range items {
+		if ctx.Err() != nil {
+			break
 		}
-
-		if *jobInfo.Type != jobType {
+		if item.Stub.Type != jobType {
 			continue
 		}
 
 		jobCount++
 		// Display job plan diff
-		if *jobInfo.Status == "dead" {
+		if item.Err != nil {
+			n.Logger.Error(item.Err)
+			continue
+		}
+		jobInfo := item.Job
+		if jobInfo == nil {
 			continue
 		}
 		output = append(output, fmt.Sprintf("+|Job: %s|Status: %s|", *jobInfo.Name, *jobInfo.Status))
@@ -340,6 +728,13 @@ func (n *NomadHelper) ListJobs(verbose bool, jobType string) {
 		for k, v := range jobInfo.Meta {
 			output = append(output, fmt.Sprintf("|%s|%s|", k, v))
 		}
+		// State kept outside of the job meta is shown like the meta keys
+		state, store, err := n.loadState(jobInfo)
+		if err != nil {
+			n.Logger.Error(err)
+		} else if state != nil && !inMeta(store) {
+			output = append(output, stateRows(state, store)...)
+		}
 		if jobType == "batch" && jobInfo.Periodic != nil {
 			err := cd.Parse(*jobInfo.Periodic.Spec)
 			if err != nil {
@@ -349,7 +744,11 @@ func (n *NomadHelper) ListJobs(verbose bool, jobType string) {
 			if err != nil {
 				n.Logger.Error(err)
 			}
-			output = append(output, fmt.Sprintf("|%s|%s|%s|", "Periodic", *jobInfo.Periodic.Spec, *cronDescription))
+			description := *cronDescription
+			if state != nil && periodicPaused(jobInfo, state.PeriodicSpec) {
+				description += " (paused)"
+			}
+			output = append(output, fmt.Sprintf("|%s|%s|%s|", "Periodic", *jobInfo.Periodic.Spec, description))
 		}
 	}
 
@@ -361,17 +760,19 @@ func (n *NomadHelper) ListJobs(verbose bool, jobType string) {
 	if jobCount == 0 {
 		result = "No jobs present"
 	}
-	fmt.Printf("%s\n", result)
+	fmt.Fprintf(n.out(), "%s\n", result)
 }
 
-// AskForConfirmation prompts the user for confirmation before proceeding
+// AskForConfirmation prompts the user for confirmation before proceeding.
+// Anything but yes, including no input at all, declines.
 func AskForConfirmation() bool {
 	var s string
 
 	fmt.Printf("Are you sure you want to continue? (y/N): ")
 	_, err := fmt.Scan(&s)
 	if err != nil {
-		panic(err)
+		fmt.Println()
+		return false
 	}
 
 	s = strings.TrimSpace(s)
@@ -383,32 +784,50 @@ func AskForConfirmation() bool {
 	return false
 }
 
-// DeleteAllJobs deregisters all jobs currently running in Nomad
-func (n *NomadHelper) DeleteAllJobs(force bool, autoApprove bool, purge bool, verbose bool) {
+// DeleteAllJobs deregisters all jobs currently running in Nomad. Every job is
+// saved to a delete batch before it is deregistered so the run can be undone
+// with UndeleteJobs. Once ctx is done no further jobs are deregistered.
+func (n *NomadHelper) DeleteAllJobs(ctx context.Context, force bool, autoApprove bool, purge bool, verbose bool) *Report {
 	var output []string
 	var jobsSkipped []string
 	var userConfirmation bool
+	var batch *DeleteBatch
+
+	report := NewReport("delete-all-jobs", force)
+	defer report.Finish()
 
 	jobs := n.Client.Jobs()
-	jobStubList, _, err := jobs.List(nil)
+	items, err := n.Inventory().Jobs(ctx, nil)
 	if err != nil {
 		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "deregister", Status: StatusFailed, Error: err.Error()})
+		return report
 	}
 
 	if force {
-		if autoApprove {
+		if autoApprove || n.Approver != nil {
 			userConfirmation = true
 		} else {
 			userConfirmation = AskForConfirmation()
 		}
 	}
 
-	for _, jobStub := range jobStubList {
+	for _, item := range items {
+		jobStub := item.Stub
+		if n.cancelled(ctx, report, jobStub, "deregister") {
+			continue
+		}
+		if reason, detail, skip := n.Selector.Skip(jobStub.Name); skip {
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "deregister", reason, detail))
+			continue
+		}
+
 		// Get the jobs object
-		jobInfo, _, err := jobs.Info(jobStub.ID, nil)
-		if err != nil {
-			n.Logger.Error(err)
+		if item.Err != nil {
+			n.failed(report, jobStub, "deregister", item.Err)
+			continue
 		}
+		jobInfo := item.Job
 
 		custodianIgnore, err := strconv.ParseBool(jobInfo.Meta["custodian-ignore"])
 		if err != nil {
@@ -418,69 +837,114 @@ func (n *NomadHelper) DeleteAllJobs(force bool, autoApprove bool, purge bool, ve
 		}
 
 		if custodianIgnore {
-			jobsSkipped = append(jobsSkipped, fmt.Sprintf("%s|%s|%t", *jobInfo.Name,
-				jobInfo.Meta["custodian-action"], custodianIgnore))
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "deregister", SkipIgnoredMeta, "custodian-ignore"))
 			continue
 
 		} else {
 			if userConfirmation {
+				if n.Approver != nil {
+					fmt.Fprintf(n.out(), "Job: %s, %s\n", *jobInfo.Name, *jobInfo.Status)
+				}
+				if !n.approved(ctx, report, jobStub, "deregister") {
+					continue
+				}
+
+				// Never deregister a job that could not be saved first
+				if batch, err = n.saveBeforeDelete(batch, purge, jobInfo); err != nil {
+					n.failed(report, jobStub, "deregister", err)
+					continue
+				}
+
 				deregisterResponse, _, err := jobs.Deregister(jobStub.ID, purge, nil)
+				n.Inventory().Invalidate(jobStub.ID)
 				if err != nil {
 					n.Logger.Error(err)
 				}
 				n.Logger.Infof("Job %s deregister response: %s", jobStub.Name, deregisterResponse)
-
+				result := n.applyResult(jobInfo, "deregister", err)
+				result.Detail = batch.ID
+				report.Add(result)
+			} else {
+				report.Add(JobResult{JobID: *jobInfo.ID, Name: *jobInfo.Name, Action: "deregister", Status: StatusPlanned})
 			}
 			n.Logger.Infof("Action: Deregister, Job: %s\n", jobStub.Name)
 		}
 	}
 
-	output = append(output, "Jobs Skipped|Scale Status|Ignore")
+	output = append(output, "Jobs Skipped|Reason|Detail")
 	if len(jobsSkipped) == 0 {
 		output = append(output, "None")
 	} else {
 		output = append(output, jobsSkipped...)
 	}
 	result := columnize.SimpleFormat(output)
-	fmt.Printf("%s\n", result)
+	fmt.Fprintf(n.out(), "%s\n", result)
+	n.writeFailures(report)
+	n.writeSkipReasons(report)
+	if batch != nil {
+		fmt.Fprintf(n.out(), "Deleted jobs were saved as batch %s. Restore them with: nomad-custodian undelete %s\n",
+			batch.ID, batch.ID)
+	}
+	return report
 }
 
-// BackupJobs will write JSON backups of all registered job
-func (n *NomadHelper) BackupJobs() {
-	jobs := n.Client.Jobs()
-	jobStubList, _, err := jobs.List(nil)
+// BackupJobs will write JSON backups of all registered job to
+// jobs-backup/<unix seconds>, or jobs-backup/<unix seconds>/<target> when
+// Target is set
+func (n *NomadHelper) BackupJobs(ctx context.Context) *Report {
+	report := NewReport("backup-jobs", true)
+	defer report.Finish()
+
+	items, err := n.Inventory().Jobs(ctx, nil)
 	if err != nil {
 		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "backup", Status: StatusFailed, Error: err.Error()})
+		return report
 	}
 
-	dir := fmt.Sprintf("jobs-backup")
+	dir := BackupDir
 	err = os.Mkdir(dir, 0755)
 	if err != nil {
 		n.Logger.Error(err)
 	}
 
+	// Every target of a run gets its own directory, as several may finish
+	// within the same second
 	now := time.Now()
 	secs := now.Unix()
-	dir = fmt.Sprintf("jobs-backup/%d/", secs)
-	err = os.Mkdir(dir, 0755)
+	dir = filepath.Join(BackupDir, fmt.Sprint(secs), filepath.FromSlash(n.Target))
+	err = os.MkdirAll(filepath.Dir(dir), 0755)
+	if err == nil {
+		err = os.Mkdir(dir, 0755)
+	}
 	if err != nil {
 		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "backup", Status: StatusFailed, Error: err.Error()})
+		return report
 	}
 
-	for _, jobStub := range jobStubList {
-		// Get the jobs object
-		jobInfo, _, err := jobs.Info(jobStub.ID, nil)
-		if err != nil {
-			n.Logger.Error(err)
+	for _, item := range items {
+		jobStub := item.Stub
+		if n.cancelled(ctx, report, jobStub, "backup") {
+			continue
 		}
 
-		jobJSON, _ := json.Marshal(jobInfo)
-		filename := fmt.Sprintf("%s.json", *jobInfo.Name)
-		n.Logger.Infof("Job %s written to %s\n", *jobInfo.Name, filename)
+		// Get the jobs object
+		if item.Err != nil {
+			n.failed(report, jobStub, "backup", item.Err)
+			continue
+		}
+		jobInfo := item.Job
 
-		err = ioutil.WriteFile(filepath.Join(dir, filepath.Base(filename)), jobJSON, 0644)
+		path, err := writeJobFile(dir, *jobInfo.Name, jobInfo)
 		if err != nil {
-			panic(err)
+			n.failed(report, jobStub, "backup", err)
+			continue
 		}
+		n.Logger.Infof("Job %s written to %s\n", *jobInfo.Name, path)
+		report.Add(JobResult{JobID: *jobInfo.ID, Name: *jobInfo.Name, Action: "backup",
+			Status: StatusApplied, Detail: path})
 	}
+	n.writeFailures(report)
+	return report
 }
@@ -1,9 +1,25 @@
 package nomadhelper
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	nomad "github.com/hashicorp/nomad/api"
+	"go.uber.org/zap"
 )
 
 func TestDisplayJobDiff(t *testing.T) {
@@ -11,7 +27,7 @@ func TestDisplayJobDiff(t *testing.T) {
 		diff nomad.JobDiff
 	}
 	fieldDiff := make([]*nomad.FieldDiff, 0)
-	fieldDiff = append(fieldDiff, &nomad.FieldDiff{"fieldType", "fieldName", "old", "new", make([]string, 0)})
+	fieldDiff = append(fieldDiff, &nomad.FieldDiff{Type: "fieldType", Name: "fieldName", Old: "old", New: "new", Annotations: make([]string, 0)})
 	tests := []struct {
 		name string
 		args args
@@ -19,16 +35,17 @@ func TestDisplayJobDiff(t *testing.T) {
 		{
 			"Nil Test",
 			args{
-				nomad.JobDiff{"one", "two", nil, nil, nil},
+				nomad.JobDiff{Type: "one", ID: "two"},
 			},
 		},
 		{
 			"Field Test",
 			args{
 				nomad.JobDiff{
-					"one", "two",
-					fieldDiff,
-					nil, nil},
+					Type:   "one",
+					ID:     "two",
+					Fields: fieldDiff,
+				},
 			},
 		},
 	}
@@ -98,3 +115,2092 @@ func TestNomadHelper_InitConfig(t *testing.T) {
 		})
 	}
 }
+
+// testJob returns a running service job with a single task group
+func testJob(id string, count int, meta map[string]string) *nomad.Job {
+	job := nomad.NewServiceJob(id, id, "global", 50)
+	job.AddDatacenter("dc1")
+	job.AddTaskGroup(nomad.NewTaskGroup(id, count).AddTask(nomad.NewTask("server", "docker")))
+	for k, v := range meta {
+		job.SetMeta(k, v)
+	}
+	return job
+}
+
+// newTestHelper returns a helper backed by the fake client
+func newTestHelper(client *FakeClient) *NomadHelper {
+	return &NomadHelper{Client: client, Logger: zap.NewNop().Sugar()}
+}
+
+func TestNomadHelper_ScaleInJobs(t *testing.T) {
+	tests := []struct {
+		name       string
+		job        *nomad.Job
+		status     string
+		force      bool
+		wantCount  int
+		wantStatus ResultStatus
+	}{
+		{"Plan", testJob("web", 3, nil), "running", false, 3, StatusPlanned},
+		{"Force", testJob("web", 3, nil), "running", true, 1, StatusApplied},
+		{"Ignored", testJob("web", 3, map[string]string{"custodian-ignore": "true"}), "running", true, 3, StatusSkipped},
+		{"Already Scaled In", testJob("web", 3, map[string]string{"custodian-action": "scaled-in"}), "running", true, 3, StatusSkipped},
+		{"Pending", testJob("web", 3, nil), "pending", true, 3, StatusSkipped},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.job.Status = &tt.status
+			client := NewFakeClient(tt.job)
+			n := newTestHelper(client)
+
+			report := n.ScaleInJobs(context.Background(), tt.force, false)
+
+			if len(report.Results) != 1 || report.Results[0].Status != tt.wantStatus {
+				t.Fatalf("expected a single %s result, got %+v", tt.wantStatus, report.Results)
+			}
+			job := client.Job("web")
+			if got := *job.TaskGroups[0].Count; got != tt.wantCount {
+				t.Errorf("expected count %d, got %d", tt.wantCount, got)
+			}
+			if tt.wantStatus == StatusApplied {
+				if job.Meta["custodian-action"] != "scaled-in" ||
+					job.Meta["custodian-web-count"] != "3" ||
+					job.Meta["custodian-revert-version"] != "0" {
+					t.Errorf("unexpected meta %v", job.Meta)
+				}
+			}
+		})
+	}
+}
+
+func TestNomadHelper_ScaleOutJobs(t *testing.T) {
+	tests := []struct {
+		name       string
+		force      bool
+		wantCount  int
+		wantStatus ResultStatus
+	}{
+		{"Plan", false, 1, StatusPlanned},
+		{"Force", true, 4, StatusApplied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewFakeClient(testJob("web", 4, nil), testJob("api", 2, nil))
+			n := newTestHelper(client)
+			n.ScaleInJobs(context.Background(), true, false)
+
+			report := n.ScaleOutJobs(context.Background(), tt.force, false)
+
+			if got := len(report.Filter(tt.wantStatus)); got != 2 {
+				t.Fatalf("expected 2 %s results, got %+v", tt.wantStatus, report.Results)
+			}
+			job := client.Job("web")
+			if got := *job.TaskGroups[0].Count; got != tt.wantCount {
+				t.Errorf("expected count %d, got %d", tt.wantCount, got)
+			}
+			if tt.force {
+				if _, ok := job.Meta["custodian-action"]; ok {
+					t.Errorf("expected custodian meta to be reverted, got %v", job.Meta)
+				}
+				if *job.Version != 2 {
+					t.Errorf("expected version 2, got %d", *job.Version)
+				}
+			}
+		})
+	}
+}
+
+func TestNomadHelper_DeleteAllJobs(t *testing.T) {
+	tests := []struct {
+		name       string
+		force      bool
+		purge      bool
+		wantStatus string
+		wantExists bool
+	}{
+		{"Plan", false, false, "running", true},
+		{"Deregister", true, false, "dead", true},
+		{"Purge", true, true, "", false},
+	}
+	_, cleanup := inTempDir(t)
+	defer cleanup()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewFakeClient(testJob("web", 2, nil),
+				testJob("nginx", 2, map[string]string{"custodian-ignore": "true"}))
+			n := newTestHelper(client)
+
+			report := n.DeleteAllJobs(context.Background(), tt.force, true, tt.purge, false)
+
+			if got := report.Count(StatusSkipped); got != 1 {
+				t.Errorf("expected the ignored job to be skipped, got %+v", report.Results)
+			}
+			if job := client.Job("nginx"); job == nil || *job.Status != "running" {
+				t.Errorf("ignored job should not change")
+			}
+			job := client.Job("web")
+			if (job != nil) != tt.wantExists {
+				t.Fatalf("expected job to exist: %t", tt.wantExists)
+			}
+			if job != nil && *job.Status != tt.wantStatus {
+				t.Errorf("expected status %s, got %s", tt.wantStatus, *job.Status)
+			}
+		})
+	}
+}
+
+// inTempDir changes to a new temporary directory and returns it along with
+// a function restoring the working directory
+func inTempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "custodian")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cwd, _ := os.Getwd()
+	os.Chdir(dir)
+	return dir, func() {
+		os.Chdir(cwd)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNomadHelper_BackupJobs(t *testing.T) {
+	dir, cleanup := inTempDir(t)
+	defer cleanup()
+
+	n := newTestHelper(NewFakeClient(testJob("web", 2, nil), testJob("api", 1, nil)))
+	report := n.BackupJobs(context.Background())
+
+	if got := report.Count(StatusApplied); got != 2 {
+		t.Fatalf("expected 2 backups, got %+v", report.Results)
+	}
+	for _, result := range report.Results {
+		data, err := ioutil.ReadFile(filepath.Join(dir, result.Detail))
+		if err != nil {
+			t.Fatal(err)
+		}
+		job := new(nomad.Job)
+		if err := json.Unmarshal(data, job); err != nil {
+			t.Fatal(err)
+		}
+		if *job.ID != result.JobID {
+			t.Errorf("expected job %s in %s, got %s", result.JobID, result.Detail, *job.ID)
+		}
+	}
+}
+
+func TestNomadHelper_BackupJobs_Targets(t *testing.T) {
+	dir, cleanup := inTempDir(t)
+	defer cleanup()
+
+	// Targets backed up one after another within the same second
+	for _, target := range []string{"prod/us-east", "prod/us-west", "staging"} {
+		n := newTestHelper(NewFakeClient(testJob("web", 2, nil)))
+		n.Target = target
+		if report := n.BackupJobs(context.Background()); report.Count(StatusApplied) != 1 {
+			t.Errorf("expected web to be backed up for %s, got %+v", target, report.Results)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, BackupDir, "*", "*", "web.json"))
+	more, _ := filepath.Glob(filepath.Join(dir, BackupDir, "*", "*", "*", "web.json"))
+	if len(files)+len(more) != 3 {
+		t.Errorf("expected a backup per target, got %v %v", files, more)
+	}
+}
+
+func TestFakeClient_FailNext(t *testing.T) {
+	client := NewFakeClient(testJob("web", 2, nil))
+	client.FailNext("Jobs.Info", "web", 1, fmt.Errorf("Unexpected response code: 500 (leader lost)"))
+
+	if _, _, err := client.Jobs().Info("web", nil); err == nil {
+		t.Error("expected the injected error")
+	}
+	if _, _, err := client.Jobs().Info("web", nil); err != nil {
+		t.Errorf("expected the second call to succeed, got %v", err)
+	}
+	if got := client.Calls("Jobs.Info"); got != 2 {
+		t.Errorf("expected 2 calls, got %d", got)
+	}
+}
+
+// cancelClient cancels the run after the first revert has been sent
+type cancelClient struct {
+	*FakeClient
+	cancel context.CancelFunc
+}
+
+func (c *cancelClient) Jobs() JobsAPI {
+	return &cancelJobs{JobsAPI: c.FakeClient.Jobs(), cancel: c.cancel}
+}
+
+type cancelJobs struct {
+	JobsAPI
+	cancel context.CancelFunc
+}
+
+func (j *cancelJobs) Revert(jobID string, version uint64, enforcePriorVersion *uint64, q *nomad.WriteOptions,
+	vaultToken string) (*nomad.JobRegisterResponse, *nomad.WriteMeta, error) {
+	defer j.cancel()
+	return j.JobsAPI.Revert(jobID, version, enforcePriorVersion, q, vaultToken)
+}
+
+func TestNomadHelper_Cancelled(t *testing.T) {
+	t.Run("Cancelled Before Start", func(t *testing.T) {
+		client := NewFakeClient(testJob("web", 3, nil), testJob("api", 2, nil))
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		report := newTestHelper(client).ScaleInJobs(ctx, true, false)
+
+		if got := report.Count(StatusCancelled); got != 2 {
+			t.Errorf("expected 2 cancelled jobs, got %+v", report.Results)
+		}
+		if client.Calls("Jobs.Register") != 0 {
+			t.Error("expected no jobs to be registered")
+		}
+	})
+
+	t.Run("Cancelled During Scale Out", func(t *testing.T) {
+		client := NewFakeClient(testJob("a", 3, nil), testJob("b", 3, nil), testJob("c", 3, nil))
+		newTestHelper(client).ScaleInJobs(context.Background(), true, false)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		n := newTestHelper(client)
+		n.Client = &cancelClient{FakeClient: client, cancel: cancel}
+		report := n.ScaleOutJobs(ctx, true, false)
+
+		applied := report.Filter(StatusApplied)
+		if len(applied) != 1 || applied[0].JobID != "a" {
+			t.Errorf("expected only job a to be scaled out, got %+v", report.Results)
+		}
+		if got := report.Count(StatusCancelled); got != 2 {
+			t.Errorf("expected 2 cancelled jobs, got %+v", report.Results)
+		}
+		if got := *client.Job("b").TaskGroups[0].Count; got != 1 {
+			t.Errorf("expected job b to stay scaled in, got count %d", got)
+		}
+
+		var buf bytes.Buffer
+		report.WriteSummary(&buf)
+		if !strings.Contains(buf.String(), "cancelled") || !strings.Contains(buf.String(), "applied") {
+			t.Errorf("unexpected summary:\n%s", buf.String())
+		}
+	})
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{fmt.Errorf("Unexpected response code: 500 (rpc error: No cluster leader)"), true},
+		{fmt.Errorf("Unexpected response code: 503 (unavailable)"), true},
+		{fmt.Errorf("Unexpected response code: 429 (too many requests)"), true},
+		{fmt.Errorf("Unexpected response code: 404 (job not found)"), false},
+		{fmt.Errorf("Unexpected response code: 403 (Permission denied)"), false},
+		{fmt.Errorf("Put http://127.0.0.1:4646/v1/jobs: dial tcp: connect: connection refused"), true},
+		{&url.Error{Op: "Put", URL: "http://127.0.0.1:4646/v1/jobs", Err: io.EOF}, true},
+		{io.ErrUnexpectedEOF, true},
+		{fmt.Errorf("failed to parse job"), false},
+		{fmt.Errorf("job timeout must be positive"), false},
+	}
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestIsUnsent(t *testing.T) {
+	dial := &url.Error{Op: "Put", URL: "http://127.0.0.1:4646/v1/jobs",
+		Err: &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("i/o timeout")}}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{dial, true},
+		{fmt.Errorf("Put http://127.0.0.1:4646/v1/jobs: dial tcp: connect: connection refused"), true},
+		{fmt.Errorf("Unexpected response code: 429 (too many requests)"), true},
+		{fmt.Errorf("Unexpected response code: 500 (rpc error: No cluster leader)"), false},
+		{&url.Error{Op: "Put", URL: "http://127.0.0.1:4646/v1/jobs", Err: io.EOF}, false},
+		{fmt.Errorf("read tcp 127.0.0.1:4646: read: connection reset by peer"), false},
+	}
+	for _, tt := range tests {
+		if got := isUnsent(tt.err); got != tt.want {
+			t.Errorf("isUnsent(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestNomadHelper_Retry(t *testing.T) {
+	defer func(s func(context.Context, time.Duration) error) { sleep = s }(sleep)
+	var delays []time.Duration
+	sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	policy := RetryPolicy{Attempts: 3, BaseDelay: time.Second, MaxDelay: 2 * time.Second}
+
+	t.Run("Transient", func(t *testing.T) {
+		delays = nil
+		client := NewFakeClient(testJob("web", 3, nil))
+		client.FailNext("Jobs.Info", "web", 2, fmt.Errorf("Unexpected response code: 503 (unavailable)"))
+		n := newTestHelper(client)
+		n.Client = NewRetryClient(client, policy, n.Logger)
+
+		report := n.ScaleInJobs(context.Background(), true, false)
+
+		if got := report.Count(StatusApplied); got != 1 {
+			t.Fatalf("expected the job to be scaled in after retrying, got %+v", report.Results)
+		}
+		if got := client.Calls("Jobs.Info"); got != 3 {
+			t.Errorf("expected 3 calls, got %d", got)
+		}
+		if len(delays) != 2 || delays[0] > time.Second || delays[1] > 2*time.Second {
+			t.Errorf("unexpected backoff delays %v", delays)
+		}
+	})
+
+	t.Run("Permanent", func(t *testing.T) {
+		client := NewFakeClient(testJob("web", 3, nil), testJob("api", 2, nil))
+		client.FailNext("Jobs.Info", "api", 5, fmt.Errorf("Unexpected response code: 403 (Permission denied)"))
+		n := newTestHelper(client)
+		n.Client = NewRetryClient(client, policy, n.Logger)
+
+		report := n.ScaleInJobs(context.Background(), true, false)
+
+		failed := report.Filter(StatusFailed)
+		if len(failed) != 1 || failed[0].JobID != "api" || !strings.Contains(failed[0].Error, "403") {
+			t.Errorf("expected api to fail without retrying, got %+v", report.Results)
+		}
+		if got := report.Count(StatusApplied); got != 1 {
+			t.Errorf("expected web to be scaled in, got %+v", report.Results)
+		}
+		if got := client.Calls("Jobs.Info"); got != 2 {
+			t.Errorf("expected a single call per job, got %d", got)
+		}
+	})
+
+	t.Run("Exhausted", func(t *testing.T) {
+		client := NewFakeClient(testJob("web", 3, nil))
+		client.Jobs().Register(testJob("web", 3, map[string]string{
+			"custodian-action": "scaled-in", "custodian-revert-version": "0"}), nil)
+		client.FailNext("Jobs.Versions", "web", 5, fmt.Errorf("Unexpected response code: 500 (leader lost)"))
+		n := newTestHelper(client)
+		n.Client = NewRetryClient(client, policy, n.Logger)
+
+		report := n.ScaleOutJobs(context.Background(), true, false)
+
+		if got := report.Count(StatusFailed); got != 1 {
+			t.Errorf("expected the job to fail after retrying, got %+v", report.Results)
+		}
+		if got := client.Calls("Jobs.Versions"); got != 3 {
+			t.Errorf("expected 3 calls, got %d", got)
+		}
+	})
+
+	t.Run("WriteMayHaveApplied", func(t *testing.T) {
+		client := NewFakeClient(testJob("web", 3, nil))
+		client.FailNext("Jobs.Register", "web", 1, &url.Error{Op: "Put", URL: "http://127.0.0.1:4646/v1/jobs", Err: io.EOF})
+		n := newTestHelper(client)
+		n.Client = NewRetryClient(client, policy, n.Logger)
+
+		report := n.ScaleInJobs(context.Background(), true, false)
+
+		if got := report.Count(StatusFailed); got != 1 {
+			t.Errorf("expected the job to fail without retrying the register, got %+v", report.Results)
+		}
+		if got := client.Calls("Jobs.Register"); got != 1 {
+			t.Errorf("expected a single register, got %d", got)
+		}
+	})
+
+	t.Run("WriteNeverSent", func(t *testing.T) {
+		client := NewFakeClient(testJob("web", 3, nil))
+		client.FailNext("Jobs.Register", "web", 1, fmt.Errorf("Put http://127.0.0.1:4646/v1/jobs: dial tcp: connect: connection refused"))
+		n := newTestHelper(client)
+		n.Client = NewRetryClient(client, policy, n.Logger)
+
+		report := n.ScaleInJobs(context.Background(), true, false)
+
+		if got := report.Count(StatusApplied); got != 1 {
+			t.Errorf("expected the job to be scaled in after retrying, got %+v", report.Results)
+		}
+		if got := client.Calls("Jobs.Register"); got != 2 {
+			t.Errorf("expected 2 registers, got %d", got)
+		}
+	})
+}
+
+func TestNomadHelper_RetryCancelled(t *testing.T) {
+	client := NewFakeClient(testJob("web", 3, nil))
+	client.FailNext("Jobs.Info", "web", 5, fmt.Errorf("Unexpected response code: 503 (unavailable)"))
+	n := newTestHelper(client)
+	n.Client = NewRetryClient(client, RetryPolicy{Attempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}, n.Logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	n.BindContext(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.Client.Jobs().Info("web", nil)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the backoff to stop when the context was cancelled")
+	}
+	if got := client.Calls("Jobs.Info"); got != 1 {
+		t.Errorf("expected a single call, got %d", got)
+	}
+}
+
+func TestInventory(t *testing.T) {
+	pending := testJob("pending", 2, nil)
+	pending.Status = stringToPtr("pending")
+	client := NewFakeClient(testJob("web", 3, nil), testJob("api", 2, nil), pending)
+	inventory := NewInventory(client, 2)
+
+	items, err := inventory.Jobs(context.Background(), Running)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("expected 3 items, got %d", len(items))
+	}
+	for _, item := range items {
+		if (item.Job != nil) != (item.Stub.ID != "pending") {
+			t.Errorf("unexpected details for %s: %v", item.Stub.ID, item.Job)
+		}
+	}
+	if got := client.Calls("Jobs.Info"); got != 2 {
+		t.Errorf("expected Info only for running jobs, got %d calls", got)
+	}
+
+	// Jobs are copies, so changing one leaves the snapshot intact
+	items[0].Job.TaskGroups[0].Count = intToPtr(10)
+	inventory.Jobs(context.Background(), Running)
+	job, _ := inventory.Job(items[0].Stub.ID)
+	if *job.TaskGroups[0].Count == 10 {
+		t.Error("expected the snapshot to be unchanged")
+	}
+	if client.Calls("Jobs.List") != 1 || client.Calls("Jobs.Info") != 2 {
+		t.Errorf("expected the snapshot to be reused, got %d List and %d Info calls",
+			client.Calls("Jobs.List"), client.Calls("Jobs.Info"))
+	}
+
+	inventory.Invalidate("web")
+	inventory.Jobs(context.Background(), Running)
+	if client.Calls("Jobs.List") != 2 || client.Calls("Jobs.Info") != 3 {
+		t.Errorf("expected web and the job list to be fetched again, got %d List and %d Info calls",
+			client.Calls("Jobs.List"), client.Calls("Jobs.Info"))
+	}
+}
+
+func TestNomadHelper_ListJobs(t *testing.T) {
+	batch := testJob("report", 1, nil)
+	batch.Type = stringToPtr("batch")
+	client := NewFakeClient(testJob("web", 3, nil), batch)
+	var out bytes.Buffer
+	n := newTestHelper(client)
+	n.Out = &out
+
+	n.ListJobs(context.Background(), false, "service")
+
+	if !strings.Contains(out.String(), "Job: web") || strings.Contains(out.String(), "report") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+	if got := client.Calls("Jobs.Info"); got != 1 {
+		t.Errorf("expected Info only for the service job, got %d calls", got)
+	}
+}
+
+func TestApprover(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []bool
+		quit  int
+	}{
+		{"Yes And No", "y\nno\n\n", []bool{true, false, false}, -1},
+		{"All", "n\nall\n", []bool{false, true, true}, -1},
+		{"Quit", "yes\nq\n", []bool{true, false, false}, 1},
+		{"Invalid Answer Asks Again", "maybe\ny\nn\nn\n", []bool{true, false, false}, -1},
+		{"No Input", "", []bool{false, false, false}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			approver := NewApprover(strings.NewReader(tt.input), &out)
+			for i, want := range tt.want {
+				got, err := approver.Approve("scale-in", "web")
+				if got != want {
+					t.Errorf("answer %d: expected %t, got %t", i, want, got)
+				}
+				if quit := tt.quit >= 0 && i >= tt.quit; (err == ErrQuit) != quit {
+					t.Errorf("answer %d: unexpected error %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestNomadHelper_Interactive(t *testing.T) {
+	client := NewFakeClient(testJob("a", 3, nil), testJob("b", 3, nil), testJob("c", 3, nil))
+	var out bytes.Buffer
+	n := newTestHelper(client)
+	n.Out = &out
+	n.Approver = NewApprover(strings.NewReader("y\nn\nq\n"), &out)
+
+	report := n.ScaleInJobs(context.Background(), true, false)
+
+	want := map[string]ResultStatus{"a": StatusApplied, "b": StatusSkipped, "c": StatusCancelled}
+	for _, result := range report.Results {
+		if result.Status != want[result.JobID] {
+			t.Errorf("expected %s for job %s, got %s", want[result.JobID], result.JobID, result.Status)
+		}
+	}
+	if got := *client.Job("b").TaskGroups[0].Count; got != 3 {
+		t.Errorf("expected declined job b to keep count 3, got %d", got)
+	}
+	if !strings.Contains(out.String(), "scale-in c? [y]es, [n]o, [a]ll, [q]uit") {
+		t.Errorf("expected a prompt per job:\n%s", out.String())
+	}
+}
+
+func TestNomadHelper_UndeleteJobs(t *testing.T) {
+	_, cleanup := inTempDir(t)
+	defer cleanup()
+
+	client := NewFakeClient(testJob("web", 2, nil), testJob("api", 3, nil),
+		testJob("nginx", 2, map[string]string{"custodian-ignore": "true"}))
+	n := newTestHelper(client)
+	n.Config = &nomad.Config{Address: "http://127.0.0.1:4646", Region: "eu"}
+	report := n.DeleteAllJobs(context.Background(), true, true, true, false)
+
+	deleted := report.Filter(StatusApplied)
+	if len(deleted) != 2 || client.Job("web") != nil || client.Job("api") != nil {
+		t.Fatalf("expected web and api to be purged, got %+v", report.Results)
+	}
+	batchID := deleted[0].Detail
+	batches, err := ListDeleteBatches()
+	if err != nil || len(batches) != 1 || batches[0].ID != batchID || len(batches[0].Jobs) != 2 {
+		t.Fatalf("expected a single batch %s with 2 jobs, got %+v (%v)", batchID, batches, err)
+	}
+	if info, err := os.Stat(jobFilePath(batches[0].dir(), "web")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the saved job to be readable by the owner only, got %v %v", info.Mode(), err)
+	}
+
+	// A batch is only restored into the region it was deleted from
+	n.Config = &nomad.Config{Address: "http://127.0.0.1:4646", Region: "us"}
+	report = n.UndeleteJobs(context.Background(), batchID, true, false)
+	if failed := report.Filter(StatusFailed); len(failed) != 1 || !strings.Contains(failed[0].Error, "was made against") {
+		t.Errorf("expected the batch to be refused in another region, got %+v", report.Results)
+	}
+	n.Config.Region = "eu"
+
+	// api was registered again by hand before the undelete
+	client.AddJob(testJob("api", 1, nil))
+
+	report = n.UndeleteJobs(context.Background(), batchID, false, false)
+	if report.Count(StatusPlanned) != 1 || client.Job("web") != nil {
+		t.Fatalf("expected a plan to restore web only, got %+v", report.Results)
+	}
+
+	report = n.UndeleteJobs(context.Background(), batchID, true, false)
+	if skipped := report.Filter(StatusSkipped); report.Count(StatusApplied) != 1 || len(skipped) != 1 ||
+		skipped[0].Reason != SkipRegistered {
+		t.Errorf("expected web to be restored and api skipped, got %+v", report.Results)
+	}
+	if job := client.Job("web"); job == nil || *job.Status != "running" || *job.TaskGroups[0].Count != 2 {
+		t.Errorf("expected web to be restored with count 2, got %+v", job)
+	}
+	if got := *client.Job("api").TaskGroups[0].Count; got != 1 {
+		t.Errorf("expected api to be left alone, got count %d", got)
+	}
+
+	report = n.UndeleteJobs(context.Background(), "missing", true, false)
+	if failed := report.Filter(StatusFailed); len(failed) != 1 || !strings.Contains(failed[0].Error, "not found") {
+		t.Errorf("expected an unknown batch to fail, got %+v", report.Results)
+	}
+}
+
+// agedJob returns a job of the given type and status submitted age ago
+func agedJob(id string, jobType string, status string, age time.Duration) *nomad.Job {
+	job := testJob(id, 1, nil)
+	job.Type = stringToPtr(jobType)
+	job.Status = stringToPtr(status)
+	job.SubmitTime = int64ToPtr(time.Now().Add(-age).UnixNano())
+	return job
+}
+
+func TestNomadHelper_GCJobs(t *testing.T) {
+	_, cleanup := inTempDir(t)
+	defer cleanup()
+
+	day := 24 * time.Hour
+	stopped := agedJob("stopped", "service", "dead", 10*day)
+	stopped.Stop = boolToPtr(true)
+	failed := agedJob("failed", "batch", "dead", 30*day)
+	recentFailure := agedJob("recent-failure", "batch", "dead", 30*day)
+	ignored := agedJob("ignored", "service", "dead", 30*day)
+	ignored.SetMeta("custodian-ignore", "true")
+	parent := agedJob("parent", "batch", "running", 60*day)
+	parent.Periodic = &nomad.PeriodicConfig{Enabled: boolToPtr(false), Spec: stringToPtr("@daily"), SpecType: stringToPtr("cron")}
+	activeParent := agedJob("active-parent", "batch", "running", 60*day)
+	activeParent.Periodic = &nomad.PeriodicConfig{Enabled: boolToPtr(true), Spec: stringToPtr("@daily"), SpecType: stringToPtr("cron")}
+	// A daily cron whose dead children were already garbage collected by Nomad
+	daily := agedJob("daily", "batch", "running", 60*day)
+	daily.Periodic = activeParent.Periodic
+	child := agedJob("active-parent/periodic-1", "batch", "running", day)
+	child.ParentID = stringToPtr("active-parent")
+
+	client := NewFakeClient(stopped, failed, recentFailure, ignored, parent, activeParent, daily, child,
+		agedJob("old-dead", "service", "dead", 10*day),
+		agedJob("new-dead", "service", "dead", day),
+		agedJob("web", "service", "running", 60*day))
+	client.AddAllocation(&nomad.Allocation{ID: "a1", JobID: "failed", ClientStatus: "failed",
+		ModifyTime: time.Now().Add(-20 * day).UnixNano()}, nil)
+	client.AddAllocation(&nomad.Allocation{ID: "a2", JobID: "recent-failure", ClientStatus: "failed",
+		ModifyTime: time.Now().Add(-day).UnixNano()}, nil)
+
+	opts := GCOptions{DeadFor: 7 * day, FailedFor: 7 * day, ParentIdleFor: 30 * day}
+	n := newTestHelper(client)
+	n.Out = ioutil.Discard
+
+	report := n.GCJobs(context.Background(), opts, false, false)
+
+	want := map[string]string{"stopped": GCStopped, "failed": GCFailed, "old-dead": GCDead, "parent": GCIdleParent}
+	planned := report.Filter(StatusPlanned)
+	if len(planned) != len(want) {
+		t.Errorf("expected %d planned jobs, got %+v", len(want), planned)
+	}
+	for _, result := range planned {
+		if want[result.JobID] != result.Detail {
+			t.Errorf("expected %s to be collected as %q, got %q", result.JobID, want[result.JobID], result.Detail)
+		}
+	}
+	if skipped := report.Filter(StatusSkipped); len(skipped) != 1 || skipped[0].JobID != "ignored" {
+		t.Errorf("expected the ignored job to be skipped, got %+v", skipped)
+	}
+	if got := client.Calls("Jobs.Info"); got != 6 {
+		t.Errorf("expected Info only for the 5 candidates and the daily cron, got %d calls", got)
+	}
+
+	report = n.GCJobs(context.Background(), opts, true, false)
+
+	for id := range want {
+		if client.Job(id) != nil {
+			t.Errorf("expected %s to be purged", id)
+		}
+	}
+	for _, id := range []string{"recent-failure", "ignored", "active-parent", "daily", "new-dead", "web"} {
+		if client.Job(id) == nil {
+			t.Errorf("expected %s to be kept", id)
+		}
+	}
+	if batches, _ := ListDeleteBatches(); len(batches) != 1 || len(batches[0].Jobs) != len(want) {
+		t.Errorf("expected the purged jobs to be saved to a delete batch, got %+v", batches)
+	}
+}
+
+func TestNomadHelper_GCJobs_StoppedDeadFor(t *testing.T) {
+	_, cleanup := inTempDir(t)
+	defer cleanup()
+
+	day := 24 * time.Hour
+	recent := agedJob("recent-stop", "service", "dead", day)
+	recent.Stop = boolToPtr(true)
+	old := agedJob("old-stop", "service", "dead", 10*day)
+	old.Stop = boolToPtr(true)
+
+	client := NewFakeClient(recent, old)
+	n := newTestHelper(client)
+	n.Out = ioutil.Discard
+
+	n.GCJobs(context.Background(), GCOptions{DeadFor: 7 * day, FailedFor: 7 * day, ParentIdleFor: 30 * day}, true, false)
+
+	if client.Job("recent-stop") == nil {
+		t.Errorf("expected a job stopped for less than dead-for to be kept")
+	}
+	if client.Job("old-stop") != nil {
+		t.Errorf("expected a job stopped for longer than dead-for to be purged")
+	}
+}
+
+func TestJobExpiry(t *testing.T) {
+	submitted := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		meta    map[string]string
+		want    time.Time
+		wantOK  bool
+		wantErr bool
+	}{
+		{"None", nil, time.Time{}, false, false},
+		{"TTL", map[string]string{TTLMetaKey: "72h"}, submitted.Add(72 * time.Hour), true, false},
+		{"TTL In Days", map[string]string{TTLMetaKey: "3d"}, submitted.Add(72 * time.Hour), true, false},
+		{"Expires", map[string]string{ExpiresMetaKey: "2026-11-01T00:00:00Z"}, time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), true, false},
+		{"Earliest Wins", map[string]string{TTLMetaKey: "30d", ExpiresMetaKey: "2026-10-02T00:00:00Z"}, time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC), true, false},
+		{"Invalid TTL", map[string]string{TTLMetaKey: "soon"}, time.Time{}, false, true},
+		{"Invalid Expires", map[string]string{ExpiresMetaKey: "tomorrow"}, time.Time{}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := testJob("web", 1, tt.meta)
+			job.SubmitTime = int64ToPtr(submitted.UnixNano())
+
+			got, ok, err := JobExpiry(job, nil)
+			if (err != nil) != tt.wantErr || ok != tt.wantOK || !got.Equal(tt.want) {
+				t.Errorf("JobExpiry() = %v, %t, %v, want %v, %t", got, ok, err, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	t.Run("Versions", func(t *testing.T) {
+		version := func(v uint64, ttl string, submitted time.Time) *nomad.Job {
+			job := testJob("web", 1, map[string]string{TTLMetaKey: ttl})
+			job.Version = uint64ToPtr(v)
+			job.SubmitTime = int64ToPtr(submitted.UnixNano())
+			return job
+		}
+		versions := []*nomad.Job{
+			version(3, "72h", submitted.Add(48*time.Hour)),
+			version(2, "72h", submitted.Add(24*time.Hour)),
+			version(1, "72h", submitted),
+			version(0, "24h", submitted.Add(-24*time.Hour)),
+		}
+
+		got, _, _ := JobExpiry(versions[0], versions)
+		if want := submitted.Add(72 * time.Hour); !got.Equal(want) {
+			t.Errorf("expected the TTL to count from the version that set it, got %v, want %v", got, want)
+		}
+		got, _, _ = JobExpiry(versions[3], versions)
+		if want := submitted; !got.Equal(want) {
+			t.Errorf("expected newer versions to be ignored, got %v, want %v", got, want)
+		}
+	})
+}
+
+func TestNomadHelper_ExpireJobs(t *testing.T) {
+	_, cleanup := inTempDir(t)
+	defer cleanup()
+
+	now := time.Now()
+	client := NewFakeClient(
+		testJob("expired", 1, map[string]string{ExpiresMetaKey: now.Add(-time.Hour).Format(time.RFC3339)}),
+		testJob("soon", 1, map[string]string{TTLMetaKey: "2h"}),
+		testJob("later", 1, map[string]string{TTLMetaKey: "30d"}),
+		testJob("ignored", 1, map[string]string{TTLMetaKey: "1h", "custodian-ignore": "true",
+			ExpiresMetaKey: now.Add(-time.Hour).Format(time.RFC3339)}),
+		testJob("broken", 1, map[string]string{TTLMetaKey: "forever"}),
+		testJob("web", 1, nil))
+	n := newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+	opts := ExpireOptions{WarnWithin: 24 * time.Hour}
+
+	report := n.ExpireJobs(context.Background(), opts, true, false)
+
+	want := map[string]ResultStatus{"expired": StatusApplied, "soon": StatusWarned, "ignored": StatusSkipped, "broken": StatusFailed}
+	if len(report.Results) != len(want) {
+		t.Errorf("expected %d results, got %+v", len(want), report.Results)
+	}
+	for _, result := range report.Results {
+		if want[result.JobID] != result.Status {
+			t.Errorf("expected %s for %s, got %s", want[result.JobID], result.JobID, result.Status)
+		}
+	}
+	if job := client.Job("expired"); job == nil || *job.Status != "dead" {
+		t.Errorf("expected the expired job to be stopped, got %+v", job)
+	}
+	for _, want := range []string{"expiring soon", "expires in 29d 23h", "invalid custodian-ttl"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in output:\n%s", want, out.String())
+		}
+	}
+
+	opts.Purge = true
+	report = n.ExpireJobs(context.Background(), opts, true, false)
+	if client.Job("expired") != nil || report.Count(StatusApplied) != 1 {
+		t.Errorf("expected the stopped job to be purged, got %+v", report.Results)
+	}
+}
+
+func TestNomadHelper_ExpireJobsAfterScaleIn(t *testing.T) {
+	_, cleanup := inTempDir(t)
+	defer cleanup()
+
+	job := testJob("web", 3, map[string]string{TTLMetaKey: "2h"})
+	job.SubmitTime = int64ToPtr(time.Now().Add(-3 * time.Hour).UnixNano())
+	client := NewFakeClient(job)
+
+	report := newTestHelper(client).ScaleInJobs(context.Background(), true, false)
+	if got := report.Count(StatusApplied); got != 1 {
+		t.Fatalf("expected the job to be scaled in, got %+v", report.Results)
+	}
+
+	n := newTestHelper(client)
+	n.Out = ioutil.Discard
+	report = n.ExpireJobs(context.Background(), ExpireOptions{}, true, false)
+
+	if got := report.Count(StatusApplied); got != 1 {
+		t.Errorf("expected the scale-in not to extend the TTL, got %+v", report.Results)
+	}
+	if job := client.Job("web"); job == nil || *job.Status != "dead" {
+		t.Errorf("expected the expired job to be stopped, got %+v", job)
+	}
+}
+
+func TestCompliancePolicy_Violations(t *testing.T) {
+	policy := CompliancePolicy{Required: []ComplianceRule{
+		{Key: "owner"},
+		{Key: "environment", Allowed: []string{"prod", "dev"}},
+	}}
+	tests := []struct {
+		meta map[string]string
+		want []string
+	}{
+		{map[string]string{"owner": "ana", "environment": "prod"}, nil},
+		{map[string]string{"environment": "qa"}, []string{"missing owner", "environment=qa not allowed"}},
+		{nil, []string{"missing owner", "missing environment"}},
+	}
+	for _, tt := range tests {
+		got := policy.Violations(testJob("web", 1, tt.meta))
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("Violations(%v) = %v, want %v", tt.meta, got, tt.want)
+		}
+	}
+
+	if err := (CompliancePolicy{Required: policy.Required, Action: "delete"}).Validate(); err == nil {
+		t.Error("expected an unknown action to be rejected")
+	}
+}
+
+func TestNomadHelper_CheckCompliance(t *testing.T) {
+	_, cleanup := inTempDir(t)
+	defer cleanup()
+
+	now := time.Now()
+	client := NewFakeClient(
+		testJob("good", 1, map[string]string{"owner": "ana", "team": "web"}),
+		testJob("fixed", 1, map[string]string{"owner": "ana", "team": "web", ViolationMetaKey: "missing owner",
+			MarkedForMetaKey: "stop@2026-10-25"}),
+		testJob("new", 3, map[string]string{"team": "web"}),
+		testJob("overdue", 1, map[string]string{"team": "data", ViolationMetaKey: "missing owner",
+			MarkedForMetaKey: Mark{MarkStop, now.Add(-time.Hour)}.String()}),
+		testJob("ignored", 1, map[string]string{"custodian-ignore": "true"}))
+	n := newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+	policy := CompliancePolicy{
+		Required:    []ComplianceRule{{Key: "owner"}},
+		Action:      ComplianceStop,
+		GracePeriod: 72 * time.Hour,
+		Now:         now,
+	}
+
+	report := n.CheckCompliance(context.Background(), policy, true, false)
+
+	if job := client.Job("fixed"); job.Meta[ViolationMetaKey] != "" || job.Meta[MarkedForMetaKey] != "" {
+		t.Errorf("expected the mark of the fixed job to be cleared, got %v", job.Meta)
+	}
+	if job := client.Job("new"); job.Meta[ViolationMetaKey] != "missing owner" || *job.Status == "dead" ||
+		!strings.HasPrefix(job.Meta[MarkedForMetaKey], "stop@") {
+		t.Errorf("expected the new violation to be marked for stop, got %v", job.Meta)
+	}
+	if job := client.Job("overdue"); *job.Status != "dead" {
+		t.Errorf("expected the overdue job to be stopped, got %s", *job.Status)
+	}
+	if job := client.Job("ignored"); job.Meta[ViolationMetaKey] != "" {
+		t.Errorf("expected the ignored job to be left alone, got %v", job.Meta)
+	}
+	if got := report.Count(StatusWarned); got != 2 {
+		t.Errorf("expected 2 warned jobs, got %+v", report.Results)
+	}
+	for _, want := range []string{"stop at", "stop due", "data  1     1"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in output:\n%s", want, out.String())
+		}
+	}
+
+	// Changing the action replaces the mark, which is acted on once due
+	policy.Action = ComplianceScaleIn
+	n.CheckCompliance(context.Background(), policy, true, false)
+	if job := client.Job("new"); *job.TaskGroups[0].Count != 3 || !strings.HasPrefix(job.Meta[MarkedForMetaKey], "scale-in@") {
+		t.Errorf("expected the violating job to be marked for scale-in, got %v", job.Meta)
+	}
+	policy.Now = now.Add(73 * time.Hour)
+	n.CheckCompliance(context.Background(), policy, true, false)
+	if job := client.Job("new"); *job.TaskGroups[0].Count != 1 || job.Meta["custodian-action"] != "scaled-in" ||
+		job.Meta[MarkedForMetaKey] != "" {
+		t.Errorf("expected the violating job to be scaled in, got %v", job.Meta)
+	}
+}
+
+func TestParseMark(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Mark
+		err   bool
+	}{
+		{"stop@2026-10-25", Mark{MarkStop, time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC)}, false},
+		{"scale-in@2026-10-25T08:30:00Z", Mark{MarkScaleIn, time.Date(2026, 10, 25, 8, 30, 0, 0, time.UTC)}, false},
+		{"delete@2026-10-25", Mark{}, true},
+		{"purge", Mark{}, true},
+		{"purge@tomorrow", Mark{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMark(tt.value)
+		if (err != nil) != tt.err || !got.At.Equal(tt.want.At) || got.Action != tt.want.Action {
+			t.Errorf("ParseMark(%q) = %v, %v", tt.value, got, err)
+			continue
+		}
+		if err == nil && got.String() != tt.value {
+			t.Errorf("expected %q to format as itself, got %q", tt.value, got.String())
+		}
+	}
+}
+
+func TestNomadHelper_ProcessMarks(t *testing.T) {
+	_, cleanup := inTempDir(t)
+	defer cleanup()
+
+	now := time.Now()
+	client := NewFakeClient(
+		testJob("scale", 3, map[string]string{MarkedForMetaKey: Mark{MarkScaleIn, now.Add(-time.Hour)}.String()}),
+		testJob("purge", 1, map[string]string{MarkedForMetaKey: Mark{MarkPurge, now.Add(-time.Hour)}.String()}),
+		testJob("later", 1, map[string]string{MarkedForMetaKey: Mark{MarkStop, now.Add(48 * time.Hour)}.String()}),
+		testJob("ignored", 1, map[string]string{MarkedForMetaKey: "stop@2020-01-01", "custodian-ignore": "true"}),
+		testJob("broken", 1, map[string]string{MarkedForMetaKey: "stop"}),
+		testJob("web", 1, nil))
+	n := newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+
+	report := n.ProcessMarks(context.Background(), now, false, false)
+	if got := report.Count(StatusPlanned); got != 2 || client.Job("purge") == nil {
+		t.Errorf("expected the due marks to be planned only, got %+v", report.Results)
+	}
+
+	report = n.ProcessMarks(context.Background(), now, true, false)
+	want := map[string]ResultStatus{"scale": StatusApplied, "purge": StatusApplied, "later": StatusWarned,
+		"ignored": StatusSkipped, "broken": StatusFailed}
+	if len(report.Results) != len(want) {
+		t.Errorf("expected %d results, got %+v", len(want), report.Results)
+	}
+	for _, result := range report.Results {
+		if want[result.JobID] != result.Status {
+			t.Errorf("expected %s for %s, got %s", want[result.JobID], result.JobID, result.Status)
+		}
+	}
+	if job := client.Job("scale"); *job.TaskGroups[0].Count != 1 || job.Meta[MarkedForMetaKey] != "" {
+		t.Errorf("expected the marked job to be scaled in and unmarked, got %v", job.Meta)
+	}
+	if client.Job("purge") != nil {
+		t.Error("expected the marked job to be purged")
+	}
+	if !strings.Contains(out.String(), "due in 1d 23h") {
+		t.Errorf("expected the pending mark in output:\n%s", out.String())
+	}
+}
+
+func TestNomadHelper_JobCosts(t *testing.T) {
+	now := time.Now()
+	client := NewFakeClient(testJob("web", 3, nil))
+
+	api := testJob("api", 2, nil)
+	api.SubmitTime = int64ToPtr(now.Add(-10 * time.Hour).UnixNano())
+	client.AddJob(api)
+	api = client.Job("api")
+	scaleInJob(api)
+	api.SubmitTime = int64ToPtr(now.Add(-4 * time.Hour).UnixNano())
+	client.AddJob(api)
+
+	gpu := testJob("gpu", 1, nil)
+	gpu.Constrain(nomad.NewConstraint("${node.class}", "=", "gpu"))
+	client.AddJob(gpu)
+
+	n := newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+	config := CostConfig{
+		Currency:    "USD",
+		Rates:       Rates{CPUPerMHz: 0.001, MemoryPerMB: 0.0001},
+		NodeClasses: map[string]Rates{"gpu": {CPUPerMHz: 0.01}},
+		Now:         now,
+	}
+
+	n.JobCosts(context.Background(), config, false)
+
+	// Every task reserves the default 100 MHz and 300 MB, 0.13 USD an hour
+	got := strings.Join(strings.Fields(out.String()), " ")
+	for _, want := range []string{
+		"web running 284.70 USD 94.90 USD 189.80 USD 0.00 USD 0s",
+		"api scaled in 189.80 USD 94.90 USD 94.90 USD 0.52 USD 4h0m0s",
+		"gpu running 730.00 USD 730.00 USD 0.00 USD",
+		"Total - 1204.50 USD 919.80 USD 284.70 USD 0.52 USD",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in output:\n%s", want, out.String())
+		}
+	}
+
+	if err := (CostConfig{}).Validate(); err == nil {
+		t.Error("expected a config without rates to be rejected")
+	}
+}
+
+func TestNomadHelper_JobCosts_StateStores(t *testing.T) {
+	client := NewFakeClient(testJob("api", 2, nil), testJob("web", 3, nil), testJob("db", 2, nil))
+	n := newTestHelper(client)
+	n.Out = ioutil.Discard
+	n.State = &VariablesStore{Client: client, Prefix: DefaultStatePrefix}
+	n.Selector = JobSelector{Jobs: []string{"api"}}
+	n.ScaleInJobs(context.Background(), true, false)
+	n = newTestHelper(client)
+	n.Out = ioutil.Discard
+	n.NativeScale = true
+	n.Selector = JobSelector{Jobs: []string{"web"}}
+	n.ScaleInJobs(context.Background(), true, false)
+
+	n = newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+	n.State = &VariablesStore{Client: client, Prefix: DefaultStatePrefix}
+	n.NativeScale = true
+	config := CostConfig{Currency: "USD", Rates: Rates{CPUPerMHz: 0.001, MemoryPerMB: 0.0001},
+		Now: time.Now().Add(2 * time.Hour)}
+
+	n.JobCosts(context.Background(), config, false)
+
+	got := strings.Join(strings.Fields(out.String()), " ")
+	for _, want := range []string{
+		"api scaled in 189.80 USD 94.90 USD 94.90 USD 0.26 USD 2h0m0s",
+		"web scaled in 284.70 USD 94.90 USD 189.80 USD 0.52 USD 2h0m0s",
+		"db running 189.80 USD 94.90 USD 94.90 USD 0.00 USD 0s",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in output:\n%s", want, out.String())
+		}
+	}
+}
+
+// usageAlloc returns a running allocation of a job's task group and the
+// usage of its server task
+func usageAlloc(id string, jobID string, cpu float64, memoryMB uint64) (*nomad.Allocation, *nomad.AllocResourceUsage) {
+	alloc := &nomad.Allocation{ID: id, JobID: jobID, TaskGroup: jobID, ClientStatus: "running"}
+	usage := &nomad.AllocResourceUsage{Tasks: map[string]*nomad.TaskResourceUsage{
+		"server": {ResourceUsage: &nomad.ResourceUsage{
+			CpuStats:    &nomad.CpuStats{TotalTicks: cpu},
+			MemoryStats: &nomad.MemoryStats{RSS: memoryMB * 1024 * 1024},
+		}},
+	}}
+	return alloc, usage
+}
+
+func TestNomadHelper_RightsizeJobs(t *testing.T) {
+	web := testJob("web", 2, nil)
+	web.TaskGroups[0].Tasks[0].Require(&nomad.Resources{CPU: intToPtr(500), MemoryMB: intToPtr(1024)})
+	client := NewFakeClient(web, testJob("fit", 1, nil), testJob("ignored", 1, map[string]string{"custodian-ignore": "true"}))
+	client.AddAllocation(usageAlloc("a1", "web", 50, 80))
+	client.AddAllocation(usageAlloc("a2", "web", 80, 100))
+	client.AddAllocation(usageAlloc("a3", "fit", 90, 280))
+	client.AddAllocation(usageAlloc("a4", "ignored", 10, 10))
+	n := newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+	opts := RightsizeOptions{Headroom: 0.2, Threshold: 0.25, MinCPU: 20, MinMemoryMB: 32}
+
+	report := n.RightsizeJobs(context.Background(), opts, false, false, false)
+	got := strings.Join(strings.Fields(out.String()), " ")
+	for _, want := range []string{
+		"web web server 500 -> 96 (peak 80, avg 65) 1024 -> 120 (peak 100)",
+		"fit fit server 100 -> 100 (peak 90, avg 90) 300 -> 300 (peak 280)",
+		"ignored ignored server 100 -> 20 (peak 10, avg 10) 300 -> 32 (peak 10)",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in output:\n%s", want, out.String())
+		}
+	}
+	if len(report.Results) != 0 {
+		t.Errorf("expected recommendations only, got %+v", report.Results)
+	}
+
+	report = n.RightsizeJobs(context.Background(), opts, true, true, false)
+	want := map[string]ResultStatus{"web": StatusApplied, "ignored": StatusSkipped}
+	if len(report.Results) != len(want) {
+		t.Errorf("expected %d results, got %+v", len(want), report.Results)
+	}
+	for _, result := range report.Results {
+		if want[result.JobID] != result.Status {
+			t.Errorf("expected %s for %s, got %s", want[result.JobID], result.JobID, result.Status)
+		}
+	}
+	resources := client.Job("web").TaskGroups[0].Tasks[0].Resources
+	if *resources.CPU != 96 || *resources.MemoryMB != 120 {
+		t.Errorf("expected the web job to be rightsized, got %d MHz and %d MB", *resources.CPU, *resources.MemoryMB)
+	}
+}
+
+func TestNomadHelper_RightsizeJobs_Unmeasured(t *testing.T) {
+	client := NewFakeClient(testJob("web", 1, nil))
+	alloc, _ := usageAlloc("a1", "web", 0, 0)
+	// cgroup v2 drivers may report neither RSS nor usage, and no CPU stats at all
+	client.AddAllocation(alloc, &nomad.AllocResourceUsage{Tasks: map[string]*nomad.TaskResourceUsage{
+		"server": {ResourceUsage: &nomad.ResourceUsage{MemoryStats: &nomad.MemoryStats{}}},
+	}})
+	n := newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+	opts := RightsizeOptions{Headroom: 0.2, Threshold: 0.25, MinCPU: 20, MinMemoryMB: 32}
+
+	report := n.RightsizeJobs(context.Background(), opts, true, true, false)
+	got := strings.Join(strings.Fields(out.String()), " ")
+	if want := "web web server 100 (unmeasured) 300 (unmeasured)"; !strings.Contains(got, want) {
+		t.Errorf("expected %q in output:\n%s", want, out.String())
+	}
+	if len(report.Results) != 0 {
+		t.Errorf("expected nothing to be updated, got %+v", report.Results)
+	}
+	resources := client.Job("web").TaskGroups[0].Tasks[0].Resources
+	if *resources.CPU != 100 || *resources.MemoryMB != 300 {
+		t.Errorf("expected the reservation to be kept, got %d MHz and %d MB", *resources.CPU, *resources.MemoryMB)
+	}
+
+	_, cleanup := inTempDir(t)
+	defer cleanup()
+	client.AddJob(testJob("web", 3, nil))
+	n = newTestHelper(client)
+	out.Reset()
+	n.Out = &out
+	n.DetectIdleJobs(context.Background(), IdleOptions{CPUThreshold: 2, Now: time.Now()}, true, false)
+	if *client.Job("web").TaskGroups[0].Count != 3 || !strings.Contains(out.String(), "cpu unmeasured") {
+		t.Errorf("expected a job without CPU stats not to be idle:\n%s", out.String())
+	}
+}
+
+// prometheusStandIn answers instant queries with the value of the job named
+// in the query, and no samples for unknown jobs
+func prometheusStandIn(values map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		if r.URL.Path != "/api/v1/query" || strings.Contains(query, "bad") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"parse error"}`)
+			return
+		}
+		result := "[]"
+		for job, value := range values {
+			if strings.Contains(query, `"`+job+`"`) {
+				result = fmt.Sprintf(`[{"metric":{"service":%q},"value":[1700000000,%q]}]`, job, value)
+			}
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":%s}}`, result)
+	}))
+}
+
+func TestPrometheusQuery_Value(t *testing.T) {
+	server := prometheusStandIn(map[string]string{"web": "12.5"})
+	defer server.Close()
+
+	query := &PrometheusQuery{URL: server.URL, Query: `sum(rate(http_requests_total{service="{{.ID}}"}[6h]))`}
+	if value, ok, err := query.Value(testJob("web", 1, nil)); err != nil || !ok || value != 12.5 {
+		t.Errorf("expected 12.5, got %v, %v, %v", value, ok, err)
+	}
+	if _, ok, err := query.Value(testJob("api", 1, nil)); err != nil || ok {
+		t.Errorf("expected no samples, got %v, %v", ok, err)
+	}
+	query.Query = `bad{service="{{.ID}}"}`
+	if _, _, err := query.Value(testJob("web", 1, nil)); err == nil || !strings.Contains(err.Error(), "parse error") {
+		t.Errorf("expected the query error, got %v", err)
+	}
+}
+
+func TestNomadHelper_DetectIdleJobs(t *testing.T) {
+	_, cleanup := inTempDir(t)
+	defer cleanup()
+
+	client := NewFakeClient(testJob("quiet", 3, nil), testJob("busy", 3, nil), testJob("single", 1, nil))
+	client.AddAllocation(usageAlloc("a1", "quiet", 1, 10))
+	client.AddAllocation(usageAlloc("a2", "quiet", 0.5, 10))
+	client.AddAllocation(usageAlloc("a3", "busy", 50, 10))
+	n := newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+	start := time.Now()
+	opts := IdleOptions{CPUThreshold: 2, IdleFor: 6 * time.Hour, Now: start}
+
+	report := n.DetectIdleJobs(context.Background(), opts, true, false)
+	if report.Count(StatusApplied) != 0 || *client.Job("quiet").TaskGroups[0].Count != 3 {
+		t.Errorf("expected nothing to be scaled in on the first idle run, got %+v", report.Results)
+	}
+	if !strings.Contains(out.String(), "idle, scale in after") || !strings.Contains(out.String(), "busy") {
+		t.Errorf("expected the idle and busy jobs in output:\n%s", out.String())
+	}
+
+	opts.Now = start.Add(7 * time.Hour)
+	report = n.DetectIdleJobs(context.Background(), opts, true, false)
+	want := map[string]ResultStatus{"quiet": StatusApplied, "single": StatusSkipped}
+	if len(report.Results) != len(want) {
+		t.Errorf("expected %d results, got %+v", len(want), report.Results)
+	}
+	for _, result := range report.Results {
+		if want[result.JobID] != result.Status {
+			t.Errorf("expected %s for %s, got %s", want[result.JobID], result.JobID, result.Status)
+		}
+	}
+	if job := client.Job("quiet"); *job.TaskGroups[0].Count != 1 || job.Meta["custodian-quiet-count"] != "3" {
+		t.Errorf("expected the idle job to be scaled in with its count saved, got %v", job.Meta)
+	}
+
+	// Prometheus waits for opts.IdleFor too and a job without samples is unknown
+	client.AddJob(testJob("unscraped", 3, nil))
+	prometheus := prometheusStandIn(map[string]string{"busy": "0"})
+	defer prometheus.Close()
+	opts = IdleOptions{IdleFor: 6 * time.Hour, Now: start,
+		Prometheus: &PrometheusQuery{URL: prometheus.URL, Query: `sum(rate(requests{service="{{.ID}}"}[6h]))`}}
+	n.DetectIdleJobs(context.Background(), opts, true, false)
+	if *client.Job("busy").TaskGroups[0].Count != 3 {
+		t.Error("expected nothing to be scaled in on the first idle run")
+	}
+	opts.Now = start.Add(7 * time.Hour)
+	n.DetectIdleJobs(context.Background(), opts, true, false)
+	if *client.Job("busy").TaskGroups[0].Count != 1 {
+		t.Error("expected the job without traffic to be scaled in")
+	}
+	if *client.Job("unscraped").TaskGroups[0].Count != 3 {
+		t.Error("expected the job without samples to be left alone")
+	}
+}
+
+func TestNomadHelper_DetectIdleJobs_Targets(t *testing.T) {
+	_, cleanup := inTempDir(t)
+	defer cleanup()
+
+	// Every region and namespace behind one address keeps its own idle clock
+	var helpers []*NomadHelper
+	for _, config := range []*nomad.Config{
+		{Address: "http://127.0.0.1:4646", Region: "eu", Namespace: "web"},
+		{Address: "http://127.0.0.1:4646", Region: "eu", Namespace: "batch"},
+		{Address: "http://127.0.0.1:4646", Region: "us", Namespace: "web"},
+	} {
+		id := config.Region + "-" + config.Namespace
+		client := NewFakeClient(testJob(id, 3, nil))
+		client.AddAllocation(usageAlloc("a1", id, 1, 10))
+		n := newTestHelper(client)
+		n.Out = ioutil.Discard
+		n.Config = config
+		helpers = append(helpers, n)
+	}
+	start := time.Now()
+	opts := IdleOptions{CPUThreshold: 2, IdleFor: 6 * time.Hour, Now: start}
+	for _, n := range helpers {
+		n.DetectIdleJobs(context.Background(), opts, true, false)
+	}
+
+	opts.Now = start.Add(7 * time.Hour)
+	for _, n := range helpers {
+		n.inventory = nil
+		report := n.DetectIdleJobs(context.Background(), opts, true, false)
+		if report.Count(StatusApplied) != 1 {
+			t.Errorf("expected the idle job to be scaled in for %s, got %+v", n.localStateKey(true), report.Results)
+		}
+	}
+}
+
+func TestNomadHelper_DetectIdleJobs_AllocationError(t *testing.T) {
+	_, cleanup := inTempDir(t)
+	defer cleanup()
+
+	client := NewFakeClient(testJob("quiet", 3, nil))
+	client.AddAllocation(usageAlloc("a1", "quiet", 1, 10))
+	client.AddAllocation(usageAlloc("a2", "quiet", 80, 10))
+	client.FailNext("Allocations.Info", "a2", 10, fmt.Errorf("Unexpected response code: 403 (Permission denied)"))
+	n := newTestHelper(client)
+	n.Out = ioutil.Discard
+	opts := IdleOptions{CPUThreshold: 2, Now: time.Now()}
+
+	n.DetectIdleJobs(context.Background(), opts, true, false)
+	if *client.Job("quiet").TaskGroups[0].Count != 3 {
+		t.Error("expected a job with an unreadable allocation to be left alone")
+	}
+}
+
+func testNode(id string, datacenter string) *nomad.NodeListStub {
+	return &nomad.NodeListStub{ID: id, Name: id, Datacenter: datacenter, Status: "ready",
+		SchedulingEligibility: nomad.NodeSchedulingEligible}
+}
+
+func nodeAlloc(id string, nodeID string, jobType string) *nomad.Allocation {
+	return &nomad.Allocation{ID: id, NodeID: nodeID, JobID: id, Job: &nomad.Job{Type: stringToPtr(jobType)},
+		DesiredStatus: "run", ClientStatus: "running"}
+}
+
+func TestNomadHelper_DrainEmptyNodes(t *testing.T) {
+	_, cleanup := inTempDir(t)
+	defer cleanup()
+
+	var posted []nodeWebhookPayload
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload nodeWebhookPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		posted = append(posted, payload)
+	}))
+	defer webhook.Close()
+
+	client := NewFakeClient()
+	for _, node := range []*nomad.NodeListStub{testNode("empty", "dc1"), testNode("system-only", "dc1"),
+		testNode("busy", "dc1"), testNode("last", "dc2")} {
+		client.AddNode(node)
+	}
+	client.AddAllocation(nodeAlloc("a1", "system-only", "system"), nil)
+	client.AddAllocation(nodeAlloc("a2", "busy", "service"), nil)
+	client.AddAllocation(nodeAlloc("a3", "busy", "service"), nil)
+	n := newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+	opts := DrainOptions{MinNodes: 1, Deadline: time.Hour, Webhook: webhook.URL}
+
+	report := n.DrainEmptyNodes(context.Background(), opts, false, false)
+	if report.Count(StatusPlanned) != 2 || report.Count(StatusSkipped) != 1 || client.Calls("Nodes.UpdateDrain") != 0 {
+		t.Errorf("expected two planned drains and the last dc2 node kept, got %+v", report.Results)
+	}
+
+	report = n.DrainEmptyNodes(context.Background(), opts, true, false)
+	if report.Count(StatusApplied) != 2 {
+		t.Errorf("expected two drained nodes, got %+v", report.Results)
+	}
+	for _, id := range []string{"empty", "system-only"} {
+		if node := client.Node(id); !node.Drain || node.SchedulingEligibility != nomad.NodeSchedulingIneligible {
+			t.Errorf("expected %s to be drained and ineligible, got %+v", id, node)
+		}
+	}
+	if node := client.Node("busy"); node.Drain {
+		t.Error("expected the busy node to be left alone")
+	}
+	if len(posted) != 1 || posted[0].Action != "drain" || len(posted[0].Nodes) != 2 {
+		t.Errorf("expected the drained nodes to be posted, got %+v", posted)
+	}
+
+	// Restoring forgets nodes that were terminated in the meantime
+	client.mu.Lock()
+	delete(client.nodes, "empty")
+	client.mu.Unlock()
+	report = n.RestoreDrainedNodes(context.Background(), opts, true, false)
+	if report.Count(StatusApplied) != 1 || report.Count(StatusSkipped) != 1 {
+		t.Errorf("expected one restored and one gone node, got %+v", report.Results)
+	}
+	if node := client.Node("system-only"); node.Drain || node.SchedulingEligibility != nomad.NodeSchedulingEligible {
+		t.Errorf("expected the node to be eligible again, got %+v", node)
+	}
+	if len(posted) != 2 || posted[1].Action != "restore" || len(posted[1].Nodes) != 1 {
+		t.Errorf("expected the restored node to be posted, got %+v", posted)
+	}
+	state, err := readDrainedNodes()
+	if err != nil || len(state) != 0 {
+		t.Errorf("expected no drained nodes left, got %v, %v", state, err)
+	}
+}
+
+func TestNomadHelper_DrainEmptyNodes_Regions(t *testing.T) {
+	_, cleanup := inTempDir(t)
+	defer cleanup()
+
+	// Regions behind one address list only their own nodes
+	regions := map[string]*NomadHelper{}
+	for _, region := range []string{"eu", "us"} {
+		client := NewFakeClient()
+		client.AddNode(testNode(region+"-empty", "dc1"))
+		client.AddNode(testNode(region+"-busy", "dc1"))
+		client.AddAllocation(nodeAlloc(region+"-a1", region+"-busy", "service"), nil)
+		n := newTestHelper(client)
+		n.Out = ioutil.Discard
+		n.Config = &nomad.Config{Address: "http://127.0.0.1:4646", Region: region}
+		regions[region] = n
+	}
+	opts := DrainOptions{MinNodes: 1, Deadline: time.Hour}
+	for _, region := range []string{"eu", "us"} {
+		if report := regions[region].DrainEmptyNodes(context.Background(), opts, true, false); report.Count(StatusApplied) != 1 {
+			t.Fatalf("expected a drained node in %s, got %+v", region, report.Results)
+		}
+	}
+
+	report := regions["eu"].RestoreDrainedNodes(context.Background(), opts, true, false)
+	if report.Count(StatusApplied) != 1 || report.Count(StatusSkipped) != 0 {
+		t.Errorf("expected only the eu node to be restored, got %+v", report.Results)
+	}
+	report = regions["us"].RestoreDrainedNodes(context.Background(), opts, true, false)
+	if report.Count(StatusApplied) != 1 {
+		t.Errorf("expected the us node to be restored, got %+v", report.Results)
+	}
+	if node := regions["us"].Client.(*FakeClient).Node("us-empty"); node.Drain {
+		t.Error("expected the us node to be eligible again")
+	}
+}
+
+func TestNomadHelper_PausePeriodic(t *testing.T) {
+	periodic := testJob("report", 1, nil)
+	periodic.Type = stringToPtr("batch")
+	periodic.Periodic = &nomad.PeriodicConfig{Spec: stringToPtr("*/30 * * * *")}
+	client := NewFakeClient(periodic, testJob("web", 3, nil))
+	n := newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+	n.PausePeriodic = true
+
+	n.ScaleInJobs(context.Background(), true, false)
+	job := client.Job("report")
+	if *job.Periodic.Enabled || job.Meta[PeriodicSpecMetaKey] != "*/30 * * * *" || !PeriodicPaused(job) {
+		t.Errorf("expected the periodic job to be paused with its spec saved, got %+v %v", job.Periodic, job.Meta)
+	}
+	if job := client.Job("web"); job.Periodic != nil || job.Meta[PeriodicSpecMetaKey] != "" {
+		t.Errorf("expected the service job to only be scaled in, got %v", job.Meta)
+	}
+
+	out.Reset()
+	n.ListJobs(context.Background(), false, "batch")
+	if !strings.Contains(out.String(), "Every 30 minutes (paused)") {
+		t.Errorf("expected the paused state in the list output:\n%s", out.String())
+	}
+
+	n.ScaleOutJobs(context.Background(), true, false)
+	job = client.Job("report")
+	if !*job.Periodic.Enabled || *job.Periodic.Spec != "*/30 * * * *" || PeriodicPaused(job) {
+		t.Errorf("expected the periodic job to be enabled again, got %+v %v", job.Periodic, job.Meta)
+	}
+}
+
+func TestNomadHelper_ScaleInSystemJobs(t *testing.T) {
+	system := testJob("logs", 1, nil)
+	system.Type = stringToPtr("system")
+	sysbatch := testJob("patch", 1, nil)
+	sysbatch.Type = stringToPtr("sysbatch")
+	client := NewFakeClient(system, sysbatch)
+	n := newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+
+	report := n.ScaleInJobs(context.Background(), true, false)
+	if report.Count(StatusSkipped) != 2 || client.Calls("Jobs.Register") != 0 {
+		t.Errorf("expected system jobs to be skipped by default, got %+v", report.Results)
+	}
+	if got := strings.Join(strings.Fields(out.String()), " "); !strings.Contains(got, "logs wrong type system job") ||
+		!strings.Contains(got, "patch wrong type sysbatch job") {
+		t.Errorf("expected a skip reason per job type:\n%s", out.String())
+	}
+
+	constraint, err := ParseConstraint("${node.class} = always-on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SystemConstraint = constraint
+	report = n.ScaleInJobs(context.Background(), true, false)
+	if report.Count(StatusApplied) != 1 || report.Count(StatusSkipped) != 1 {
+		t.Errorf("expected the system job to be constrained and the sysbatch job skipped, got %+v", report.Results)
+	}
+	job := client.Job("logs")
+	if len(job.Constraints) != 1 || job.Constraints[0].RTarget != "always-on" || *job.TaskGroups[0].Count != 1 ||
+		job.Meta["custodian-action"] != "scaled-in" {
+		t.Errorf("expected the constraint to be added, got %+v %v", job.Constraints, job.Meta)
+	}
+
+	n.ScaleOutJobs(context.Background(), true, false)
+	if job := client.Job("logs"); len(job.Constraints) != 0 || job.Meta["custodian-action"] != "" {
+		t.Errorf("expected scale-out to remove the constraint, got %+v %v", job.Constraints, job.Meta)
+	}
+
+	if _, err := ParseConstraint("${node.class}"); err == nil {
+		t.Error("expected an incomplete constraint to be rejected")
+	}
+}
+
+func TestJobSelector_Skip(t *testing.T) {
+	selector := JobSelector{Jobs: []string{"web-*", "api"}, Ignore: []string{"web-legacy"}}
+	tests := []struct {
+		name       string
+		wantReason string
+		wantSkip   bool
+	}{
+		{"web-frontend", "", false},
+		{"api", "", false},
+		{"web-legacy", SkipIgnoredConfig, true},
+		{"worker", SkipFilteredOut, true},
+	}
+	for _, tt := range tests {
+		reason, _, skip := selector.Skip(tt.name)
+		if reason != tt.wantReason || skip != tt.wantSkip {
+			t.Errorf("%s: expected %q %t, got %q %t", tt.name, tt.wantReason, tt.wantSkip, reason, skip)
+		}
+	}
+	if _, _, skip := (JobSelector{}).Skip("anything"); skip {
+		t.Error("expected an empty selector to select every job")
+	}
+}
+
+func TestNomadHelper_SkipReasons(t *testing.T) {
+	pending := testJob("pending", 2, nil)
+	pending.Status = stringToPtr("pending")
+	client := NewFakeClient(testJob("web", 3, nil), testJob("legacy", 3, nil), testJob("worker", 3, nil),
+		testJob("pinned", 3, map[string]string{"custodian-ignore": "true"}), testJob("done", 1,
+			map[string]string{"custodian-action": "scaled-in"}), pending)
+	n := newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+	n.Selector = JobSelector{Jobs: []string{"web", "legacy", "pinned", "done", "pending"}, Ignore: []string{"leg*"}}
+
+	report := n.ScaleInJobs(context.Background(), false, false)
+	want := map[string]string{"legacy": SkipIgnoredConfig, "worker": SkipFilteredOut, "pinned": SkipIgnoredMeta,
+		"done": SkipScaledIn, "pending": SkipNotRunning}
+	for _, result := range report.Filter(StatusSkipped) {
+		if want[result.JobID] != result.Reason {
+			t.Errorf("expected %s to be skipped as %q, got %q", result.JobID, want[result.JobID], result.Reason)
+		}
+		delete(want, result.JobID)
+	}
+	if len(want) != 0 {
+		t.Errorf("expected skips for %v", want)
+	}
+	got := strings.Join(strings.Fields(out.String()), " ")
+	for _, row := range []string{"legacy ignored via config leg*", "pending not running pending", "Skip Reason Jobs",
+		"ignored via meta 1", "already scaled in 1", "filtered out 1"} {
+		if !strings.Contains(got, row) {
+			t.Errorf("expected %q in output:\n%s", row, out.String())
+		}
+	}
+}
+
+func TestNomadHelper_IgnoreJobs(t *testing.T) {
+	_, cleanup := inTempDir(t)
+	defer cleanup()
+
+	expired := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	client := NewFakeClient(
+		agedJob("vault", "service", "dead", 30*24*time.Hour),
+		agedJob("old", "service", "dead", 30*24*time.Hour),
+		testJob("vault-preview", 1, map[string]string{ExpiresMetaKey: expired}),
+		testJob("preview", 1, map[string]string{ExpiresMetaKey: expired}),
+		testJob("vault-legacy", 1, map[string]string{MarkedForMetaKey: "stop@2026-01-01"}))
+	n := newTestHelper(client)
+	n.Out = ioutil.Discard
+	n.Selector = JobSelector{Ignore: []string{"vault*"}}
+
+	reports := []*Report{
+		n.GCJobs(context.Background(), GCOptions{DeadFor: 24 * time.Hour}, true, false),
+		n.ExpireJobs(context.Background(), ExpireOptions{Purge: true}, true, false),
+		n.ProcessMarks(context.Background(), time.Time{}, true, false),
+	}
+	for _, report := range reports {
+		for _, result := range report.Results {
+			ignored := strings.HasPrefix(result.JobID, "vault")
+			if ignored && (result.Status != StatusSkipped || result.Reason != SkipIgnoredConfig) {
+				t.Errorf("%s: expected %s to be ignored via config, got %+v", report.Command, result.JobID, result)
+			}
+			if !ignored && result.Status != StatusApplied {
+				t.Errorf("%s: expected %s to be changed, got %+v", report.Command, result.JobID, result)
+			}
+		}
+	}
+	for _, id := range []string{"vault", "vault-preview"} {
+		if client.Job(id) == nil {
+			t.Errorf("expected %s to be kept", id)
+		}
+	}
+	if job := client.Job("vault-legacy"); job == nil || *job.Status != "running" {
+		t.Errorf("expected vault-legacy to keep running, got %+v", job)
+	}
+	if client.Job("old") != nil || client.Job("preview") != nil {
+		t.Error("expected the jobs not ignored to be purged")
+	}
+
+	batches, _ := ListDeleteBatches()
+	n.Selector = JobSelector{Ignore: []string{"old"}}
+	for _, batch := range batches {
+		n.UndeleteJobs(context.Background(), batch.ID, true, false)
+	}
+	if client.Job("old") != nil || client.Job("preview") == nil {
+		t.Errorf("expected only preview to be restored from %d batches", len(batches))
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	original := testJob("web", 3, nil)
+	original.Version = uint64ToPtr(0)
+	scaledIn := func(meta map[string]string) *nomad.Job {
+		job := testJob("web", 1, map[string]string{"custodian-action": "scaled-in", "custodian-revert-version": "0",
+			"custodian-web-count": "3"})
+		for k, v := range meta {
+			job.SetMeta(k, v)
+		}
+		return job
+	}
+	tests := []struct {
+		name     string
+		job      *nomad.Job
+		versions []*nomad.Job
+		want     string
+		wantFix  string
+	}{
+		{"Consistent", scaledIn(nil), []*nomad.Job{original}, "", ""},
+		{"Not Scaled In", testJob("web", 3, nil), nil, "", ""},
+		{"Stale Keys", testJob("web", 3, map[string]string{"custodian-web-count": "3"}), nil,
+			"custodian-web-count left without custodian-action", FixClearMeta},
+		{"Unknown Action", testJob("web", 3, map[string]string{"custodian-action": "paused"}), nil,
+			`unknown custodian-action "paused"`, FixClearMeta},
+		{"Count Edited", scaledIn(map[string]string{"custodian-web-count": "5"}), []*nomad.Job{original},
+			"custodian-web-count is 5, version 0 has 3", FixRecomputeCounts},
+		{"Missing Version", scaledIn(nil), nil, "revert version 0 no longer exists", FixScaleOut},
+		{"Missing Count", scaledIn(map[string]string{"custodian-web-count": ""}), []*nomad.Job{original},
+			`invalid custodian-web-count ""`, FixRecomputeCounts},
+		{"Removed Group", scaledIn(map[string]string{"custodian-api-count": "2"}), []*nomad.Job{original},
+			"custodian-api-count saved for a group that no longer exists", FixRecomputeCounts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := Diagnose(tt.job, tt.versions)
+			if got := strings.Join(d.Problems, "; "); got != tt.want || d.Fix != tt.wantFix {
+				t.Errorf("expected %q fixed with %q, got %q fixed with %q", tt.want, tt.wantFix, got, d.Fix)
+			}
+		})
+	}
+}
+
+func TestNomadHelper_Doctor(t *testing.T) {
+	client := NewFakeClient(testJob("web", 3, nil), testJob("api", 2, nil),
+		testJob("stale", 2, map[string]string{"custodian-stale-count": "2"}),
+		testJob("pinned", 2, map[string]string{"custodian-pinned-count": "2", "custodian-ignore": "true"}),
+		testJob("healthy", 2, nil))
+	n := newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+	n.Selector = JobSelector{Jobs: []string{"web", "api"}}
+	n.ScaleInJobs(context.Background(), true, false)
+	n.Selector = JobSelector{}
+
+	// A task group added by hand while scaled in, and a saved count edited
+	web := client.Job("web")
+	web.AddTaskGroup(nomad.NewTaskGroup("worker", 2).AddTask(nomad.NewTask("worker", "docker")))
+	client.AddJob(web)
+	api := client.Job("api")
+	api.SetMeta("custodian-api-count", "5")
+	client.AddJob(api)
+
+	out.Reset()
+	report := n.Doctor(context.Background(), "", false, false)
+	if report.Count(StatusWarned) != 4 || client.Calls("Jobs.Register") != 2 {
+		t.Fatalf("expected 4 jobs reported without changes, got %+v", report.Results)
+	}
+	got := strings.Join(strings.Fields(out.String()), " ")
+	for _, want := range []string{"web group worker has no saved count scale-out group worker runs 2 while scaled in",
+		"api custodian-api-count is 5, version 0 has 2 recompute-counts",
+		"stale custodian-stale-count left without custodian-action clear-meta"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in output:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(got, "healthy") {
+		t.Errorf("expected jobs without scale-in meta to be left out:\n%s", out.String())
+	}
+
+	report = n.Doctor(context.Background(), "unknown", true, false)
+	if report.Count(StatusFailed) != 1 {
+		t.Errorf("expected an unknown fix to fail, got %+v", report.Results)
+	}
+
+	report = n.Doctor(context.Background(), FixSuggested, true, false)
+	if report.Count(StatusApplied) != 3 || report.Count(StatusSkipped) != 1 {
+		t.Fatalf("expected 3 fixes and the ignored job skipped, got %+v", report.Results)
+	}
+	if job := client.Job("web"); len(job.TaskGroups) != 1 || *job.TaskGroups[0].Count != 3 || len(scaleMetaKeys(job)) != 0 {
+		t.Errorf("expected web to be scaled out to its revert version, got %v", job.Meta)
+	}
+	if job := client.Job("api"); job.Meta["custodian-api-count"] != "2" || job.Meta["custodian-action"] != "scaled-in" {
+		t.Errorf("expected the api count to be recomputed, got %v", job.Meta)
+	}
+	if job := client.Job("stale"); len(job.Meta) != 0 {
+		t.Errorf("expected the stale meta to be cleared, got %v", job.Meta)
+	}
+	if job := client.Job("pinned"); job.Meta["custodian-pinned-count"] != "2" {
+		t.Errorf("expected the ignored job to be left alone, got %v", job.Meta)
+	}
+
+	out.Reset()
+	n.Doctor(context.Background(), "", false, false)
+	if got := strings.Join(strings.Fields(out.String()), " "); strings.Contains(got, "web") || strings.Contains(got, "api") {
+		t.Errorf("expected the fixed jobs to be consistent:\n%s", out.String())
+	}
+}
+
+func TestNomadHelper_Doctor_StateStore(t *testing.T) {
+	dir, cleanup := inTempDir(t)
+	defer cleanup()
+	client := NewFakeClient(testJob("web", 3, nil), testJob("api", 2, nil), testJob("gone", 2, nil))
+	file := &FileStore{Path: filepath.Join(dir, "state.json")}
+	n := newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+	n.State = file
+	n.ScaleInJobs(context.Background(), true, false)
+
+	// A task group added by hand while scaled in, a saved count edited and
+	// a state left for a job scaled out by hand
+	web := client.Job("web")
+	web.AddTaskGroup(nomad.NewTaskGroup("worker", 2).AddTask(nomad.NewTask("worker", "docker")))
+	client.AddJob(web)
+	api := client.Job("api")
+	state, _ := file.Load(api)
+	state.Counts["api"] = 5
+	file.Save(api, state)
+	gone := client.Job("gone")
+	file.Save(gone, &ScaleState{Action: "paused"})
+
+	n = newTestHelper(client)
+	n.Out = &out
+	n.State = file
+	out.Reset()
+	report := n.Doctor(context.Background(), "", false, false)
+	if report.Count(StatusWarned) != 3 {
+		t.Fatalf("expected 3 jobs reported, got %+v", report.Results)
+	}
+	got := strings.Join(strings.Fields(out.String()), " ")
+	for _, want := range []string{"web group worker has no saved count scale-out group worker runs 2 while scaled in",
+		"api custodian-api-count is 5, version 0 has 2 recompute-counts",
+		`gone unknown custodian-action "paused" clear-meta`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in output:\n%s", want, out.String())
+		}
+	}
+
+	report = n.Doctor(context.Background(), FixSuggested, true, false)
+	if report.Count(StatusApplied) != 3 {
+		t.Fatalf("expected 3 fixes, got %+v", report.Results)
+	}
+	if job := client.Job("web"); len(job.TaskGroups) != 1 || *job.TaskGroups[0].Count != 3 {
+		t.Errorf("expected web to be scaled out to its revert version, got %+v", job.TaskGroups)
+	}
+	if state, _ := file.Load(client.Job("web")); state != nil {
+		t.Errorf("expected the state of web to be removed, got %+v", state)
+	}
+	if state, _ := file.Load(client.Job("api")); state == nil || state.Counts["api"] != 2 {
+		t.Errorf("expected the api count to be recomputed, got %+v", state)
+	}
+	if state, _ := file.Load(client.Job("gone")); state != nil {
+		t.Errorf("expected the unknown state to be cleared, got %+v", state)
+	}
+}
+
+func TestNomadHelper_ApplyPlan_Target(t *testing.T) {
+	dir, cleanup := inTempDir(t)
+	defer cleanup()
+
+	client := NewFakeClient(testJob("web", 3, nil))
+	n := newTestHelper(client)
+	n.Out = ioutil.Discard
+	n.Config = &nomad.Config{Address: "http://127.0.0.1:4646", Region: "eu", Namespace: "web"}
+	n.Plan = NewPlanFile("scale-in")
+	n.ScaleInJobs(context.Background(), false, false)
+
+	path := filepath.Join(dir, "plan.json")
+	if err := n.Plan.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the plan to be readable by the owner only, got %v %v", info.Mode(), err)
+	}
+	plan, err := ReadPlanFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, config := range []*nomad.Config{
+		{Address: "http://127.0.0.1:4646", Region: "us", Namespace: "web"},
+		{Address: "http://127.0.0.1:4646", Region: "eu", Namespace: "batch"},
+	} {
+		n.Config = config
+		report := n.ApplyPlan(context.Background(), plan)
+		failed := report.Filter(StatusFailed)
+		if len(failed) != 1 || failed[0].Name != "*" || !strings.Contains(failed[0].Error, "plan was made against") {
+			t.Errorf("expected the plan to be refused for %+v, got %+v", config, report.Results)
+		}
+	}
+	if client.Calls("Jobs.EnforceRegister") != 0 {
+		t.Error("expected no job to be registered")
+	}
+
+	n.Config = &nomad.Config{Address: "http://127.0.0.1:4646", Region: "eu", Namespace: "web"}
+	if report := n.ApplyPlan(context.Background(), plan); report.Count(StatusApplied) != 1 {
+		t.Errorf("expected the plan to be applied to its own target, got %+v", report.Results)
+	}
+}
+
+func TestNomadHelper_NativeScale(t *testing.T) {
+	client := NewFakeClient(testJob("web", 3, nil), testJob("api", 2, nil), testJob("single", 1, nil),
+		testJob("legacy", 4, nil))
+	// Jobs scaled in by registering them are still scaled out in native mode
+	legacy := client.Job("legacy")
+	scaleInJob(legacy)
+	client.AddJob(legacy)
+	n := newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+	n.NativeScale = true
+	n.Plan = NewPlanFile("scale-in")
+
+	report := n.ScaleInJobs(context.Background(), false, false)
+	if report.Count(StatusPlanned) != 2 || len(n.Plan.Changes) != 2 || n.Plan.Changes[0].Job != nil {
+		t.Fatalf("expected 2 planned scale changes, got %+v %+v", report.Results, n.Plan.Changes)
+	}
+	if got := strings.Join(strings.Fields(out.String()), " "); !strings.Contains(got, "Task Group From To web 3 1") {
+		t.Errorf("expected the count change in the output:\n%s", out.String())
+	}
+	if client.Calls("Scaling.Scale") != 0 {
+		t.Fatal("expected no counts to change while planning")
+	}
+
+	report = n.ApplyPlan(context.Background(), n.Plan)
+	if report.Count(StatusApplied) != 2 {
+		t.Fatalf("expected the planned scale changes to be applied, got %+v", report.Results)
+	}
+	job := client.Job("web")
+	if *job.TaskGroups[0].Count != 1 || len(job.Meta) != 0 || client.Calls("Jobs.Register") != 0 {
+		t.Errorf("expected web to be scaled without registering the job, got count %d and meta %v",
+			*job.TaskGroups[0].Count, job.Meta)
+	}
+	status, _, _ := client.Scaling().Status("web", nil)
+	if events := status.TaskGroups["web"].Events; len(events) != 1 || events[0].Meta["custodian-count"] != "3" {
+		t.Errorf("expected the original count in the scaling event, got %+v", events)
+	}
+
+	n.Plan = nil
+	report = n.ScaleInJobs(context.Background(), true, false)
+	for _, result := range report.Filter(StatusSkipped) {
+		if result.Reason != SkipScaledIn {
+			t.Errorf("expected %s to be skipped as scaled in, got %q", result.JobID, result.Reason)
+		}
+	}
+	if report.Count(StatusSkipped) != 4 || client.Calls("Scaling.Scale") != 2 {
+		t.Errorf("expected every job to be skipped, got %+v", report.Results)
+	}
+
+	client.FailNext("Scaling.Status", "api", 1, fmt.Errorf("permission denied"))
+	report = n.ScaleOutJobs(context.Background(), true, false)
+	if report.Count(StatusApplied) != 2 || report.Count(StatusFailed) != 1 {
+		t.Fatalf("expected web and legacy to be scaled out and api to fail, got %+v", report.Results)
+	}
+	if *client.Job("web").TaskGroups[0].Count != 3 || *client.Job("legacy").TaskGroups[0].Count != 4 {
+		t.Errorf("expected the original counts to be restored")
+	}
+	report = n.ScaleOutJobs(context.Background(), true, false)
+	if report.Count(StatusApplied) != 1 || *client.Job("api").TaskGroups[0].Count != 2 {
+		t.Errorf("expected api to be scaled out on the next run, got %+v", report.Results)
+	}
+}
+
+// consulStandIn serves the Consul KV endpoint from a map
+func consulStandIn(kv map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		if r.Header.Get("X-Consul-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			value, ok := kv[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, value)
+		case http.MethodPut:
+			body, _ := ioutil.ReadAll(r.Body)
+			kv[key] = string(body)
+			fmt.Fprint(w, "true")
+		case http.MethodDelete:
+			delete(kv, key)
+			fmt.Fprint(w, "true")
+		}
+	}))
+}
+
+func TestStateStores(t *testing.T) {
+	dir, cleanup := inTempDir(t)
+	defer cleanup()
+	kv := make(map[string]string)
+	consul := consulStandIn(kv)
+	defer consul.Close()
+	client := NewFakeClient()
+
+	stores := []StateStore{
+		MetaStore{},
+		&VariablesStore{Client: client, Prefix: DefaultStatePrefix},
+		&ConsulStore{Address: consul.URL, Token: "secret", Prefix: DefaultStatePrefix},
+		&FileStore{Path: filepath.Join(dir, "state.json"), Cluster: "http://127.0.0.1:4646"},
+	}
+	for _, store := range stores {
+		t.Run(store.Name(), func(t *testing.T) {
+			job := testJob("web", 3, nil)
+			job.Canonicalize()
+			if state, err := store.Load(job); err != nil || state != nil {
+				t.Fatalf("expected no state, got %+v %v", state, err)
+			}
+			want := &ScaleState{Action: "scaled-in", RevertVersion: uint64ToPtr(4), Counts: map[string]int{"web": 3},
+				PeriodicSpec: "*/30 * * * *"}
+			if !inMeta(store) {
+				want.Version, want.JobModifyIndex = uint64ToPtr(5), uint64ToPtr(42)
+			}
+			if err := store.Save(job, want); err != nil {
+				t.Fatal(err)
+			}
+			got, err := store.Load(job)
+			if err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %+v, got %+v %v", want, got, err)
+			}
+			if err := store.Delete(job); err != nil {
+				t.Fatal(err)
+			}
+			if state, err := store.Load(job); err != nil || state != nil {
+				t.Errorf("expected the state to be deleted, got %+v %v", state, err)
+			}
+		})
+	}
+	if _, err := (&ConsulStore{Address: consul.URL, Prefix: DefaultStatePrefix}).Load(testJob("web", 3, nil)); err == nil {
+		t.Error("expected consul errors to be returned")
+	}
+	if _, err := newTestHelper(client).NewStateStore("etcd", StateStoreOptions{}); err == nil {
+		t.Error("expected an unknown store to be rejected")
+	}
+}
+
+func TestNomadHelper_ScaleOutAfterRedeploy(t *testing.T) {
+	dir, cleanup := inTempDir(t)
+	defer cleanup()
+	client := NewFakeClient(testJob("web", 3, nil), testJob("api", 2, nil))
+	file := &FileStore{Path: filepath.Join(dir, "state.json")}
+	n := newTestHelper(client)
+	n.Out = ioutil.Discard
+	n.State = file
+	if report := n.ScaleInJobs(context.Background(), true, false); report.Count(StatusApplied) != 2 {
+		t.Fatalf("expected both jobs to be scaled in, got %+v", report.Results)
+	}
+	if state, _ := file.Load(client.Job("web")); state == nil || state.Version == nil || *state.Version != 1 {
+		t.Fatalf("expected the scaled in version in the state, got %+v", state)
+	}
+
+	// web is redeployed from its jobspec while scaled in
+	client.Jobs().Register(testJob("web", 4, nil), nil)
+
+	n = newTestHelper(client)
+	n.Out = ioutil.Discard
+	n.State = file
+	report := n.ScaleOutJobs(context.Background(), true, false)
+
+	failed := report.Filter(StatusFailed)
+	if len(failed) != 1 || failed[0].JobID != "web" || !strings.Contains(failed[0].Error, "registered again") {
+		t.Errorf("expected web to fail with drift, got %+v", report.Results)
+	}
+	if job := client.Job("web"); *job.Version != 2 || *job.TaskGroups[0].Count != 4 {
+		t.Errorf("expected the redeploy of web to be kept, got version %d count %d", *job.Version, *job.TaskGroups[0].Count)
+	}
+	if state, _ := file.Load(client.Job("web")); state == nil {
+		t.Error("expected the state of web to be kept")
+	}
+	if job := client.Job("api"); report.Count(StatusApplied) != 1 || *job.TaskGroups[0].Count != 2 {
+		t.Errorf("expected api to be scaled out, got %+v", report.Results)
+	}
+}
+
+func TestNomadHelper_StateStore(t *testing.T) {
+	client := NewFakeClient(testJob("web", 3, nil), testJob("api", 2, nil))
+	n := newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+	// api was scaled in before the state moved out of the job meta
+	n.Selector = JobSelector{Jobs: []string{"api"}}
+	n.ScaleInJobs(context.Background(), true, false)
+	n.Selector = JobSelector{}
+	n.State = &VariablesStore{Client: client, Prefix: DefaultStatePrefix}
+
+	report := n.ScaleInJobs(context.Background(), true, false)
+	if report.Count(StatusApplied) != 1 || report.Count(StatusSkipped) != 1 {
+		t.Fatalf("expected web to be scaled in and api skipped, got %+v", report.Results)
+	}
+	job := client.Job("web")
+	if *job.TaskGroups[0].Count != 1 || len(job.Meta) != 0 {
+		t.Errorf("expected web to be scaled in without meta, got %v", job.Meta)
+	}
+	variable, _, _ := client.Variables().Read("nomad-custodian/web", nil)
+	if variable == nil || variable.Items["web-count"] != "3" || variable.Items["revert-version"] != "0" {
+		t.Fatalf("expected the state in a variable, got %+v", variable)
+	}
+
+	out.Reset()
+	n.ListJobs(context.Background(), false, "service")
+	if got := strings.Join(strings.Fields(out.String()), " "); !strings.Contains(got,
+		"custodian-action scaled-in (nomad-variables) custodian-revert-version 0 custodian-web-count 3") {
+		t.Errorf("expected the variable in the list output:\n%s", out.String())
+	}
+
+	report = n.ScaleOutJobs(context.Background(), true, false)
+	if report.Count(StatusApplied) != 2 {
+		t.Fatalf("expected both jobs to be scaled out, got %+v", report.Results)
+	}
+	if *client.Job("web").TaskGroups[0].Count != 3 || *client.Job("api").TaskGroups[0].Count != 2 {
+		t.Errorf("expected the original counts to be restored")
+	}
+	if variable, _, _ := client.Variables().Read("nomad-custodian/web", nil); variable != nil {
+		t.Errorf("expected the variable to be deleted, got %+v", variable)
+	}
+
+	// A state that could not be saved leaves the job unchanged
+	client.FailNext("Variables.Upsert", "", 1, fmt.Errorf("permission denied"))
+	report = n.ScaleInJobs(context.Background(), true, false)
+	if report.Count(StatusFailed) != 1 || *client.Job("web").TaskGroups[0].Count+*client.Job("api").TaskGroups[0].Count != 4 {
+		t.Errorf("expected one job to fail and stay scaled out, got %+v", report.Results)
+	}
+}
+
+func TestNomadHelper_MigrateState(t *testing.T) {
+	dir, cleanup := inTempDir(t)
+	defer cleanup()
+	client := NewFakeClient(testJob("web", 3, nil), testJob("api", 2, nil))
+	n := newTestHelper(client)
+	var out bytes.Buffer
+	n.Out = &out
+	n.ScaleInJobs(context.Background(), true, false)
+	file := &FileStore{Path: filepath.Join(dir, "state.json")}
+
+	report := n.MigrateState(context.Background(), MetaStore{}, file, false, false)
+	if report.Count(StatusPlanned) != 2 || client.Job("web").Meta["custodian-action"] != "scaled-in" {
+		t.Fatalf("expected 2 planned migrations, got %+v", report.Results)
+	}
+	report = n.MigrateState(context.Background(), MetaStore{}, file, true, false)
+	if report.Count(StatusApplied) != 2 {
+		t.Fatalf("expected 2 migrations, got %+v", report.Results)
+	}
+	job := client.Job("web")
+	if state, _ := file.Load(job); len(job.Meta) != 0 || !state.ScaledIn() || state.Counts["web"] != 3 {
+		t.Errorf("expected the state to move to the file, got meta %v and %+v", job.Meta, state)
+	}
+
+	report = n.MigrateState(context.Background(), file, &VariablesStore{Client: client, Prefix: "custodian"}, true, false)
+	if report.Count(StatusApplied) != 2 {
+		t.Fatalf("expected 2 migrations, got %+v", report.Results)
+	}
+	if state, _ := file.Load(job); state != nil {
+		t.Errorf("expected the file to be emptied, got %+v", state)
+	}
+
+	n.ScaleOutJobs(context.Background(), true, false)
+	if *client.Job("web").TaskGroups[0].Count != 3 || *client.Job("api").TaskGroups[0].Count != 2 {
+		t.Errorf("expected the migrated state to scale the jobs out")
+	}
+	if report := n.MigrateState(context.Background(), MetaStore{}, MetaStore{}, true, false); report.Count(StatusFailed) != 1 {
+		t.Errorf("expected migrating to the same store to fail, got %+v", report.Results)
+	}
+}
@@ -0,0 +1,243 @@
+package nomadhelper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/ryanuber/columnize"
+)
+
+// PlanFile is a saved set of job changes that can be reviewed and applied
+// later. Each change records the job modify index it was planned against so
+// jobs changed in the meantime are refused instead of overwritten.
+type PlanFile struct {
+	Command   string          `json:"command"`
+	Address   string          `json:"address"`
+	Region    string          `json:"region,omitempty"`
+	Namespace string          `json:"namespace,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	Changes   []PlannedChange `json:"changes"`
+}
+
+// PlannedChange is the job spec to register for a single job, or the task
+// group counts to change through the scale endpoint in native scale mode
+type PlannedChange struct {
+	JobID          string         `json:"job_id"`
+	Name           string         `json:"name"`
+	Action         string         `json:"action"`
+	JobModifyIndex uint64         `json:"job_modify_index"`
+	Diff           *nomad.JobDiff `json:"diff,omitempty"`
+	Job            *nomad.Job     `json:"job,omitempty"`
+	Scale          []GroupScale   `json:"scale,omitempty"`
+
+	// State is saved to the configured state store before a scale-in is
+	// registered, and ClearState removes it after a scale-out
+	State      *ScaleState `json:"state,omitempty"`
+	ClearState bool        `json:"clear_state,omitempty"`
+}
+
+// NewPlanFile returns an empty plan for the given command
+func NewPlanFile(command string) *PlanFile {
+	return &PlanFile{Command: command, CreatedAt: time.Now().UTC()}
+}
+
+// Add records a planned change and returns it
+func (p *PlanFile) Add(action string, job *nomad.Job, modifyIndex uint64, diff *nomad.JobDiff) *PlannedChange {
+	p.Changes = append(p.Changes, PlannedChange{
+		JobID:          *job.ID,
+		Name:           *job.Name,
+		Action:         action,
+		JobModifyIndex: modifyIndex,
+		Diff:           diff,
+		Job:            job,
+	})
+	return &p.Changes[len(p.Changes)-1]
+}
+
+// AddScale records planned task group count changes
+func (p *PlanFile) AddScale(action string, job *nomad.Job, changes []GroupScale) {
+	p.Changes = append(p.Changes, PlannedChange{
+		JobID:          *job.ID,
+		Name:           *job.Name,
+		Action:         action,
+		JobModifyIndex: *job.JobModifyIndex,
+		Scale:          changes,
+	})
+}
+
+// Write saves the plan as JSON, readable only by the owner as it holds full
+// job specs
+func (p *PlanFile) Write(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0600)
+}
+
+// ReadPlanFile loads a plan written by PlanFile.Write
+func ReadPlanFile(path string) (*PlanFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plan := new(PlanFile)
+	if err := json.Unmarshal(data, plan); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return plan, nil
+}
+
+// recordPlan adds a planned change to the plan file being written, if any,
+// and returns it
+func (n *NomadHelper) recordPlan(action string, job *nomad.Job, modifyIndex uint64, diff *nomad.JobDiff) *PlannedChange {
+	if n.Plan == nil {
+		return nil
+	}
+	n.planTarget()
+	return n.Plan.Add(action, job, modifyIndex, diff)
+}
+
+// recordScalePlan adds planned task group count changes to the plan file
+// being written, if any
+func (n *NomadHelper) recordScalePlan(action string, job *nomad.Job, changes []GroupScale) {
+	if n.Plan == nil {
+		return
+	}
+	n.planTarget()
+	n.Plan.AddScale(action, job, changes)
+}
+
+// planTarget records the cluster the plan is made against
+func (n *NomadHelper) planTarget() {
+	if n.Plan.Address == "" && n.Config != nil {
+		n.Plan.Address = n.Config.Address
+		n.Plan.Region = n.Config.Region
+		n.Plan.Namespace = n.Config.Namespace
+	}
+}
+
+// checkTarget returns an error when a saved file, e.g. a plan, was made
+// against another address, region or namespace than the configured one.
+// Files without an address are not checked.
+func (n *NomadHelper) checkTarget(what string, address string, region string, namespace string) error {
+	if n.Config == nil || address == "" {
+		return nil
+	}
+	target := func(address string, region string, namespace string) string {
+		if region == "" {
+			region = "default region"
+		}
+		if namespace == "" {
+			namespace = "default namespace"
+		}
+		return fmt.Sprintf("%s (%s, %s)", address, region, namespace)
+	}
+	if address != n.Config.Address || region != n.Config.Region || namespace != n.Config.Namespace {
+		return fmt.Errorf("%s was made against %s, not %s", what, target(address, region, namespace),
+			target(n.Config.Address, n.Config.Region, n.Config.Namespace))
+	}
+	return nil
+}
+
+// ApplyPlan registers exactly the jobs in a saved plan. Jobs not selected by
+// n.Selector are skipped, a job whose modify index no longer matches the plan
+// is refused, and the plan is refused as a whole when it was made against a
+// different cluster, region or namespace. Once ctx is done no further jobs
+// are changed.
+func (n *NomadHelper) ApplyPlan(ctx context.Context, plan *PlanFile) *Report {
+	var jobsSkipped []string
+
+	report := NewReport("apply", true)
+	defer report.Finish()
+
+	if err := n.checkTarget("plan", plan.Address, plan.Region, plan.Namespace); err != nil {
+		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: plan.Command, Status: StatusFailed, Error: err.Error()})
+		n.writeFailures(report)
+		return report
+	}
+
+	jobs := n.Client.Jobs()
+	for _, change := range plan.Changes {
+		stub := &nomad.JobListStub{ID: change.JobID, Name: change.Name}
+		if n.cancelled(ctx, report, stub, change.Action) {
+			continue
+		}
+		if reason, detail, skip := n.Selector.Skip(change.Name); skip {
+			jobsSkipped = append(jobsSkipped, skipped(report, stub, change.Action, reason, detail))
+			continue
+		}
+
+		current, _, err := jobs.Info(change.JobID, nil)
+		if err != nil {
+			n.failed(report, stub, change.Action, err)
+			continue
+		}
+		if *current.JobModifyIndex != change.JobModifyIndex {
+			n.failed(report, stub, change.Action, fmt.Errorf("job modified since the plan was made (modify index %d, planned %d)",
+				*current.JobModifyIndex, change.JobModifyIndex))
+			continue
+		}
+
+		fmt.Fprintf(n.out(), "Job: %s, %s\n", change.Name, change.Action)
+		if change.Job == nil {
+			// Native scale mode changes counts without registering the job
+			fprintGroupScales(n.out(), change.Scale)
+			err := n.applyScale(ctx, change.JobID, change.Action, change.Scale)
+			report.Add(n.applyResult(current, change.Action, err))
+			continue
+		}
+		if change.Diff != nil {
+			FprintJobDiff(n.out(), *change.Diff)
+		}
+
+		store := n.stateStore()
+		if change.State != nil && !inMeta(store) {
+			if err := store.Save(change.Job, change.State); err != nil {
+				n.failed(report, stub, change.Action, fmt.Errorf("saving the scale state to %s: %v", store.Name(), err))
+				continue
+			}
+		}
+
+		// The modify index is enforced again by Nomad in case the job
+		// changes between the check above and the register
+		resp, _, err := jobs.EnforceRegister(change.Job, change.JobModifyIndex, nil)
+		n.Inventory().Invalidate(change.JobID)
+		if err != nil {
+			n.Logger.Error(err)
+			if change.State != nil && !inMeta(store) {
+				if deleteErr := store.Delete(change.Job); deleteErr != nil {
+					n.Logger.Error(deleteErr)
+				}
+			}
+		} else {
+			if resp.Warnings != "" {
+				n.Logger.Infof("Warnings: %s\n", resp.Warnings)
+			}
+			switch {
+			case change.ClearState:
+				err = dropState(change.Job, store)
+			case change.State != nil && !inMeta(store):
+				err = n.saveScaledIn(change.Job, change.State, store)
+			}
+		}
+		report.Add(n.applyResult(change.Job, change.Action, err))
+	}
+
+	if len(jobsSkipped) > 0 {
+		output := append([]string{"Jobs Skipped|Reason|Detail"}, jobsSkipped...)
+		fmt.Fprintf(n.out(), "\n%s\n", columnize.SimpleFormat(output))
+	}
+	n.writeFailures(report)
+	n.writeSkipReasons(report)
+	return report
+}
@@ -0,0 +1,84 @@
+package nomadhelper
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+// ErrQuit is returned by Approver once the user has quit
+var ErrQuit = errors.New("quit by user")
+
+// Approver asks for approval of each job change in interactive mode
+type Approver struct {
+	in   *bufio.Reader
+	out  io.Writer
+	all  bool
+	quit bool
+}
+
+// NewApprover returns an approver reading answers from in and writing
+// prompts to out
+func NewApprover(in io.Reader, out io.Writer) *Approver {
+	return &Approver{in: bufio.NewReader(in), out: out}
+}
+
+// Approve asks whether to apply the action to a job. Answering all approves
+// this and every following job, answering quit declines this and every
+// following job with ErrQuit. Running out of input is treated as quit.
+func (a *Approver) Approve(action string, name string) (bool, error) {
+	if a.quit {
+		return false, ErrQuit
+	}
+	if a.all {
+		return true, nil
+	}
+
+	for {
+		fmt.Fprintf(a.out, "%s %s? [y]es, [n]o, [a]ll, [q]uit (default no): ", action, name)
+		line, err := a.in.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(a.out)
+			a.quit = true
+			return false, ErrQuit
+		}
+
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			return true, nil
+		case "n", "no", "":
+			return false, nil
+		case "a", "all":
+			a.all = true
+			return true, nil
+		case "q", "quit":
+			a.quit = true
+			return false, ErrQuit
+		}
+	}
+}
+
+// approved asks for approval when running interactively and reports whether
+// the change should go ahead. Declined jobs are recorded as skipped, jobs
+// after a quit or once ctx is done as cancelled.
+func (n *NomadHelper) approved(ctx context.Context, report *Report, jobStub *nomad.JobListStub, action string) bool {
+	if n.Approver == nil {
+		return !n.cancelled(ctx, report, jobStub, action)
+	}
+	ok, err := n.Approver.Approve(action, jobStub.Name)
+	if err != nil {
+		report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: action, Status: StatusCancelled, Error: err.Error()})
+		return false
+	}
+	if !ok {
+		report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: action, Status: StatusSkipped,
+			Reason: SkipDeclined, Detail: "declined"})
+		return false
+	}
+	return !n.cancelled(ctx, report, jobStub, action)
+}
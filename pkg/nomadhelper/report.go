@@ -0,0 +1,144 @@
+package nomadhelper
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ryanuber/columnize"
+)
+
+// ResultStatus describes the outcome of a custodian action on a single job
+type ResultStatus string
+
+// ResultStatus values recorded for each job in a run
+const (
+	StatusPlanned ResultStatus = "planned"
+	StatusApplied ResultStatus = "applied"
+	StatusSkipped ResultStatus = "skipped"
+	StatusFailed  ResultStatus = "failed"
+
+	// StatusCancelled is recorded for jobs left unchanged because the run
+	// was interrupted or timed out
+	StatusCancelled ResultStatus = "cancelled"
+
+	// StatusWarned is recorded for jobs left unchanged whose owners are
+	// warned about an upcoming action, e.g. jobs about to expire
+	StatusWarned ResultStatus = "warned"
+)
+
+// JobResult records what happened to a single job during a run
+type JobResult struct {
+	JobID  string
+	Name   string
+	Action string
+	Status ResultStatus
+	// Reason is why a skipped job was left unchanged, e.g. SkipIgnoredMeta
+	Reason string
+	Detail string
+	Error  string
+}
+
+// Report collects the per-job results of a single custodian run
+type Report struct {
+	Cluster   string
+	Command   string
+	Applied   bool
+	StartTime time.Time
+	EndTime   time.Time
+	Results   []JobResult
+
+	mu sync.Mutex
+}
+
+// NewReport returns an empty report for the given command
+func NewReport(command string, applied bool) *Report {
+	return &Report{
+		Command:   command,
+		Applied:   applied,
+		StartTime: time.Now(),
+	}
+}
+
+// Add records a job result. It is safe to call from multiple goroutines.
+func (r *Report) Add(result JobResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Results = append(r.Results, result)
+}
+
+// Merge adds the results of another report, e.g. of a phase run after the
+// main command
+func (r *Report) Merge(other *Report) {
+	other.mu.Lock()
+	results := append([]JobResult(nil), other.Results...)
+	other.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Results = append(r.Results, results...)
+}
+
+// Finish marks the end of the run
+func (r *Report) Finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.EndTime = time.Now()
+}
+
+// Filter returns the results with the given status
+func (r *Report) Filter(status ResultStatus) []JobResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var results []JobResult
+	for _, result := range r.Results {
+		if result.Status == status {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// Count returns the number of results with the given status
+func (r *Report) Count(status ResultStatus) int {
+	return len(r.Filter(status))
+}
+
+// SkipCounts returns the number of skipped jobs per reason. Failed jobs are
+// counted as SkipError. Skipped jobs without a reason are left out.
+func (r *Report) SkipCounts() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	counts := make(map[string]int)
+	for _, result := range r.Results {
+		switch {
+		case result.Status == StatusFailed:
+			counts[SkipError]++
+		case result.Status == StatusSkipped && result.Reason != "":
+			counts[result.Reason]++
+		}
+	}
+	return counts
+}
+
+// WriteSummary writes a table of every job that was changed, failed or left
+// unchanged by an interrupted run. Skipped jobs are left out.
+func (r *Report) WriteSummary(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	output := []string{"Job|Action|Status|Error"}
+	for _, result := range r.Results {
+		if result.Status == StatusSkipped {
+			continue
+		}
+		output = append(output, fmt.Sprintf("%s|%s|%s|%s", result.Name, result.Action, result.Status, result.Error))
+	}
+	if len(output) == 1 {
+		output = append(output, "None")
+	}
+	fmt.Fprintf(w, "%s\n", columnize.SimpleFormat(output))
+}
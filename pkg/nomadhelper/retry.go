@@ -0,0 +1,403 @@
+package nomadhelper
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"go.uber.org/zap"
+)
+
+// RetryPolicy controls how failed Nomad API calls are retried
+type RetryPolicy struct {
+	// Attempts is the total number of tries, including the first one
+	Attempts int
+	// BaseDelay is the delay before the first retry. It doubles on every
+	// following retry up to MaxDelay, with full jitter applied.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// DefaultRetryPolicy is used when no policy is configured
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:  3,
+	BaseDelay: 500 * time.Millisecond,
+	MaxDelay:  10 * time.Second,
+}
+
+// sleep waits for d or until ctx is done. It is replaced in tests.
+var sleep = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// responseCodePattern matches the status code in errors from the API client
+var responseCodePattern = regexp.MustCompile(`Unexpected response code: (\d+)`)
+
+// IsRetryable reports whether an error from the Nomad API is transient.
+// Server errors, rate limiting and connection failures are retryable; client
+// errors such as 400, 403 and 404 are permanent, as are modify index
+// conflicts, which Nomad reports as server errors.
+func IsRetryable(err error) bool {
+	if err == nil || strings.Contains(err.Error(), "Enforcing job modify index") {
+		return false
+	}
+
+	if m := responseCodePattern.FindStringSubmatch(err.Error()); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return code == 429 || code >= 500 && code != 501
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "connection reset") || strings.Contains(msg, "connection refused")
+}
+
+// isUnsent reports whether an error shows the request never reached Nomad:
+// the connection could not be established, or the request was rate limited
+// before it was handled. Only these failures are retried for calls that
+// change a job, as a reset or timeout may come after the change was applied.
+func isUnsent(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if m := responseCodePattern.FindStringSubmatch(err.Error()); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return code == 429
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return strings.Contains(err.Error(), "connection refused")
+}
+
+// backoff returns the delay before the given retry, starting at 1
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.BaseDelay << uint(retry-1)
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
+
+// do calls fn until it succeeds, returns an error that is not retryable or runs
+// out of attempts. Waiting for the next attempt stops when ctx is done, in
+// which case the last error is returned.
+func (p RetryPolicy) do(ctx context.Context, logger *zap.SugaredLogger, name string, retryable func(error) bool, fn func() error) error {
+	attempts := p.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = fn()
+		if err == nil || !retryable(err) || attempt == attempts {
+			return err
+		}
+		delay := p.backoff(attempt)
+		if logger != nil {
+			logger.Warnf("%s failed (attempt %d of %d), retrying in %s: %v", name, attempt, attempts, delay, err)
+		}
+		if sleep(ctx, delay) != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// retryClient wraps a NomadClient and retries transient failures. Reads and
+// idempotent writes are retried on any transient error; registering,
+// reverting, deregistering and scaling jobs only when the request never
+// reached Nomad.
+type retryClient struct {
+	client NomadClient
+	policy RetryPolicy
+	logger *zap.SugaredLogger
+	ctx    context.Context
+}
+
+// NewRetryClient wraps a client so every call is retried according to the policy
+func NewRetryClient(client NomadClient, policy RetryPolicy, logger *zap.SugaredLogger) NomadClient {
+	return &retryClient{client: client, policy: policy, logger: logger}
+}
+
+func (c *retryClient) Jobs() JobsAPI {
+	return &retryJobs{c.client.Jobs(), c}
+}
+
+func (c *retryClient) Deployments() DeploymentsAPI {
+	return &retryDeployments{c.client.Deployments(), c}
+}
+
+func (c *retryClient) Evaluations() EvaluationsAPI {
+	return &retryEvaluations{c.client.Evaluations(), c}
+}
+
+func (c *retryClient) Allocations() AllocationsAPI {
+	return &retryAllocations{c.client.Allocations(), c}
+}
+
+func (c *retryClient) Nodes() NodesAPI {
+	return &retryNodes{c.client.Nodes(), c}
+}
+
+func (c *retryClient) Scaling() ScalingAPI {
+	return &retryScaling{c.client.Scaling(), c}
+}
+
+func (c *retryClient) Variables() VariablesAPI {
+	return &retryVariables{c.client.Variables(), c}
+}
+
+// withContext returns a copy of the client whose backoff stops when ctx is done
+func (c *retryClient) withContext(ctx context.Context) *retryClient {
+	bound := *c
+	bound.ctx = ctx
+	return &bound
+}
+
+func (c *retryClient) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+func (c *retryClient) do(name string, fn func() error) error {
+	return c.policy.do(c.context(), c.logger, name, IsRetryable, fn)
+}
+
+// write retries a call that changes a job only when it was never sent
+func (c *retryClient) write(name string, fn func() error) error {
+	return c.policy.do(c.context(), c.logger, name, isUnsent, fn)
+}
+
+type retryJobs struct {
+	jobs JobsAPI
+	c    *retryClient
+}
+
+func (j *retryJobs) List(q *nomad.QueryOptions) (stubs []*nomad.JobListStub, qm *nomad.QueryMeta, err error) {
+	err = j.c.do("list jobs", func() error {
+		stubs, qm, err = j.jobs.List(q)
+		return err
+	})
+	return
+}
+
+func (j *retryJobs) Info(jobID string, q *nomad.QueryOptions) (job *nomad.Job, qm *nomad.QueryMeta, err error) {
+	err = j.c.do("read job "+jobID, func() error {
+		job, qm, err = j.jobs.Info(jobID, q)
+		return err
+	})
+	return
+}
+
+func (j *retryJobs) Versions(jobID string, diffs bool, q *nomad.QueryOptions) (versions []*nomad.Job, jobDiffs []*nomad.JobDiff, qm *nomad.QueryMeta, err error) {
+	err = j.c.do("read versions of job "+jobID, func() error {
+		versions, jobDiffs, qm, err = j.jobs.Versions(jobID, diffs, q)
+		return err
+	})
+	return
+}
+
+func (j *retryJobs) Plan(job *nomad.Job, diff bool, q *nomad.WriteOptions) (resp *nomad.JobPlanResponse, wm *nomad.WriteMeta, err error) {
+	err = j.c.do("plan job "+*job.ID, func() error {
+		resp, wm, err = j.jobs.Plan(job, diff, q)
+		return err
+	})
+	return
+}
+
+func (j *retryJobs) Register(job *nomad.Job, q *nomad.WriteOptions) (resp *nomad.JobRegisterResponse, wm *nomad.WriteMeta, err error) {
+	err = j.c.write("register job "+*job.ID, func() error {
+		resp, wm, err = j.jobs.Register(job, q)
+		return err
+	})
+	return
+}
+
+func (j *retryJobs) EnforceRegister(job *nomad.Job, modifyIndex uint64, q *nomad.WriteOptions) (resp *nomad.JobRegisterResponse, wm *nomad.WriteMeta, err error) {
+	err = j.c.write("register job "+*job.ID, func() error {
+		resp, wm, err = j.jobs.EnforceRegister(job, modifyIndex, q)
+		return err
+	})
+	return
+}
+
+func (j *retryJobs) Revert(jobID string, version uint64, enforcePriorVersion *uint64, q *nomad.WriteOptions,
+	vaultToken string) (resp *nomad.JobRegisterResponse, wm *nomad.WriteMeta, err error) {
+	err = j.c.write("revert job "+jobID, func() error {
+		resp, wm, err = j.jobs.Revert(jobID, version, enforcePriorVersion, q, vaultToken)
+		return err
+	})
+	return
+}
+
+func (j *retryJobs) Deregister(jobID string, purge bool, q *nomad.WriteOptions) (evalID string, wm *nomad.WriteMeta, err error) {
+	err = j.c.write("deregister job "+jobID, func() error {
+		evalID, wm, err = j.jobs.Deregister(jobID, purge, q)
+		return err
+	})
+	return
+}
+
+type retryDeployments struct {
+	deployments DeploymentsAPI
+	c           *retryClient
+}
+
+func (d *retryDeployments) List(q *nomad.QueryOptions) (deployments []*nomad.Deployment, qm *nomad.QueryMeta, err error) {
+	err = d.c.do("list deployments", func() error {
+		deployments, qm, err = d.deployments.List(q)
+		return err
+	})
+	return
+}
+
+func (d *retryDeployments) Info(deploymentID string, q *nomad.QueryOptions) (deployment *nomad.Deployment, qm *nomad.QueryMeta, err error) {
+	err = d.c.do("read deployment "+deploymentID, func() error {
+		deployment, qm, err = d.deployments.Info(deploymentID, q)
+		return err
+	})
+	return
+}
+
+type retryEvaluations struct {
+	evaluations EvaluationsAPI
+	c           *retryClient
+}
+
+func (e *retryEvaluations) Info(evalID string, q *nomad.QueryOptions) (eval *nomad.Evaluation, qm *nomad.QueryMeta, err error) {
+	err = e.c.do("read evaluation "+evalID, func() error {
+		eval, qm, err = e.evaluations.Info(evalID, q)
+		return err
+	})
+	return
+}
+
+type retryAllocations struct {
+	allocations AllocationsAPI
+	c           *retryClient
+}
+
+func (a *retryAllocations) List(q *nomad.QueryOptions) (allocs []*nomad.AllocationListStub, qm *nomad.QueryMeta, err error) {
+	err = a.c.do("list allocations", func() error {
+		allocs, qm, err = a.allocations.List(q)
+		return err
+	})
+	return
+}
+
+func (a *retryAllocations) Info(allocID string, q *nomad.QueryOptions) (alloc *nomad.Allocation, qm *nomad.QueryMeta, err error) {
+	err = a.c.do("read allocation "+allocID, func() error {
+		alloc, qm, err = a.allocations.Info(allocID, q)
+		return err
+	})
+	return
+}
+
+func (a *retryAllocations) Stats(alloc *nomad.Allocation, q *nomad.QueryOptions) (usage *nomad.AllocResourceUsage, err error) {
+	err = a.c.do("read stats of allocation "+alloc.ID, func() error {
+		usage, err = a.allocations.Stats(alloc, q)
+		return err
+	})
+	return
+}
+
+type retryNodes struct {
+	nodes NodesAPI
+	c     *retryClient
+}
+
+func (n *retryNodes) List(q *nomad.QueryOptions) (nodes []*nomad.NodeListStub, qm *nomad.QueryMeta, err error) {
+	err = n.c.do("list nodes", func() error {
+		nodes, qm, err = n.nodes.List(q)
+		return err
+	})
+	return
+}
+
+func (n *retryNodes) UpdateDrain(nodeID string, spec *nomad.DrainSpec, markEligible bool,
+	q *nomad.WriteOptions) (resp *nomad.NodeDrainUpdateResponse, err error) {
+	err = n.c.do("update drain of node "+nodeID, func() error {
+		resp, err = n.nodes.UpdateDrain(nodeID, spec, markEligible, q)
+		return err
+	})
+	return
+}
+
+type retryScaling struct {
+	scaling ScalingAPI
+	c       *retryClient
+}
+
+func (s *retryScaling) Scale(jobID string, req *ScalingRequest, q *nomad.WriteOptions) (resp *nomad.JobRegisterResponse, wm *nomad.WriteMeta, err error) {
+	err = s.c.write("scale job "+jobID, func() error {
+		resp, wm, err = s.scaling.Scale(jobID, req, q)
+		return err
+	})
+	return
+}
+
+func (s *retryScaling) Status(jobID string, q *nomad.QueryOptions) (status *JobScaleStatus, qm *nomad.QueryMeta, err error) {
+	err = s.c.do("read scale status of job "+jobID, func() error {
+		status, qm, err = s.scaling.Status(jobID, q)
+		return err
+	})
+	return
+}
+
+type retryVariables struct {
+	variables VariablesAPI
+	c         *retryClient
+}
+
+func (v *retryVariables) Read(path string, q *nomad.QueryOptions) (variable *Variable, qm *nomad.QueryMeta, err error) {
+	err = v.c.do("read variable "+path, func() error {
+		variable, qm, err = v.variables.Read(path, q)
+		return err
+	})
+	return
+}
+
+func (v *retryVariables) Upsert(variable *Variable, q *nomad.WriteOptions) (result *Variable, wm *nomad.WriteMeta, err error) {
+	err = v.c.do("write variable "+variable.Path, func() error {
+		result, wm, err = v.variables.Upsert(variable, q)
+		return err
+	})
+	return
+}
+
+func (v *retryVariables) Delete(path string, q *nomad.WriteOptions) (wm *nomad.WriteMeta, err error) {
+	err = v.c.do("delete variable "+path, func() error {
+		wm, err = v.variables.Delete(path, q)
+		return err
+	})
+	return
+}
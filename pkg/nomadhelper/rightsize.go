@@ -0,0 +1,382 @@
+package nomadhelper
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/ryanuber/columnize"
+)
+
+// RightsizeOptions controls how usage is sampled and turned into
+// recommendations
+type RightsizeOptions struct {
+	// Window is how long allocation stats are sampled for
+	Window time.Duration
+	// Interval is the time between two samples
+	Interval time.Duration
+	// Headroom is added on top of the peak usage, e.g. 0.2 for 20%
+	Headroom float64
+	// Threshold is the smallest relative change recommended, e.g. 0.25 for 25%
+	Threshold float64
+	// MinCPU and MinMemoryMB are the smallest resources recommended
+	MinCPU      int
+	MinMemoryMB int
+}
+
+// taskUsage is the sampled usage of a single task across its allocations.
+// CPU and memory are counted separately since a sample may measure only one
+// of them.
+type taskUsage struct {
+	samples    int
+	cpuSamples int
+	memSamples int
+	peakCPU    float64
+	totalCPU   float64
+	peakMemMB  float64
+}
+
+// add records one sample of a task's usage
+func (u *taskUsage) add(usage *nomad.ResourceUsage) {
+	if usage == nil {
+		return
+	}
+	u.samples++
+	if usage.CpuStats != nil && measured(usage.CpuStats.Measured, "Total Ticks") {
+		u.cpuSamples++
+		u.totalCPU += usage.CpuStats.TotalTicks
+		u.peakCPU = math.Max(u.peakCPU, usage.CpuStats.TotalTicks)
+	}
+	if usage.MemoryStats != nil {
+		// Not every driver measures RSS, and some report neither. A running
+		// task always uses some memory, so zero is no measurement.
+		memory := usage.MemoryStats.RSS
+		if memory == 0 {
+			memory = usage.MemoryStats.Usage
+		}
+		if memory > 0 {
+			u.memSamples++
+			u.peakMemMB = math.Max(u.peakMemMB, float64(memory)/1024/1024)
+		}
+	}
+}
+
+// measured reports whether a driver measures a stat. Agents that do not list
+// what they measure are trusted.
+func measured(stats []string, stat string) bool {
+	if len(stats) == 0 {
+		return true
+	}
+	for _, s := range stats {
+		if s == stat {
+			return true
+		}
+	}
+	return false
+}
+
+// usageKey identifies a task of a job
+type usageKey struct {
+	job, group, task string
+}
+
+// Recommendation is the resources recommended for a single task
+type Recommendation struct {
+	JobID string
+	Group string
+	Task  string
+
+	CPU         int
+	CPUMeasured bool
+	PeakCPU     float64
+	AvgCPU      float64
+	NewCPU      int
+
+	MemoryMB       int
+	MemoryMeasured bool
+	PeakMemMB      float64
+	NewMemoryMB    int
+}
+
+// usageColumn formats the reserved and recommended value of one resource
+func usageColumn(reserved int, recommended int, measured bool, usage string) string {
+	if !measured {
+		return fmt.Sprintf("%d (unmeasured)", reserved)
+	}
+	return fmt.Sprintf("%d -> %d (%s)", reserved, recommended, usage)
+}
+
+// Changed reports whether the recommendation differs from the reserved
+// resources
+func (r Recommendation) Changed() bool {
+	return r.NewCPU != r.CPU || r.NewMemoryMB != r.MemoryMB
+}
+
+// recommend turns the peak usage into a new reservation. The reservation is
+// kept when the change is smaller than the threshold.
+func recommend(reserved int, peak float64, minimum int, opts RightsizeOptions) int {
+	recommended := int(math.Ceil(peak * (1 + opts.Headroom)))
+	if recommended < minimum {
+		recommended = minimum
+	}
+	if reserved > 0 && math.Abs(float64(recommended-reserved))/float64(reserved) < opts.Threshold {
+		return reserved
+	}
+	return recommended
+}
+
+// sampleUsage samples the stats of the allocations every opts.Interval until
+// opts.Window has passed. At least one sample is taken. Sampling stops early
+// once ctx is done.
+func (n *NomadHelper) sampleUsage(ctx context.Context, allocs []*nomad.Allocation, opts RightsizeOptions) (map[usageKey]*taskUsage, []error) {
+	var mu sync.Mutex
+	usage := make(map[usageKey]*taskUsage)
+	var errs []error
+
+	concurrency := n.Concurrency
+	if concurrency < 1 {
+		concurrency = DefaultConcurrency
+	}
+
+	rounds := 1
+	if opts.Interval > 0 && opts.Window > opts.Interval {
+		rounds = int(opts.Window / opts.Interval)
+	}
+	for round := 0; round < rounds; round++ {
+		if round > 0 {
+			select {
+			case <-ctx.Done():
+				return usage, errs
+			case <-time.After(opts.Interval):
+			}
+		}
+
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, concurrency)
+		for _, alloc := range allocs {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(alloc *nomad.Allocation) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				stats, err := n.Client.Allocations().Stats(alloc, nil)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					// Allocations may stop while they are sampled
+					if round == 0 {
+						errs = append(errs, fmt.Errorf("allocation %s of %s: %v", alloc.ID, alloc.JobID, err))
+					}
+					return
+				}
+				for task, taskStats := range stats.Tasks {
+					key := usageKey{alloc.JobID, alloc.TaskGroup, task}
+					if usage[key] == nil {
+						usage[key] = new(taskUsage)
+					}
+					usage[key].add(taskStats.ResourceUsage)
+				}
+			}(alloc)
+		}
+		wg.Wait()
+	}
+	return usage, errs
+}
+
+// RightsizeJobs samples the CPU and memory used by every task of the running
+// jobs over opts.Window and recommends new resources based on the peak usage
+// plus opts.Headroom. With update set the jobs are planned with the
+// recommended resources, and updated when force is set too. Jobs with
+// custodian-ignore set or not selected by n.Selector get recommendations but
+// are never updated.
+func (n *NomadHelper) RightsizeJobs(ctx context.Context, opts RightsizeOptions, update bool, force bool, verbose bool) *Report {
+	var output []string
+	var jobsSkipped []string
+
+	report := NewReport("rightsize", force)
+	defer report.Finish()
+
+	items, err := n.Inventory().Jobs(ctx, func(stub *nomad.JobListStub) bool {
+		return stub.Status == "running" && stub.ParentID == ""
+	})
+	var stubs []*nomad.AllocationListStub
+	if err == nil {
+		stubs, _, err = n.Client.Allocations().List(nil)
+	}
+	if err != nil {
+		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "rightsize", Status: StatusFailed, Error: err.Error()})
+		n.writeFailures(report)
+		return report
+	}
+
+	jobsByID := make(map[string]InventoryItem)
+	for _, item := range items {
+		if item.Job == nil && item.Err == nil {
+			continue
+		}
+		if item.Err != nil {
+			n.failed(report, item.Stub, "rightsize", item.Err)
+			continue
+		}
+		jobsByID[item.Stub.ID] = item
+	}
+
+	var allocs []*nomad.Allocation
+	for _, stub := range stubs {
+		item, ok := jobsByID[stub.JobID]
+		if !ok || stub.ClientStatus != "running" {
+			continue
+		}
+		alloc, _, err := n.Client.Allocations().Info(stub.ID, nil)
+		if err != nil {
+			n.failed(report, item.Stub, "rightsize", err)
+			continue
+		}
+		allocs = append(allocs, alloc)
+	}
+
+	if verbose {
+		n.Logger.Infof("Sampling %d allocations for %s\n", len(allocs), opts.Window)
+	}
+	usage, errs := n.sampleUsage(ctx, allocs, opts)
+	for _, err := range errs {
+		n.Logger.Error(err)
+	}
+
+	recommendations := make(map[string][]Recommendation)
+	var keys []usageKey
+	for key := range usage {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.job != b.job {
+			return a.job < b.job
+		}
+		if a.group != b.group {
+			return a.group < b.group
+		}
+		return a.task < b.task
+	})
+
+	output = append(output, "Job|Group|Task|CPU (MHz)|Memory (MB)")
+	for _, key := range keys {
+		task := findTask(jobsByID[key.job].Job, key.group, key.task)
+		if task == nil || task.Resources == nil || task.Resources.CPU == nil || task.Resources.MemoryMB == nil {
+			continue
+		}
+		u := usage[key]
+		if u.samples == 0 {
+			continue
+		}
+		r := Recommendation{
+			JobID:          key.job,
+			Group:          key.group,
+			Task:           key.task,
+			CPU:            *task.Resources.CPU,
+			CPUMeasured:    u.cpuSamples > 0,
+			NewCPU:         *task.Resources.CPU,
+			MemoryMB:       *task.Resources.MemoryMB,
+			MemoryMeasured: u.memSamples > 0,
+			NewMemoryMB:    *task.Resources.MemoryMB,
+		}
+		// A resource that was never measured keeps its reservation rather
+		// than shrinking to the minimum
+		if r.CPUMeasured {
+			r.PeakCPU = u.peakCPU
+			r.AvgCPU = u.totalCPU / float64(u.cpuSamples)
+			r.NewCPU = recommend(r.CPU, r.PeakCPU, opts.MinCPU, opts)
+		}
+		if r.MemoryMeasured {
+			r.PeakMemMB = u.peakMemMB
+			r.NewMemoryMB = recommend(r.MemoryMB, r.PeakMemMB, opts.MinMemoryMB, opts)
+		}
+		recommendations[key.job] = append(recommendations[key.job], r)
+
+		output = append(output, fmt.Sprintf("%s|%s|%s|%s|%s",
+			*jobsByID[key.job].Job.Name, key.group, key.task,
+			usageColumn(r.CPU, r.NewCPU, r.CPUMeasured, fmt.Sprintf("peak %.0f, avg %.0f", r.PeakCPU, r.AvgCPU)),
+			usageColumn(r.MemoryMB, r.NewMemoryMB, r.MemoryMeasured, fmt.Sprintf("peak %.0f", r.PeakMemMB))))
+	}
+	if len(output) == 1 {
+		output = append(output, "None")
+	}
+	fmt.Fprintf(n.out(), "%s\n\n", columnize.SimpleFormat(output))
+
+	if update {
+		for _, item := range items {
+			jobStub := item.Stub
+			changes := recommendations[jobStub.ID]
+			if len(changes) == 0 {
+				continue
+			}
+			if n.cancelled(ctx, report, jobStub, "rightsize") {
+				continue
+			}
+			if reason, detail, skip := n.Selector.Skip(jobStub.Name); skip {
+				jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "rightsize", reason, detail))
+				continue
+			}
+			jobInfo := item.Job
+
+			custodianIgnore, err := strconv.ParseBool(jobInfo.Meta["custodian-ignore"])
+			if err != nil && jobInfo.Meta["custodian-ignore"] != "" {
+				n.Logger.Error(err)
+			}
+			if custodianIgnore {
+				jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "rightsize", SkipIgnoredMeta, "custodian-ignore"))
+				continue
+			}
+
+			changed := false
+			for _, r := range changes {
+				if !r.Changed() {
+					continue
+				}
+				task := findTask(jobInfo, r.Group, r.Task)
+				task.Resources.CPU = intToPtr(r.NewCPU)
+				task.Resources.MemoryMB = intToPtr(r.NewMemoryMB)
+				changed = true
+			}
+			if changed {
+				n.planOrApply(ctx, report, jobStub, "rightsize", jobInfo, force)
+			}
+		}
+
+		output = []string{"Jobs Skipped|Reason|Detail"}
+		if len(jobsSkipped) == 0 {
+			output = append(output, "None")
+		} else {
+			output = append(output, jobsSkipped...)
+		}
+		fmt.Fprintf(n.out(), "%s\n", columnize.SimpleFormat(output))
+	}
+	n.writeFailures(report)
+	n.writeSkipReasons(report)
+	return report
+}
+
+// findTask returns a task of a job by group and task name
+func findTask(job *nomad.Job, group string, name string) *nomad.Task {
+	if job == nil {
+		return nil
+	}
+	for _, taskGroup := range job.TaskGroups {
+		if taskGroup.Name == nil || *taskGroup.Name != group {
+			continue
+		}
+		for _, task := range taskGroup.Tasks {
+			if task.Name == name {
+				return task
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package nomadhelper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/ryanuber/columnize"
+)
+
+// ScalingRequest is the body of a job scale request
+type ScalingRequest struct {
+	Count          *int64
+	Target         map[string]string
+	Message        string
+	Error          bool
+	Meta           map[string]interface{}
+	PolicyOverride bool
+}
+
+// JobScaleStatus is the scale status of every task group of a job
+type JobScaleStatus struct {
+	JobID          string
+	JobCreateIndex uint64
+	JobModifyIndex uint64
+	JobStopped     bool
+	TaskGroups     map[string]TaskGroupScaleStatus
+}
+
+// TaskGroupScaleStatus is the scale status of a task group with its recent
+// scaling events
+type TaskGroupScaleStatus struct {
+	Desired   int
+	Placed    int
+	Running   int
+	Healthy   int
+	Unhealthy int
+	Events    []*ScalingEvent
+}
+
+// ScalingEvent records a change of a task group count. Nomad only keeps the
+// most recent events of each task group.
+type ScalingEvent struct {
+	Count         *int64
+	PreviousCount int64
+	Error         bool
+	Message       string
+	Meta          map[string]interface{}
+	EvalID        *string
+	Time          uint64
+	CreateIndex   uint64
+}
+
+// GroupScale is a task group count changed through the scale endpoint
+type GroupScale struct {
+	Group    string `json:"group"`
+	Count    int    `json:"count"`
+	Previous int    `json:"previous"`
+}
+
+// scaleRequest builds the request changing a task group count. The event of
+// a scale-in keeps the original count in its meta for ScaleOutJobs.
+func scaleRequest(jobID string, action string, change GroupScale) *ScalingRequest {
+	count := int64(change.Count)
+	req := &ScalingRequest{
+		Count:   &count,
+		Target:  map[string]string{"Job": jobID, "Group": change.Group},
+		Message: fmt.Sprintf("nomad-custodian %s from %d to %d", action, change.Previous, change.Count),
+		Meta:    map[string]interface{}{"custodian-action": "scaled-out"},
+	}
+	if action == "scale-in" {
+		req.Meta["custodian-action"] = "scaled-in"
+		req.Meta["custodian-count"] = fmt.Sprint(change.Previous)
+	}
+	return req
+}
+
+// nativeScaleIn returns the task groups ScaleInJobs sets to count=1 through
+// the scale endpoint
+func nativeScaleIn(job *nomad.Job) []GroupScale {
+	var changes []GroupScale
+	for _, taskGroup := range job.TaskGroups {
+		if count := currentCount(taskGroup); count > 1 {
+			changes = append(changes, GroupScale{Group: *taskGroup.Name, Count: 1, Previous: count})
+		}
+	}
+	return changes
+}
+
+// nativeScaledIn returns the original count of every task group of a job
+// whose latest custodian scaling event is a scale-in
+func (n *NomadHelper) nativeScaledIn(job *nomad.Job) ([]GroupScale, error) {
+	status, _, err := n.Client.Scaling().Status(*job.ID, nil)
+	if err != nil {
+		return nil, err
+	}
+	return scaledInGroups(job, status)
+}
+
+// scaledInGroups returns the original count of every task group whose
+// latest custodian scaling event in the scale status is a scale-in
+func scaledInGroups(job *nomad.Job, status *JobScaleStatus) ([]GroupScale, error) {
+	var changes []GroupScale
+	for _, taskGroup := range job.TaskGroups {
+		var latest *ScalingEvent
+		for _, event := range status.TaskGroups[*taskGroup.Name].Events {
+			if _, ok := event.Meta["custodian-action"]; ok && (latest == nil || event.CreateIndex > latest.CreateIndex) {
+				latest = event
+			}
+		}
+		if latest == nil || latest.Meta["custodian-action"] != "scaled-in" {
+			continue
+		}
+		value, _ := latest.Meta["custodian-count"].(string)
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid custodian-count %q in the scaling event of group %s", value, *taskGroup.Name)
+		}
+		changes = append(changes, GroupScale{Group: *taskGroup.Name, Count: count, Previous: currentCount(taskGroup)})
+	}
+	return changes, nil
+}
+
+// fprintGroupScales writes the task group counts changed through the scale
+// endpoint to w, like FprintJobDiff
+func fprintGroupScales(w io.Writer, changes []GroupScale) {
+	output := []string{"|Task Group|From|To"}
+	for _, change := range changes {
+		output = append(output, fmt.Sprintf("|%s|%d|%d", change.Group, change.Previous, change.Count))
+	}
+	fmt.Fprintf(w, "%s\n\n", columnize.SimpleFormat(output))
+}
+
+// applyScale changes the task group counts through the scale endpoint and
+// stops at the first failure
+func (n *NomadHelper) applyScale(ctx context.Context, jobID string, action string, changes []GroupScale) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer n.Inventory().Invalidate(jobID)
+	for _, change := range changes {
+		resp, _, err := n.Client.Scaling().Scale(jobID, scaleRequest(jobID, action, change), nil)
+		if err != nil {
+			n.Logger.Error(err)
+			return fmt.Errorf("group %s: %v", change.Group, err)
+		}
+		if resp.Warnings != "" {
+			n.Logger.Infof("Warnings: %s\n", resp.Warnings)
+		}
+	}
+	return nil
+}
+
+// planOrScale changes task group counts through the scale endpoint when
+// force is set and it is approved, or records the change as planned
+// otherwise. It is the native scale mode counterpart of planOrApply.
+func (n *NomadHelper) planOrScale(ctx context.Context, report *Report, jobStub *nomad.JobListStub, action string,
+	job *nomad.Job, changes []GroupScale, force bool) bool {
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Group < changes[j].Group })
+	fmt.Fprintf(n.out(), "Job: %s, %s\n", *job.Name, action)
+	fprintGroupScales(n.out(), changes)
+
+	if !force {
+		n.recordScalePlan(action, job, changes)
+		report.Add(JobResult{JobID: *job.ID, Name: *job.Name, Action: action, Status: StatusPlanned})
+		return true
+	}
+	if !n.approved(ctx, report, jobStub, action) {
+		return false
+	}
+	err := n.applyScale(ctx, *job.ID, action, changes)
+	report.Add(n.applyResult(job, action, err))
+	return err == nil
+}
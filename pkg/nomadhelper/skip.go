@@ -0,0 +1,89 @@
+package nomadhelper
+
+import (
+	"fmt"
+	"path"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/ryanuber/columnize"
+)
+
+// Reasons a job is skipped, recorded in JobResult.Reason
+const (
+	SkipIgnoredMeta   = "ignored via meta"
+	SkipIgnoredConfig = "ignored via config"
+	SkipScaledIn      = "already scaled in"
+	SkipNotScaledIn   = "not scaled in"
+	SkipNotRunning    = "not running"
+	SkipWrongType     = "wrong type"
+	SkipFilteredOut   = "filtered out"
+	SkipDeclined      = "declined"
+	SkipRegistered    = "already registered"
+	SkipMinNodes      = "min nodes"
+	SkipNodeGone      = "node gone"
+	// SkipError counts the failed jobs in the skip summary
+	SkipError = "error"
+)
+
+// skipReasonOrder is the order reasons are summarized in
+var skipReasonOrder = []string{SkipIgnoredMeta, SkipIgnoredConfig, SkipScaledIn, SkipNotScaledIn, SkipNotRunning,
+	SkipWrongType, SkipFilteredOut, SkipDeclined, SkipRegistered, SkipMinNodes, SkipNodeGone, SkipError}
+
+// JobSelector picks the jobs a run may change by name. Patterns use
+// path.Match syntax, e.g. web-*.
+type JobSelector struct {
+	// Jobs are the patterns a job must match one of, every job when empty
+	Jobs []string
+	// Ignore are the patterns of jobs that are never changed, like jobs
+	// with custodian-ignore set
+	Ignore []string
+}
+
+// Skip returns the reason a job is not selected and the pattern responsible.
+// ok is false for selected jobs.
+func (s JobSelector) Skip(name string) (reason string, detail string, ok bool) {
+	if pattern, matched := matchAny(s.Ignore, name); matched {
+		return SkipIgnoredConfig, pattern, true
+	}
+	if _, matched := matchAny(s.Jobs, name); len(s.Jobs) > 0 && !matched {
+		return SkipFilteredOut, "", true
+	}
+	return "", "", false
+}
+
+// matchAny returns the first pattern matching name. Invalid patterns never
+// match.
+func matchAny(patterns []string, name string) (string, bool) {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// skipped records a skipped job and returns its row in the skipped table
+func skipped(report *Report, jobStub *nomad.JobListStub, action string, reason string, detail string) string {
+	report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: action, Status: StatusSkipped,
+		Reason: reason, Detail: detail})
+	if detail == "" {
+		detail = "-"
+	}
+	return fmt.Sprintf("%s|%s|%s", jobStub.Name, reason, detail)
+}
+
+// writeSkipReasons prints the number of jobs skipped for each reason, with
+// failed jobs counted as errors
+func (n *NomadHelper) writeSkipReasons(report *Report) {
+	counts := report.SkipCounts()
+	if len(counts) == 0 {
+		return
+	}
+	output := []string{"Skip Reason|Jobs"}
+	for _, reason := range skipReasonOrder {
+		if counts[reason] > 0 {
+			output = append(output, fmt.Sprintf("%s|%d", reason, counts[reason]))
+		}
+	}
+	fmt.Fprintf(n.out(), "\n%s\n", columnize.SimpleFormat(output))
+}
@@ -0,0 +1,657 @@
+package nomadhelper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"github.com/ryanuber/columnize"
+)
+
+// State store backends
+const (
+	// StoreMeta keeps the state in custodian-* job meta keys
+	StoreMeta = "meta"
+	// StoreNomadVariables keeps the state in Nomad Variables
+	StoreNomadVariables = "nomad-variables"
+	// StoreConsul keeps the state in the Consul KV store
+	StoreConsul = "consul"
+	// StoreFile keeps the state in a local JSON file
+	StoreFile = "file"
+)
+
+// DefaultStatePrefix is the Nomad Variables and Consul KV path the state of
+// every job is kept under
+const DefaultStatePrefix = "nomad-custodian"
+
+// ScaleState is what a scale-in records for ScaleOutJobs
+type ScaleState struct {
+	Action string `json:"action"`
+	// RevertVersion is the job version ScaleOutJobs reverts to, nil when
+	// none was recorded
+	RevertVersion *uint64 `json:"revert_version,omitempty"`
+	// Counts are the task group counts before the scale-in
+	Counts map[string]int `json:"counts,omitempty"`
+	// PeriodicSpec is the spec of a periodic job paused by the scale-in
+	PeriodicSpec string `json:"periodic_spec,omitempty"`
+	// Version and JobModifyIndex are those of the scaled in job. They are
+	// only recorded by stores other than job meta, whose state outlives a
+	// redeploy of the job.
+	Version        *uint64 `json:"version,omitempty"`
+	JobModifyIndex *uint64 `json:"job_modify_index,omitempty"`
+}
+
+// ScaledIn reports whether the state is that of a scaled in job
+func (s *ScaleState) ScaledIn() bool {
+	return s != nil && s.Action == "scaled-in"
+}
+
+// Drift returns an error when the job was registered again since it was
+// scaled in, in which case reverting it would roll back that deploy
+func (s *ScaleState) Drift(job *nomad.Job) error {
+	if s == nil || s.Version == nil || s.JobModifyIndex == nil || job.Version == nil || job.JobModifyIndex == nil {
+		return nil
+	}
+	if *job.Version != *s.Version || *job.JobModifyIndex != *s.JobModifyIndex {
+		return fmt.Errorf("job was registered again since the scale-in (version %d, modify index %d, scaled in at version %d, modify index %d)",
+			*job.Version, *job.JobModifyIndex, *s.Version, *s.JobModifyIndex)
+	}
+	return nil
+}
+
+// StateStore keeps the scale state of jobs between a scale-in and the
+// following scale-out
+type StateStore interface {
+	// Name is the backend name, e.g. file
+	Name() string
+	// Load returns the state of a job, nil when none is recorded
+	Load(job *nomad.Job) (*ScaleState, error)
+	// Save records the state of a job
+	Save(job *nomad.Job, state *ScaleState) error
+	// Delete removes the state of a job
+	Delete(job *nomad.Job) error
+}
+
+// StateStoreOptions configures the state store backends
+type StateStoreOptions struct {
+	// Prefix is the Nomad Variables and Consul KV path, DefaultStatePrefix when empty
+	Prefix string
+	// Path is the file the file backend writes, jobs-backup/scale-state.json when empty
+	Path string
+	// ConsulAddress and ConsulToken are used by the consul backend
+	ConsulAddress string
+	ConsulToken   string
+}
+
+// NewStateStore returns the state store for a backend name. Every backend
+// but job meta keeps the state outside of the job spec.
+func (n *NomadHelper) NewStateStore(backend string, opts StateStoreOptions) (StateStore, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultStatePrefix
+	}
+	address := ""
+	if n.Config != nil {
+		address = n.Config.Address
+	}
+	switch backend {
+	case "", StoreMeta:
+		return MetaStore{}, nil
+	case StoreNomadVariables:
+		return &VariablesStore{Client: n.Client, Prefix: opts.Prefix}, nil
+	case StoreConsul:
+		if opts.ConsulAddress == "" {
+			return nil, fmt.Errorf("the consul state store needs a Consul address")
+		}
+		return &ConsulStore{Address: opts.ConsulAddress, Token: opts.ConsulToken, Prefix: opts.Prefix}, nil
+	case StoreFile:
+		path := opts.Path
+		if path == "" {
+			path = filepath.Join(BackupDir, "scale-state.json")
+		}
+		return &FileStore{Path: path, Cluster: address}, nil
+	}
+	return nil, fmt.Errorf("unknown state store %q, expected one of %s, %s, %s or %s", backend,
+		StoreMeta, StoreNomadVariables, StoreConsul, StoreFile)
+}
+
+// jobNamespace returns the namespace of a job, default when unset
+func jobNamespace(job *nomad.Job) string {
+	if job.Namespace == nil || *job.Namespace == "" {
+		return "default"
+	}
+	return *job.Namespace
+}
+
+// MetaStore keeps the state in the job meta. Saving only changes the job,
+// which must be registered afterwards.
+type MetaStore struct{}
+
+// Name returns meta
+func (MetaStore) Name() string {
+	return StoreMeta
+}
+
+// Load reads the custodian-* meta keys. Invalid counts and revert versions
+// are left out, Diagnose explains them.
+func (MetaStore) Load(job *nomad.Job) (*ScaleState, error) {
+	action := job.Meta["custodian-action"]
+	if action == "" {
+		return nil, nil
+	}
+	state := &ScaleState{Action: action, PeriodicSpec: job.Meta[PeriodicSpecMetaKey]}
+	if version, err := strconv.ParseUint(job.Meta["custodian-revert-version"], 10, 64); err == nil {
+		state.RevertVersion = &version
+	}
+	for key, value := range job.Meta {
+		group, ok := isCountKey(key)
+		if !ok {
+			continue
+		}
+		if count, err := strconv.Atoi(value); err == nil {
+			if state.Counts == nil {
+				state.Counts = make(map[string]int)
+			}
+			state.Counts[group] = count
+		}
+	}
+	return state, nil
+}
+
+// Save writes the custodian-* meta keys
+func (MetaStore) Save(job *nomad.Job, state *ScaleState) error {
+	clearScaleMeta(job)
+	for group, count := range state.Counts {
+		job.SetMeta(fmt.Sprintf("custodian-%s-count", group), fmt.Sprint(count))
+	}
+	job.SetMeta("custodian-action", state.Action)
+	if state.RevertVersion != nil {
+		job.SetMeta("custodian-revert-version", fmt.Sprint(*state.RevertVersion))
+	}
+	if state.PeriodicSpec != "" {
+		job.SetMeta(PeriodicSpecMetaKey, state.PeriodicSpec)
+	}
+	return nil
+}
+
+// Delete removes the custodian-* meta keys
+func (MetaStore) Delete(job *nomad.Job) error {
+	clearScaleMeta(job)
+	return nil
+}
+
+// inMeta reports whether a store keeps the state in the job meta, which is
+// only saved by registering the job
+func inMeta(store StateStore) bool {
+	_, ok := store.(MetaStore)
+	return ok
+}
+
+// stateItems turns a state into Nomad Variable items, which are strings
+func stateItems(state *ScaleState) map[string]string {
+	items := map[string]string{"action": state.Action}
+	if state.RevertVersion != nil {
+		items["revert-version"] = fmt.Sprint(*state.RevertVersion)
+	}
+	if state.PeriodicSpec != "" {
+		items["periodic-spec"] = state.PeriodicSpec
+	}
+	if state.Version != nil && state.JobModifyIndex != nil {
+		items["version"] = fmt.Sprint(*state.Version)
+		items["job-modify-index"] = fmt.Sprint(*state.JobModifyIndex)
+	}
+	for group, count := range state.Counts {
+		items[group+"-count"] = fmt.Sprint(count)
+	}
+	return items
+}
+
+// itemsState reads a state written by stateItems
+func itemsState(items map[string]string) (*ScaleState, error) {
+	state := &ScaleState{Action: items["action"], PeriodicSpec: items["periodic-spec"]}
+	for key, value := range items {
+		switch {
+		case key == "revert-version":
+			version, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid revert-version %q", value)
+			}
+			state.RevertVersion = &version
+		case key == "version" || key == "job-modify-index":
+			value, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", key, value)
+			}
+			if key == "version" {
+				state.Version = &value
+			} else {
+				state.JobModifyIndex = &value
+			}
+		case strings.HasSuffix(key, "-count"):
+			count, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", key, value)
+			}
+			if state.Counts == nil {
+				state.Counts = make(map[string]int)
+			}
+			state.Counts[strings.TrimSuffix(key, "-count")] = count
+		}
+	}
+	return state, nil
+}
+
+// VariablesStore keeps the state of every job in a Nomad Variable at
+// <prefix>/<job> in the job's namespace. It needs Nomad 1.4 or later.
+type VariablesStore struct {
+	Client NomadClient
+	Prefix string
+}
+
+// Name returns nomad-variables
+func (s *VariablesStore) Name() string {
+	return StoreNomadVariables
+}
+
+func (s *VariablesStore) path(job *nomad.Job) string {
+	return s.Prefix + "/" + *job.ID
+}
+
+// Load reads the variable of a job
+func (s *VariablesStore) Load(job *nomad.Job) (*ScaleState, error) {
+	variable, _, err := s.Client.Variables().Read(s.path(job), &nomad.QueryOptions{Namespace: jobNamespace(job)})
+	if err != nil || variable == nil {
+		return nil, err
+	}
+	state, err := itemsState(variable.Items)
+	if err != nil {
+		return nil, fmt.Errorf("variable %s: %v", variable.Path, err)
+	}
+	return state, nil
+}
+
+// Save writes the variable of a job
+func (s *VariablesStore) Save(job *nomad.Job, state *ScaleState) error {
+	variable := &Variable{Namespace: jobNamespace(job), Path: s.path(job), Items: stateItems(state)}
+	_, _, err := s.Client.Variables().Upsert(variable, &nomad.WriteOptions{Namespace: variable.Namespace})
+	return err
+}
+
+// Delete removes the variable of a job
+func (s *VariablesStore) Delete(job *nomad.Job) error {
+	_, err := s.Client.Variables().Delete(s.path(job), &nomad.WriteOptions{Namespace: jobNamespace(job)})
+	return err
+}
+
+// ConsulStore keeps the state of every job as JSON in the Consul KV store at
+// <prefix>/<region>/<namespace>/<job>
+type ConsulStore struct {
+	Address string
+	Token   string
+	Prefix  string
+	Client  *http.Client
+}
+
+// Name returns consul
+func (s *ConsulStore) Name() string {
+	return StoreConsul
+}
+
+func (s *ConsulStore) do(method string, job *nomad.Job, body []byte) ([]byte, int, error) {
+	region := "global"
+	if job.Region != nil && *job.Region != "" {
+		region = *job.Region
+	}
+	key := strings.Join([]string{s.Prefix, region, jobNamespace(job), *job.ID}, "/")
+	req, err := http.NewRequest(method, strings.TrimSuffix(s.Address, "/")+"/v1/kv/"+
+		(&url.URL{Path: key}).EscapedPath()+"?raw", bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.Token != "" {
+		req.Header.Set("X-Consul-Token", s.Token)
+	}
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return nil, resp.StatusCode, fmt.Errorf("consul returned %s: %s", resp.Status, data)
+	}
+	return data, resp.StatusCode, nil
+}
+
+// Load reads the key of a job
+func (s *ConsulStore) Load(job *nomad.Job) (*ScaleState, error) {
+	data, status, err := s.do(http.MethodGet, job, nil)
+	if err != nil || status == http.StatusNotFound {
+		return nil, err
+	}
+	state := new(ScaleState)
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("consul key of job %s: %v", *job.ID, err)
+	}
+	return state, nil
+}
+
+// Save writes the key of a job
+func (s *ConsulStore) Save(job *nomad.Job, state *ScaleState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.do(http.MethodPut, job, data)
+	return err
+}
+
+// Delete removes the key of a job
+func (s *ConsulStore) Delete(job *nomad.Job) error {
+	_, _, err := s.do(http.MethodDelete, job, nil)
+	return err
+}
+
+// FileStore keeps the state of every job in a local JSON file, per cluster
+// address and namespace/job
+type FileStore struct {
+	Path    string
+	Cluster string
+
+	mu sync.Mutex
+}
+
+// Name returns file
+func (s *FileStore) Name() string {
+	return StoreFile
+}
+
+func (s *FileStore) read() (map[string]map[string]*ScaleState, error) {
+	states := make(map[string]map[string]*ScaleState)
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return states, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("%s: %v", s.Path, err)
+	}
+	return states, nil
+}
+
+// update changes the states of the cluster and writes the file
+func (s *FileStore) update(fn func(states map[string]*ScaleState)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	states, err := s.read()
+	if err != nil {
+		return err
+	}
+	if states[s.Cluster] == nil {
+		states[s.Cluster] = make(map[string]*ScaleState)
+	}
+	fn(states[s.Cluster])
+	if len(states[s.Cluster]) == 0 {
+		delete(states, s.Cluster)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.Path, data, 0644)
+}
+
+func fileKey(job *nomad.Job) string {
+	return jobNamespace(job) + "/" + *job.ID
+}
+
+// Load reads the state of a job from the file
+func (s *FileStore) Load(job *nomad.Job) (*ScaleState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	states, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return states[s.Cluster][fileKey(job)], nil
+}
+
+// Save writes the state of a job to the file
+func (s *FileStore) Save(job *nomad.Job, state *ScaleState) error {
+	return s.update(func(states map[string]*ScaleState) {
+		states[fileKey(job)] = state
+	})
+}
+
+// Delete removes the state of a job from the file
+func (s *FileStore) Delete(job *nomad.Job) error {
+	return s.update(func(states map[string]*ScaleState) {
+		delete(states, fileKey(job))
+	})
+}
+
+// stateStore returns the configured state store, job meta by default
+func (n *NomadHelper) stateStore() StateStore {
+	if n.State == nil {
+		return MetaStore{}
+	}
+	return n.State
+}
+
+// loadState returns the state of a job and the store it was found in. Jobs
+// scaled in before another store was configured keep their state in the job
+// meta, which is looked at last.
+func (n *NomadHelper) loadState(job *nomad.Job) (*ScaleState, StateStore, error) {
+	store := n.stateStore()
+	state, err := store.Load(job)
+	if err != nil || state != nil || inMeta(store) {
+		return state, store, err
+	}
+	state, err = MetaStore{}.Load(job)
+	return state, MetaStore{}, err
+}
+
+// scaledIn reports whether a job is scaled in. Errors reading the state are
+// logged.
+func (n *NomadHelper) scaledIn(job *nomad.Job) bool {
+	state, _, err := n.loadState(job)
+	if err != nil {
+		n.Logger.Error(err)
+	}
+	return state.ScaledIn()
+}
+
+// stageState writes the state of a job about to be registered into its meta
+// when job meta is the configured store
+func (n *NomadHelper) stageState(job *nomad.Job, state *ScaleState) {
+	if store := n.stateStore(); inMeta(store) {
+		store.Save(job, state)
+	}
+}
+
+// applyScaleIn registers a scaled in job. Stores other than job meta get the
+// state first, so a job is never left scaled in without it, and lose it
+// again when the job could not be registered.
+func (n *NomadHelper) applyScaleIn(ctx context.Context, job *nomad.Job, state *ScaleState) error {
+	store := n.stateStore()
+	if !inMeta(store) {
+		if err := store.Save(job, state); err != nil {
+			return fmt.Errorf("saving the scale state to %s: %v", store.Name(), err)
+		}
+	}
+	err := n.ApplyChanges(ctx, job)
+	if inMeta(store) {
+		return err
+	}
+	if err != nil {
+		if deleteErr := store.Delete(job); deleteErr != nil {
+			n.Logger.Error(deleteErr)
+		}
+		return err
+	}
+	return n.saveScaledIn(job, state, store)
+}
+
+// saveScaledIn adds the version and modify index of a registered scaled in
+// job to its state, so ScaleOutJobs can tell when it was redeployed since
+func (n *NomadHelper) saveScaledIn(job *nomad.Job, state *ScaleState, store StateStore) error {
+	registered, _, err := n.Client.Jobs().Info(*job.ID, &nomad.QueryOptions{Namespace: jobNamespace(job)})
+	if err != nil {
+		return fmt.Errorf("reading the scaled in job: %v", err)
+	}
+	recorded := *state
+	recorded.Version = registered.Version
+	recorded.JobModifyIndex = registered.JobModifyIndex
+	if err := store.Save(job, &recorded); err != nil {
+		return fmt.Errorf("saving the scale state to %s: %v", store.Name(), err)
+	}
+	return nil
+}
+
+// dropState removes the state of a scaled out job from a store other than
+// job meta, which the revert already removed
+func dropState(job *nomad.Job, store StateStore) error {
+	if inMeta(store) {
+		return nil
+	}
+	if err := store.Delete(job); err != nil {
+		return fmt.Errorf("removing the scale state from %s: %v", store.Name(), err)
+	}
+	return nil
+}
+
+// stateRows returns the list rows of a state kept outside of the job meta
+func stateRows(state *ScaleState, store StateStore) []string {
+	rows := []string{fmt.Sprintf("|custodian-action|%s (%s)|", state.Action, store.Name())}
+	if state.RevertVersion != nil {
+		rows = append(rows, fmt.Sprintf("|custodian-revert-version|%d|", *state.RevertVersion))
+	}
+	var groups []string
+	for group := range state.Counts {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		rows = append(rows, fmt.Sprintf("|custodian-%s-count|%d|", group, state.Counts[group]))
+	}
+	return rows
+}
+
+// MigrateState moves the state of every job from one store to another and
+// makes the new store the configured one. Moving to or from job meta registers the
+// job with the meta keys added or removed, other stores are written
+// directly. The state is saved to the new store before it is removed from
+// the old one. Changes are planned unless force is set.
+func (n *NomadHelper) MigrateState(ctx context.Context, from StateStore, to StateStore, force bool, verbose bool) *Report {
+	var jobsSkipped []string
+
+	report := NewReport("migrate-state", force)
+	defer report.Finish()
+	n.State = to
+
+	items, err := n.Inventory().Jobs(ctx, func(stub *nomad.JobListStub) bool {
+		return stub.ParentID == "" && stub.Status != "dead"
+	})
+	if err == nil && from.Name() == to.Name() {
+		err = fmt.Errorf("the state is already kept in %s", to.Name())
+	}
+	if err != nil {
+		n.Logger.Error(err)
+		report.Add(JobResult{Name: "*", Action: "migrate-state", Status: StatusFailed, Error: err.Error()})
+		n.writeFailures(report)
+		return report
+	}
+
+	if verbose {
+		n.Logger.Infof("Number of jobs: %d\n", len(items))
+	}
+
+	output := []string{"Job|Action|From|To"}
+	for _, item := range items {
+		jobStub := item.Stub
+		if item.Job == nil && item.Err == nil {
+			continue
+		}
+		if n.cancelled(ctx, report, jobStub, "migrate-state") {
+			continue
+		}
+		if reason, detail, skip := n.Selector.Skip(jobStub.Name); skip {
+			jobsSkipped = append(jobsSkipped, skipped(report, jobStub, "migrate-state", reason, detail))
+			continue
+		}
+		if item.Err != nil {
+			n.failed(report, jobStub, "migrate-state", item.Err)
+			continue
+		}
+		jobInfo := item.Job
+
+		state, err := from.Load(jobInfo)
+		if err != nil {
+			n.failed(report, jobStub, "migrate-state", err)
+			continue
+		}
+		if state == nil {
+			continue
+		}
+		output = append(output, fmt.Sprintf("%s|%s|%s|%s", jobStub.Name, state.Action, from.Name(), to.Name()))
+
+		switch {
+		case inMeta(from):
+			// The meta keys are only removed from the job in memory here.
+			// applyScaleIn saves the state to the new store before the job
+			// is registered without them.
+			clearScaleMeta(jobInfo)
+			n.planOrApplyState(ctx, report, jobStub, "migrate-state", jobInfo, state, force)
+		case inMeta(to):
+			if n.planOrApplyState(ctx, report, jobStub, "migrate-state", jobInfo, state, force) && force {
+				if err := from.Delete(jobInfo); err != nil {
+					n.Logger.Error(err)
+				}
+			}
+		case !force:
+			report.Add(JobResult{JobID: jobStub.ID, Name: jobStub.Name, Action: "migrate-state", Status: StatusPlanned})
+		case n.approved(ctx, report, jobStub, "migrate-state"):
+			err := to.Save(jobInfo, state)
+			if err == nil {
+				err = from.Delete(jobInfo)
+			}
+			report.Add(n.applyResult(jobInfo, "migrate-state", err))
+		}
+	}
+	if len(output) == 1 {
+		output = append(output, "None")
+	}
+	fmt.Fprintf(n.out(), "%s\n", columnize.SimpleFormat(output))
+
+	if len(jobsSkipped) > 0 {
+		output = append([]string{"Jobs Skipped|Reason|Detail"}, jobsSkipped...)
+		fmt.Fprintf(n.out(), "\n%s\n", columnize.SimpleFormat(output))
+	}
+	n.writeFailures(report)
+	n.writeSkipReasons(report)
+	return report
+}
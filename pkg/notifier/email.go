@@ -0,0 +1,44 @@
+package notifier
+
+import (
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// sendMail is replaced in tests
+var sendMail = smtp.SendMail
+
+// Email sends the rendered event through an SMTP server
+type Email struct {
+	base
+}
+
+// Notify sends the event as a plain text email
+func (e *Email) Notify(event Event) error {
+	text, err := e.Render(event)
+	if err != nil {
+		return err
+	}
+
+	subject := e.config.Subject
+	if subject == "" {
+		subject = fmt.Sprintf("nomad-custodian %s %s", event.Report.Command, event.Kind)
+	}
+
+	port := e.config.SMTPPort
+	if port == 0 {
+		port = 25
+	}
+	addr := fmt.Sprintf("%s:%d", e.config.SMTPHost, port)
+
+	var auth smtp.Auth
+	if e.config.Username != "" {
+		auth = smtp.PlainAuth("", e.config.Username, e.config.Password, e.config.SMTPHost)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		e.config.From, strings.Join(e.config.To, ", "), subject, text)
+
+	return sendMail(addr, auth, e.config.From, e.config.To, []byte(msg))
+}
@@ -0,0 +1,161 @@
+// Package notifier sends summaries of custodian runs to webhooks, chat and email
+package notifier
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+)
+
+// Kind specifies whether an event describes planned or applied changes
+type Kind string
+
+// Kind values sent to notifiers
+const (
+	KindPlanned Kind = "planned"
+	KindApplied Kind = "applied"
+)
+
+// Event is a single notification about a custodian run
+type Event struct {
+	Kind    Kind
+	Message string
+	Report  *nomadhelper.Report
+}
+
+// NewEvent builds the event for a finished run. Runs that applied changes
+// produce an applied event, plans produce a planned event.
+func NewEvent(report *nomadhelper.Report, message string) Event {
+	kind := KindPlanned
+	if report.Applied {
+		kind = KindApplied
+	}
+	return Event{Kind: kind, Message: message, Report: report}
+}
+
+// Notifier delivers events to a single destination
+type Notifier interface {
+	Name() string
+	Notify(event Event) error
+}
+
+// Config describes a single notifier in the config file
+type Config struct {
+	Name     string            `mapstructure:"name"`
+	Type     string            `mapstructure:"type"`
+	URL      string            `mapstructure:"url"`
+	Headers  map[string]string `mapstructure:"headers"`
+	Events   []string          `mapstructure:"events"`
+	Template string            `mapstructure:"template"`
+
+	// Email settings
+	SMTPHost string   `mapstructure:"smtp_host"`
+	SMTPPort int      `mapstructure:"smtp_port"`
+	Username string   `mapstructure:"username"`
+	Password string   `mapstructure:"password"`
+	From     string   `mapstructure:"from"`
+	To       []string `mapstructure:"to"`
+	Subject  string   `mapstructure:"subject"`
+}
+
+// DefaultTemplate renders a plain text summary of an event
+const DefaultTemplate = `{{if .Message}}{{.Message}}
+{{end}}{{if .Report.Cluster}}[{{.Report.Cluster}}] {{end}}nomad-custodian {{.Report.Command}} {{.Kind}}: {{len (.Report.Filter "planned")}} planned, {{len (.Report.Filter "applied")}} applied, {{len (.Report.Filter "failed")}} failed, {{len (.Report.Filter "skipped")}} skipped
+{{range .Report.Results}}{{if ne .Status "skipped"}}* {{.Name}}: {{.Action}} {{.Status}}{{if eq .Status "warned"}} ({{.Detail}}){{end}}{{if .Error}} ({{.Error}}){{end}}
+{{end}}{{end}}`
+
+// New creates the notifier described by the config
+func New(config Config) (Notifier, error) {
+	text := config.Template
+	if text == "" {
+		text = DefaultTemplate
+	}
+	tmpl, err := template.New(config.Name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("notifier %s: %v", config.Name, err)
+	}
+
+	base := base{config: config, template: tmpl}
+	switch strings.ToLower(config.Type) {
+	case "webhook":
+		return &Webhook{base}, nil
+	case "slack":
+		return &Slack{base}, nil
+	case "email", "smtp":
+		return &Email{base}, nil
+	default:
+		return nil, fmt.Errorf("notifier %s: unknown type %q", config.Name, config.Type)
+	}
+}
+
+// Dispatcher sends events to every configured notifier subscribed to them
+type Dispatcher struct {
+	Notifiers []Notifier
+	events    map[string][]string
+}
+
+// NewDispatcher creates notifiers for all configs
+func NewDispatcher(configs []Config) (*Dispatcher, error) {
+	d := &Dispatcher{events: make(map[string][]string)}
+	for _, config := range configs {
+		notifier, err := New(config)
+		if err != nil {
+			return nil, err
+		}
+		d.Notifiers = append(d.Notifiers, notifier)
+		d.events[notifier.Name()] = config.Events
+	}
+	return d, nil
+}
+
+// Dispatch sends the event to all subscribed notifiers and returns the errors
+// of the notifiers that failed
+func (d *Dispatcher) Dispatch(event Event) []error {
+	var errs []error
+	for _, notifier := range d.Notifiers {
+		if !subscribed(d.events[notifier.Name()], event.Kind) {
+			continue
+		}
+		if err := notifier.Notify(event); err != nil {
+			errs = append(errs, fmt.Errorf("notifier %s: %v", notifier.Name(), err))
+		}
+	}
+	return errs
+}
+
+// subscribed reports whether the event kind is in the list. An empty list
+// subscribes to all events.
+func subscribed(events []string, kind Kind) bool {
+	if len(events) == 0 {
+		return true
+	}
+	for _, event := range events {
+		if Kind(event) == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// base holds the config and template shared by all notifiers
+type base struct {
+	config   Config
+	template *template.Template
+}
+
+// Name returns the configured notifier name
+func (b base) Name() string {
+	return b.config.Name
+}
+
+// Render executes the notifier template for the event
+func (b base) Render(event Event) (string, error) {
+	var buf bytes.Buffer
+	if err := b.template.Execute(&buf, event); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,142 @@
+package notifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+)
+
+func testReport(applied bool) *nomadhelper.Report {
+	report := nomadhelper.NewReport("scale-in", applied)
+	status := nomadhelper.StatusPlanned
+	if applied {
+		status = nomadhelper.StatusApplied
+	}
+	report.Add(nomadhelper.JobResult{JobID: "couchbase", Name: "couchbase", Action: "scale-in", Status: status})
+	report.Add(nomadhelper.JobResult{JobID: "nginx", Name: "nginx", Action: "scale-in", Status: nomadhelper.StatusSkipped})
+	report.Finish()
+	return report
+}
+
+func TestWebhookAndSlack(t *testing.T) {
+	var bodies []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" && r.URL.Path == "/hook" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		bodies = append(bodies, body)
+	}))
+	defer server.Close()
+
+	d, err := NewDispatcher([]Config{
+		{Name: "hook", Type: "webhook", URL: server.URL + "/hook", Headers: map[string]string{"X-Token": "secret"}},
+		{Name: "chat", Type: "slack", URL: server.URL + "/chat", Events: []string{"applied"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := d.Dispatch(NewEvent(testReport(false), "Scale in starts in 15 minutes"))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(bodies) != 1 {
+		t.Fatalf("expected only the webhook to receive the planned event, got %d requests", len(bodies))
+	}
+	if bodies[0]["kind"] != "planned" || bodies[0]["command"] != "scale-in" {
+		t.Errorf("unexpected webhook payload: %v", bodies[0])
+	}
+	if !strings.HasPrefix(bodies[0]["text"].(string), "Scale in starts in 15 minutes") {
+		t.Errorf("message missing from text: %q", bodies[0]["text"])
+	}
+
+	errs = d.Dispatch(NewEvent(testReport(true), ""))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(bodies) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(bodies))
+	}
+	text := bodies[2]["text"].(string)
+	if !strings.Contains(text, "1 applied") || !strings.Contains(text, "* couchbase: scale-in applied") {
+		t.Errorf("unexpected slack text: %q", text)
+	}
+	if strings.Contains(text, "nginx") {
+		t.Errorf("skipped jobs should not be listed: %q", text)
+	}
+}
+
+func TestWebhookError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	d, err := NewDispatcher([]Config{{Name: "hook", Type: "webhook", URL: server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := d.Dispatch(NewEvent(testReport(true), "")); len(errs) != 1 {
+		t.Errorf("expected one error, got %v", errs)
+	}
+}
+
+func TestEmail(t *testing.T) {
+	var gotAddr string
+	var gotMsg string
+	sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		gotAddr = addr
+		gotMsg = string(msg)
+		return nil
+	}
+	defer func() { sendMail = smtp.SendMail }()
+
+	n, err := New(Config{
+		Name:     "mail",
+		Type:     "email",
+		SMTPHost: "localhost",
+		From:     "custodian@example.com",
+		To:       []string{"ops@example.com"},
+		Template: "{{.Report.Command}} {{.Kind}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(NewEvent(testReport(true), "")); err != nil {
+		t.Fatal(err)
+	}
+	if gotAddr != "localhost:25" {
+		t.Errorf("unexpected address %s", gotAddr)
+	}
+	if !strings.Contains(gotMsg, "Subject: nomad-custodian scale-in applied") ||
+		!strings.HasSuffix(gotMsg, "scale-in applied") {
+		t.Errorf("unexpected message %q", gotMsg)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"Unknown Type", Config{Name: "x", Type: "pager"}},
+		{"Bad Template", Config{Name: "x", Type: "slack", Template: "{{.Nope"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.config); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package notifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jsuar/nomad-custodian/pkg/nomadhelper"
+)
+
+// httpClient is shared by the webhook and slack notifiers
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// Webhook posts a generic JSON payload to a URL
+type Webhook struct {
+	base
+}
+
+// WebhookPayload is the JSON body sent by the webhook notifier
+type WebhookPayload struct {
+	Kind    Kind                    `json:"kind"`
+	Cluster string                  `json:"cluster,omitempty"`
+	Command string                  `json:"command"`
+	Message string                  `json:"message,omitempty"`
+	Text    string                  `json:"text"`
+	Results []nomadhelper.JobResult `json:"results"`
+}
+
+// Notify posts the event to the webhook URL
+func (w *Webhook) Notify(event Event) error {
+	text, err := w.Render(event)
+	if err != nil {
+		return err
+	}
+	return post(w.config, WebhookPayload{
+		Kind:    event.Kind,
+		Cluster: event.Report.Cluster,
+		Command: event.Report.Command,
+		Message: event.Message,
+		Text:    text,
+		Results: event.Report.Results,
+	})
+}
+
+// Slack posts a Slack-compatible incoming webhook payload
+type Slack struct {
+	base
+}
+
+// SlackPayload is the JSON body understood by Slack and compatible chat tools
+type SlackPayload struct {
+	Text string `json:"text"`
+}
+
+// Notify posts the rendered event to the Slack webhook URL
+func (s *Slack) Notify(event Event) error {
+	text, err := s.Render(event)
+	if err != nil {
+		return err
+	}
+	return post(s.config, SlackPayload{Text: text})
+}
+
+// post sends the payload as JSON to the configured URL
+func post(config Config, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response code: %d", resp.StatusCode)
+	}
+	return nil
+}